@@ -0,0 +1,91 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// BatchResult is the outcome of one op of a batch; Error is set if the op
+// was rejected and nothing was written for it.
+type BatchResult struct {
+	Op      string `json:"op"`
+	Key     string `json:"key"`
+	Version uint64 `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// BatchResponse carries the per-op results of a batch, in request order.
+type BatchResponse struct {
+	Index   uint64        `json:"index,omitempty"`
+	Results []BatchResult `json:"results"`
+}
+
+// Failed returns the results of the ops that were rejected.
+func (r *BatchResponse) Failed() []BatchResult {
+	var out []BatchResult
+	for _, res := range r.Results {
+		if res.Error != "" {
+			out = append(out, res)
+		}
+	}
+	return out
+}
+
+// Batch sends independent set/delete ops in one request, which the server
+// commits as a single Raft entry. It is not atomic: check the per-op results
+// (or use Txn when all-or-nothing is needed).
+func (c *Client) Batch(ops []TxnOp) (*BatchResponse, error) {
+	body, err := json.Marshal(struct {
+		Ops []TxnOp `json:"ops"`
+	}{ops})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.DoRequest(http.MethodPut, "/v1/batch", body, map[string]string{"Content-Type": "application/json"})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return decodeBatchResponse(resp)
+}
+
+// PutMany stores every pair in one batch. ExpiresAt and Version are ignored;
+// use Batch with TxnOp.TTL for expiring keys.
+func (c *Client) PutMany(kvs []KV) (*BatchResponse, error) {
+	return c.Batch(putOps(kvs))
+}
+
+// DeleteMany deletes every key in one batch.
+func (c *Client) DeleteMany(keys []string) (*BatchResponse, error) {
+	return c.Batch(deleteOps(keys))
+}
+
+func putOps(kvs []KV) []TxnOp {
+	ops := make([]TxnOp, len(kvs))
+	for i, kv := range kvs {
+		ops[i] = SetOp(kv.Key, kv.Value)
+	}
+	return ops
+}
+
+func deleteOps(keys []string) []TxnOp {
+	ops := make([]TxnOp, len(keys))
+	for i, k := range keys {
+		ops[i] = DeleteOp(k)
+	}
+	return ops
+}
+
+func decodeBatchResponse(resp *http.Response) (*BatchResponse, error) {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("batch failed: status=%d body=%s", resp.StatusCode, string(b))
+	}
+	var out BatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decode batch response: %w", err)
+	}
+	return &out, nil
+}
@@ -2,13 +2,16 @@ package client
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,6 +23,7 @@ type Client struct {
 	leader    string        // cached leader base URL (e.g. "http://127.0.0.1:8080")
 	tryLimit  int           // number of nodes to try before giving up
 	retryWait time.Duration // wait between retries
+	next      atomic.Uint32 // round-robin cursor for follower reads
 }
 
 // New creates a Client. Provide at least one node HTTP address.
@@ -185,9 +189,11 @@ func isTemporaryRedirect(resp *http.Response, err error) bool {
 }
 
 // normalizeLeaderAddr converts a leader identifier into an HTTP base URL.
-// If leader looks like "http://..." or "https://..." it is returned trimmed.
-// If leader looks like "host:port", this function returns "http://host:8080"
-// (default HTTP port 8080). If leader contains only host (no port) returns "http://host".
+// Servers send the leader's advertised HTTP URL ("http://..." or "https://..."),
+// which is returned trimmed. A bare "host:port" is a Raft address, sent by
+// older servers or by a leader whose URL has not replicated yet; the port
+// says nothing about HTTP, so as a last resort this guesses
+// "http://host:8080". If leader contains only host (no port) returns "http://host".
 func normalizeLeaderAddr(leader string) string {
 	leader = strings.TrimSpace(leader)
 	if leader == "" {
@@ -224,6 +230,23 @@ func (c *Client) Put(key string, value []byte) error {
 	return fmt.Errorf("put failed: status=%d body=%s", resp.StatusCode, string(b))
 }
 
+// PutWithTTL stores a key that expires after ttl. The deadline is fixed by the
+// leader when it accepts the write and is rounded up to whole seconds.
+func (c *Client) PutWithTTL(key string, value []byte, ttl time.Duration) error {
+	path := "/v1/keys/" + url.PathEscape(key)
+	headers := map[string]string{"X-Keyper-TTL": ttl.String()}
+	resp, err := c.DoRequest(http.MethodPut, path, value, headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	b, _ := io.ReadAll(resp.Body)
+	return fmt.Errorf("put failed: status=%d body=%s", resp.StatusCode, string(b))
+}
+
 // Get fetches a key value. Returns the raw bytes or error.
 func (c *Client) Get(key string) ([]byte, error) {
 	path := "/v1/keys/" + url.PathEscape(key)
@@ -257,6 +280,169 @@ func (c *Client) Delete(key string) error {
 	return fmt.Errorf("delete failed: status=%d body=%s", resp.StatusCode, string(b))
 }
 
+// ErrPreconditionFailed is returned by conditional writes when the key is not
+// in the expected state (the server answered 412).
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// GetVersioned fetches a key value together with its version (the ETag).
+func (c *Client) GetVersioned(key string) ([]byte, uint64, error) {
+	path := "/v1/keys/" + url.PathEscape(key)
+	resp, err := c.DoRequest(http.MethodGet, path, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, 0, fmt.Errorf("not found")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, 0, fmt.Errorf("get failed status=%d body=%s", resp.StatusCode, string(b))
+	}
+	val, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	version, err := parseETag(resp.Header.Get("ETag"))
+	if err != nil {
+		return nil, 0, err
+	}
+	return val, version, nil
+}
+
+// CompareAndSwap writes key only if its current version equals version.
+// It returns the new version, or ErrPreconditionFailed on a mismatch.
+func (c *Client) CompareAndSwap(key string, value []byte, version uint64) (uint64, error) {
+	return c.conditionalPut(key, value, map[string]string{"If-Match": `"` + strconv.FormatUint(version, 10) + `"`})
+}
+
+// PutIfAbsent writes key only if it does not exist yet. It returns the new
+// version, or ErrPreconditionFailed if the key already exists.
+func (c *Client) PutIfAbsent(key string, value []byte) (uint64, error) {
+	return c.conditionalPut(key, value, map[string]string{"If-None-Match": "*"})
+}
+
+// CompareAndDelete deletes key only if its current version equals version.
+func (c *Client) CompareAndDelete(key string, version uint64) error {
+	path := "/v1/keys/" + url.PathEscape(key)
+	headers := map[string]string{"If-Match": `"` + strconv.FormatUint(version, 10) + `"`}
+	resp, err := c.DoRequest(http.MethodDelete, path, nil, headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return ErrPreconditionFailed
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	b, _ := io.ReadAll(resp.Body)
+	return fmt.Errorf("delete failed: status=%d body=%s", resp.StatusCode, string(b))
+}
+
+func (c *Client) conditionalPut(key string, value []byte, headers map[string]string) (uint64, error) {
+	path := "/v1/keys/" + url.PathEscape(key)
+	resp, err := c.DoRequest(http.MethodPut, path, value, headers)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return 0, ErrPreconditionFailed
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("put failed: status=%d body=%s", resp.StatusCode, string(b))
+	}
+	return parseETag(resp.Header.Get("ETag"))
+}
+
+// parseETag extracts the numeric key version from an ETag header value.
+func parseETag(etag string) (uint64, error) {
+	v, err := strconv.ParseUint(strings.Trim(etag, `"`), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ETag %q", etag)
+	}
+	return v, nil
+}
+
+// KV is a key/value pair returned by Scan.
+type KV struct {
+	Key       string `json:"key"`
+	Value     []byte `json:"value"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Version   uint64 `json:"version,omitempty"`
+}
+
+// ScanOptions selects the range of a Scan. Start and End bound the half-open
+// range [Start, End) and are intersected with Prefix; empty means unbounded.
+// Token resumes a previous page and must be used with the same range options.
+type ScanOptions struct {
+	Prefix  string
+	Start   string
+	End     string
+	Limit   int // 0 uses the server default
+	Reverse bool
+	Token   string
+
+	Read ReadOptions // consistency of the scan; zero is linearizable
+}
+
+// ScanPage is one page of scan results. NextToken is empty on the last page.
+type ScanPage struct {
+	Items     []KV   `json:"items"`
+	NextToken string `json:"next_token,omitempty"`
+}
+
+// query encodes the options as GET /v1/keys query parameters.
+func (o ScanOptions) query() string {
+	q := url.Values{}
+	if o.Prefix != "" {
+		q.Set("prefix", o.Prefix)
+	}
+	if o.Start != "" {
+		q.Set("start", o.Start)
+	}
+	if o.End != "" {
+		q.Set("end", o.End)
+	}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.Reverse {
+		q.Set("reverse", "true")
+	}
+	if o.Token != "" {
+		q.Set("token", o.Token)
+	}
+	return q.Encode()
+}
+
+// Scan lists one page of keys in the requested range, at the consistency
+// chosen by opts.Read (linearizable by default).
+func (c *Client) Scan(opts ScanOptions) (*ScanPage, error) {
+	path := "/v1/keys?" + opts.query()
+	resp, err := c.doRead(path, opts.Read)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return decodeScanPage(resp)
+}
+
+func decodeScanPage(resp *http.Response) (*ScanPage, error) {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("scan failed status=%d body=%s", resp.StatusCode, string(b))
+	}
+	var page ScanPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("decode scan page: %w", err)
+	}
+	return &page, nil
+}
+
 // Status queries a single node's /v1/status (tries leader cached first).
 func (c *Client) Status() (string, error) {
 	resp, err := c.DoRequest(http.MethodGet, "/v1/status", nil, nil)
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Consistency selects how fresh a read must be.
+type Consistency string
+
+const (
+	// Linearizable reads go to the leader, which confirms its leadership
+	// with a Barrier first. This is the server default.
+	Linearizable Consistency = "linearizable"
+	// Lease reads go to the leader, which skips the Barrier while its
+	// leadership lease is valid.
+	Lease Consistency = "lease"
+	// Bounded reads may be served by a follower that is within MaxLag
+	// entries / MaxStaleness of the leader.
+	Bounded Consistency = "bounded"
+	// Stale reads are served by whichever node is asked.
+	Stale Consistency = "stale"
+)
+
+// ReadOptions picks the consistency of a single read. The zero value uses
+// the server default (linearizable). MaxLag and MaxStaleness only apply to
+// Bounded reads; leaving both zero uses the server's defaults.
+type ReadOptions struct {
+	Consistency  Consistency
+	MaxLag       uint64
+	MaxStaleness time.Duration
+}
+
+func (o ReadOptions) headers() map[string]string {
+	if o.Consistency == "" {
+		return nil
+	}
+	h := map[string]string{"X-Keyper-Consistency": string(o.Consistency)}
+	if o.Consistency == Bounded {
+		if o.MaxLag > 0 {
+			h["X-Keyper-Max-Lag"] = strconv.FormatUint(o.MaxLag, 10)
+		}
+		if o.MaxStaleness > 0 {
+			h["X-Keyper-Max-Staleness"] = o.MaxStaleness.String()
+		}
+	}
+	return h
+}
+
+// doRead sends a read. Bounded and stale reads are spread over the nodes
+// round-robin instead of going to the leader; a node that is too far behind
+// redirects, and the read then falls back to the leader.
+func (c *Client) doRead(path string, opts ReadOptions) (*http.Response, error) {
+	headers := opts.headers()
+	if (opts.Consistency == Bounded || opts.Consistency == Stale) && len(c.addrs) > 0 {
+		base := c.addrs[int(c.next.Add(1)-1)%len(c.addrs)]
+		resp, err := c.doOnce(base, http.MethodGet, path, nil, headers)
+		if err == nil && !isTemporaryRedirect(resp, nil) {
+			return resp, nil
+		}
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+	}
+	return c.DoRequest(http.MethodGet, path, nil, headers)
+}
+
+// GetWithOptions fetches a key at the given consistency, returning its value
+// and version.
+func (c *Client) GetWithOptions(key string, opts ReadOptions) ([]byte, uint64, error) {
+	resp, err := c.doRead("/v1/keys/"+url.PathEscape(key), opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, 0, fmt.Errorf("not found")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, 0, fmt.Errorf("get failed status=%d body=%s", resp.StatusCode, string(b))
+	}
+	val, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	version, err := parseETag(resp.Header.Get("ETag"))
+	if err != nil {
+		return nil, 0, err
+	}
+	return val, version, nil
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Member is one server of the Raft configuration as reported by GET
+// /v1/members. The Raft numbers come from the node itself and are empty
+// (with Error set) when it could not be reached.
+type Member struct {
+	ID           string            `json:"id"`
+	RaftAddr     string            `json:"raft_addr"`
+	HTTPAddr     string            `json:"http_addr,omitempty"`
+	Suffrage     string            `json:"suffrage"`
+	Leader       bool              `json:"leader"`
+	State        string            `json:"state,omitempty"`
+	LastContact  string            `json:"last_contact,omitempty"`
+	AppliedIndex uint64            `json:"applied_index,omitempty"`
+	CommitIndex  uint64            `json:"commit_index,omitempty"`
+	Stats        map[string]string `json:"stats,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// MemberList is the cluster membership and the current leader's ID.
+type MemberList struct {
+	Leader  string   `json:"leader,omitempty"`
+	Members []Member `json:"members"`
+}
+
+// Members lists the servers in the Raft configuration.
+func (c *Client) Members() (*MemberList, error) {
+	resp, err := c.DoRequest(http.MethodGet, "/v1/members", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("members failed: status=%d body=%s", resp.StatusCode, string(b))
+	}
+	var out MemberList
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RemoveMember removes node id from the Raft configuration.
+func (c *Client) RemoveMember(id string) error {
+	resp, err := c.DoRequest(http.MethodDelete, "/v1/members/"+url.PathEscape(id), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	b, _ := io.ReadAll(resp.Body)
+	return fmt.Errorf("remove member failed: status=%d body=%s", resp.StatusCode, string(b))
+}
+
+// ErrLearnerBehind is returned by PromoteMember when the learner has not
+// caught up with the leader yet; retry later.
+var ErrLearnerBehind = errors.New("learner has not caught up")
+
+// PromoteMember turns learner id into a voter, provided its applied index is
+// within maxLag entries of the leader's (0 uses the server default).
+func (c *Client) PromoteMember(id string, maxLag int) error {
+	path := "/v1/members/" + url.PathEscape(id) + "/promote"
+	if maxLag > 0 {
+		path += "?max_lag=" + strconv.Itoa(maxLag)
+	}
+	resp, err := c.DoRequest(http.MethodPost, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusConflict {
+		return fmt.Errorf("%w: %s", ErrLearnerBehind, strings.TrimSpace(string(b)))
+	}
+	return fmt.Errorf("promote member failed: status=%d body=%s", resp.StatusCode, string(b))
+}
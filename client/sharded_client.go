@@ -1,10 +1,14 @@
 package client
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
+	"sync"
 
 	"github.com/sada-02/keyper/shard"
 )
@@ -161,3 +165,186 @@ func (sc *ShardedClient) Delete(key string) error {
 	b, _ := io.ReadAll(resp.Body)
 	return fmt.Errorf("delete failed status=%d body=%s", resp.StatusCode, string(b))
 }
+
+// Batch splits ops by the node owning each key and sends the pieces to their
+// nodes in parallel. Results come back in the order of ops. If a piece fails
+// its ops are marked with the error and the first such error is returned along
+// with the results of the pieces that succeeded. Index is only set when every
+// op went to the same node.
+func (sc *ShardedClient) Batch(ops []TxnOp) (*BatchResponse, error) {
+	groups := map[string][]int{} // node -> indexes into ops
+	var order []string
+	for i, op := range ops {
+		node, ok := sc.ring.GetNode(op.Key)
+		if !ok {
+			return nil, fmt.Errorf("no nodes in ring")
+		}
+		if _, seen := groups[node]; !seen {
+			order = append(order, node)
+		}
+		groups[node] = append(groups[node], i)
+	}
+
+	type result struct {
+		resp *BatchResponse
+		err  error
+	}
+	results := make([]result, len(order))
+	var wg sync.WaitGroup
+	for i, node := range order {
+		piece := make([]TxnOp, len(groups[node]))
+		for j, idx := range groups[node] {
+			piece[j] = ops[idx]
+		}
+		wg.Add(1)
+		go func(i int, node string, piece []TxnOp) {
+			defer wg.Done()
+			results[i].resp, results[i].err = sc.sendBatch(node, piece)
+		}(i, node, piece)
+	}
+	wg.Wait()
+
+	out := &BatchResponse{Results: make([]BatchResult, len(ops))}
+	var firstErr error
+	for i, node := range order {
+		res := results[i]
+		if res.err == nil && len(res.resp.Results) != len(groups[node]) {
+			res.err = fmt.Errorf("got %d results for %d ops", len(res.resp.Results), len(groups[node]))
+		}
+		for j, idx := range groups[node] {
+			if res.err != nil {
+				out.Results[idx] = BatchResult{Op: ops[idx].Op, Key: ops[idx].Key, Error: res.err.Error()}
+				continue
+			}
+			out.Results[idx] = res.resp.Results[j]
+		}
+		if res.err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("batch %s: %w", node, res.err)
+		}
+	}
+	if len(order) == 1 && firstErr == nil {
+		out.Index = results[0].resp.Index
+	}
+	return out, firstErr
+}
+
+// PutMany stores every pair, one batch per owning node.
+func (sc *ShardedClient) PutMany(kvs []KV) (*BatchResponse, error) {
+	return sc.Batch(putOps(kvs))
+}
+
+// DeleteMany deletes every key, one batch per owning node.
+func (sc *ShardedClient) DeleteMany(keys []string) (*BatchResponse, error) {
+	return sc.Batch(deleteOps(keys))
+}
+
+// sendBatch sends one piece of a batch to node, following a leader redirect.
+func (sc *ShardedClient) sendBatch(node string, ops []TxnOp) (*BatchResponse, error) {
+	body, err := json.Marshal(struct {
+		Ops []TxnOp `json:"ops"`
+	}{ops})
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{"Content-Type": "application/json"}
+	resp, err := sc.baseClient.DoRequestTo(node, "PUT", "/v1/batch", body, headers)
+	if err != nil {
+		return nil, err
+	}
+	// If redirected, let cluster-aware client follow the leader and retry.
+	if resp.StatusCode == http.StatusTemporaryRedirect || resp.StatusCode == http.StatusFound || resp.StatusCode == http.StatusMovedPermanently {
+		_ = resp.Body.Close()
+		resp, err = sc.baseClient.DoRequest("PUT", "/v1/batch", body, headers)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer resp.Body.Close()
+	return decodeBatchResponse(resp)
+}
+
+// Scan fans the scan out to every node in the ring in parallel and merge-sorts
+// the pages into one. Keys reported by several nodes (e.g. replicas of the
+// same Raft group) are returned once. The continuation token has the same
+// format as a single node's, so it can be passed back to ShardedClient.Scan.
+func (sc *ShardedClient) Scan(opts ScanOptions) (*ScanPage, error) {
+	nodes := sc.ring.Nodes()
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes in ring")
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = 100
+	}
+	path := "/v1/keys?" + opts.query()
+	headers := opts.Read.headers()
+
+	type result struct {
+		page *ScanPage
+		err  error
+	}
+	results := make([]result, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node string) {
+			defer wg.Done()
+			resp, err := sc.baseClient.DoRequestTo(node, "GET", path, nil, headers)
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			// If redirected, let cluster-aware client follow the leader and retry.
+			if resp.StatusCode == http.StatusTemporaryRedirect || resp.StatusCode == http.StatusFound || resp.StatusCode == http.StatusMovedPermanently {
+				_ = resp.Body.Close()
+				resp, err = sc.baseClient.DoRequest("GET", path, nil, headers)
+				if err != nil {
+					results[i].err = err
+					return
+				}
+			}
+			defer resp.Body.Close()
+			results[i].page, results[i].err = decodeScanPage(resp)
+		}(i, node)
+	}
+	wg.Wait()
+
+	more := false
+	seen := map[string]struct{}{}
+	merged := []KV{}
+	for i, res := range results {
+		if res.err != nil {
+			return nil, fmt.Errorf("scan %s: %w", nodes[i], res.err)
+		}
+		if res.page.NextToken != "" {
+			more = true
+		}
+		for _, kv := range res.page.Items {
+			if _, dup := seen[kv.Key]; dup {
+				continue
+			}
+			seen[kv.Key] = struct{}{}
+			merged = append(merged, kv)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		if opts.Reverse {
+			return merged[i].Key > merged[j].Key
+		}
+		return merged[i].Key < merged[j].Key
+	})
+	if len(merged) > opts.Limit {
+		merged = merged[:opts.Limit]
+		more = true
+	}
+
+	page := &ScanPage{Items: merged}
+	if more && len(merged) > 0 {
+		// Every node honours the same boundary, so one token resumes them all.
+		last := merged[len(merged)-1].Key
+		if !opts.Reverse {
+			last += "\x00"
+		}
+		page.NextToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+	}
+	return page, nil
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// TxnGuard is a condition on one key. Every field that is set must hold.
+type TxnGuard struct {
+	Key     string  `json:"key"`
+	Exists  *bool   `json:"exists,omitempty"`
+	Version *uint64 `json:"version,omitempty"`
+	Value   []byte  `json:"value,omitempty"`
+}
+
+// TxnOp is a set or delete inside a transaction. TTL uses the PUT syntax.
+type TxnOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	TTL   string `json:"ttl,omitempty"`
+}
+
+// TxnRequest runs Success if every guard holds, Failure otherwise.
+type TxnRequest struct {
+	Guards  []TxnGuard `json:"guards,omitempty"`
+	Success []TxnOp    `json:"success,omitempty"`
+	Failure []TxnOp    `json:"failure,omitempty"`
+}
+
+// TxnOpResult is the outcome of one op of the branch that ran.
+type TxnOpResult struct {
+	Op      string `json:"op"`
+	Key     string `json:"key"`
+	Version uint64 `json:"version,omitempty"`
+}
+
+// TxnResponse reports which branch ran and its per-op results.
+type TxnResponse struct {
+	Succeeded bool          `json:"succeeded"`
+	Index     uint64        `json:"index,omitempty"`
+	Results   []TxnOpResult `json:"results"`
+}
+
+// SetOp builds a set op for a transaction.
+func SetOp(key string, value []byte) TxnOp {
+	return TxnOp{Op: "set", Key: key, Value: value}
+}
+
+// DeleteOp builds a delete op for a transaction.
+func DeleteOp(key string) TxnOp {
+	return TxnOp{Op: "delete", Key: key}
+}
+
+// Txn submits an all-or-nothing multi-key transaction to the leader.
+func (c *Client) Txn(req TxnRequest) (*TxnResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.DoRequest(http.MethodPost, "/v1/txn", body, map[string]string{"Content-Type": "application/json"})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("txn failed: status=%d body=%s", resp.StatusCode, string(b))
+	}
+	var out TxnResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decode txn response: %w", err)
+	}
+	return &out, nil
+}
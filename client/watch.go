@@ -0,0 +1,134 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrWatchCompacted is returned by Watch when the revision to resume from is
+// no longer retained by the server; the caller should re-read current state.
+var ErrWatchCompacted = errors.New("watch revision compacted")
+
+// WatchEvent is one committed change delivered by Watch.
+type WatchEvent struct {
+	Type      string `json:"type"` // "set" or "delete"
+	Key       string `json:"key"`
+	Value     []byte `json:"value,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Revision  uint64 `json:"revision"`
+	Error     string `json:"error,omitempty"` // set on the server's final "error" line
+}
+
+// WatchOptions selects what to watch. With Prefix set, Key is a prefix (an
+// empty prefix watches every key). Since resumes after that revision; 0 means
+// only changes from now on.
+type WatchOptions struct {
+	Key    string
+	Prefix bool
+	Since  uint64
+}
+
+// Watch streams committed changes to fn until ctx is cancelled or fn returns
+// an error. Any node can serve a watch; when a stream breaks Watch reconnects
+// (to the same or another node) and resumes from the last revision it saw, so
+// fn sees every event once and in order.
+func (c *Client) Watch(ctx context.Context, opts WatchOptions, fn func(WatchEvent) error) error {
+	// the regular client has a request timeout that would cut the stream
+	stream := &http.Client{Transport: c.http.Transport}
+
+	since := opts.Since
+	var lastRev uint64 // newest revision delivered to fn
+	seenAtLast := 0    // events of lastRev already delivered
+
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		bases := c.addrs
+		if leader := c.getLeader(); leader != "" {
+			bases = append([]string{leader}, bases...)
+		}
+		if len(bases) == 0 {
+			return errors.New("no node addresses configured")
+		}
+		base := bases[attempt%len(bases)]
+
+		// Several events can share a revision (txn, batch), so resume from the
+		// revision before the last one and skip what was already delivered.
+		q := url.Values{}
+		if opts.Prefix {
+			q.Set("prefix", opts.Key)
+		} else {
+			q.Set("key", opts.Key)
+		}
+		skip := 0
+		if lastRev > 0 {
+			q.Set("since", strconv.FormatUint(lastRev-1, 10))
+			skip = seenAtLast
+		} else if since > 0 {
+			q.Set("since", strconv.FormatUint(since, 10))
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/v1/watch?"+q.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := stream.Do(req)
+		if err != nil {
+			time.Sleep(c.retryWait)
+			continue
+		}
+		if resp.StatusCode == http.StatusGone {
+			_ = resp.Body.Close()
+			return ErrWatchCompacted
+		}
+		if resp.StatusCode != http.StatusOK {
+			b, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+				return fmt.Errorf("watch failed: status=%d body=%s", resp.StatusCode, string(b))
+			}
+			time.Sleep(c.retryWait)
+			continue
+		}
+
+		sc := bufio.NewScanner(resp.Body)
+		sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for sc.Scan() {
+			line := sc.Bytes()
+			if len(line) == 0 {
+				continue // keepalive
+			}
+			var ev WatchEvent
+			if err := json.Unmarshal(line, &ev); err != nil {
+				_ = resp.Body.Close()
+				return fmt.Errorf("decode watch event: %w", err)
+			}
+			if ev.Type == "error" {
+				break // server ended the stream; reconnect and resume
+			}
+			if ev.Revision == lastRev && skip > 0 {
+				skip--
+				continue
+			}
+			if ev.Revision != lastRev {
+				lastRev, seenAtLast = ev.Revision, 0
+			}
+			seenAtLast++
+			if err := fn(ev); err != nil {
+				_ = resp.Body.Close()
+				return err
+			}
+		}
+		_ = resp.Body.Close()
+		time.Sleep(c.retryWait)
+	}
+}
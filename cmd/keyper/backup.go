@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sada-02/keyper/httpapi"
+	"github.com/sada-02/keyper/store"
+)
+
+// backupMeta is written next to every backup as <name>.json.
+type backupMeta struct {
+	Source        string          `json:"source"`
+	TakenAt       time.Time       `json:"taken_at"`
+	Index         uint64          `json:"index,omitempty"`
+	Term          uint64          `json:"term,omitempty"`
+	Size          int64           `json:"size"`
+	SHA256        string          `json:"sha256"`
+	Records       uint64          `json:"records"`
+	Configuration json.RawMessage `json:"configuration,omitempty"`
+}
+
+// runBackup streams POST /v1/admin/snapshot from a node into dir as a
+// timestamped file, verifies it (SHA-256 against the server's trailer, then a
+// full decode with record count and CRC check) and only then moves it into
+// place, and finally prunes the oldest backups beyond --keep.
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	addr := fs.String("addr", "http://127.0.0.1:8080", "HTTP address of the node to back up")
+	dir := fs.String("to", "", "directory to write backups into (required)")
+	keep := fs.Int("keep", 7, "number of backups to keep in the directory (0 keeps all)")
+	timeout := fs.Duration("timeout", 10*time.Minute, "give up if the backup takes longer")
+	_ = fs.Parse(args)
+	if *dir == "" {
+		return errors.New("--to is required")
+	}
+	base := strings.TrimRight(*addr, "/")
+	if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
+		base = "http://" + base
+	}
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	resp, err := client.Post(base+"/v1/admin/snapshot", "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("snapshot failed: status=%d body=%s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+
+	takenAt := time.Now().UTC()
+	meta := backupMeta{Source: base, TakenAt: takenAt}
+	meta.Index, _ = strconv.ParseUint(resp.Header.Get(httpapi.SnapshotIndexHeader), 10, 64)
+	meta.Term, _ = strconv.ParseUint(resp.Header.Get(httpapi.SnapshotTermHeader), 10, 64)
+	if conf := resp.Header.Get(httpapi.SnapshotConfigHeader); conf != "" {
+		meta.Configuration = json.RawMessage(conf)
+	}
+
+	name := fmt.Sprintf("keyper-%s-%d.snap", takenAt.Format("20060102T150405Z"), meta.Index)
+	final := filepath.Join(*dir, name)
+	tmp, err := os.CreateTemp(*dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sum := sha256.New()
+	meta.Size, err = io.Copy(io.MultiWriter(tmp, sum), resp.Body)
+	if err != nil {
+		return fmt.Errorf("download snapshot: %w", err)
+	}
+	meta.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	// the trailer is only set once the whole body was sent
+	want := resp.Trailer.Get(httpapi.SnapshotSHA256Trailer)
+	if want == "" {
+		return errors.New("snapshot incomplete: server sent no checksum")
+	}
+	if want != meta.SHA256 {
+		return fmt.Errorf("checksum mismatch: got %s, server says %s", meta.SHA256, want)
+	}
+	if size := resp.Header.Get(httpapi.SnapshotSizeHeader); size != "" && size != strconv.FormatInt(meta.Size, 10) {
+		return fmt.Errorf("size mismatch: got %d bytes, server says %s", meta.Size, size)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	info, err := store.InspectSnapshot(tmp)
+	if err != nil {
+		return fmt.Errorf("verify snapshot: %w", err)
+	}
+	meta.Records = info.Records
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(&meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(strings.TrimSuffix(final, ".snap")+".json", append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), final); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s (%d bytes, %d records, index %d, sha256 %s)\n", final, meta.Size, meta.Records, meta.Index, meta.SHA256)
+
+	return pruneBackups(*dir, *keep)
+}
+
+// pruneBackups removes all but the newest keep backups in dir. Backup names
+// start with a UTC timestamp, so name order is age order.
+func pruneBackups(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	snaps, err := filepath.Glob(filepath.Join(dir, "keyper-*.snap"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(snaps)
+	for len(snaps) > keep {
+		old := snaps[0]
+		snaps = snaps[1:]
+		if err := os.Remove(old); err != nil {
+			return err
+		}
+		_ = os.Remove(strings.TrimSuffix(old, ".snap") + ".json")
+		fmt.Printf("removed old backup %s\n", old)
+	}
+	return nil
+}
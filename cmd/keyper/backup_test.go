@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sada-02/keyper/httpapi"
+	"github.com/sada-02/keyper/store"
+)
+
+// TestBackup backs up a raftless node, checks the file and its metadata,
+// and makes sure a download without the checksum trailer is never kept.
+func TestBackup(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "dkvs_test_backup_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(base)
+	t.Cleanup(func() { os.RemoveAll(base) })
+
+	s, err := store.NewBadgerStore(filepath.Join(base, "data"))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	for i := 0; i < 20; i++ {
+		if err := s.Set([]byte("k"+strconv.Itoa(i)), []byte("v")); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	mux := http.NewServeMux()
+	httpapi.NewHandler(s, "n1").Register(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	dir := filepath.Join(base, "backups")
+	if err := runBackup([]string{"--addr", srv.URL, "--to", dir}); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	snaps, _ := filepath.Glob(filepath.Join(dir, "keyper-*.snap"))
+	if len(snaps) != 1 {
+		t.Fatalf("backups: %v, want one", snaps)
+	}
+	b, err := os.ReadFile(strings.TrimSuffix(snaps[0], ".snap") + ".json")
+	if err != nil {
+		t.Fatalf("read metadata: %v", err)
+	}
+	var meta backupMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		t.Fatalf("metadata: %v", err)
+	}
+	f, err := os.Open(snaps[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := store.InspectSnapshot(f)
+	if err != nil {
+		t.Fatalf("inspect backup: %v", err)
+	}
+	if meta.Records != 20 || info.Records != 20 || meta.SHA256 == "" {
+		t.Fatalf("metadata %+v, file has %d records; want 20 and a checksum", meta, info.Records)
+	}
+
+	// a server that stops before the trailer leaves nothing behind
+	cut := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := http.Post(srv.URL+r.URL.Path, "", nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		_, _ = io.Copy(w, resp.Body)
+	}))
+	defer cut.Close()
+	failed := filepath.Join(base, "failed")
+	if err := runBackup([]string{"--addr", cut.URL, "--to", failed}); err == nil || !strings.Contains(err.Error(), "no checksum") {
+		t.Fatalf("backup without trailer: %v", err)
+	}
+	if left, _ := os.ReadDir(failed); len(left) != 0 {
+		t.Fatalf("failed backup left %v", left)
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dkvs_test_prune_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"keyper-20250101T000000Z-5", "keyper-20250102T000000Z-9", "keyper-20250103T000000Z-2"}
+	for _, n := range names {
+		for _, ext := range []string{".snap", ".json"} {
+			if err := os.WriteFile(filepath.Join(dir, n+ext), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	other := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(other, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pruneBackups(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := filepath.Glob(filepath.Join(dir, "keyper-*")); len(got) != 6 {
+		t.Fatalf("keep 0 removed files: %v", got)
+	}
+	if err := pruneBackups(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := filepath.Glob(filepath.Join(dir, "keyper-*"))
+	want := []string{
+		filepath.Join(dir, names[1]+".json"), filepath.Join(dir, names[1]+".snap"),
+		filepath.Join(dir, names[2]+".json"), filepath.Join(dir, names[2]+".snap"),
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("after pruning to 2: %v, want %v", got, want)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("prune removed a file that is not a backup: %v", err)
+	}
+}
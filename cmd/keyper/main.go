@@ -0,0 +1,43 @@
+// Command keyper holds operator tools that run alongside the server.
+//
+//	keyper backup --addr http://127.0.0.1:8080 --to ./backups [--keep 7]
+//	keyper recover --data-dir ./data --node-id node1 --peers peers.json
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: keyper <command> [flags]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  backup   take an online snapshot of a node into a local directory")
+	fmt.Fprintln(os.Stderr, "  recover  rewrite a stopped node's raft configuration after quorum loss")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "backup":
+		err = runBackup(os.Args[2:])
+	case "recover":
+		err = runRecover(os.Args[2:])
+	case "help", "-h", "--help":
+		usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "keyper %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
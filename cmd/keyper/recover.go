@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	raftnode "github.com/sada-02/keyper/raft"
+)
+
+// runRecover rewrites the Raft configuration of a stopped node after the
+// cluster lost quorum. Run it on each survivor with the same peers file, then
+// start the nodes normally; the server's --recover-peers does both at once.
+func runRecover(args []string) error {
+	fs := flag.NewFlagSet("recover", flag.ExitOnError)
+	var opts raftnode.RecoverOptions
+	fs.StringVar(&opts.DataDir, "data-dir", "./data", "data directory of the stopped node")
+	fs.StringVar(&opts.NodeID, "node-id", "", "ID of the node that owns the data directory (required)")
+	fs.StringVar(&opts.PeersFile, "peers", "", `JSON file listing the surviving members, e.g. [{"id":"node1","address":"10.0.0.1:12000"}] (required)`)
+	fs.BoolVar(&opts.Force, "force", false, "recover even if a quorum of the old voters answers on its raft address")
+	fs.DurationVar(&opts.ProbeTimeout, "probe-timeout", time.Second, "how long to wait for each old voter when checking the cluster is really down")
+	_ = fs.Parse(args)
+	if opts.NodeID == "" || opts.PeersFile == "" {
+		return errors.New("--node-id and --peers are required")
+	}
+
+	conf, err := raftnode.RecoverCluster(opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("recovered %s with configuration:\n", opts.DataDir)
+	for _, srv := range conf.Servers {
+		fmt.Printf("  %s %s (%s)\n", srv.ID, srv.Address, srv.Suffrage)
+	}
+	fmt.Println("start the node normally (without --join) to resume")
+	return nil
+}
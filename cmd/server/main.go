@@ -4,32 +4,56 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	raft "github.com/hashicorp/raft"
 	"github.com/sada-02/keyper/config"
 	"github.com/sada-02/keyper/httpapi"
 	raftnode "github.com/sada-02/keyper/raft"
-	"github.com/sada-02/keyper/store"
-	"github.com/sada-02/keyper/shard"
 	shardraft "github.com/sada-02/keyper/shardraft"
+	"github.com/sada-02/keyper/store"
+	"github.com/sada-02/keyper/watch"
 )
 
 func main() {
-	cfg := config.Load()
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	if cfg.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatalf("print config: %v", err)
+		}
+		return
+	}
 
 	// Create data dir if not exists
 	if err := os.MkdirAll(cfg.DataDir, 0o755); err != nil {
 		log.Fatalf("failed to create data dir: %v", err)
 	}
 
-	st, err := store.NewBadgerStore(cfg.DataDir)
+	// Recovery needs the data dir to itself, so it runs before the store opens.
+	if cfg.RecoverPeers != "" {
+		if err := recoverCluster(cfg); err != nil {
+			log.Fatalf("recover: %v", err)
+		}
+	}
+
+	st, err := store.NewBadgerStoreWithOptions(cfg.DataDir, badgerOptions(cfg))
 	if err != nil {
 		log.Fatalf("open store: %v", err)
 	}
@@ -38,18 +62,30 @@ func main() {
 	}()
 
 	h := httpapi.NewHandler(st, cfg.NodeID)
-	h.ShardMgr = shard.NewManager()
-	h.ShardRafts = make(map[string]*shardraft.ShardRaft)
+	h.Watch = watch.NewHub(watch.DefaultHistory)
+	h.ForwardToLeader = cfg.ForwardToLeader
+	h.PeerHTTP = cfg.Peers
 
 	// If Raft enabled, initialize node and attach to handler
 	var rn *raftnode.Node
 	if cfg.EnableRaft {
 		raftCfg := &raftnode.RaftConfig{
-			NodeID:   cfg.NodeID,
-			RaftAddr: cfg.RaftAddr,
-			DataDir:  cfg.DataDir,
-			Store:    st,
-			JoinAddr: cfg.JoinAddr,
+			NodeID:        cfg.NodeID,
+			RaftAddr:      cfg.RaftAddr,
+			RaftAdvertise: cfg.RaftAdvertise,
+			HTTPAddr:      cfg.HTTPAdvertise,
+			DataDir:       cfg.DataDir,
+			Store:         st,
+			JoinAddr:      cfg.JoinAddr,
+			Watch:         h.Watch,
+
+			CompressSnapshots: cfg.CompressSnapshots,
+			LogStore:          cfg.RaftLogStore,
+			GroupCommit: raftnode.GroupCommit{
+				MaxBatch: cfg.GroupCommitMax,
+				Window:   cfg.GroupCommitWindow,
+			},
+			Tuning: raftTuning(cfg),
 		}
 		nnode, err := raftnode.NewNode(raftCfg)
 		if err != nil {
@@ -58,20 +94,21 @@ func main() {
 		rn = nnode
 		h.RaftNode = rn
 
-		fmt.Printf("Started raft node: id=%s raft_addr=%s leader=%s\n", rn.ID, rn.Addr, rn.Leader())
+		fmt.Printf("Started raft node: id=%s raft_addr=%s http_addr=%s leader=%s\n", rn.ID, rn.Addr, rn.HTTPAddr, rn.Leader())
 
 		// If join flag provided, attempt auto-join to the cluster leader.
 		if cfg.JoinAddr != "" {
 			// joinLeader will retry for a bit until it succeeds or times out.
-			if err := joinLeader(cfg.JoinAddr, cfg.NodeID, cfg.RaftAddr, 30*time.Second); err != nil {
+			if err := joinLeader(cfg.JoinAddr, cfg.NodeID, cfg.RaftAdvertise, cfg.HTTPAdvertise, !cfg.JoinAsLearner, 30*time.Second); err != nil {
 				log.Fatalf("failed to join leader at %s: %v", cfg.JoinAddr, err)
 			}
 			fmt.Printf("Successfully joined cluster via %s\n", cfg.JoinAddr)
 		}
 	}
 
+	placementStop := make(chan struct{})
 	if cfg.ShardCount > 0 {
-		startShards(cfg, h)
+		startShards(cfg, h, rn, placementStop)
 	}
 
 	mux := http.NewServeMux()
@@ -80,10 +117,12 @@ func main() {
 	h.RegisterShardRoutes(mux)
 
 	srv := &http.Server{
-		Addr:         cfg.HTTPAddr,
-		Handler:      mux,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		Addr:              cfg.HTTPAddr,
+		Handler:           mux,
+		ReadTimeout:       cfg.HTTPReadTimeout,
+		ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout,
+		WriteTimeout:      cfg.HTTPWriteTimeout,
+		IdleTimeout:       cfg.HTTPIdleTimeout,
 	}
 
 	// Run server in goroutine
@@ -97,48 +136,103 @@ func main() {
 	// Graceful shutdown on SIGINT/SIGTERM
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-	<-stop
+	sig := <-stop
 	fmt.Println("\nshutting down...")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// Drain before stopping anything: refuse new writes, let in-flight ones
+	// finish and move leadership elsewhere, on the main raft and every shard
+	// raft at once.
+	close(placementStop)
+	var shards []*shardraft.ShardRaft
+	if h.Shards != nil {
+		shards = h.Shards.List()
+	}
+	drainNodes(rn, shards, 10*time.Second)
+
+	// With --leave-on-terminate, SIGTERM means the node is going away for
+	// good; SIGINT (a restart from the terminal) keeps it in the configuration.
+	if sig == syscall.SIGTERM && cfg.LeaveOnTerminate && rn != nil {
+		if err := leaveCluster(rn, 15*time.Second); err != nil {
+			log.Printf("leave cluster: %v", err)
+		} else {
+			fmt.Println("left the cluster")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.HTTPShutdownTimeout)
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Printf("server shutdown: %v", err)
 	}
 
-	// Shutdown raft if needed
+	// Shutdown raft if needed; the store is closed by the deferred Close
 	if rn != nil && rn.Raft != nil {
-		f := rn.Raft.Shutdown()
-		_ = f.Error()
+		if err := rn.Shutdown(); err != nil {
+			log.Printf("raft shutdown: %v", err)
+		}
 	}
 
-	// Shutdown per-shard raft instances (if any)
-	if h.ShardRafts != nil {
-		for id, sr := range h.ShardRafts {
-			if sr == nil {
-				continue
-			}
- 			// shut down raft instance
- 			if sr.Node != nil && sr.Node.Raft != nil {
- 				_ = sr.Node.Raft.Shutdown()
- 			}
- 			// close per-shard store
- 			if sr.Store != nil {
- 				_ = sr.Store.Close()
- 			}
- 			fmt.Printf("shard %s shut down\n", id)
- 		}
- 	}
+	// Shutdown per-shard raft instances (if any), each before its store
+	if h.Shards != nil {
+		h.Shards.Shutdown()
+	}
+}
+
+// drainNodes drains the main raft node and every shard raft in parallel.
+func drainNodes(rn *raftnode.Node, shards []*shardraft.ShardRaft, timeout time.Duration) {
+	var wg sync.WaitGroup
+	drain := func(name string, n *raftnode.Node) {
+		defer wg.Done()
+		if err := n.Drain(timeout); err != nil {
+			log.Printf("drain %s: %v", name, err)
+		}
+	}
+	if rn != nil {
+		wg.Add(1)
+		go drain("raft", rn)
+	}
+	for _, sr := range shards {
+		wg.Add(1)
+		go drain("shard "+sr.ShardID, sr.Node)
+	}
+	wg.Wait()
+}
+
+// recoverCluster rewrites the Raft configuration in cfg's data dir to the
+// members of the --recover-peers file, as keyper recover does, so the node
+// can start after the cluster lost quorum. A data dir already recovered to
+// that file is left alone, so restarting with the flag still set is safe.
+func recoverCluster(cfg *config.Config) error {
+	conf, err := raftnode.RecoverCluster(raftnode.RecoverOptions{
+		NodeID:    cfg.NodeID,
+		DataDir:   cfg.DataDir,
+		PeersFile: cfg.RecoverPeers,
+		Force:     cfg.RecoverForce,
+	})
+	if errors.Is(err, raftnode.ErrNothingToRecover) {
+		log.Printf("recover: configuration already matches %s, starting normally", cfg.RecoverPeers)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Recovered %s with configuration:\n", cfg.DataDir)
+	for _, srv := range conf.Servers {
+		fmt.Printf("  %s %s (%s)\n", srv.ID, srv.Address, srv.Suffrage)
+	}
+	return nil
 }
 
 // joinLeader tries to POST to leaderAddr + "/v1/join" the JSON
-// {"node_id": "<nodeID>", "raft_addr":"<raftAddr>"} and follows
-// leader redirects returned via X-Raft-Leader header. It will retry
-// until timeout.
-func joinLeader(leaderHTTP string, nodeID string, raftAddr string, timeout time.Duration) error {
+// {"node_id": "<nodeID>", "raft_addr":"<raftAddr>", "http_addr":"<httpAddr>", "voter":<voter>}
+// and follows leader redirects returned via X-Raft-Leader header. It will
+// retry until timeout.
+func joinLeader(leaderHTTP string, nodeID string, raftAddr string, httpAddr string, voter bool, timeout time.Duration) error {
 	type joinReq struct {
 		NodeID   string `json:"node_id"`
 		RaftAddr string `json:"raft_addr"`
+		HTTPAddr string `json:"http_addr"`
+		Voter    bool   `json:"voter"`
 	}
 
 	client := &http.Client{
@@ -152,6 +246,8 @@ func joinLeader(leaderHTTP string, nodeID string, raftAddr string, timeout time.
 	reqBody := joinReq{
 		NodeID:   nodeID,
 		RaftAddr: raftAddr,
+		HTTPAddr: httpAddr,
+		Voter:    voter,
 	}
 	bodyBytes, _ := json.Marshal(reqBody)
 
@@ -184,15 +280,13 @@ func joinLeader(leaderHTTP string, nodeID string, raftAddr string, timeout time.
 		// If redirected or follower returns TemporaryRedirect, check X-Raft-Leader header and retry to that leader.
 		if resp.StatusCode == http.StatusTemporaryRedirect || resp.StatusCode == http.StatusMovedPermanently || resp.StatusCode == http.StatusFound {
 			if leader := resp.Header.Get("X-Raft-Leader"); leader != "" {
-				// leader may include raft addr; convert raft addr to http if needed
-				// assume leader header contains raft address (host:port) or http://host:port
-				tgt := leader
-				// if leader looks like "host:port" convert to http://host:8080 default?
-				if _, _, err := net.SplitHostPort(leader); err == nil {
-					// Convert to http address on default http port 8080
-					tgt = "http://" + leader
+				// The header carries the leader's advertised HTTP URL. A bare
+				// host:port is a Raft address (the leader has not registered
+				// its URL yet), which we cannot turn into an HTTP one; retry
+				// where we are until the leader's record replicates.
+				if strings.HasPrefix(leader, "http://") || strings.HasPrefix(leader, "https://") {
+					target = leader
 				}
-				target = tgt
 				fmt.Printf("[join] redirect to leader %s (resp status %d)\n", target, resp.StatusCode)
 				time.Sleep(500 * time.Millisecond)
 				continue
@@ -206,3 +300,63 @@ func joinLeader(leaderHTTP string, nodeID string, raftAddr string, timeout time.
 
 	return fmt.Errorf("join timed out after %s", timeout.String())
 }
+
+// leaveCluster removes this node from the Raft configuration. The leader
+// removes itself (and steps down); a follower asks the leader to remove it
+// with DELETE /v1/members/{id}. The last voter never leaves, since an empty
+// configuration could not elect anyone.
+func leaveCluster(rn *raftnode.Node, timeout time.Duration) error {
+	fut := rn.Raft.GetConfiguration()
+	if err := fut.Error(); err != nil {
+		return err
+	}
+	voters, member, voter := 0, false, false
+	for _, srv := range fut.Configuration().Servers {
+		if srv.Suffrage == raft.Voter {
+			voters++
+		}
+		if string(srv.ID) == rn.ID {
+			member = true
+			voter = srv.Suffrage == raft.Voter
+		}
+	}
+	if !member {
+		return nil
+	}
+	if voter && voters == 1 {
+		return errors.New("last voter in the cluster, not leaving")
+	}
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if rn.Raft.State() == raft.Leader {
+			return rn.RemoveServer(rn.ID, time.Until(deadline))
+		}
+		leader := rn.LeaderHTTP()
+		if leader == "" {
+			time.Sleep(200 * time.Millisecond)
+			continue
+		}
+		req, _ := http.NewRequest(http.MethodDelete, leader+"/v1/members/"+url.PathEscape(rn.ID), nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			fmt.Printf("[leave] error contacting %s: %v\n", leader, err)
+			time.Sleep(500 * time.Millisecond)
+			continue
+		}
+		_ = resp.Body.Close()
+		// 404: someone removed us already
+		if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		fmt.Printf("[leave] unexpected status %d from %s\n", resp.StatusCode, leader)
+		time.Sleep(500 * time.Millisecond)
+	}
+	return fmt.Errorf("leave timed out after %s", timeout.String())
+}
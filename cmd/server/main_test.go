@@ -0,0 +1,268 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	raft "github.com/hashicorp/raft"
+	"github.com/sada-02/keyper/config"
+	"github.com/sada-02/keyper/httpapi"
+	raftnode "github.com/sada-02/keyper/raft"
+	"github.com/sada-02/keyper/store"
+)
+
+type testServer struct {
+	node *raftnode.Node
+	url  string
+	stop func() // shuts the node down and closes its store; safe to repeat
+}
+
+// startServer runs a raft node in dir behind the HTTP API, founding a
+// cluster unless join is set, in which case it waits to be added.
+func startServer(t *testing.T, id, dir, join string) *testServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	raftAddr := l.Addr().String()
+	l.Close()
+	return startServerAt(t, id, dir, join, raftAddr)
+}
+
+// startServerAt is startServer with the raft address given, so a stopped
+// node can come back on the address its peers know it by.
+func startServerAt(t *testing.T, id, dir, join, raftAddr string) *testServer {
+	t.Helper()
+	s, err := store.NewBadgerStore(dir)
+	if err != nil {
+		t.Fatalf("open store %s: %v", id, err)
+	}
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	n, err := raftnode.NewNode(&raftnode.RaftConfig{
+		NodeID:   id,
+		RaftAddr: raftAddr,
+		HTTPAddr: srv.URL,
+		DataDir:  dir,
+		Store:    s,
+		JoinAddr: join,
+		LogStore: raftnode.LogStoreBadger,
+		Tuning: raftnode.Tuning{
+			HeartbeatTimeout:   200 * time.Millisecond,
+			ElectionTimeout:    200 * time.Millisecond,
+			LeaderLeaseTimeout: 100 * time.Millisecond,
+			CommitTimeout:      10 * time.Millisecond,
+		},
+	})
+	if err != nil {
+		srv.Close()
+		s.Close()
+		t.Fatalf("start %s: %v", id, err)
+	}
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			srv.Close()
+			_ = n.Shutdown()
+			s.Close()
+		})
+	}
+	t.Cleanup(stop)
+	h := httpapi.NewHandler(s, id)
+	h.RaftNode = n
+	h.Register(mux)
+	if join == "" {
+		waitFor(t, id+" to lead", func() bool { return n.Raft.State() == raft.Leader })
+	}
+	return &testServer{node: n, url: srv.URL, stop: stop}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// suffrage returns id's suffrage in n's configuration, or -1 if it has none.
+func suffrage(t *testing.T, n *raftnode.Node, id string) raft.ServerSuffrage {
+	t.Helper()
+	fut := n.Raft.GetConfiguration()
+	if err := fut.Error(); err != nil {
+		t.Fatalf("configuration: %v", err)
+	}
+	for _, srv := range fut.Configuration().Servers {
+		if string(srv.ID) == id {
+			return srv.Suffrage
+		}
+	}
+	return -1
+}
+
+// TestJoinAsLearner joins one node with --join-as-learner and one without,
+// the way main does, and checks which of them became voters.
+func TestJoinAsLearner(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "dkvs_test_join_learner_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(base)
+	t.Cleanup(func() { os.RemoveAll(base) })
+
+	a := startServer(t, "a", filepath.Join(base, "a"), "")
+	for _, c := range []struct {
+		id   string
+		args []string
+		want raft.ServerSuffrage
+	}{
+		{"b", []string{"--join-as-learner"}, raft.Nonvoter},
+		{"c", nil, raft.Voter},
+	} {
+		n := startServer(t, c.id, filepath.Join(base, c.id), a.url)
+		cfg, err := config.Load(append([]string{"--node-id", c.id, "--join", a.url, "--raft-addr", n.node.Addr}, c.args...))
+		if err != nil {
+			t.Fatalf("config: %v", err)
+		}
+		if err := joinLeader(cfg.JoinAddr, cfg.NodeID, cfg.RaftAdvertise, n.url, !cfg.JoinAsLearner, 10*time.Second); err != nil {
+			t.Fatalf("join %s: %v", c.id, err)
+		}
+		if s := suffrage(t, a.node, c.id); s != c.want {
+			t.Fatalf("%s joined as %v, want %v", c.id, s, c.want)
+		}
+	}
+}
+
+// TestLeaveCluster has nodes of a small cluster leave it the way a node
+// does on SIGTERM: the last voter stays, a follower is removed by the
+// leader, a 404 from the leader counts as removed already, and the leader
+// removes itself.
+func TestLeaveCluster(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "dkvs_test_leave_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(base)
+	t.Cleanup(func() { os.RemoveAll(base) })
+
+	a := startServer(t, "a", filepath.Join(base, "a"), "")
+	if err := leaveCluster(a.node, 5*time.Second); err == nil || !strings.Contains(err.Error(), "last voter") {
+		t.Fatalf("last voter left: %v", err)
+	}
+	if s := suffrage(t, a.node, "a"); s != raft.Voter {
+		t.Fatalf("last voter is now %v", s)
+	}
+
+	nodes := map[string]*testServer{}
+	for _, id := range []string{"b", "c"} {
+		n := startServer(t, id, filepath.Join(base, id), a.url)
+		if err := joinLeader(a.url, id, n.node.Addr, n.url, true, 10*time.Second); err != nil {
+			t.Fatalf("join %s: %v", id, err)
+		}
+		waitFor(t, id+" to learn the leader's address", func() bool { return n.node.LeaderHTTP() == a.url })
+		nodes[id] = n
+	}
+
+	if err := leaveCluster(nodes["b"].node, 10*time.Second); err != nil {
+		t.Fatalf("follower leave: %v", err)
+	}
+	if s := suffrage(t, a.node, "b"); s != -1 {
+		t.Fatalf("b left but is still a %v", s)
+	}
+
+	// a leader that no longer knows c answers 404, which c takes as done
+	gone := make(chan string, 1)
+	stale := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case gone <- r.Method + " " + r.URL.Path:
+		default:
+		}
+		http.Error(w, "no such member", http.StatusNotFound)
+	}))
+	t.Cleanup(stale.Close)
+	if err := a.node.RegisterMember(raftnode.Member{ID: "a", RaftAddr: a.node.Addr, HTTPAddr: stale.URL}, 5*time.Second); err != nil {
+		t.Fatalf("register a: %v", err)
+	}
+	c := nodes["c"]
+	waitFor(t, "c to see the new address", func() bool { return c.node.LeaderHTTP() == stale.URL })
+	if err := leaveCluster(c.node, 10*time.Second); err != nil {
+		t.Fatalf("leave answered 404: %v", err)
+	}
+	if got := <-gone; got != "DELETE /v1/members/c" {
+		t.Fatalf("leave sent %s", got)
+	}
+
+	// c is still in the configuration, so the leader is not the last voter
+	if err := leaveCluster(a.node, 10*time.Second); err != nil {
+		t.Fatalf("leader leave: %v", err)
+	}
+	waitFor(t, "c to drop a", func() bool { return suffrage(t, c.node, "a") == -1 })
+}
+
+// TestRecoverOnStart loses two of three voters, recovers the survivor the
+// way main does with --recover-peers and checks that it starts as a cluster
+// of one with its data, and that recovering again is a no-op.
+func TestRecoverOnStart(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "dkvs_test_recover_start_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(base)
+	t.Cleanup(func() { os.RemoveAll(base) })
+
+	dir := filepath.Join(base, "a")
+	a := startServer(t, "a", dir, "")
+	nodes := []*testServer{a}
+	for _, id := range []string{"b", "c"} {
+		n := startServer(t, id, filepath.Join(base, id), a.url)
+		if err := joinLeader(a.url, id, n.node.Addr, n.url, true, 10*time.Second); err != nil {
+			t.Fatalf("join %s: %v", id, err)
+		}
+		nodes = append(nodes, n)
+	}
+	req, _ := http.NewRequest(http.MethodPut, a.url+"/v1/keys/k", strings.NewReader("v"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("put: %s", resp.Status)
+	}
+	raftAddr := a.node.Addr
+	for _, n := range nodes {
+		n.stop()
+	}
+
+	peers := filepath.Join(base, "peers.json")
+	if err := os.WriteFile(peers, []byte(`[{"id":"a","address":"`+raftAddr+`"}]`), 0o644); err != nil {
+		t.Fatalf("write peers: %v", err)
+	}
+	cfg, err := config.Load([]string{"--enable-raft", "--node-id", "a", "--data-dir", dir, "--raft-addr", raftAddr, "--recover-peers", peers})
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	if err := recoverCluster(cfg); err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+	// a restart with the flag still set finds nothing to do
+	if err := recoverCluster(cfg); err != nil {
+		t.Fatalf("recover again: %v", err)
+	}
+
+	a = startServerAt(t, "a", dir, "", raftAddr)
+	if s := suffrage(t, a.node, "b"); s != -1 {
+		t.Fatalf("lost voter b is still a %v", s)
+	}
+	resp, err = http.Get(a.url + "/v1/keys/k")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("get after recovery: %s", resp.Status)
+	}
+}
@@ -1,43 +1,80 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"net"
 	"strconv"
 
 	"github.com/sada-02/keyper/config"
 	"github.com/sada-02/keyper/httpapi"
-	"github.com/sada-02/keyper/shard"
+	raftnode "github.com/sada-02/keyper/raft"
 	"github.com/sada-02/keyper/shardraft"
+	"github.com/sada-02/keyper/store"
 )
 
-// startShards starts per-shard raft instances for each shard that this node should host.
-// It populates handler.ShardRafts with running shard servers.
-func startShards(cfg *config.Config, h *httpapi.Handler) {
-	// ensure shard manager present
-	if h.ShardMgr == nil {
-		h.ShardMgr = shard.NewManager()
-	}
-	if h.ShardRafts == nil {
-		h.ShardRafts = make(map[string]*shardraft.ShardRaft)
-	}
+// startShards sets up the shard rafts this node hosts. With the main raft
+// running, the replicated placement table decides which those are; without
+// it every shard runs here as a single-node group.
+func startShards(cfg *config.Config, h *httpapi.Handler, rn *raftnode.Node, stop <-chan struct{}) {
+	h.ShardCount = cfg.ShardCount
+	h.Shards = shardraft.NewHost(shardraft.HostConfig{
+		NodeID:     cfg.NodeID,
+		RaftHost:   hostOf(cfg.RaftAddr),
+		RaftAdHost: hostOf(cfg.RaftAdvertise),
+		BasePort:   cfg.RaftBasePort,
+		HTTPAddr:   cfg.HTTPAdvertise,
+		DataDir:    cfg.DataDir,
+		Options:    shardraft.Options{Raft: raftTuning(cfg), Badger: badgerOptions(cfg), LogStore: cfg.RaftLogStore},
+		ShardCount: cfg.ShardCount,
+		Replicas:   cfg.ShardReplicas,
+	})
 
-	for i := 0; i < cfg.ShardCount; i++ {
-		shardID := strconv.Itoa(i)
+	if rn == nil {
+		p := &raftnode.Placement{}
+		for i := 0; i < cfg.ShardCount; i++ {
+			id := strconv.Itoa(i)
+			p.Shards = append(p.Shards, raftnode.ShardPlacement{ID: id, Replicas: []string{cfg.NodeID}, Bootstrap: cfg.NodeID})
+		}
+		h.Shards.Reconcile(p, nil)
+		return
+	}
+	go h.Shards.Follow(rn, stop)
+}
 
-		// For this MVP we host all shards on every node if ShardCount > 0.
-		// In a later step, you'll host only assigned shards.
-		h.ShardMgr.AddShard(shardID)
+// raftTuning maps the raft-* settings onto raftnode.Tuning.
+func raftTuning(cfg *config.Config) raftnode.Tuning {
+	return raftnode.Tuning{
+		HeartbeatTimeout:   cfg.RaftHeartbeatTimeout,
+		ElectionTimeout:    cfg.RaftElectionTimeout,
+		LeaderLeaseTimeout: cfg.RaftLeaderLeaseTimeout,
+		CommitTimeout:      cfg.RaftCommitTimeout,
+		SnapshotInterval:   cfg.RaftSnapshotInterval,
+		SnapshotThreshold:  cfg.RaftSnapshotThreshold,
+		TrailingLogs:       cfg.RaftTrailingLogs,
+		MaxAppendEntries:   cfg.RaftMaxAppendEntries,
+		SnapshotRetain:     cfg.RaftSnapshotRetain,
+		MaxPool:            cfg.RaftMaxPool,
+		TransportTimeout:   cfg.RaftTransportTimeout,
+	}
+}
 
-		raftPort := cfg.RaftBasePort + i
-		raftAddr := fmt.Sprintf("127.0.0.1:%d", raftPort)
+// badgerOptions maps the badger-* settings onto store.Options.
+func badgerOptions(cfg *config.Config) store.Options {
+	return store.Options{
+		SyncWrites:       cfg.BadgerSyncWrites,
+		MemTableSize:     cfg.BadgerMemTableSize,
+		ValueLogFileSize: cfg.BadgerValueLogFileSize,
+		ValueThreshold:   cfg.BadgerValueThreshold,
+		BlockCacheSize:   cfg.BadgerBlockCacheSize,
+		IndexCacheSize:   cfg.BadgerIndexCacheSize,
+		NumCompactors:    cfg.BadgerNumCompactors,
+	}
+}
 
-		sr, err := shardraft.StartShardRaft(cfg.NodeID, shardID, raftAddr, cfg.DataDir, cfg.JoinAddr)
-		if err != nil {
-			log.Printf("warning: unable to start shard raft %s at %s: %v", shardID, raftAddr, err)
-			continue
-		}
-		h.ShardRafts[shardID] = sr
-		log.Printf("started shard %s raft at %s (node id %s)", shardID, raftAddr, sr.Node.ID)
+// hostOf returns the host part of a host:port address, or "" if addr has none.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
 	}
+	return host
 }
@@ -1,11 +1,28 @@
 package config
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
 )
 
-// Config holds runtime configuration from flags.
+// EnvPrefix starts the environment variable for every setting: the flag
+// name upper-cased with dashes as underscores, e.g. KEYPER_RAFT_ADDR.
+const EnvPrefix = "KEYPER_"
+
+// Config holds runtime configuration. Each setting is a flag; it can also
+// come from a YAML or TOML file (--config) or a KEYPER_* environment
+// variable. Flags win over the environment, which wins over the file.
 type Config struct {
+	ConfigFile  string // YAML (.yaml, .yml) or TOML (.toml) file
+	PrintConfig bool   // print the effective config and exit
+
 	DataDir    string
 	HTTPAddr   string
 	NodeID     string
@@ -13,26 +30,362 @@ type Config struct {
 	RaftAddr   string
 	JoinAddr   string
 
+	JoinAsLearner    bool // join as a non-voting learner (promote later)
+	LeaveOnTerminate bool // leave the Raft configuration on SIGTERM
+
+	// Quorum-loss recovery run before the node starts (see keyper recover).
+	RecoverPeers string // peers file to rewrite the Raft configuration to
+	RecoverForce bool   // recover even if a quorum of the old voters answers
+
+	// Advertised addresses: what other nodes and clients use to reach this
+	// one, when it differs from the bind address (0.0.0.0, NAT, containers).
+	HTTPAdvertise string // HTTP base URL, e.g. http://10.0.0.5:8080
+	RaftAdvertise string // Raft host:port
+
+	CompressSnapshots bool // gzip Raft FSM snapshots
+
+	// Group commit: concurrent writes share one Raft entry
+	GroupCommitMax    int           // most commands per entry (<= 1 disables)
+	GroupCommitWindow time.Duration // extra wait for more commands
+
+	// Follower forwarding
+	ForwardToLeader bool              // proxy writes/linearizable reads to the leader
+	Peers           map[string]string // node ID -> HTTP base URL
+
+	// Raft tuning, shared by the main raft and every shard raft
+	RaftHeartbeatTimeout   time.Duration
+	RaftElectionTimeout    time.Duration
+	RaftLeaderLeaseTimeout time.Duration
+	RaftCommitTimeout      time.Duration
+	RaftSnapshotInterval   time.Duration
+	RaftSnapshotThreshold  uint64
+	RaftTrailingLogs       uint64
+	RaftMaxAppendEntries   int
+	RaftSnapshotRetain     int
+	RaftMaxPool            int
+	RaftTransportTimeout   time.Duration
+	RaftLogStore           string // bolt or badger
+
+	// Badger tuning
+	BadgerSyncWrites       bool
+	BadgerMemTableSize     int64
+	BadgerValueLogFileSize int64
+	BadgerValueThreshold   int64
+	BadgerBlockCacheSize   int64
+	BadgerIndexCacheSize   int64
+	BadgerNumCompactors    int
+
+	// HTTP server timeouts (0 means none, as in net/http)
+	HTTPReadTimeout       time.Duration
+	HTTPReadHeaderTimeout time.Duration
+	HTTPWriteTimeout      time.Duration
+	HTTPIdleTimeout       time.Duration
+	HTTPShutdownTimeout   time.Duration // grace period for in-flight requests
+
 	// Phase 6: per-shard options
-	ShardCount   int // number of shards to start on this node (0 = disabled)
-	RaftBasePort int // base port for per-shard raft instances; shard i uses base + i
+	ShardCount    int // number of shards to start on this node (0 = disabled)
+	RaftBasePort  int // base port for per-shard raft instances; shard i uses base + i
+	ShardReplicas int // voters the main leader places of each shard, as nodes allow
+
+	fs *flag.FlagSet
 }
 
-// Load parses command-line flags into Config.
-func Load() *Config {
+// Load builds the Config from args (without the program name), the
+// environment and the config file, then validates it. With -h it returns
+// flag.ErrHelp after printing usage.
+func Load(args []string) (*Config, error) {
 	c := &Config{}
+	fs := flag.NewFlagSet("keyper", flag.ContinueOnError)
+	c.fs = fs
+
+	fs.StringVar(&c.ConfigFile, "config", "", "YAML (.yaml/.yml) or TOML (.toml) config file; keys are flag names, optionally nested by prefix (raft: {heartbeat-timeout: 1s})")
+	fs.BoolVar(&c.PrintConfig, "print-config", false, "print the effective configuration as YAML and exit")
+
+	fs.StringVar(&c.DataDir, "data-dir", "./data", "data directory for Badger")
+	fs.StringVar(&c.HTTPAddr, "http-addr", ":8080", "http listen address")
+	fs.StringVar(&c.NodeID, "node-id", "node-1", "node identifier")
+	fs.BoolVar(&c.EnableRaft, "enable-raft", false, "enable raft replication")
+	fs.StringVar(&c.RaftAddr, "raft-addr", "127.0.0.1:12000", "raft bind address (host:port)")
+	fs.StringVar(&c.HTTPAdvertise, "http-advertise", "", "HTTP URL other nodes and clients use to reach this node (default: derived from -http-addr)")
+	fs.StringVar(&c.RaftAdvertise, "raft-advertise", "", "raft address other nodes dial (default: derived from -raft-addr)")
+	fs.StringVar(&c.JoinAddr, "join", "", "HTTP address of existing node to join (e.g. http://host:8080)")
+	fs.BoolVar(&c.JoinAsLearner, "join-as-learner", false, "join as a non-voting learner; promote with POST /v1/members/{id}/promote")
+	fs.StringVar(&c.RecoverPeers, "recover-peers", "", "after quorum loss, rewrite the raft configuration to the members in this JSON peers file, then start (as keyper recover does)")
+	fs.BoolVar(&c.RecoverForce, "recover-force", false, "with -recover-peers, recover even if a quorum of the old voters answers on its raft address")
+	fs.BoolVar(&c.LeaveOnTerminate, "leave-on-terminate", false, "on SIGTERM, remove this node from the raft configuration before exiting (SIGINT never leaves)")
+	fs.BoolVar(&c.CompressSnapshots, "snapshot-compress", false, "gzip raft snapshots")
+	fs.IntVar(&c.GroupCommitMax, "group-commit-max", 64, "max concurrent writes coalesced into one raft entry (<= 1 disables)")
+	fs.DurationVar(&c.GroupCommitWindow, "group-commit-window", 0, "how long to wait for more writes before committing a group")
+	fs.BoolVar(&c.ForwardToLeader, "forward-to-leader", false, "followers proxy writes and linearizable reads to the leader instead of redirecting")
+	c.Peers = map[string]string{}
+	fs.Var((*peersValue)(&c.Peers), "peers", "HTTP URLs of cluster nodes for forwarding, as id=url[,id=url...]")
+
+	fs.DurationVar(&c.RaftHeartbeatTimeout, "raft-heartbeat-timeout", time.Second, "how long a follower waits without contact before starting an election")
+	fs.DurationVar(&c.RaftElectionTimeout, "raft-election-timeout", time.Second, "how long a candidate waits without a leader before starting an election")
+	fs.DurationVar(&c.RaftLeaderLeaseTimeout, "raft-leader-lease-timeout", 500*time.Millisecond, "how long a leader stays leader without contact with a quorum (also bounds lease reads)")
+	fs.DurationVar(&c.RaftCommitTimeout, "raft-commit-timeout", 50*time.Millisecond, "how long the leader waits before sending a heartbeat that carries the commit index")
+	fs.DurationVar(&c.RaftSnapshotInterval, "raft-snapshot-interval", 120*time.Second, "how often to check whether a snapshot is due")
+	fs.Uint64Var(&c.RaftSnapshotThreshold, "raft-snapshot-threshold", 8192, "log entries since the last snapshot that make a snapshot due")
+	fs.Uint64Var(&c.RaftTrailingLogs, "raft-trailing-logs", 10240, "log entries kept after a snapshot, so slow followers can catch up from the log")
+	fs.IntVar(&c.RaftMaxAppendEntries, "raft-max-append-entries", 64, "max log entries per AppendEntries RPC")
+	fs.IntVar(&c.RaftSnapshotRetain, "raft-snapshot-retain", 1, "snapshots kept on disk")
+	fs.IntVar(&c.RaftMaxPool, "raft-max-pool", 3, "pooled raft connections per peer")
+	fs.DurationVar(&c.RaftTransportTimeout, "raft-transport-timeout", 10*time.Second, "I/O deadline for raft RPCs")
+	fs.StringVar(&c.RaftLogStore, "raft-log-store", "bolt", "raft log backend: bolt (raft/raft.db) or badger (raft/log); switching migrates the log on start")
 
-	flag.StringVar(&c.DataDir, "data-dir", "./data", "data directory for Badger")
-	flag.StringVar(&c.HTTPAddr, "http-addr", ":8080", "http listen address")
-	flag.StringVar(&c.NodeID, "node-id", "node-1", "node identifier")
-	flag.BoolVar(&c.EnableRaft, "enable-raft", false, "enable raft replication")
-	flag.StringVar(&c.RaftAddr, "raft-addr", "127.0.0.1:12000", "raft bind address (host:port)")
-	flag.StringVar(&c.JoinAddr, "join", "", "HTTP address of existing node to join (e.g. http://host:8080)")
+	fs.BoolVar(&c.BadgerSyncWrites, "badger-sync-writes", true, "fsync every write to Badger")
+	fs.Int64Var(&c.BadgerMemTableSize, "badger-mem-table-size", 64<<20, "bytes per Badger memtable")
+	fs.Int64Var(&c.BadgerValueLogFileSize, "badger-value-log-file-size", 1<<30-1, "bytes per Badger value log file")
+	fs.Int64Var(&c.BadgerValueThreshold, "badger-value-threshold", 1<<20, "values of at least this many bytes are stored in the value log")
+	fs.Int64Var(&c.BadgerBlockCacheSize, "badger-block-cache-size", 256<<20, "bytes of Badger block cache")
+	fs.Int64Var(&c.BadgerIndexCacheSize, "badger-index-cache-size", 0, "bytes of Badger index cache (0 keeps all indices in memory)")
+	fs.IntVar(&c.BadgerNumCompactors, "badger-num-compactors", 4, "concurrent Badger compactions (0 or at least 2)")
+
+	fs.DurationVar(&c.HTTPReadTimeout, "http-read-timeout", 10*time.Second, "max time to read a request, body included")
+	fs.DurationVar(&c.HTTPReadHeaderTimeout, "http-read-header-timeout", 0, "max time to read request headers (0 uses -http-read-timeout)")
+	fs.DurationVar(&c.HTTPWriteTimeout, "http-write-timeout", 10*time.Second, "max time to write a response")
+	fs.DurationVar(&c.HTTPIdleTimeout, "http-idle-timeout", 0, "how long idle keep-alive connections stay open (0 uses -http-read-timeout)")
+	fs.DurationVar(&c.HTTPShutdownTimeout, "http-shutdown-timeout", 5*time.Second, "how long shutdown waits for in-flight requests")
 
 	// Phase 6 flags:
-	flag.IntVar(&c.ShardCount, "shard-count", 0, "number of shards (0 = no per-shard raft instances started automatically)")
-	flag.IntVar(&c.RaftBasePort, "raft-base-port", 12000, "base port for per-shard raft instances; shard i uses base+ i")
+	fs.IntVar(&c.ShardCount, "shard-count", 0, "number of shards (0 = no per-shard raft instances started automatically)")
+	fs.IntVar(&c.RaftBasePort, "raft-base-port", 12000, "base port for per-shard raft instances; shard i uses base+ i")
+	fs.IntVar(&c.ShardReplicas, "shard-replicas", 3, "replicas of each shard the leader places on cluster nodes, as many as there are")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Each source only fills settings no stronger source gave.
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || f.Name == "print-config" {
+			return
+		}
+		if v, ok := os.LookupEnv(EnvName(f.Name)); ok {
+			if err := fs.Set(f.Name, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", EnvName(f.Name), err))
+			}
+			set[f.Name] = true
+		}
+	})
+	if c.ConfigFile != "" {
+		values, err := readFile(c.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range values {
+			if fs.Lookup(kv.name) == nil || kv.name == "config" || kv.name == "print-config" {
+				errs = append(errs, fmt.Errorf("%s: unknown setting %q", c.ConfigFile, kv.name))
+				continue
+			}
+			if set[kv.name] {
+				continue
+			}
+			if err := fs.Set(kv.name, kv.value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s: %w", c.ConfigFile, kv.name, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	if c.HTTPAdvertise == "" {
+		c.HTTPAdvertise = "http://" + advertiseHostPort(c.HTTPAddr)
+	} else if !strings.HasPrefix(c.HTTPAdvertise, "http://") && !strings.HasPrefix(c.HTTPAdvertise, "https://") {
+		c.HTTPAdvertise = "http://" + c.HTTPAdvertise
+	}
+	c.HTTPAdvertise = strings.TrimRight(c.HTTPAdvertise, "/")
+	if c.RaftAdvertise == "" {
+		c.RaftAdvertise = advertiseHostPort(c.RaftAddr)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// EnvName returns the environment variable that sets the named flag.
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Validate reports every setting that is out of range or inconsistent with
+// another, as one error.
+func (c *Config) Validate() error {
+	var errs []error
+	bad := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.DataDir == "" {
+		bad("data-dir must not be empty")
+	}
+	if c.NodeID == "" {
+		bad("node-id must not be empty")
+	}
+	for name, addr := range map[string]string{"http-addr": c.HTTPAddr, "raft-addr": c.RaftAddr, "raft-advertise": c.RaftAdvertise} {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			bad("%s: %v", name, err)
+		}
+	}
+	if c.JoinAsLearner && c.JoinAddr == "" {
+		bad("join-as-learner needs join")
+	}
+	if c.RecoverPeers != "" && !c.EnableRaft {
+		bad("recover-peers needs enable-raft")
+	}
+	if c.RecoverPeers != "" && c.JoinAddr != "" {
+		bad("recover-peers and join cannot be used together")
+	}
+	if c.RecoverForce && c.RecoverPeers == "" {
+		bad("recover-force needs recover-peers")
+	}
+	if c.GroupCommitWindow < 0 {
+		bad("group-commit-window must not be negative")
+	}
+	if c.ShardCount < 0 {
+		bad("shard-count must not be negative")
+	}
+	if c.ShardReplicas < 1 {
+		bad("shard-replicas must be at least 1")
+	}
+
+	// the same limits raft.ValidateConfig enforces, named by flag
+	if c.RaftHeartbeatTimeout < 5*time.Millisecond {
+		bad("raft-heartbeat-timeout must be at least 5ms")
+	}
+	if c.RaftElectionTimeout < c.RaftHeartbeatTimeout {
+		bad("raft-election-timeout (%s) must be at least raft-heartbeat-timeout (%s)", c.RaftElectionTimeout, c.RaftHeartbeatTimeout)
+	}
+	if c.RaftLeaderLeaseTimeout < 5*time.Millisecond {
+		bad("raft-leader-lease-timeout must be at least 5ms")
+	}
+	if c.RaftLeaderLeaseTimeout > c.RaftHeartbeatTimeout {
+		bad("raft-leader-lease-timeout (%s) must not exceed raft-heartbeat-timeout (%s)", c.RaftLeaderLeaseTimeout, c.RaftHeartbeatTimeout)
+	}
+	if c.RaftCommitTimeout < time.Millisecond {
+		bad("raft-commit-timeout must be at least 1ms")
+	}
+	if c.RaftSnapshotInterval < 5*time.Millisecond {
+		bad("raft-snapshot-interval must be at least 5ms")
+	}
+	if c.RaftSnapshotThreshold == 0 {
+		bad("raft-snapshot-threshold must be positive")
+	}
+	// raftnode.Tuning reads zero as "keep the default"
+	if c.RaftTrailingLogs == 0 {
+		bad("raft-trailing-logs must be positive")
+	}
+	if c.RaftMaxAppendEntries < 1 || c.RaftMaxAppendEntries > 1024 {
+		bad("raft-max-append-entries must be between 1 and 1024")
+	}
+	if c.RaftSnapshotRetain < 1 {
+		bad("raft-snapshot-retain must be at least 1")
+	}
+	if c.RaftMaxPool < 1 {
+		bad("raft-max-pool must be at least 1")
+	}
+	if c.RaftTransportTimeout <= 0 {
+		bad("raft-transport-timeout must be positive")
+	}
+	if c.RaftLogStore != "bolt" && c.RaftLogStore != "badger" {
+		bad("raft-log-store must be bolt or badger, not %q", c.RaftLogStore)
+	}
+
+	// Badger rejects these at open time with less helpful messages
+	if c.BadgerMemTableSize <= 0 {
+		bad("badger-mem-table-size must be positive")
+	}
+	if c.BadgerValueLogFileSize < 1<<20 || c.BadgerValueLogFileSize >= 2<<30 {
+		bad("badger-value-log-file-size must be at least 1MiB and below 2GiB")
+	}
+	if c.BadgerValueThreshold <= 0 || c.BadgerValueThreshold > 1<<20 {
+		bad("badger-value-threshold must be between 1 and 1048576")
+	}
+	if c.BadgerBlockCacheSize < 0 || c.BadgerIndexCacheSize < 0 {
+		bad("badger cache sizes must not be negative")
+	}
+	if c.BadgerNumCompactors < 0 || c.BadgerNumCompactors == 1 {
+		bad("badger-num-compactors must be 0 or at least 2")
+	}
+
+	for name, d := range map[string]time.Duration{
+		"http-read-timeout":        c.HTTPReadTimeout,
+		"http-read-header-timeout": c.HTTPReadHeaderTimeout,
+		"http-write-timeout":       c.HTTPWriteTimeout,
+		"http-idle-timeout":        c.HTTPIdleTimeout,
+		"http-shutdown-timeout":    c.HTTPShutdownTimeout,
+	} {
+		if d < 0 {
+			bad("%s must not be negative", name)
+		}
+	}
+
+	// map iteration above is unordered; keep the report stable
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errors.Join(errs...)
+}
+
+// Print writes the effective configuration to w as YAML, in a form Load
+// accepts back as a config file.
+func (c *Config) Print(w io.Writer) error {
+	b, err := marshalYAML(c.fs)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// peersValue is the --peers flag: id=url pairs, merged across repeats.
+type peersValue map[string]string
+
+func (p *peersValue) String() string {
+	if p == nil {
+		return ""
+	}
+	ids := make([]string, 0, len(*p))
+	for id := range *p {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	pairs := make([]string, len(ids))
+	for i, id := range ids {
+		pairs[i] = id + "=" + (*p)[id]
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (p *peersValue) Set(v string) error {
+	for _, kv := range strings.Split(v, ",") {
+		id, u, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok || id == "" || u == "" {
+			return fmt.Errorf("want id=url, got %q", kv)
+		}
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			u = "http://" + u
+		}
+		(*p)[id] = u
+	}
+	return nil
+}
+
+func (p *peersValue) Get() any { return map[string]string(*p) }
 
-	flag.Parse()
-	return c
+// advertiseHostPort turns a bind address into one peers can dial. An empty
+// or wildcard host becomes 127.0.0.1, which suits single-machine clusters;
+// anything else must set the advertise flag explicitly.
+func advertiseHostPort(bind string) string {
+	host, port, err := net.SplitHostPort(bind)
+	if err != nil {
+		return bind
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
 }
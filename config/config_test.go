@@ -0,0 +1,119 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, body string) string {
+	t.Helper()
+	dir := filepath.Join(os.TempDir(), "dkvs_test_config_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, "keyper.yaml", `
+node-id: from-file
+data-dir: /var/lib/keyper
+raft:
+  heartbeat-timeout: 2s
+  election-timeout: 2s
+  snapshot-retain: 3
+peers:
+  n2: 10.0.0.2:8080
+`)
+	t.Setenv("KEYPER_NODE_ID", "from-env")
+	t.Setenv("KEYPER_RAFT_SNAPSHOT_RETAIN", "5")
+
+	c, err := Load([]string{"--config", path, "--raft-snapshot-retain", "7"})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if c.DataDir != "/var/lib/keyper" || c.RaftHeartbeatTimeout != 2*time.Second {
+		t.Fatalf("file settings not applied: %+v", c)
+	}
+	if c.NodeID != "from-env" {
+		t.Fatalf("env should override the file, got node id %q", c.NodeID)
+	}
+	if c.RaftSnapshotRetain != 7 {
+		t.Fatalf("flag should override env and file, got retain %d", c.RaftSnapshotRetain)
+	}
+	if c.Peers["n2"] != "http://10.0.0.2:8080" {
+		t.Fatalf("peers table not applied: %v", c.Peers)
+	}
+
+	// the printed config loads back to the same settings
+	var out bytes.Buffer
+	if err := c.Print(&out); err != nil {
+		t.Fatalf("print: %v", err)
+	}
+	printed := writeConfig(t, "printed.yaml", out.String())
+	os.Unsetenv("KEYPER_NODE_ID")
+	os.Unsetenv("KEYPER_RAFT_SNAPSHOT_RETAIN")
+	again, err := Load([]string{"--config", printed})
+	if err != nil {
+		t.Fatalf("load printed config: %v\n%s", err, out.String())
+	}
+	var out2 bytes.Buffer
+	_ = again.Print(&out2)
+	if out.String() != out2.String() {
+		t.Fatalf("printed config does not round-trip:\n%s\nvs\n%s", out.String(), out2.String())
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	path := writeConfig(t, "keyper.toml", `
+node_id = "n1"
+
+[badger]
+sync_writes = false
+mem_table_size = 16777216
+
+[http]
+write_timeout = "30s"
+`)
+	c, err := Load([]string{"--config", path})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if c.NodeID != "n1" || c.BadgerSyncWrites || c.BadgerMemTableSize != 16<<20 || c.HTTPWriteTimeout != 30*time.Second {
+		t.Fatalf("toml settings not applied: %+v", c)
+	}
+}
+
+func TestLoadRejectsBadSettings(t *testing.T) {
+	path := writeConfig(t, "bad.yaml", "raft:\n  heartbeat-timeot: 1s\n")
+	if _, err := Load([]string{"--config", path}); err == nil || !strings.Contains(err.Error(), `unknown setting "raft-heartbeat-timeot"`) {
+		t.Fatalf("expected unknown setting error, got %v", err)
+	}
+
+	_, err := Load([]string{"--raft-leader-lease-timeout", "2s", "--badger-num-compactors", "1", "--raft-trailing-logs", "0"})
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{"raft-leader-lease-timeout", "badger-num-compactors", "raft-trailing-logs"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %s in %v", want, err)
+		}
+	}
+
+	_, err = Load([]string{"--recover-peers", "peers.json", "--join", "http://127.0.0.1:8080"})
+	for _, want := range []string{"recover-peers needs enable-raft", "recover-peers and join"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %s in %v", want, err)
+		}
+	}
+}
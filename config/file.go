@@ -0,0 +1,142 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// setting is one flag value taken from a config file.
+type setting struct {
+	name  string
+	value string
+}
+
+// readFile parses a YAML or TOML config file, chosen by extension, into flag
+// settings. Keys are flag names; underscores count as dashes, and nested
+// tables join their keys with a dash, so
+//
+//	raft:
+//	  heartbeat-timeout: 500ms
+//
+// sets raft-heartbeat-timeout. Lists become comma-separated values, and a
+// table under a flag's own name (peers) becomes id=url pairs.
+func readFile(path string) ([]setting, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	doc := map[string]any{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &doc)
+	case ".toml":
+		err = toml.Unmarshal(b, &doc)
+	default:
+		return nil, fmt.Errorf("config file %s: unknown format %q (want .yaml, .yml or .toml)", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse config file %s: %w", path, err)
+	}
+
+	var out []setting
+	flatten("", doc, &out)
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out, nil
+}
+
+// knownTables are flags whose value is written as a table in a file.
+var knownTables = map[string]bool{"peers": true}
+
+func flatten(prefix string, v any, out *[]setting) {
+	m, ok := v.(map[string]any)
+	if !ok || knownTables[prefix] {
+		*out = append(*out, setting{name: prefix, value: scalar(v)})
+		return
+	}
+	for k, sub := range m {
+		name := strings.ToLower(strings.ReplaceAll(k, "_", "-"))
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+		flatten(name, sub, out)
+	}
+}
+
+// scalar renders a decoded file value the way it would be typed as a flag.
+func scalar(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []any:
+		parts := make([]string, len(v))
+		for i, e := range v {
+			parts[i] = scalar(e)
+		}
+		return strings.Join(parts, ",")
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, len(keys))
+		for i, k := range keys {
+			pairs[i] = k + "=" + scalar(v[k])
+		}
+		return strings.Join(pairs, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// marshalYAML renders every flag in fs but config and print-config as a
+// flat YAML mapping, in flag name order.
+func marshalYAML(fs *flag.FlagSet) ([]byte, error) {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		var v any = f.Value.String()
+		if g, ok := f.Value.(flag.Getter); ok {
+			v = g.Get()
+		}
+		if d, ok := v.(time.Duration); ok {
+			v = d.String()
+		}
+		val := &yaml.Node{}
+		if err = val.Encode(v); err != nil {
+			err = fmt.Errorf("%s: %w", f.Name, err)
+			return
+		}
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: f.Name}, val)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
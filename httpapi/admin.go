@@ -0,0 +1,233 @@
+package httpapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	raft "github.com/hashicorp/raft"
+	"github.com/sada-02/keyper/store"
+)
+
+// Headers describing the snapshot streamed by POST /v1/admin/snapshot. The
+// SHA-256 of the body follows it as a trailer, once it is known.
+const (
+	SnapshotIndexHeader   = "X-Keyper-Snapshot-Index"
+	SnapshotTermHeader    = "X-Keyper-Snapshot-Term"
+	SnapshotSizeHeader    = "X-Keyper-Snapshot-Size"
+	SnapshotConfigHeader  = "X-Keyper-Snapshot-Configuration" // JSON list of servers
+	SnapshotSHA256Trailer = "X-Keyper-Snapshot-Sha256"
+)
+
+// snapshotServer is one server of the configuration stored with a snapshot.
+type snapshotServer struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"`
+}
+
+// transferLeadershipHandler serves POST /v1/admin/transfer-leadership, which
+// moves leadership off this node, to the voter named by ?id= or a JSON body
+// {"id": "..."}, or else to the most up to date follower. It answers with the
+// new leader once one is known.
+func (h *Handler) transferLeadershipHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.RaftNode == nil {
+		http.Error(w, "raft not enabled", http.StatusBadRequest)
+		return
+	}
+	target := r.URL.Query().Get("id")
+	if target == "" {
+		var req struct {
+			ID string `json:"id"`
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "bad body", http.StatusBadRequest)
+			return
+		}
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &req); err != nil {
+				http.Error(w, "invalid json", http.StatusBadRequest)
+				return
+			}
+		}
+		target = req.ID
+	}
+	if !h.requireLeader(w) {
+		return
+	}
+	if target == h.RaftNode.ID {
+		http.Error(w, "already leader", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.RaftNode.TransferLeadership(target); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) {
+			h.redirectToLeader(w, "not leader")
+			return
+		}
+		http.Error(w, "leadership transfer failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the transfer is done once the target has won; wait to hear about it
+	deadline := time.Now().Add(2 * time.Second)
+	_, leader := h.RaftNode.Raft.LeaderWithID()
+	for (leader == "" || string(leader) == h.RaftNode.ID) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		_, leader = h.RaftNode.Raft.LeaderWithID()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"leader": string(leader), "leader_http": h.leaderURL()})
+}
+
+// snapshotHandler serves POST /v1/admin/snapshot: it takes a snapshot of this
+// node's state right away and streams it back, which is an online backup.
+// Without Raft the store is dumped directly. A sharded node keeps its keys in
+// the shard stores, which the snapshot would leave out, so it refuses.
+func (h *Handler) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.ShardCount > 0 {
+		http.Error(w, "snapshots do not cover shard stores; not available with --shard-count", http.StatusBadRequest)
+		return
+	}
+	// a large snapshot outlasts the server's write timeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	sum := sha256.New()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Trailer", SnapshotSHA256Trailer)
+
+	if h.RaftNode == nil {
+		snap, err := h.Store.Snapshot(false)
+		if err != nil {
+			http.Error(w, "snapshot failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer snap.Remove()
+		if _, err := snap.WriteTo(io.MultiWriter(w, sum)); err != nil {
+			return
+		}
+		w.Header().Set(SnapshotSHA256Trailer, hex.EncodeToString(sum.Sum(nil)))
+		return
+	}
+
+	meta, rc, err := h.RaftNode.OpenSnapshot()
+	if err != nil {
+		http.Error(w, "snapshot failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+	servers := make([]snapshotServer, 0, len(meta.Configuration.Servers))
+	for _, srv := range meta.Configuration.Servers {
+		servers = append(servers, snapshotServer{ID: string(srv.ID), Address: string(srv.Address), Suffrage: strings.ToLower(srv.Suffrage.String())})
+	}
+	conf, _ := json.Marshal(servers)
+	w.Header().Set(SnapshotIndexHeader, strconv.FormatUint(meta.Index, 10))
+	w.Header().Set(SnapshotTermHeader, strconv.FormatUint(meta.Term, 10))
+	w.Header().Set(SnapshotSizeHeader, strconv.FormatInt(meta.Size, 10))
+	w.Header().Set(SnapshotConfigHeader, string(conf))
+	if _, err := io.Copy(io.MultiWriter(w, sum), rc); err != nil {
+		// headers are gone; a missing trailer tells the client it is incomplete
+		return
+	}
+	w.Header().Set(SnapshotSHA256Trailer, hex.EncodeToString(sum.Sum(nil)))
+}
+
+// restoreHandler serves POST /v1/admin/restore: the body is a snapshot from
+// POST /v1/admin/snapshot, which replaces the state of the whole cluster.
+// The upload is checked in full before anything is touched. The snapshot's
+// last index (X-Keyper-Snapshot-Index) is optional; versions found in the
+// snapshot are honoured either way. Like snapshots, it is refused on a
+// sharded node.
+func (h *Handler) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.ShardCount > 0 {
+		http.Error(w, "snapshots do not cover shard stores; not available with --shard-count", http.StatusBadRequest)
+		return
+	}
+	if h.RaftNode != nil && !h.requireLeader(w) {
+		return
+	}
+	var index uint64
+	if v := r.Header.Get(SnapshotIndexHeader); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid "+SnapshotIndexHeader, http.StatusBadRequest)
+			return
+		}
+		index = n
+	}
+	_ = http.NewResponseController(w).SetReadDeadline(time.Time{})
+
+	f, err := os.CreateTemp("", "keyper-restore-*")
+	if err != nil {
+		http.Error(w, "spool snapshot: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, r.Body)
+	if err != nil {
+		http.Error(w, "read snapshot: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	info, err := store.InspectSnapshot(f)
+	if err != nil {
+		http.Error(w, "invalid snapshot: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if h.RaftNode == nil {
+		if err := h.Store.Restore(f); err != nil {
+			http.Error(w, "restore failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if h.Watch != nil {
+			h.Watch.Reset()
+		}
+	} else {
+		if info.MaxVersion > index {
+			index = info.MaxVersion
+		}
+		if err := h.RaftNode.Restore(f, size, index, 30*time.Second); err != nil {
+			if errors.Is(err, raft.ErrNotLeader) {
+				h.redirectToLeader(w, "not leader")
+				return
+			}
+			http.Error(w, "restore failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]uint64{"records": info.Records}
+	if h.RaftNode != nil {
+		resp["index"] = h.RaftNode.Raft.AppliedIndex()
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
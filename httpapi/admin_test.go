@@ -0,0 +1,132 @@
+package httpapi_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/sada-02/keyper/httpapi"
+	"github.com/sada-02/keyper/store"
+)
+
+// newServer serves a raftless handler over a fresh store in dir.
+func newServer(t *testing.T, dir string) (*store.BadgerStore, *httpapi.Handler, *httptest.Server) {
+	t.Helper()
+	s, err := store.NewBadgerStore(dir)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	h := httpapi.NewHandler(s, "n1")
+	mux := http.NewServeMux()
+	h.Register(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return s, h, srv
+}
+
+// TestSnapshotRestore takes a snapshot of one store over HTTP, checks it
+// against the SHA-256 trailer and restores it into another, which must end
+// up with exactly its keys; a damaged upload must be turned away whole.
+func TestSnapshotRestore(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "dkvs_test_admin_snapshot_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(base)
+	t.Cleanup(func() { os.RemoveAll(base) })
+	// restore spools the upload under the temp dir; nothing may be left there
+	spool := filepath.Join(base, "tmp")
+	if err := os.MkdirAll(spool, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TMPDIR", spool)
+
+	src, _, srcSrv := newServer(t, filepath.Join(base, "src"))
+	for i := 0; i < 100; i++ {
+		if err := src.Set([]byte("k"+strconv.Itoa(i)), []byte("v"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+
+	resp, err := http.Post(srcSrv.URL+"/v1/admin/snapshot", "", nil)
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	snap, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("snapshot: %s, %v", resp.Status, err)
+	}
+	sum := sha256.Sum256(snap)
+	if got := resp.Trailer.Get(httpapi.SnapshotSHA256Trailer); got != hex.EncodeToString(sum[:]) {
+		t.Fatalf("trailer %q, want the body's SHA-256 %x", got, sum)
+	}
+
+	dst, _, dstSrv := newServer(t, filepath.Join(base, "dst"))
+	if err := dst.Set([]byte("stale"), []byte("x")); err != nil {
+		t.Fatalf("set stale: %v", err)
+	}
+	restore := func(body []byte) (int, []byte) {
+		resp, err := http.Post(dstSrv.URL+"/v1/admin/restore", "application/octet-stream", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("restore: %v", err)
+		}
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, out
+	}
+
+	// a truncated upload fails inspection and leaves the store alone
+	if code, msg := restore(snap[:len(snap)-10]); code != http.StatusBadRequest {
+		t.Fatalf("truncated restore: %d %s, want 400", code, msg)
+	}
+	if _, err := dst.Get([]byte("stale")); err != nil {
+		t.Fatalf("rejected restore touched the store: %v", err)
+	}
+
+	code, msg := restore(snap)
+	if code != http.StatusOK {
+		t.Fatalf("restore: %d %s", code, msg)
+	}
+	var res map[string]uint64
+	if err := json.Unmarshal(msg, &res); err != nil || res["records"] != 100 {
+		t.Fatalf("restore answered %s, want 100 records", msg)
+	}
+	if v, err := dst.Get([]byte("k42")); err != nil || string(v) != "v42" {
+		t.Fatalf("k42 = %q, %v", v, err)
+	}
+	if _, err := dst.Get([]byte("stale")); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("stale key survived the restore: %v", err)
+	}
+	if left, _ := os.ReadDir(spool); len(left) != 0 {
+		t.Fatalf("restore left spool files: %v", left)
+	}
+}
+
+// TestSnapshotRestoreSharded checks that a sharded node refuses both, since
+// its keys live in shard stores a snapshot does not cover.
+func TestSnapshotRestoreSharded(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dkvs_test_admin_sharded_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	_, h, srv := newServer(t, dir)
+	h.ShardCount = 2
+
+	for _, path := range []string{"/v1/admin/snapshot", "/v1/admin/restore"} {
+		resp, err := http.Post(srv.URL+path, "", nil)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s on a sharded node: %s, want 400", path, resp.Status)
+		}
+	}
+}
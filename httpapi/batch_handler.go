@@ -0,0 +1,136 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	raftnode "github.com/sada-02/keyper/raft"
+	"github.com/sada-02/keyper/store"
+	"github.com/sada-02/keyper/watch"
+)
+
+// maxBatchOps caps a single batch so one request cannot build an unbounded
+// Raft entry.
+const maxBatchOps = 10000
+
+type batchRequest struct {
+	Ops []txnOp `json:"ops"`
+}
+
+type batchResponse struct {
+	Index   uint64              `json:"index,omitempty"` // Raft index the batch committed at
+	Results []store.BatchResult `json:"results"`
+}
+
+// batchKeys returns the keys a /v1/batch body writes.
+func batchKeys(body []byte) ([]string, error) {
+	var req batchRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(req.Ops))
+	for i, op := range req.Ops {
+		keys[i] = op.Key
+	}
+	return keys, nil
+}
+
+// batchHandler implements PUT (or POST) /v1/batch:
+//
+//	{"ops": [{"op":"set","key":"a","value":"<base64>","ttl":"30s"}, {"op":"delete","key":"b"}]}
+//
+// All ops travel in a single Raft log entry and are written with one Badger
+// WriteBatch, so a bulk load pays for one Apply and one sync instead of one
+// per key. The batch is not a transaction: a malformed op is rejected on its
+// own and reported in its result while the others are applied. Results come
+// back in request order. With --shard-count every key must belong to one
+// shard, whose group applies the batch.
+func (h *Handler) batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "bad body", http.StatusBadRequest)
+		return
+	}
+	var req batchRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if len(req.Ops) == 0 {
+		http.Error(w, "no ops", http.StatusBadRequest)
+		return
+	}
+	if len(req.Ops) > maxBatchOps {
+		http.Error(w, fmt.Sprintf("too many ops: %d > %d", len(req.Ops), maxBatchOps), http.StatusBadRequest)
+		return
+	}
+
+	if h.RaftNode != nil {
+		// Only the leader may stamp TTL deadlines and propose the entry.
+		if !h.requireLeader(w) {
+			return
+		}
+	}
+
+	// Ops with an unparseable TTL are rejected here; the rest are proposed
+	// and validated again by the store on every replica.
+	results := make([]store.BatchResult, len(req.Ops))
+	ops := make([]store.TxnOp, 0, len(req.Ops))
+	pos := make([]int, 0, len(req.Ops)) // request index of each proposed op
+	for i, op := range req.Ops {
+		ttl, err := parseTTLValue(op.TTL)
+		if err != nil {
+			results[i] = store.BatchResult{Op: op.Op, Key: op.Key, Error: err.Error()}
+			continue
+		}
+		ops = append(ops, store.TxnOp{Op: op.Op, Key: op.Key, Value: op.Value, ExpiresAt: expiryDeadline(ttl)})
+		pos = append(pos, i)
+	}
+
+	resp := batchResponse{Results: results}
+	if len(ops) > 0 {
+		var applied []store.BatchResult
+		if h.RaftNode != nil {
+			cmd := &raftnode.Command{Op: "batch", Batch: ops}
+			res, err := h.RaftNode.Apply(cmd, 5*time.Second)
+			if err != nil {
+				h.applyFailed(w, err)
+				return
+			}
+			var ok bool
+			if applied, ok = res.Response.([]store.BatchResult); !ok {
+				http.Error(w, "unexpected batch result", http.StatusInternalServerError)
+				return
+			}
+			resp.Index = res.Index
+		} else {
+			applied, err = h.Store.ApplyBatch(ops, 0)
+			if err != nil {
+				http.Error(w, "batch failed: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			written := make([]store.TxnOp, 0, len(ops))
+			for i, op := range ops {
+				if applied[i].Error == "" {
+					written = append(written, op)
+				}
+			}
+			h.publishLocal(watch.TxnEvents(written, 0)...)
+		}
+		for i, res := range applied {
+			results[pos[i]] = res
+		}
+	}
+
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
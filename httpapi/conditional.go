@@ -0,0 +1,62 @@
+package httpapi
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sada-02/keyper/store"
+)
+
+// formatETag renders a key version as a strong HTTP entity tag.
+func formatETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// parseCondition turns the If-Match / If-None-Match headers of a write into a
+// store.Condition. Supported forms are If-Match: * (key must exist),
+// If-Match: "<version>" (key must be at that version) and If-None-Match: *
+// (key must not exist). It returns nil when neither header is present.
+func parseCondition(r *http.Request) (*store.Condition, error) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	ifNoneMatch := strings.TrimSpace(r.Header.Get("If-None-Match"))
+	if ifMatch != "" && ifNoneMatch != "" {
+		return nil, errors.New("If-Match and If-None-Match are mutually exclusive")
+	}
+
+	if ifNoneMatch != "" {
+		if ifNoneMatch != "*" {
+			return nil, errors.New("only If-None-Match: * is supported")
+		}
+		return &store.Condition{MustNotExist: true}, nil
+	}
+	if ifMatch == "" {
+		return nil, nil
+	}
+	if ifMatch == "*" {
+		return &store.Condition{MustExist: true}, nil
+	}
+	// versions are strong tags, but tolerate weak or unquoted forms
+	tag := strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`)
+	v, err := strconv.ParseUint(tag, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid If-Match version: " + ifMatch)
+	}
+	return &store.Condition{Version: &v}, nil
+}
+
+// writeConditionFailed answers 412 Precondition Failed when err is a failed
+// write condition, carrying the key's current version as ETag (omitted when
+// the key does not exist). It reports whether it wrote a response.
+func writeConditionFailed(w http.ResponseWriter, err error) bool {
+	var cerr *store.ConditionError
+	if !errors.As(err, &cerr) {
+		return false
+	}
+	if cerr.Exists {
+		w.Header().Set("ETag", formatETag(cerr.Version))
+	}
+	http.Error(w, cerr.Error(), http.StatusPreconditionFailed)
+	return true
+}
@@ -0,0 +1,140 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Read consistency levels, chosen per request with ?consistency= or the
+// X-Keyper-Consistency header.
+const (
+	// Linearizable reads are served by the leader after a Barrier (default).
+	Linearizable = "linearizable"
+	// Lease reads are served by the leader without a Barrier while its
+	// leadership lease is valid.
+	Lease = "lease"
+	// Bounded reads are served by any node whose state is within the
+	// requested lag of the leader; other nodes redirect to the leader.
+	Bounded = "bounded"
+	// Stale reads are served by any node from its local state.
+	Stale = "stale"
+
+	ConsistencyHeader = "X-Keyper-Consistency"
+	// MaxLagHeader and MaxStalenessHeader (or ?max_lag= / ?max_staleness=)
+	// bound a bounded read, in log entries and as a duration. When neither
+	// is given both defaults apply; when one is given only that one does.
+	MaxLagHeader       = "X-Keyper-Max-Lag"
+	MaxStalenessHeader = "X-Keyper-Max-Staleness"
+	// AppliedIndexHeader reports the log index the serving node had applied.
+	AppliedIndexHeader = "X-Keyper-Applied-Index"
+
+	defaultMaxLag       = 1000
+	defaultMaxStaleness = 5 * time.Second
+)
+
+// readConsistency is the parsed consistency of one read request.
+type readConsistency struct {
+	level        string
+	maxLag       uint64 // 0 = not bounded by entries
+	maxStaleness time.Duration
+}
+
+// param returns the query parameter name, falling back to the header.
+func param(r *http.Request, name, header string) string {
+	if v := r.URL.Query().Get(name); v != "" {
+		return v
+	}
+	return r.Header.Get(header)
+}
+
+func parseConsistency(r *http.Request) (readConsistency, error) {
+	rc := readConsistency{level: param(r, "consistency", ConsistencyHeader)}
+	switch rc.level {
+	case "":
+		rc.level = Linearizable
+	case Linearizable, Lease, Stale:
+	case Bounded:
+		lag := param(r, "max_lag", MaxLagHeader)
+		staleness := param(r, "max_staleness", MaxStalenessHeader)
+		if lag == "" && staleness == "" {
+			rc.maxLag, rc.maxStaleness = defaultMaxLag, defaultMaxStaleness
+			break
+		}
+		if lag != "" {
+			n, err := strconv.ParseUint(lag, 10, 64)
+			if err != nil {
+				return rc, fmt.Errorf("invalid max_lag: %s", lag)
+			}
+			// 0 entries behind is a meaningful bound; store it as +1 so
+			// that 0 can mean "unbounded"
+			rc.maxLag = n + 1
+		}
+		if staleness != "" {
+			d, err := parseTTLValue(staleness)
+			if err != nil || d <= 0 {
+				return rc, fmt.Errorf("invalid max_staleness: %s", staleness)
+			}
+			rc.maxStaleness = d
+		}
+	default:
+		return rc, fmt.Errorf("invalid consistency: %s", rc.level)
+	}
+	return rc, nil
+}
+
+// consistentRead prepares this node to serve a read at the consistency the
+// request asks for. It writes the error or leader redirect itself and returns
+// false when the read must not be served here. Without Raft every read is
+// local and this always succeeds.
+func (h *Handler) consistentRead(w http.ResponseWriter, r *http.Request) bool {
+	rc, err := parseConsistency(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if h.RaftNode == nil {
+		return true
+	}
+
+	switch rc.level {
+	case Linearizable, Lease:
+		if h.RaftNode.Raft.State() != raft.Leader {
+			h.redirectToLeader(w, "not leader — read must go to leader")
+			return false
+		}
+		read := h.RaftNode.LinearizableRead
+		if rc.level == Lease {
+			read = h.RaftNode.LeaseRead
+		}
+		if err := read(5 * time.Second); err != nil {
+			http.Error(w, "raft barrier failed: "+err.Error(), http.StatusInternalServerError)
+			return false
+		}
+	case Bounded:
+		entries, staleness := h.RaftNode.ReadLag()
+		if (rc.maxLag > 0 && entries >= rc.maxLag) || (rc.maxStaleness > 0 && staleness > rc.maxStaleness) {
+			if h.RaftNode.Raft.State() != raft.Leader {
+				h.redirectToLeader(w, "follower too far behind for bounded read")
+				return false
+			}
+			// the leader is never behind the cluster; wait for it to apply
+			if err := h.RaftNode.LinearizableRead(5 * time.Second); err != nil {
+				http.Error(w, "raft barrier failed: "+err.Error(), http.StatusInternalServerError)
+				return false
+			}
+		}
+	}
+	w.Header().Set(ConsistencyHeader, rc.level)
+	w.Header().Set(AppliedIndexHeader, strconv.FormatUint(h.RaftNode.Raft.AppliedIndex(), 10))
+	return true
+}
+
+// redirectToLeader answers 307 with the leader in X-Raft-Leader, if known.
+func (h *Handler) redirectToLeader(w http.ResponseWriter, msg string) {
+	h.setLeaderHeader(w)
+	http.Error(w, msg, http.StatusTemporaryRedirect)
+}
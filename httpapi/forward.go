@@ -0,0 +1,163 @@
+package httpapi
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	raft "github.com/hashicorp/raft"
+)
+
+const (
+	// ServedByHeader names the node that actually handled the request, which
+	// differs from the node the client talked to when it was forwarded.
+	ServedByHeader = "X-Keyper-Served-By"
+	// ForwardedHeader counts how many times a request has been forwarded.
+	ForwardedHeader = "X-Keyper-Forwarded"
+
+	// maxForwardHops bounds how often one request is passed on, so nodes
+	// with diverging views of the leader cannot bounce it forever.
+	maxForwardHops = 3
+	// forwardRetryFor bounds how long a request waits for a reachable leader
+	// while leadership is changing; it covers a typical election.
+	forwardRetryFor  = 5 * time.Second
+	forwardRetryWait = 100 * time.Millisecond
+)
+
+// forwardClient proxies requests to the leader. Redirects are handed back to
+// the forwarding loop rather than followed.
+var forwardClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// forwarding wraps a handler so every response names the serving node and,
+// when ForwardToLeader is set, requests that only the leader may serve are
+// proxied to it instead of being answered with a 307.
+func (h *Handler) forwarding(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(ServedByHeader, h.NodeID)
+		if !h.ForwardToLeader || h.RaftNode == nil || !needsLeader(r) || h.RaftNode.Raft.State() == raft.Leader {
+			next(w, r)
+			return
+		}
+		hops, _ := strconv.Atoi(r.Header.Get(ForwardedHeader))
+		if hops >= maxForwardHops {
+			// give up forwarding; the handler answers with a redirect
+			next(w, r)
+			return
+		}
+		h.forward(w, r, hops+1, next)
+	}
+}
+
+// needsLeader reports whether r can only be served by the leader: every
+// write, and reads at linearizable or lease consistency.
+func needsLeader(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return true
+	}
+	switch param(r, "consistency", ConsistencyHeader) {
+	case "", Linearizable, Lease:
+		return true
+	}
+	return false
+}
+
+// forward proxies r to the current leader and streams the answer back. It
+// retries while there is no leader, while the request cannot reach it, and
+// when the node it reached was no longer the leader. If this node becomes
+// leader meanwhile, or no leader is reached in time, r is handled locally.
+func (h *Handler) forward(w http.ResponseWriter, r *http.Request, hops int, local http.HandlerFunc) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "bad body", http.StatusBadRequest)
+		return
+	}
+	serveLocally := func() {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		local(w, r)
+	}
+
+	deadline := time.Now().Add(forwardRetryFor)
+	for attempt := 0; attempt == 0 || time.Now().Before(deadline); attempt++ {
+		if attempt > 0 {
+			time.Sleep(forwardRetryWait)
+		}
+		if h.RaftNode.Raft.State() == raft.Leader {
+			serveLocally()
+			return
+		}
+		leader := h.leaderURL()
+		if leader == "" {
+			continue // election in progress, or the leader's URL is unknown
+		}
+
+		req, err := http.NewRequestWithContext(r.Context(), r.Method, leader+r.URL.RequestURI(), bytes.NewReader(body))
+		if err != nil {
+			http.Error(w, "forward failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		req.Header = r.Header.Clone()
+		req.Header.Set(ForwardedHeader, strconv.Itoa(hops))
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			req.Header.Add("X-Forwarded-For", host)
+		}
+
+		resp, err := forwardClient.Do(req)
+		if err != nil {
+			var opErr *net.OpError
+			if errors.As(err, &opErr) && opErr.Op == "dial" {
+				continue // never reached the leader: safe to retry
+			}
+			// the request may have been applied; do not resend it
+			http.Error(w, "forward to leader failed: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		if resp.StatusCode == http.StatusTemporaryRedirect {
+			// the node we reached has lost leadership; try the new leader
+			_ = resp.Body.Close()
+			continue
+		}
+
+		for k, vs := range resp.Header {
+			w.Header()[k] = vs
+		}
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+		_ = resp.Body.Close()
+		return
+	}
+	serveLocally()
+}
+
+// leaderURL returns the HTTP base URL of the current leader, or "" if there
+// is no leader or its URL is not known. The replicated membership table is
+// consulted first; PeerHTTP covers leaders that have not registered yet.
+func (h *Handler) leaderURL() string {
+	if u := h.RaftNode.LeaderHTTP(); u != "" {
+		return u
+	}
+	_, id := h.RaftNode.Raft.LeaderWithID()
+	if id == "" {
+		return ""
+	}
+	return strings.TrimRight(h.PeerHTTP[string(id)], "/")
+}
+
+// setLeaderHeader names the leader in X-Raft-Leader: its HTTP URL when known,
+// otherwise its Raft address so older clients still learn something.
+func (h *Handler) setLeaderHeader(w http.ResponseWriter) {
+	if u := h.leaderURL(); u != "" {
+		w.Header().Set("X-Raft-Leader", u)
+	} else if leader := h.RaftNode.Leader(); leader != "" {
+		w.Header().Set("X-Raft-Leader", leader)
+	}
+}
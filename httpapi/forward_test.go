@@ -0,0 +1,119 @@
+package httpapi_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sada-02/keyper/httpapi"
+	raftnode "github.com/sada-02/keyper/raft"
+)
+
+// TestForwardToLeader has a follower forward to a fake leader and checks
+// what is forwarded: writes and linearizable reads with their body, method
+// and hop count, and the leader's status, headers and body on the way
+// back; stale reads and requests out of hops are served by the follower.
+func TestForwardToLeader(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "dkvs_test_forward_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(base)
+	t.Cleanup(func() { os.RemoveAll(base) })
+
+	type seen struct {
+		method, uri, body, hops string
+	}
+	got := make(chan seen, 10)
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- seen{r.Method, r.URL.RequestURI(), string(body), r.Header.Get(httpapi.ForwardedHeader)}
+		w.Header().Set("ETag", `"7"`)
+		w.Header().Set(httpapi.NextTokenHeader, "next")
+		w.Header().Set(httpapi.ServedByHeader, "a")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("from the leader"))
+	}))
+	t.Cleanup(leader.Close)
+
+	a := startRaftServer(t, "a", filepath.Join(base, "a"), "")
+	b := startRaftServer(t, "b", filepath.Join(base, "b"), a.srv.URL)
+	if code, msg := a.do(t, http.MethodPost, "/v1/join", map[string]any{"node_id": "b", "raft_addr": b.node.Addr, "http_addr": b.srv.URL}); code != http.StatusNoContent {
+		t.Fatalf("join b: %d %s", code, msg)
+	}
+	// the leader's URL, as b knows it, is the fake's
+	if err := a.node.RegisterMember(raftnode.Member{ID: "a", RaftAddr: a.node.Addr, HTTPAddr: leader.URL}, 5*time.Second); err != nil {
+		t.Fatalf("register a: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for b.node.LeaderHTTP() != leader.URL {
+		if time.Now().After(deadline) {
+			t.Fatal("b never learned the leader's URL")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	b.h.ForwardToLeader = true
+
+	send := func(method, path, body string, hdr http.Header) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, b.srv.URL+path, strings.NewReader(body))
+		for k, vs := range hdr {
+			req.Header[k] = vs
+		}
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		return resp
+	}
+
+	for _, c := range []struct {
+		method, path, body string
+	}{
+		{http.MethodPut, "/v1/keys/k", "hello"},
+		{http.MethodGet, "/v1/keys?prefix=k&limit=1", ""},
+		{http.MethodGet, "/v1/keys/k?consistency=linearizable", ""},
+	} {
+		resp := send(c.method, c.path, c.body, nil)
+		msg, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated || string(msg) != "from the leader" {
+			t.Fatalf("%s %s: %d %q, want the leader's answer", c.method, c.path, resp.StatusCode, msg)
+		}
+		for k, want := range map[string]string{"ETag": `"7"`, httpapi.NextTokenHeader: "next", httpapi.ServedByHeader: "a"} {
+			if v := resp.Header.Get(k); v != want {
+				t.Fatalf("%s %s: %s %q, want the leader's %q", c.method, c.path, k, v, want)
+			}
+		}
+		select {
+		case s := <-got:
+			if want := (seen{c.method, c.path, c.body, "1"}); s != want {
+				t.Fatalf("leader got %+v, want %+v", s, want)
+			}
+		default:
+			t.Fatalf("%s %s was not forwarded", c.method, c.path)
+		}
+	}
+
+	// a stale read is served by b, and so is a request out of hops, by
+	// redirecting it
+	resp := send(http.MethodGet, "/v1/keys/k?consistency=stale", "", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get(httpapi.ServedByHeader) != "b" {
+		t.Fatalf("stale read: %d served by %q, want 404 from b", resp.StatusCode, resp.Header.Get(httpapi.ServedByHeader))
+	}
+	resp = send(http.MethodPut, "/v1/keys/k", "hello", http.Header{httpapi.ForwardedHeader: {"3"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("X-Raft-Leader") != leader.URL {
+		t.Fatalf("write out of hops: %d to %q, want a redirect to the leader", resp.StatusCode, resp.Header.Get("X-Raft-Leader"))
+	}
+	select {
+	case s := <-got:
+		t.Fatalf("leader got %+v, which b should have served", s)
+	default:
+	}
+}
@@ -11,18 +11,31 @@ import (
 
 	raft "github.com/hashicorp/raft"
 	raftnode "github.com/sada-02/keyper/raft"
-	"github.com/sada-02/keyper/shard"
 	shardraft "github.com/sada-02/keyper/shardraft"
 	"github.com/sada-02/keyper/store"
+	"github.com/sada-02/keyper/watch"
 )
 
 // Handler holds dependencies for HTTP endpoints.
 type Handler struct {
-	Store      *store.BadgerStore
-	NodeID     string
-	RaftNode   *raftnode.Node // nil if Raft disabled
-	ShardMgr   *shard.ShardManager
-	ShardRafts map[string]*shardraft.ShardRaft
+	Store    *store.BadgerStore
+	NodeID   string
+	RaftNode *raftnode.Node // nil if Raft disabled
+	Watch    *watch.Hub     // change feed for /v1/watch; nil disables it
+
+	// ShardCount spreads keys over that many shards, each served by the
+	// shard raft Shards runs for it here or redirected to a node that runs
+	// one; 0 serves every key from Store and RaftNode.
+	ShardCount int
+	Shards     *shardraft.Host
+
+	// ForwardToLeader makes a follower proxy writes and linearizable reads
+	// to the leader instead of answering 307. PeerHTTP maps Raft node IDs to
+	// their HTTP base URLs so the leader can be reached.
+	ForwardToLeader bool
+	PeerHTTP        map[string]string
+
+	shardID string // set on the view forShard returns
 }
 
 // NewHandler builds a Handler.
@@ -35,23 +48,53 @@ func NewHandler(s *store.BadgerStore, nodeID string) *Handler {
 
 // Register registers HTTP routes on mux.
 func (h *Handler) Register(mux *http.ServeMux) {
-	// Key API: PUT/GET/DELETE /v1/keys/{key}
-	mux.HandleFunc("/v1/keys/", h.keyHandler)
+	// Key API: PUT/GET/DELETE /v1/keys/{key}, routed to the key's shard
+	mux.HandleFunc("/v1/keys/", h.routeKey)
+
+	// Range scan / prefix listing: GET /v1/keys?prefix=&start=&end=&limit=
+	mux.HandleFunc("/v1/keys", h.forwarding(h.scanHandler))
 
 	// Status endpoint
 	mux.HandleFunc("/v1/status", h.statusHandler)
 
+	// Change feed: GET /v1/watch?key= or ?prefix=
+	mux.HandleFunc("/v1/watch", h.watchHandler)
+
+	// Multi-key atomic transaction: POST /v1/txn
+	mux.HandleFunc("/v1/txn", h.routeKeys(txnKeys, (*Handler).txnHandler))
+
+	// Bulk writes in one log entry: PUT /v1/batch
+	mux.HandleFunc("/v1/batch", h.routeKeys(batchKeys, (*Handler).batchHandler))
+
 	// Join endpoint for adding voters (leader must implement).
 	mux.HandleFunc("/v1/join", h.joinHandler)
+
+	// Membership: GET /v1/members, DELETE /v1/members/{id}
+	mux.HandleFunc("/v1/members", h.membersHandler)
+	mux.HandleFunc("/v1/members/", h.forwarding(h.memberHandler))
+
+	// Operations: POST /v1/admin/transfer-leadership, /v1/admin/snapshot, /v1/admin/restore
+	mux.HandleFunc("/v1/admin/transfer-leadership", h.forwarding(h.transferLeadershipHandler))
+	mux.HandleFunc("/v1/admin/snapshot", h.snapshotHandler)
+	mux.HandleFunc("/v1/admin/restore", h.restoreHandler)
 }
 
 func (h *Handler) keyHandler(w http.ResponseWriter, r *http.Request) {
 	// path: /v1/keys/<key>
 	key := strings.TrimPrefix(r.URL.Path, "/v1/keys/")
+	if key == "" && r.Method == http.MethodGet {
+		// GET /v1/keys/ is the same listing as GET /v1/keys
+		h.scanHandler(w, r)
+		return
+	}
 	if key == "" {
 		http.Error(w, "key required", http.StatusBadRequest)
 		return
 	}
+	if store.IsMetaKey([]byte(key)) {
+		http.Error(w, "key reserved", http.StatusBadRequest)
+		return
+	}
 
 	switch r.Method {
 	case http.MethodPut:
@@ -60,60 +103,68 @@ func (h *Handler) keyHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "failed to read body", http.StatusBadRequest)
 			return
 		}
+		ttl, err := parseTTL(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		expiresAt := expiryDeadline(ttl)
+		cond, err := parseCondition(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		// If Raft enabled, apply via raft; else write directly.
 		if h.RaftNode != nil {
 			// If not leader, redirect client to leader
-			if h.RaftNode.Raft.State() != raft.Leader {
-				leader := h.RaftNode.Leader()
-				if leader != "" {
-					w.Header().Set("X-Raft-Leader", leader)
-				}
-				http.Error(w, "not leader", http.StatusTemporaryRedirect)
+			if !h.requireLeader(w) {
 				return
 			}
 			cmd := &raftnode.Command{
-				Op:    "set",
-				Key:   key,
-				Value: body,
+				Op:        "set",
+				Key:       key,
+				Value:     body,
+				ExpiresAt: expiresAt,
+				Cond:      cond,
 			}
-			if err := h.RaftNode.ApplyCommand(cmd, 5*time.Second); err != nil {
-				http.Error(w, "raft apply failed: "+err.Error(), http.StatusInternalServerError)
+			res, err := h.RaftNode.Apply(cmd, 5*time.Second)
+			if err != nil {
+				if writeConditionFailed(w, err) {
+					return
+				}
+				h.applyFailed(w, err)
 				return
 			}
+			w.Header().Set("ETag", formatETag(res.Index))
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
 
 		// No raft -> direct write
-		if err := h.Store.Set([]byte(key), body); err != nil {
+		version, err := h.Store.CheckAndSet(&store.KVPair{
+			Key:       key,
+			Value:     body,
+			ExpiresAt: expiresAt,
+		}, cond)
+		if err != nil {
+			if writeConditionFailed(w, err) {
+				return
+			}
 			http.Error(w, "set failed: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		h.publishLocal(watch.Event{Type: "set", Key: key, Value: body, ExpiresAt: expiresAt})
+		w.Header().Set("ETag", formatETag(version))
 		w.WriteHeader(http.StatusNoContent)
 	case http.MethodGet:
-		// Linearizable read:
+		// Read at the requested consistency (linearizable by default):
 		if h.RaftNode != nil {
-			// If follower -> redirect client to leader
-			if h.RaftNode.Raft.State() != raft.Leader {
-				leader := h.RaftNode.Leader()
-				if leader != "" {
-					w.Header().Set("X-Raft-Leader", leader)
-				}
-				// ask client to retry at leader (307 Temporary Redirect)
-				http.Error(w, "not leader — read must go to leader", http.StatusTemporaryRedirect)
+			if !h.consistentRead(w, r) {
 				return
 			}
 
-			// We are leader: issue a Barrier so that all preceding commits are applied
-			// before serving the read. Barrier returns a Future.
-			barrierFut := h.RaftNode.Raft.Barrier(5 * time.Second)
-			if err := barrierFut.Error(); err != nil {
-				http.Error(w, "raft barrier failed: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			// Now safe to read from local store (linearizable)
-			val, err := h.Store.Get([]byte(key))
+			// Now safe to read from local store
+			kv, err := h.Store.GetEntry([]byte(key))
 			if err != nil {
 				if errors.Is(err, store.ErrNotFound) {
 					http.Error(w, "not found", http.StatusNotFound)
@@ -122,12 +173,13 @@ func (h *Handler) keyHandler(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "get failed: "+err.Error(), http.StatusInternalServerError)
 				return
 			}
-			w.Write(val)
+			w.Header().Set("ETag", formatETag(kv.Version))
+			w.Write(kv.Value)
 			return
 		}
 
 		// Raft not enabled -> direct read (best-effort)
-		val, err := h.Store.Get([]byte(key))
+		kv, err := h.Store.GetEntry([]byte(key))
 		if err != nil {
 			if errors.Is(err, store.ErrNotFound) {
 				http.Error(w, "not found", http.StatusNotFound)
@@ -136,31 +188,40 @@ func (h *Handler) keyHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "get failed: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
-		w.Write(val)
+		w.Header().Set("ETag", formatETag(kv.Version))
+		w.Write(kv.Value)
 	case http.MethodDelete:
+		cond, err := parseCondition(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if h.RaftNode != nil {
-			if h.RaftNode.Raft.State() != raft.Leader {
-				leader := h.RaftNode.Leader()
-				if leader != "" {
-					w.Header().Set("X-Raft-Leader", leader)
-				}
-				http.Error(w, "not leader", http.StatusTemporaryRedirect)
+			// If not leader, redirect client to leader
+			if !h.requireLeader(w) {
 				return
 			}
 			cmd := &raftnode.Command{
-				Op:  "delete",
-				Key: key,
+				Op:   "delete",
+				Key:  key,
+				Cond: cond,
 			}
 			if err := h.RaftNode.ApplyCommand(cmd, 5*time.Second); err != nil {
-				http.Error(w, "raft apply failed: "+err.Error(), http.StatusInternalServerError)
+				if writeConditionFailed(w, err) {
+					return
+				}
+				h.applyFailed(w, err)
 				return
 			}
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
 		// No raft -> direct delete
-		err := h.Store.Delete([]byte(key))
+		err = h.Store.CheckAndDelete([]byte(key), cond)
 		if err != nil {
+			if writeConditionFailed(w, err) {
+				return
+			}
 			if errors.Is(err, store.ErrNotFound) {
 				http.Error(w, "not found", http.StatusNotFound)
 				return
@@ -168,6 +229,7 @@ func (h *Handler) keyHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "delete failed: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		h.publishLocal(watch.Event{Type: "delete", Key: key})
 		w.WriteHeader(http.StatusNoContent)
 	default:
 		w.Header().Set("Allow", "PUT, GET, DELETE")
@@ -175,16 +237,108 @@ func (h *Handler) keyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// publishLocal feeds watchers in non-Raft mode, where there is no FSM to
+// publish committed writes. The hub numbers these events itself.
+func (h *Handler) publishLocal(events ...watch.Event) {
+	if h.RaftNode == nil && h.Watch != nil {
+		h.Watch.Publish(events...)
+	}
+}
+
+// requireLeader reports whether this node is the Raft leader and may accept
+// writes. Otherwise it redirects the client to the leader and returns false.
+func (h *Handler) requireLeader(w http.ResponseWriter) bool {
+	if h.RaftNode.Raft.State() == raft.Leader {
+		return true
+	}
+	h.redirectToLeader(w, "not leader")
+	return false
+}
+
+// applyFailed reports a failed Raft apply. A node that is draining, whose
+// leadership is moving, or whose shard has just handed the key on answers
+// 503 so the client retries; one that lost leadership mid-request redirects
+// to the new leader.
+func (h *Handler) applyFailed(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, raftnode.ErrDraining), errors.Is(err, raft.ErrLeadershipTransferInProgress), errors.Is(err, raftnode.ErrNotOwned):
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "raft apply failed: "+err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, raft.ErrNotLeader), errors.Is(err, raft.ErrLeadershipLost):
+		h.redirectToLeader(w, "not leader")
+	default:
+		http.Error(w, "raft apply failed: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// TTLHeader is the request header that may carry a per-key TTL on PUT.
+const TTLHeader = "X-Keyper-TTL"
+
+// parseTTL reads the optional TTL of a PUT from the "ttl" query parameter or
+// the X-Keyper-TTL header. Both accept a Go duration ("90s", "5m") or a plain
+// number of seconds. A zero duration means no expiry.
+func parseTTL(r *http.Request) (time.Duration, error) {
+	raw := r.URL.Query().Get("ttl")
+	if raw == "" {
+		raw = r.Header.Get(TTLHeader)
+	}
+	return parseTTLValue(raw)
+}
+
+// parseTTLValue parses a TTL given as a Go duration or a number of seconds.
+// An empty string means no TTL.
+func parseTTLValue(raw string) (time.Duration, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	var ttl time.Duration
+	if secs, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		ttl = time.Duration(secs) * time.Second
+	} else {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return 0, errors.New("invalid ttl: " + raw)
+		}
+		ttl = d
+	}
+	if ttl < 0 {
+		return 0, errors.New("ttl must not be negative")
+	}
+	return ttl, nil
+}
+
+// expiryDeadline converts a TTL into the absolute deadline (unix seconds)
+// stored with the key. Badger expires at second granularity, so the deadline
+// is rounded up: a key never disappears before its TTL has elapsed.
+func expiryDeadline(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	deadline := time.Now().Add(ttl)
+	secs := deadline.Unix()
+	if deadline.Nanosecond() > 0 {
+		secs++
+	}
+	return secs
+}
+
 func (h *Handler) statusHandler(w http.ResponseWriter, r *http.Request) {
 	leader := ""
+	leaderHTTP := ""
 	isLeader := false
+	applied := ""
 	if h.RaftNode != nil {
 		leader = h.RaftNode.Leader()
+		leaderHTTP = h.leaderURL()
 		if h.RaftNode.Raft.State() == raft.Leader {
 			isLeader = true
 		}
+		// the last entry written to the store, which survives restarts
+		if index, err := h.RaftNode.PersistedIndex(); err == nil {
+			applied = `,"applied_index":` + strconv.FormatUint(index, 10)
+		}
 	}
-	resp := `{"node_id":"` + h.NodeID + `","status":"ok","is_leader":` + strconv.FormatBool(isLeader) + `,"leader_addr":"` + leader + `"}`
+	resp := `{"node_id":"` + h.NodeID + `","status":"ok","is_leader":` + strconv.FormatBool(isLeader) + `,"leader_addr":"` + leader + `","leader_http":"` + leaderHTTP + `"` + applied + `}`
 
 	_, _ = w.Write([]byte(resp))
 }
@@ -202,15 +356,15 @@ func (h *Handler) joinHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// only leader should authorize join
-	if h.RaftNode.Raft.State() != raft.Leader {
-		w.Header().Set("X-Raft-Leader", h.RaftNode.Leader())
-		http.Error(w, "not leader", http.StatusTemporaryRedirect)
+	if !h.requireLeader(w) {
 		return
 	}
 
 	var req struct {
 		NodeID   string `json:"node_id"`
 		RaftAddr string `json:"raft_addr"`
+		HTTPAddr string `json:"http_addr"` // advertised HTTP URL; optional for older nodes
+		Voter    *bool  `json:"voter"`     // false joins as a learner; default true
 	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -227,10 +381,22 @@ func (h *Handler) joinHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Add voter
-	if err := h.RaftNode.AddVoter(req.NodeID, req.RaftAddr, 10*time.Second); err != nil {
+	if req.Voter != nil && !*req.Voter {
+		// learner: promote later with POST /v1/members/{id}/promote
+		if err := h.RaftNode.AddNonvoter(req.NodeID, req.RaftAddr, 10*time.Second); err != nil {
+			http.Error(w, "add nonvoter failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if err := h.RaftNode.AddVoter(req.NodeID, req.RaftAddr, 10*time.Second); err != nil {
 		http.Error(w, "add voter failed: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if req.HTTPAddr != "" {
+		m := raftnode.Member{ID: req.NodeID, RaftAddr: req.RaftAddr, HTTPAddr: strings.TrimRight(req.HTTPAddr, "/")}
+		if err := h.RaftNode.RegisterMember(m, 10*time.Second); err != nil {
+			http.Error(w, "register member failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,258 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	raft "github.com/hashicorp/raft"
+	raftnode "github.com/sada-02/keyper/raft"
+)
+
+// memberStatusTimeout bounds how long GET /v1/members waits for each node to
+// report its own Raft numbers.
+const memberStatusTimeout = time.Second
+
+// memberStatus is one server of the Raft configuration. The Raft numbers are
+// reported by the node itself, so they are missing (and Error says why) when
+// it cannot be reached.
+type memberStatus struct {
+	ID           string            `json:"id"`
+	RaftAddr     string            `json:"raft_addr"`
+	HTTPAddr     string            `json:"http_addr,omitempty"`
+	Suffrage     string            `json:"suffrage"` // voter, nonvoter or staging
+	Leader       bool              `json:"leader"`
+	State        string            `json:"state,omitempty"`
+	LastContact  string            `json:"last_contact,omitempty"`
+	AppliedIndex uint64            `json:"applied_index,omitempty"`
+	CommitIndex  uint64            `json:"commit_index,omitempty"`
+	Stats        map[string]string `json:"stats,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+type membersResponse struct {
+	Leader  string         `json:"leader,omitempty"`
+	Members []memberStatus `json:"members"`
+}
+
+var memberClient = &http.Client{Timeout: memberStatusTimeout}
+
+// membersHandler serves GET /v1/members, the Raft configuration as this node
+// sees it, with every node's own view of its Raft state. ?local=true reports
+// only this node and is what the other nodes are asked for.
+func (h *Handler) membersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.RaftNode == nil {
+		http.Error(w, "raft not enabled", http.StatusBadRequest)
+		return
+	}
+	fut := h.RaftNode.Raft.GetConfiguration()
+	if err := fut.Error(); err != nil {
+		http.Error(w, "read configuration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, leaderID := h.RaftNode.Raft.LeaderWithID()
+	resp := membersResponse{Leader: string(leaderID), Members: []memberStatus{}}
+	local := r.URL.Query().Get("local") == "true"
+
+	for _, srv := range fut.Configuration().Servers {
+		if local && string(srv.ID) != h.RaftNode.ID {
+			continue
+		}
+		m := memberStatus{
+			ID:       string(srv.ID),
+			RaftAddr: string(srv.Address),
+			Suffrage: strings.ToLower(srv.Suffrage.String()),
+			Leader:   srv.ID == leaderID,
+		}
+		if rec, err := h.RaftNode.Member(m.ID); err == nil {
+			m.HTTPAddr = rec.HTTPAddr
+		}
+		resp.Members = append(resp.Members, m)
+	}
+	var wg sync.WaitGroup
+	for i := range resp.Members {
+		m := &resp.Members[i]
+		if m.ID == h.RaftNode.ID {
+			h.fillLocalStatus(m)
+			continue
+		}
+		if m.HTTPAddr == "" {
+			m.Error = "no http address registered"
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := h.fetchMemberStatus(m); err != nil {
+				m.Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&resp)
+}
+
+// fillLocalStatus adds this node's own Raft numbers to m.
+func (h *Handler) fillLocalStatus(m *memberStatus) {
+	stats := h.RaftNode.Raft.Stats()
+	m.State = h.RaftNode.Raft.State().String()
+	m.LastContact = stats["last_contact"]
+	m.AppliedIndex = h.RaftNode.Raft.AppliedIndex()
+	m.CommitIndex = h.RaftNode.Raft.CommitIndex()
+	m.Stats = stats
+}
+
+// membersPath is where the membership endpoints of h's Raft group live:
+// /v1/members for the main raft and /v1/shards/{id}/members for a shard's.
+func (h *Handler) membersPath() string {
+	if h.shardID != "" {
+		return "/v1/shards/" + h.shardID + "/members"
+	}
+	return "/v1/members"
+}
+
+// fetchMemberStatus asks the node m describes for its own Raft numbers.
+func (h *Handler) fetchMemberStatus(m *memberStatus) error {
+	resp, err := memberClient.Get(m.HTTPAddr + h.membersPath() + "?local=true")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("status " + resp.Status)
+	}
+	var out membersResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return err
+	}
+	if len(out.Members) != 1 || out.Members[0].ID != m.ID {
+		return errors.New("node does not consider itself a member")
+	}
+	self := out.Members[0]
+	m.State = self.State
+	m.LastContact = self.LastContact
+	m.AppliedIndex = self.AppliedIndex
+	m.CommitIndex = self.CommitIndex
+	m.Stats = self.Stats
+	return nil
+}
+
+// memberHandler serves DELETE /v1/members/{id}, which removes the node from
+// the Raft configuration, and POST /v1/members/{id}/promote, which turns a
+// learner into a voter. Only the leader can do either.
+func (h *Handler) memberHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, h.membersPath()), "/")
+	if rest == "" {
+		h.membersHandler(w, r)
+		return
+	}
+	id, action, _ := strings.Cut(rest, "/")
+	switch {
+	case action == "" && r.Method == http.MethodDelete, action == "promote" && r.Method == http.MethodPost:
+	case action == "" || action == "promote":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if h.RaftNode == nil {
+		http.Error(w, "raft not enabled", http.StatusBadRequest)
+		return
+	}
+	if !h.requireLeader(w) {
+		return
+	}
+	fut := h.RaftNode.Raft.GetConfiguration()
+	if err := fut.Error(); err != nil {
+		http.Error(w, "read configuration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var srv *raft.Server
+	servers := fut.Configuration().Servers
+	for i := range servers {
+		if string(servers[i].ID) == id {
+			srv = &servers[i]
+			break
+		}
+	}
+	if srv == nil {
+		http.Error(w, "no such member", http.StatusNotFound)
+		return
+	}
+
+	if action == "promote" {
+		h.promote(w, r, srv)
+		return
+	}
+	if err := h.RaftNode.RemoveServer(id, 10*time.Second); err != nil {
+		h.membershipChangeFailed(w, "remove server failed", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// membershipChangeFailed reports a failed configuration change, redirecting
+// if leadership moved while it was in flight.
+func (h *Handler) membershipChangeFailed(w http.ResponseWriter, msg string, err error) {
+	if errors.Is(err, raft.ErrNotLeader) {
+		h.redirectToLeader(w, "not leader")
+		return
+	}
+	http.Error(w, msg+": "+err.Error(), http.StatusInternalServerError)
+}
+
+// defaultPromoteMaxLag is how many log entries a learner's applied index may
+// trail the leader's when it is promoted; ?max_lag= overrides it.
+const defaultPromoteMaxLag = 100
+
+// promote makes the learner srv a voter once it has caught up, as reported
+// by the learner itself; see raftnode.Node.Promote. A learner that is too
+// far behind is refused with 409 and can be retried.
+func (h *Handler) promote(w http.ResponseWriter, r *http.Request, srv *raft.Server) {
+	if srv.Suffrage == raft.Voter {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	maxLag := uint64(defaultPromoteMaxLag)
+	if v := r.URL.Query().Get("max_lag"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid max_lag", http.StatusBadRequest)
+			return
+		}
+		maxLag = n
+	}
+
+	m := memberStatus{ID: string(srv.ID)}
+	if rec, err := h.RaftNode.Member(m.ID); err == nil {
+		m.HTTPAddr = rec.HTTPAddr
+	}
+	if m.HTTPAddr == "" {
+		http.Error(w, "learner has no http address registered; cannot check its progress", http.StatusConflict)
+		return
+	}
+	if err := h.fetchMemberStatus(&m); err != nil {
+		http.Error(w, "cannot reach learner: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err := h.RaftNode.Promote(m.ID, m.AppliedIndex, maxLag, 10*time.Second); err != nil {
+		if errors.Is(err, raftnode.ErrLearnerBehind) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		h.membershipChangeFailed(w, "promote failed", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
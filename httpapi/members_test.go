@@ -0,0 +1,203 @@
+package httpapi_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	raft "github.com/hashicorp/raft"
+	"github.com/sada-02/keyper/httpapi"
+	raftnode "github.com/sada-02/keyper/raft"
+	"github.com/sada-02/keyper/store"
+)
+
+type raftServer struct {
+	node *raftnode.Node
+	h    *httpapi.Handler
+	srv  *httptest.Server
+}
+
+// startRaftServer serves a handler over a raft node in dir, which founds a
+// cluster unless join is set, and then waits to be added to one.
+func startRaftServer(t *testing.T, id, dir, join string) *raftServer {
+	t.Helper()
+	s, err := store.NewBadgerStore(dir)
+	if err != nil {
+		t.Fatalf("open store %s: %v", id, err)
+	}
+	t.Cleanup(func() { s.Close() })
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	raftAddr := l.Addr().String()
+	l.Close()
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	n, err := raftnode.NewNode(&raftnode.RaftConfig{
+		NodeID:   id,
+		RaftAddr: raftAddr,
+		HTTPAddr: srv.URL,
+		DataDir:  dir,
+		Store:    s,
+		JoinAddr: join,
+		LogStore: raftnode.LogStoreBadger,
+		Tuning: raftnode.Tuning{
+			HeartbeatTimeout:   200 * time.Millisecond,
+			ElectionTimeout:    200 * time.Millisecond,
+			LeaderLeaseTimeout: 100 * time.Millisecond,
+			CommitTimeout:      10 * time.Millisecond,
+		},
+	})
+	if err != nil {
+		t.Fatalf("start %s: %v", id, err)
+	}
+	t.Cleanup(func() { _ = n.Shutdown() })
+	h := httpapi.NewHandler(s, id)
+	h.RaftNode = n
+	h.Register(mux)
+	if join == "" {
+		deadline := time.Now().Add(10 * time.Second)
+		for n.Raft.State() != raft.Leader {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s never became leader", id)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	return &raftServer{node: n, h: h, srv: srv}
+}
+
+// do sends a request to rs and returns the status and body.
+func (rs *raftServer) do(t *testing.T, method, path string, body any) (int, string) {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		r = bytes.NewReader(b)
+	}
+	req, _ := http.NewRequest(method, rs.srv.URL+path, r)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(msg)
+}
+
+// suffrage returns id's suffrage in n's configuration, or -1 if it has none.
+func suffrage(t *testing.T, n *raftnode.Node, id string) raft.ServerSuffrage {
+	t.Helper()
+	fut := n.Raft.GetConfiguration()
+	if err := fut.Error(); err != nil {
+		t.Fatalf("configuration: %v", err)
+	}
+	for _, srv := range fut.Configuration().Servers {
+		if string(srv.ID) == id {
+			return srv.Suffrage
+		}
+	}
+	return -1
+}
+
+// TestJoinLearnerAndPromote joins a node as a learner through /v1/join and
+// promotes it once it has caught up, and checks that a learner reporting an
+// applied index too far behind is refused.
+func TestJoinLearnerAndPromote(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "dkvs_test_promote_http_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(base)
+	t.Cleanup(func() { os.RemoveAll(base) })
+
+	a := startRaftServer(t, "a", filepath.Join(base, "a"), "")
+	b := startRaftServer(t, "b", filepath.Join(base, "b"), a.srv.URL)
+	learner := false
+	if code, msg := a.do(t, http.MethodPost, "/v1/join", map[string]any{"node_id": "b", "raft_addr": b.node.Addr, "http_addr": b.srv.URL, "voter": &learner}); code != http.StatusNoContent {
+		t.Fatalf("join b: %d %s", code, msg)
+	}
+	if s := suffrage(t, a.node, "b"); s != raft.Nonvoter {
+		t.Fatalf("b joined as %v, want a nonvoter", s)
+	}
+
+	// a learner that says it has applied nothing; its raft address is never dialled
+	behind := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"members":[{"id":"c","applied_index":0}]}`))
+	}))
+	t.Cleanup(behind.Close)
+	if code, msg := a.do(t, http.MethodPost, "/v1/join", map[string]any{"node_id": "c", "raft_addr": "127.0.0.1:1", "http_addr": behind.URL, "voter": &learner}); code != http.StatusNoContent {
+		t.Fatalf("join c: %d %s", code, msg)
+	}
+	for i := 0; i < 10; i++ {
+		if code, msg := a.do(t, http.MethodPut, "/v1/keys/k"+strconv.Itoa(i), "v"); code != http.StatusNoContent {
+			t.Fatalf("put: %d %s", code, msg)
+		}
+	}
+	if code, msg := a.do(t, http.MethodPost, "/v1/members/c/promote?max_lag=5", nil); code != http.StatusConflict {
+		t.Fatalf("promote of a lagging learner: %d %s, want 409", code, msg)
+	}
+	if s := suffrage(t, a.node, "c"); s != raft.Nonvoter {
+		t.Fatalf("refused learner is now a %v", s)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for b.node.Raft.AppliedIndex() < a.node.Raft.AppliedIndex() {
+		if time.Now().After(deadline) {
+			t.Fatal("b never caught up")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if code, msg := a.do(t, http.MethodPost, "/v1/members/b/promote?max_lag=5", nil); code != http.StatusNoContent {
+		t.Fatalf("promote of a caught-up learner: %d %s", code, msg)
+	}
+	if s := suffrage(t, a.node, "b"); s != raft.Voter {
+		t.Fatalf("promoted b is a %v, want a voter", s)
+	}
+	if code, msg := a.do(t, http.MethodPost, "/v1/members/x/promote", nil); code != http.StatusNotFound {
+		t.Fatalf("promote of an unknown member: %d %s, want 404", code, msg)
+	}
+}
+
+// TestRemoveMember removes a voter with DELETE /v1/members/{id} and checks
+// that it leaves the configuration and the membership table, and that
+// removing it again finds no such member.
+func TestRemoveMember(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "dkvs_test_remove_member_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(base)
+	t.Cleanup(func() { os.RemoveAll(base) })
+
+	a := startRaftServer(t, "a", filepath.Join(base, "a"), "")
+	b := startRaftServer(t, "b", filepath.Join(base, "b"), a.srv.URL)
+	if code, msg := a.do(t, http.MethodPost, "/v1/join", map[string]any{"node_id": "b", "raft_addr": b.node.Addr, "http_addr": b.srv.URL}); code != http.StatusNoContent {
+		t.Fatalf("join b: %d %s", code, msg)
+	}
+	if s := suffrage(t, a.node, "b"); s != raft.Voter {
+		t.Fatalf("b joined as %v, want a voter", s)
+	}
+
+	if code, msg := a.do(t, http.MethodGet, "/v1/members/b", nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET of a member: %d %s, want 405", code, msg)
+	}
+	if code, msg := a.do(t, http.MethodDelete, "/v1/members/b", nil); code != http.StatusNoContent {
+		t.Fatalf("remove b: %d %s", code, msg)
+	}
+	if s := suffrage(t, a.node, "b"); s != -1 {
+		t.Fatalf("removed b is still a %v", s)
+	}
+	if _, err := a.node.Member("b"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("member record of removed b: %v", err)
+	}
+	if code, msg := a.do(t, http.MethodDelete, "/v1/members/b", nil); code != http.StatusNotFound {
+		t.Fatalf("second removal of b: %d %s, want 404", code, msg)
+	}
+}
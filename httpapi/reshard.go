@@ -0,0 +1,171 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	raftnode "github.com/sada-02/keyper/raft"
+	"github.com/sada-02/keyper/shard"
+	shardraft "github.com/sada-02/keyper/shardraft"
+)
+
+// reshardHandler serves POST /v1/shards/{id}/split and /merge. A split with
+// JSON {"key":"m"} hands the shard's keys from "m" on to a new shard; with
+// no body it hands on half its hash range. A merge with {"with":"3"} puts
+// the shard and shard 3, the other half of a hash split or the key range
+// next to it, into a new shard, founded on a node hosting replicas of both.
+// New shards take the next free shard number, and listen on the shard base
+// port plus that number; splits and merges started at once each get their own.
+//
+// The shards split or merged cut the keys they hand on through their own
+// logs, the placement table switches to the new shard in one entry, and the
+// new shard loads the cut; keys in transit answer 503 until it has. The
+// leader records the split or merge and answers 202 with it; "reshard" in
+// the placement entries and /v1/shards/status shows how far it got.
+func (h *Handler) reshardHandler(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/shards/"), "/")
+	if h.RaftNode == nil || h.ShardCount <= 0 {
+		http.Error(w, "splits and merges need raft and --shard-count", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "bad body", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Key  string `json:"key"`
+		With string `json:"with"`
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+	}
+	if action == raftnode.ReshardMerge && (req.With == "" || req.With == id) {
+		http.Error(w, "with must name another shard", http.StatusBadRequest)
+		return
+	}
+	if !h.requireLeader(w) {
+		return
+	}
+	p, err := h.RaftNode.Placement()
+	if err != nil {
+		http.Error(w, "read placement: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ids := []string{id}
+	if action == raftnode.ReshardMerge {
+		ids = append(ids, req.With)
+	}
+	from := make([]*raftnode.ShardPlacement, len(ids))
+	for i, sid := range ids {
+		s := p.Shard(sid)
+		switch {
+		case s == nil:
+			http.Error(w, "no shard "+sid, http.StatusNotFound)
+			return
+		case s.Move.Active():
+			http.Error(w, "shard "+sid+" is moving; retry once the move ends", http.StatusConflict)
+			return
+		case s.Reshard.Active():
+			http.Error(w, "shard "+sid+" is already being split or merged", http.StatusConflict)
+			return
+		}
+		from[i] = s
+	}
+
+	res := raftnode.Reshard{Kind: action, From: ids, To: nextShardID(p, h.ShardCount), Phase: raftnode.ReshardCutting}
+	if action == raftnode.ReshardSplit {
+		cur := from[0].KeyRange(h.ShardCount)
+		var keep shard.Range
+		if req.Key != "" {
+			keep, res.Range, err = cur.SplitKey(req.Key)
+		} else {
+			keep, res.Range, err = cur.SplitHash()
+		}
+		if err != nil {
+			http.Error(w, "split shard "+id+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		res.Keep = &keep
+	} else {
+		res.Range, err = shard.Merge(from[0].KeyRange(h.ShardCount), from[1].KeyRange(h.ShardCount))
+		if err != nil {
+			http.Error(w, "merge shards "+id+" and "+req.With+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if shardraft.Founder(from...) == "" {
+			http.Error(w, "no node hosts replicas of both shards; move one so that one does", http.StatusConflict)
+			return
+		}
+	}
+	// another split or merge may have taken the number since p was read
+	for tries := 1; ; tries++ {
+		err = h.RaftNode.Reshard(res, nil, "", 5*time.Second)
+		if !errors.Is(err, raftnode.ErrShardTaken) || tries == 5 {
+			break
+		}
+		if p, err = h.RaftNode.Placement(); err != nil {
+			http.Error(w, "read placement: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res.To = nextShardID(p, h.ShardCount)
+	}
+	if err != nil {
+		h.applyFailed(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// nextShardID returns the number of the next new shard: one past every
+// shard in p and every shard a split or merge recorded there made, and
+// never one of the count the cluster started with.
+func nextShardID(p *raftnode.Placement, count int) string {
+	next := count
+	for _, s := range p.Shards {
+		ids := []string{s.ID}
+		if s.Reshard != nil {
+			ids = append(ids, s.Reshard.To)
+		}
+		for _, id := range ids {
+			if n, err := strconv.Atoi(id); err == nil && n >= next {
+				next = n + 1
+			}
+		}
+	}
+	return strconv.Itoa(next)
+}
+
+// cutHandler serves POST /v1/shards/{id}/cut with a cut as JSON, which the
+// main leader sends while splitting or merging the shard: every replica
+// writes the keys the shard hands on to a file the new shard's founder
+// loads, then drops them. The shard's leader answers {"index":N}, N being
+// the cut's log index, so the caller can tell when a replica has applied it.
+func (h *Handler) cutHandler(w http.ResponseWriter, r *http.Request) {
+	var c raftnode.Cut
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil || c.From != h.shardID || c.To == "" {
+		http.Error(w, "a cut from shard "+h.shardID+" to another is required", http.StatusBadRequest)
+		return
+	}
+	if !h.requireLeader(w) {
+		return
+	}
+	index, err := h.RaftNode.Cut(c, 5*time.Second)
+	if err != nil {
+		h.applyFailed(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]uint64{"index": index})
+}
@@ -0,0 +1,146 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sada-02/keyper/store"
+)
+
+const (
+	// defaultScanLimit is the page size used when the request does not set one.
+	defaultScanLimit = 100
+	// maxScanLimit caps a single page so one request cannot pin a huge read txn.
+	maxScanLimit = 1000
+
+	// NextTokenHeader carries the continuation token of a scan page. It is set
+	// for both JSON and NDJSON responses and is absent on the last page.
+	NextTokenHeader = "X-Keyper-Next-Token"
+)
+
+// scanResponse is the JSON body of GET /v1/keys.
+type scanResponse struct {
+	Items     []store.KVPair `json:"items"`
+	NextToken string         `json:"next_token,omitempty"`
+}
+
+// scanHandler implements the paginated range scan:
+//
+//	GET /v1/keys?prefix=&start=&end=&limit=&reverse=&token=&format=
+//
+// The range is [start, end) intersected with the prefix. Pages come back in
+// key order (descending with reverse=true); when more keys remain the response
+// carries a continuation token to pass back as ?token= together with the same
+// range parameters. With format=ndjson (or Accept: application/x-ndjson) each
+// pair is written on its own line and the token is only returned in the
+// X-Keyper-Next-Token header.
+//
+// With --shard-count the keys are spread over the shard stores, and a scan
+// answers 400.
+func (h *Handler) scanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.ShardCount > 0 {
+		http.Error(w, "scans are not supported with --shard-count: keys are spread over the shard stores", http.StatusBadRequest)
+		return
+	}
+
+	q := r.URL.Query()
+	start := []byte(q.Get("start"))
+	end := []byte(q.Get("end"))
+	if prefix := q.Get("prefix"); prefix != "" {
+		p := []byte(prefix)
+		if bytes.Compare(start, p) < 0 {
+			start = p
+		}
+		if pe := store.PrefixEnd(p); pe != nil && (len(end) == 0 || bytes.Compare(pe, end) < 0) {
+			end = pe
+		}
+	}
+
+	limit := defaultScanLimit
+	if raw := q.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if limit > maxScanLimit {
+		limit = maxScanLimit
+	}
+
+	reverse := false
+	if raw := q.Get("reverse"); raw != "" {
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			http.Error(w, "invalid reverse", http.StatusBadRequest)
+			return
+		}
+		reverse = b
+	}
+
+	// The token is the boundary to resume from: the new inclusive start when
+	// scanning forward, the new exclusive end when scanning in reverse.
+	if tok := q.Get("token"); tok != "" {
+		boundary, err := base64.RawURLEncoding.DecodeString(tok)
+		if err != nil {
+			http.Error(w, "invalid token", http.StatusBadRequest)
+			return
+		}
+		if reverse {
+			end = boundary
+		} else {
+			start = boundary
+		}
+	}
+
+	ndjson := q.Get("format") == "ndjson" || strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+
+	// Scans honour the same consistency levels as GET.
+	if h.RaftNode != nil {
+		if !h.consistentRead(w, r) {
+			return
+		}
+	}
+
+	items, more, err := h.Store.Scan(start, end, limit, reverse)
+	if err != nil {
+		http.Error(w, "scan failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	next := ""
+	if more && len(items) > 0 {
+		last := []byte(items[len(items)-1].Key)
+		if !reverse {
+			// smallest key strictly greater than last
+			last = append(last, 0)
+		}
+		next = base64.RawURLEncoding.EncodeToString(last)
+		w.Header().Set(NextTokenHeader, next)
+	}
+
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		for i := range items {
+			if err := enc.Encode(&items[i]); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	b, _ := json.Marshal(scanResponse{Items: items, NextToken: next})
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
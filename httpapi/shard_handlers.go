@@ -4,85 +4,339 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	raft "github.com/hashicorp/raft"
+	raftnode "github.com/sada-02/keyper/raft"
+	shardraft "github.com/sada-02/keyper/shardraft"
 )
 
-// RegisterShardRoutes registers admin shard endpoints.
-// Requires Handler.ShardMgr to be non-nil.
+// RegisterShardRoutes registers the shard endpoints.
 func (h *Handler) RegisterShardRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("/v1/shards", h.shardsListHandler)          // GET list
-	mux.HandleFunc("/v1/shards/assign", h.shardsAssignHandler) // POST assign
-	mux.HandleFunc("/v1/shards/status", h.shardsStatusHandler) // GET status for all local shard rafts
+	mux.HandleFunc("/v1/shards", h.shardsListHandler)                        // GET placement table
+	mux.HandleFunc("/v1/shards/assign", h.forwarding(h.shardsAssignHandler)) // POST assign
+	mux.HandleFunc("/v1/shards/status", h.shardsStatusHandler)               // GET status for all local shard rafts
+	mux.HandleFunc("/v1/shards/", h.shardHandler)                            // per-shard join, leader, move, split, merge and members
 }
 
+// shardsListHandler serves GET /v1/shards: the placement table as applied on
+// this node, with its version as ETag. A client that sends the version back
+// in If-None-Match gets 304 while its copy is current. Without Raft the
+// table lists the shards running here, at version 0.
 func (h *Handler) shardsListHandler(w http.ResponseWriter, r *http.Request) {
-	if h.ShardMgr == nil {
-		http.Error(w, "shard manager not enabled", http.StatusBadRequest)
-		return
-	}
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	list := h.ShardMgr.List()
-	b, _ := json.Marshal(list)
+	p, err := h.placement()
+	if err != nil {
+		http.Error(w, "read placement: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", formatETag(p.Version))
+	if inm := r.Header.Get("If-None-Match"); inm != "" && strings.Trim(strings.TrimPrefix(inm, "W/"), `"`) == strconv.FormatUint(p.Version, 10) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writePlacement(w, p)
+}
+
+func writePlacement(w http.ResponseWriter, p *raftnode.Placement) {
+	w.Header().Set("ETag", formatETag(p.Version))
 	w.Header().Set("Content-Type", "application/json")
-	_, _ = w.Write(b)
+	_ = json.NewEncoder(w).Encode(p)
 }
 
-func (h *Handler) shardsAssignHandler(w http.ResponseWriter, r *http.Request) {
-	if h.ShardMgr == nil {
-		http.Error(w, "shard manager not enabled", http.StatusBadRequest)
-		return
+func (h *Handler) placement() (*raftnode.Placement, error) {
+	if h.RaftNode != nil {
+		return h.RaftNode.Placement()
+	}
+	p := &raftnode.Placement{Shards: []raftnode.ShardPlacement{}}
+	if h.Shards != nil {
+		for _, sr := range h.Shards.List() {
+			p.Shards = append(p.Shards, raftnode.ShardPlacement{ID: sr.ShardID, Replicas: []string{h.NodeID}, Leader: h.NodeID})
+		}
 	}
+	return p, nil
+}
+
+// shardsAssignHandler serves POST /v1/shards/assign with JSON
+// {"shard_id":"1","nodes":["node1","node2"]}, which sets the nodes hosting
+// replicas of the shard. Each node starts its shard raft once it applies the
+// change. Assign only adds replicas: one that leaves out a current replica is
+// refused, since that replica would stay a voter of the shard's group; moves
+// take replicas off nodes. The leader answers with the new placement table.
+func (h *Handler) shardsAssignHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if h.RaftNode == nil || h.ShardCount <= 0 {
+		http.Error(w, "shard placement needs raft and --shard-count", http.StatusBadRequest)
+		return
+	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "bad body", http.StatusBadRequest)
 		return
 	}
 	var req struct {
-		ShardID  string `json:"shard_id"`
-		RaftAddr string `json:"raft_addr"` // optional
+		ShardID string   `json:"shard_id"`
+		Nodes   []string `json:"nodes"`
 	}
 	if err := json.Unmarshal(body, &req); err != nil {
 		http.Error(w, "invalid json", http.StatusBadRequest)
 		return
 	}
-	if req.ShardID == "" {
-		http.Error(w, "shard_id required", http.StatusBadRequest)
+	n, err := strconv.Atoi(req.ShardID)
+	if err != nil || n < 0 {
+		http.Error(w, "shard_id must be a shard number", http.StatusBadRequest)
+		return
+	}
+	if len(req.Nodes) == 0 {
+		http.Error(w, "nodes required", http.StatusBadRequest)
+		return
+	}
+	seen := make(map[string]bool)
+	for _, id := range req.Nodes {
+		if seen[id] {
+			http.Error(w, "node "+id+" listed twice", http.StatusBadRequest)
+			return
+		}
+		seen[id] = true
+		if _, err := h.RaftNode.Member(id); err != nil {
+			http.Error(w, "unknown node "+id, http.StatusBadRequest)
+			return
+		}
+	}
+	if !h.requireLeader(w) {
+		return
+	}
+	if p, err := h.RaftNode.Placement(); err == nil {
+		s := p.Shard(req.ShardID)
+		switch {
+		case s == nil && n >= h.ShardCount:
+			// shards past the initial ones only come from splits and merges
+			http.Error(w, "no shard "+req.ShardID, http.StatusBadRequest)
+			return
+		case s != nil && s.Move.Active():
+			http.Error(w, "shard "+req.ShardID+" is moving; retry once the move ends", http.StatusConflict)
+			return
+		case s != nil && s.Reshard.Active():
+			http.Error(w, "shard "+req.ShardID+" is being split or merged; retry once that ends", http.StatusConflict)
+			return
+		}
+		if s != nil {
+			for _, node := range s.Replicas {
+				if !seen[node] {
+					http.Error(w, "assign cannot remove replica "+node+" of shard "+req.ShardID+"; use POST /v1/shards/"+req.ShardID+"/move", http.StatusConflict)
+					return
+				}
+			}
+		}
+	}
+	// a shard placed for the first time is founded by its first node
+	if err := h.RaftNode.AssignShard(req.ShardID, req.Nodes, req.Nodes[0], 5*time.Second); err != nil {
+		h.applyFailed(w, err)
+		return
+	}
+	p, err := h.RaftNode.Placement()
+	if err != nil {
+		http.Error(w, "read placement: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writePlacement(w, p)
+}
+
+// shardHandler serves the per-shard endpoints under /v1/shards/{id}/.
+func (h *Handler) shardHandler(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/shards/"), "/")
+	switch {
+	case id == "":
+		http.NotFound(w, r)
+	case action == "members":
+		if sh := h.shardView(w, r, id); sh != nil {
+			sh.membersHandler(w, r)
+		}
+	case strings.HasPrefix(action, "members/"):
+		if sh := h.shardView(w, r, id); sh != nil {
+			sh.forwarding(sh.memberHandler)(w, r)
+		}
+	case action != "join" && action != "leader" && action != "move" && action != "split" && action != "merge" && action != "cut":
+		http.NotFound(w, r)
+	case r.Method != http.MethodPost:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	case action == "join":
+		if sh := h.shardView(w, r, id); sh != nil {
+			sh.forwarding(sh.joinHandler)(w, r)
+		}
+	case action == "cut":
+		if sh := h.shardView(w, r, id); sh != nil {
+			sh.forwarding(sh.cutHandler)(w, r)
+		}
+	case action == "leader":
+		h.forwarding(h.shardLeaderHandler)(w, r)
+	case action == "split" || action == "merge":
+		h.forwarding(h.reshardHandler)(w, r)
+	default:
+		h.forwarding(h.shardMoveHandler)(w, r)
+	}
+}
+
+// shardView returns the view of h serving this node's replica of shard id,
+// on which the main raft's join and membership endpoints act on the shard's
+// Raft group instead: POST /v1/shards/{id}/join adds a server, normally
+// "<node>-shard-<id>", and /v1/shards/{id}/members lists, removes and
+// promotes them. A node that does not host the shard redirects to one that
+// does and returns nil.
+func (h *Handler) shardView(w http.ResponseWriter, r *http.Request, id string) *Handler {
+	var sr *shardraft.ShardRaft
+	if h.Shards != nil {
+		sr = h.Shards.Get(id)
+	}
+	if sr == nil {
+		w.Header().Set(ServedByHeader, h.NodeID)
+		h.redirectToShard(w, r, id)
+		return nil
+	}
+	return h.forShard(sr)
+}
+
+// shardMoveHandler serves POST /v1/shards/{id}/move with JSON
+// {"from":"node1","to":"node4"}, which moves the shard's replica on one node
+// to another without taking the shard offline: the target joins the shard's
+// group as a learner, catches up through snapshot and log and is promoted,
+// then the source leaves the group and deletes its replica. The leader
+// records the move and answers 202 with the shard's placement entry; its
+// "move" shows how far the move got, as does /v1/shards/status.
+func (h *Handler) shardMoveHandler(w http.ResponseWriter, r *http.Request) {
+	id, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/shards/"), "/")
+	if h.RaftNode == nil || h.ShardCount <= 0 {
+		http.Error(w, "shard moves need raft and --shard-count", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.From == "" || req.To == "" {
+		http.Error(w, "from and to required", http.StatusBadRequest)
+		return
+	}
+	if _, err := h.RaftNode.Member(req.To); err != nil {
+		http.Error(w, "unknown node "+req.To, http.StatusBadRequest)
+		return
+	}
+	if !h.requireLeader(w) {
+		return
+	}
+	p, err := h.RaftNode.Placement()
+	if err != nil {
+		http.Error(w, "read placement: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s := p.Shard(id)
+	switch {
+	case s == nil:
+		http.Error(w, "no shard "+id, http.StatusNotFound)
+		return
+	case s.Move.Active():
+		http.Error(w, "shard "+id+" is already moving from "+s.Move.From+" to "+s.Move.To, http.StatusConflict)
+		return
+	case s.Reshard.Active():
+		http.Error(w, "shard "+id+" is being split or merged; retry once that ends", http.StatusConflict)
+		return
+	case !s.HasReplica(req.From):
+		http.Error(w, req.From+" hosts no replica of shard "+id, http.StatusBadRequest)
+		return
+	case s.HasReplica(req.To):
+		http.Error(w, req.To+" already hosts a replica of shard "+id, http.StatusBadRequest)
+		return
+	}
+	m := raftnode.ShardMove{From: req.From, To: req.To, Phase: raftnode.MoveAddLearner}
+	if err := h.RaftNode.MoveShard(id, m, 5*time.Second); err != nil {
+		h.applyFailed(w, err)
+		return
+	}
+	if p, err = h.RaftNode.Placement(); err != nil {
+		http.Error(w, "read placement: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(p.Shard(id))
+}
+
+// shardLeaderHandler serves POST /v1/shards/{id}/leader with JSON
+// {"node_id":...}, which the node whose shard raft won an election sends to
+// record itself as the shard's leader. Only the leader can apply it.
+func (h *Handler) shardLeaderHandler(w http.ResponseWriter, r *http.Request) {
+	id, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/shards/"), "/")
+	if h.RaftNode == nil {
+		http.Error(w, "raft not enabled", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		NodeID string `json:"node_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NodeID == "" {
+		http.Error(w, "node_id required", http.StatusBadRequest)
+		return
+	}
+	if !h.requireLeader(w) {
+		return
+	}
+	if err := h.RaftNode.ReportShardLeader(id, req.NodeID, 5*time.Second); err != nil {
+		h.applyFailed(w, err)
 		return
 	}
-	h.ShardMgr.AddShard(req.ShardID)
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// shardsStatusHandler returns per-shard raft info we are running locally.
+// shardsStatusHandler returns per-shard raft info we are running locally,
+// with the key range, last move and last split or merge of each shard.
+// Replicas stopped after a failed apply are listed too, with "failed"
+// saying why.
 func (h *Handler) shardsStatusHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	type ShardInfo struct {
-		ShardID  string `json:"shard_id"`
-		NodeID   string `json:"node_id,omitempty"`
-		RaftAddr string `json:"raft_addr,omitempty"`
-		IsLeader bool   `json:"is_leader"`
-	}
-	out := []ShardInfo{}
-	if h.ShardRafts != nil {
-		for id, sr := range h.ShardRafts {
-			info := ShardInfo{ShardID: id}
-			if sr != nil && sr.Node != nil {
-				info.NodeID = sr.Node.ID
-				info.RaftAddr = sr.Node.Addr
-				if sr.Node.Raft != nil {
-					info.IsLeader = sr.Node.Raft.State() == 3 // raft.Leader == 3 (avoid import cycle)
-				}
+	out := []shardInfo{}
+	var p *raftnode.Placement
+	if h.RaftNode != nil {
+		p, _ = h.RaftNode.Placement()
+	}
+	if h.Shards != nil {
+		for _, sr := range h.Shards.List() {
+			out = append(out, shardInfo{
+				ShardID:      sr.ShardID,
+				NodeID:       sr.Node.ID,
+				RaftAddr:     sr.Node.Addr,
+				IsLeader:     sr.Node.Raft.State() == raft.Leader,
+				AppliedIndex: sr.Node.Raft.AppliedIndex(),
+				Ready:        sr.Ready(),
+			})
+		}
+		failed := h.Shards.Failed()
+		ids := make([]string, 0, len(failed))
+		for id := range failed {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			out = append(out, shardInfo{ShardID: id, Failed: failed[id]})
+		}
+	}
+	if p != nil {
+		for i := range out {
+			if s := p.Shard(out[i].ShardID); s != nil {
+				r := s.KeyRange(h.ShardCount)
+				out[i].KeyRange, out[i].Move, out[i].Reshard = &r, s.Move, s.Reshard
 			}
-			out = append(out, info)
 		}
 	}
 	b, _ := json.Marshal(out)
@@ -0,0 +1,194 @@
+package httpapi
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+
+	raftnode "github.com/sada-02/keyper/raft"
+	"github.com/sada-02/keyper/shard"
+	shardraft "github.com/sada-02/keyper/shardraft"
+)
+
+// ShardHeader names the shard a key request was routed to.
+const ShardHeader = "X-Keyper-Shard"
+
+// shardInfo is one entry of GET /v1/shards/status.
+type shardInfo struct {
+	ShardID      string `json:"shard_id"`
+	NodeID       string `json:"node_id,omitempty"`
+	RaftAddr     string `json:"raft_addr,omitempty"`
+	IsLeader     bool   `json:"is_leader"`
+	AppliedIndex uint64 `json:"applied_index"`
+	Ready        bool   `json:"ready"`            // false until a shard made by a split or merge has its keys
+	Failed       string `json:"failed,omitempty"` // why the replica stopped, if it failed
+
+	// from the placement table: the keys the shard owns, its last replica
+	// move and its last split or merge
+	KeyRange *shard.Range        `json:"key_range,omitempty"`
+	Move     *raftnode.ShardMove `json:"move,omitempty"`
+	Reshard  *raftnode.Reshard   `json:"reshard,omitempty"`
+}
+
+// routeKey serves /v1/keys/{key}. With ShardCount set the key goes to the
+// shard whose range in the placement table holds it, or that it hashes to
+// while the table is empty, and is served by that shard's Raft group and
+// store, which redirects to the shard's leader like the main raft does to
+// its own. A shard the placement table puts elsewhere is redirected to a
+// node hosting it. Keys caught in a split or merge, between their old shard
+// cutting them off and the new one loading them, get 503 and Retry-After.
+func (h *Handler) routeKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/keys/")
+	if h.ShardCount <= 0 || key == "" {
+		h.forwarding(h.keyHandler)(w, r)
+		return
+	}
+	h.serveShard(w, r, h.locateKey(key), []string{key}, (*Handler).keyHandler)
+}
+
+// routeKeys wraps the handler of requests that write several keys, /v1/txn
+// and /v1/batch, whose keys keys reads from the body. With ShardCount set
+// the request goes to the shard all its keys belong to, as routeKey sends a
+// single key. One spanning shards gets 400: every shard applies its own log,
+// so it could not be applied in one entry.
+func (h *Handler) routeKeys(keys func(body []byte) ([]string, error), next func(*Handler, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		local := func(w http.ResponseWriter, r *http.Request) { next(h, w, r) }
+		if h.ShardCount <= 0 {
+			h.forwarding(local)(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "bad body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		all, err := keys(body)
+		if err != nil {
+			// the handler turns it away before touching the store
+			local(w, r)
+			return
+		}
+		id := ""
+		var routed []string
+		for _, key := range all {
+			if key == "" {
+				continue // rejected by the shard's handler
+			}
+			s := h.locateKey(key)
+			if id != "" && s != id {
+				http.Error(w, "keys "+routed[0]+" and "+key+" are on shards "+id+" and "+s+"; send a request per shard", http.StatusBadRequest)
+				return
+			}
+			id = s
+			routed = append(routed, key)
+		}
+		if id == "" {
+			http.Error(w, "at least one key is required with --shard-count", http.StatusBadRequest)
+			return
+		}
+		h.serveShard(w, r, id, routed, next)
+	}
+}
+
+// locateKey returns the shard whose range in the placement table holds key,
+// or that it hashes to while the table is empty.
+func (h *Handler) locateKey(key string) string {
+	if h.RaftNode != nil {
+		if p, err := h.RaftNode.Placement(); err == nil {
+			if s := p.Locate(key, h.ShardCount); s != nil {
+				return s.ID
+			}
+		}
+	}
+	return shard.ForKey(key, h.ShardCount)
+}
+
+// serveShard serves r with next from shard id's Raft group and store, if
+// this node hosts it and it owns keys, or redirects to a node that hosts it.
+func (h *Handler) serveShard(w http.ResponseWriter, r *http.Request, id string, keys []string, next func(*Handler, http.ResponseWriter, *http.Request)) {
+	w.Header().Set(ShardHeader, id)
+	var sr *shardraft.ShardRaft
+	if h.Shards != nil {
+		sr = h.Shards.Get(id)
+	}
+	if sr == nil {
+		w.Header().Set(ServedByHeader, h.NodeID)
+		h.redirectToShard(w, r, id)
+		return
+	}
+	for _, key := range keys {
+		if !sr.Ready() || !sr.Node.Owns(key) {
+			w.Header().Set(ServedByHeader, h.NodeID)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "key "+key+" is moving between shards by a split or merge", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	sh := h.forShard(sr)
+	sh.forwarding(func(w http.ResponseWriter, r *http.Request) { next(sh, w, r) })(w, r)
+}
+
+// forShard returns a copy of h that serves from the shard's Raft group and
+// store. Shard writes are not published to the watch hub, whose event
+// indexes follow the main raft's log.
+func (h *Handler) forShard(sr *shardraft.ShardRaft) *Handler {
+	sh := *h
+	sh.RaftNode = sr.Node
+	sh.Store = sr.Store
+	sh.Watch = nil
+	sh.shardID = sr.ShardID
+	return &sh
+}
+
+// redirectToShard answers a request for a shard this node does not host
+// with a 307 to a node that does, the shard's leader if the placement table
+// names one. The node is named in Location and X-Raft-Leader; 503 means the
+// table places the shard nowhere this node can name.
+func (h *Handler) redirectToShard(w http.ResponseWriter, r *http.Request, shardID string) {
+	target := h.locateShard(shardID)
+	if target == "" {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "shard "+shardID+" is not hosted on this node and has no known replica", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("X-Raft-Leader", target)
+	w.Header().Set("Location", target+r.URL.RequestURI())
+	http.Error(w, "shard "+shardID+" is not hosted on this node", http.StatusTemporaryRedirect)
+}
+
+// locateShard returns the HTTP URL of another node hosting shardID, its
+// leader first, or "".
+func (h *Handler) locateShard(shardID string) string {
+	if h.RaftNode == nil {
+		return ""
+	}
+	p, err := h.RaftNode.Placement()
+	if err != nil {
+		return ""
+	}
+	s := p.Shard(shardID)
+	if s == nil {
+		return ""
+	}
+	for _, node := range append([]string{s.Leader}, s.Replicas...) {
+		if node == "" || node == h.NodeID {
+			continue
+		}
+		if u := h.nodeURL(node); u != "" {
+			return u
+		}
+	}
+	return ""
+}
+
+// nodeURL returns the HTTP base URL of a node from the membership table, or
+// from PeerHTTP if it has not registered one.
+func (h *Handler) nodeURL(id string) string {
+	if m, err := h.RaftNode.Member(id); err == nil && m.HTTPAddr != "" {
+		return strings.TrimRight(m.HTTPAddr, "/")
+	}
+	return strings.TrimRight(h.PeerHTTP[id], "/")
+}
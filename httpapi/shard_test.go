@@ -0,0 +1,67 @@
+package httpapi_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sada-02/keyper/httpapi"
+	"github.com/sada-02/keyper/shard"
+)
+
+// TestShardedRouting checks what a sharded node does with the requests that
+// do not name a single key: scans and watches are refused, txns and batches
+// spanning shards are refused, and ones on a single shard go to that shard
+// rather than to the node's own store.
+func TestShardedRouting(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dkvs_test_shard_routing_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s, h, srv := newServer(t, dir)
+	h.ShardCount = 2
+
+	// two keys on different shards
+	a, b := "k0", ""
+	for i := 1; b == ""; i++ {
+		if k := "k" + strconv.Itoa(i); shard.ForKey(k, 2) != shard.ForKey(a, 2) {
+			b = k
+		}
+	}
+
+	for _, c := range []struct {
+		method, path, body string
+		want               int
+		shard              string // X-Keyper-Shard of a routed request
+	}{
+		{http.MethodGet, "/v1/keys?prefix=k", "", http.StatusBadRequest, ""},
+		{http.MethodGet, "/v1/watch?key=" + a, "", http.StatusBadRequest, ""},
+		{http.MethodPost, "/v1/txn", `{"guards":[{"key":"` + a + `","exists":false}],"success":[{"op":"set","key":"` + b + `","value":"eA=="}]}`, http.StatusBadRequest, ""},
+		{http.MethodPut, "/v1/batch", `{"ops":[{"op":"set","key":"` + a + `","value":"eA=="},{"op":"delete","key":"` + b + `"}]}`, http.StatusBadRequest, ""},
+		{http.MethodPut, "/v1/batch", `{"ops":[{"op":"delete","key":""}]}`, http.StatusBadRequest, ""},
+		{http.MethodPut, "/v1/batch", `{"ops":`, http.StatusBadRequest, ""},
+		// single-shard requests reach the router, which knows no node hosting the shard
+		{http.MethodPost, "/v1/txn", `{"success":[{"op":"set","key":"` + a + `","value":"eA=="}]}`, http.StatusServiceUnavailable, shard.ForKey(a, 2)},
+		{http.MethodPut, "/v1/batch", `{"ops":[{"op":"set","key":"` + b + `","value":"eA=="},{"op":"delete","key":"` + b + `"}]}`, http.StatusServiceUnavailable, shard.ForKey(b, 2)},
+	} {
+		req, _ := http.NewRequest(c.method, srv.URL+c.path, strings.NewReader(c.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", c.method, c.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.want {
+			t.Fatalf("%s %s %s: %s, want %d", c.method, c.path, c.body, resp.Status, c.want)
+		}
+		if got := resp.Header.Get(httpapi.ShardHeader); got != c.shard {
+			t.Fatalf("%s %s %s: routed to shard %q, want %q", c.method, c.path, c.body, got, c.shard)
+		}
+	}
+	for _, k := range []string{a, b} {
+		if _, err := s.Get([]byte(k)); err == nil {
+			t.Fatalf("%s written to the node's own store", k)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	raftnode "github.com/sada-02/keyper/raft"
+	"github.com/sada-02/keyper/store"
+	"github.com/sada-02/keyper/watch"
+)
+
+// txnGuard is one guard of POST /v1/txn. Every field that is set must hold:
+// exists (true/false), version equals, value (base64) equals.
+type txnGuard struct {
+	Key     string  `json:"key"`
+	Exists  *bool   `json:"exists,omitempty"`
+	Version *uint64 `json:"version,omitempty"`
+	Value   []byte  `json:"value,omitempty"`
+}
+
+// txnOp is one set/delete op of POST /v1/txn; ttl works as on PUT.
+type txnOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	TTL   string `json:"ttl,omitempty"`
+}
+
+type txnRequest struct {
+	Guards  []txnGuard `json:"guards"`
+	Success []txnOp    `json:"success"`
+	Failure []txnOp    `json:"failure"`
+}
+
+type txnResponse struct {
+	Succeeded bool                `json:"succeeded"`
+	Index     uint64              `json:"index,omitempty"` // Raft index the txn committed at
+	Results   []store.TxnOpResult `json:"results"`
+}
+
+// txnKeys returns the keys a POST /v1/txn body guards or writes.
+func txnKeys(body []byte) ([]string, error) {
+	var req txnRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, g := range req.Guards {
+		keys = append(keys, g.Key)
+	}
+	for _, op := range append(req.Success, req.Failure...) {
+		keys = append(keys, op.Key)
+	}
+	return keys, nil
+}
+
+// txnHandler implements POST /v1/txn:
+//
+//	{"guards":  [{"key":"a","exists":true}, {"key":"b","version":42}],
+//	 "success": [{"op":"set","key":"a","value":"<base64>"}, {"op":"delete","key":"b"}],
+//	 "failure": [...]}
+//
+// If every guard holds the success ops run, otherwise the failure ops do. The
+// whole request is one Raft log entry applied in one Badger transaction, so
+// no replica ever observes part of a branch. The response says which branch
+// ran ("succeeded") and carries the per-op results. With --shard-count every
+// key must belong to one shard, whose group applies the txn.
+func (h *Handler) txnHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "bad body", http.StatusBadRequest)
+		return
+	}
+	var req txnRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	if h.RaftNode != nil {
+		// Only the leader may stamp TTL deadlines and propose the entry.
+		if !h.requireLeader(w) {
+			return
+		}
+	}
+
+	treq, err := req.toStore()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := txnResponse{}
+	if h.RaftNode != nil {
+		cmd := &raftnode.Command{Op: "txn", Txn: treq}
+		res, err := h.RaftNode.Apply(cmd, 5*time.Second)
+		if err != nil {
+			h.applyFailed(w, err)
+			return
+		}
+		tres, ok := res.Response.(*store.TxnResult)
+		if !ok {
+			http.Error(w, "unexpected txn result", http.StatusInternalServerError)
+			return
+		}
+		resp.Succeeded = tres.Succeeded
+		resp.Results = tres.Results
+		resp.Index = res.Index
+	} else {
+		tres, err := h.Store.ApplyTxn(treq, 0)
+		if err != nil {
+			http.Error(w, "txn failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.Succeeded = tres.Succeeded
+		resp.Results = tres.Results
+		ops := treq.Success
+		if !tres.Succeeded {
+			ops = treq.Failure
+		}
+		h.publishLocal(watch.TxnEvents(ops, 0)...)
+	}
+
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+// toStore validates the request and converts it into the replicated form,
+// turning TTLs into absolute deadlines.
+func (req *txnRequest) toStore() (*store.TxnRequest, error) {
+	out := &store.TxnRequest{}
+	for _, g := range req.Guards {
+		sg := store.Guard{Key: g.Key}
+		if g.Exists != nil {
+			sg.MustExist = *g.Exists
+			sg.MustNotExist = !*g.Exists
+		}
+		sg.Version = g.Version
+		sg.Value = g.Value
+		out.Guards = append(out.Guards, sg)
+	}
+	convert := func(ops []txnOp) ([]store.TxnOp, error) {
+		res := make([]store.TxnOp, 0, len(ops))
+		for _, op := range ops {
+			ttl, err := parseTTLValue(op.TTL)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, store.TxnOp{
+				Op:        op.Op,
+				Key:       op.Key,
+				Value:     op.Value,
+				ExpiresAt: expiryDeadline(ttl),
+			})
+		}
+		return res, nil
+	}
+	var err error
+	if out.Success, err = convert(req.Success); err != nil {
+		return nil, err
+	}
+	if out.Failure, err = convert(req.Failure); err != nil {
+		return nil, err
+	}
+	if err := out.Validate(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,150 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sada-02/keyper/watch"
+)
+
+// watchKeepalive is how often an idle watch stream writes a keepalive so
+// proxies and clients can tell a quiet stream from a dead connection.
+const watchKeepalive = 15 * time.Second
+
+// RevisionHeader reports the newest revision a node has published when a
+// watch stream starts.
+const RevisionHeader = "X-Keyper-Revision"
+
+// watchHandler implements GET /v1/watch?key=<k> or ?prefix=<p>, streaming
+// every committed set/delete on the key or prefix. Events carry the Raft
+// index as their revision; pass ?since=<rev> (or the SSE Last-Event-ID
+// header) to resume after a disconnect. The stream is NDJSON by default and
+// server-sent events with format=sse or Accept: text/event-stream.
+//
+// Any node can serve a watch, followers included: events are published by
+// the FSM as entries are applied locally. Shard writes are not published,
+// so with --shard-count a watch answers 400.
+func (h *Handler) watchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.ShardCount > 0 {
+		http.Error(w, "watches are not supported with --shard-count: shard writes are not published", http.StatusBadRequest)
+		return
+	}
+	if h.Watch == nil {
+		http.Error(w, "watch not enabled", http.StatusBadRequest)
+		return
+	}
+
+	q := r.URL.Query()
+	if q.Has("key") == q.Has("prefix") {
+		http.Error(w, "exactly one of key or prefix required", http.StatusBadRequest)
+		return
+	}
+	target, prefix := q.Get("key"), false
+	if q.Has("prefix") {
+		target, prefix = q.Get("prefix"), true
+	}
+	if !prefix && target == "" {
+		http.Error(w, "key required", http.StatusBadRequest)
+		return
+	}
+
+	var since *uint64
+	rawSince := q.Get("since")
+	if rawSince == "" {
+		rawSince = r.Header.Get("Last-Event-ID")
+	}
+	if rawSince != "" {
+		v, err := strconv.ParseUint(rawSince, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+		since = &v
+	}
+
+	sse := q.Get("format") == "sse" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+
+	sub, err := h.Watch.Subscribe(target, prefix, since)
+	if err != nil {
+		if errors.Is(err, watch.ErrCompacted) {
+			w.Header().Set(RevisionHeader, strconv.FormatUint(h.Watch.LastRevision(), 10))
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		http.Error(w, "watch failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer sub.Close()
+
+	// Watches outlive the server's WriteTimeout; lift the deadline for this stream.
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set(RevisionHeader, strconv.FormatUint(h.Watch.LastRevision(), 10))
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+
+	ticker := time.NewTicker(watchKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			keepalive := "\n"
+			if sse {
+				keepalive = ": keepalive\n\n"
+			}
+			if _, err := w.Write([]byte(keepalive)); err != nil {
+				return
+			}
+		case ev, ok := <-sub.C:
+			if !ok {
+				// closed by the hub: tell the client why before ending the stream
+				if err := sub.Err(); err != nil {
+					writeWatchError(w, sse, err)
+					_ = rc.Flush()
+				}
+				return
+			}
+			b, _ := json.Marshal(ev)
+			var werr error
+			if sse {
+				_, werr = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Revision, ev.Type, b)
+			} else {
+				_, werr = fmt.Fprintf(w, "%s\n", b)
+			}
+			if werr != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeWatchError(w http.ResponseWriter, sse bool, err error) {
+	b, _ := json.Marshal(map[string]string{"type": "error", "error": err.Error()})
+	if sse {
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", b)
+		return
+	}
+	fmt.Fprintf(w, "%s\n", b)
+}
@@ -0,0 +1,80 @@
+package raftnode
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	raft "github.com/hashicorp/raft"
+	"github.com/sada-02/keyper/store"
+)
+
+// appliedMeta names the metadata entry holding the index of the last log
+// entry written to the store. The FSM writes it in the same transaction as
+// the entry's data, so the store always knows exactly which entries it holds.
+const appliedMeta = "applied-index"
+
+func encodeIndex(index uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, index)
+}
+
+// AppliedIndex returns the index of the last Raft entry written to s, or 0
+// if s holds none (new, restored from a snapshot and not written since, or
+// written before the index was recorded).
+func AppliedIndex(s *store.BadgerStore) (uint64, error) {
+	b, err := s.GetMeta(appliedMeta)
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 8 {
+		return 0, fmt.Errorf("applied index: want 8 bytes, got %d", len(b))
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// PersistedIndex is AppliedIndex of the node's store: how far the data on
+// disk goes, which after a restart can be ahead of Raft's applied index.
+func (n *Node) PersistedIndex() (uint64, error) {
+	return AppliedIndex(n.store)
+}
+
+// markApplied records index as applied without writing anything else, for
+// entries that fail before they touch the store.
+func (f *fsm) markApplied(index uint64) error {
+	return f.update(index, func(*store.Tx) error { return nil })
+}
+
+// storeCoversSnapshot reports whether the store already holds everything
+// the latest snapshot does, in which case restoring it on start would only
+// rewind the store. That is so when the store's applied index reaches the
+// snapshot's, or when every entry in between is one the FSM never sees
+// (leader no-ops and configuration changes). If those entries are gone from
+// the log, or the store has no applied index, it does not.
+func storeCoversSnapshot(applied uint64, snapshots raft.SnapshotStore, logs raft.LogStore) (bool, error) {
+	if applied == 0 {
+		return false, nil
+	}
+	metas, err := snapshots.List()
+	if err != nil {
+		return false, err
+	}
+	if len(metas) == 0 {
+		return true, nil
+	}
+	for i := applied + 1; i <= metas[0].Index; i++ {
+		var l raft.Log
+		if err := logs.GetLog(i, &l); err != nil {
+			if errors.Is(err, raft.ErrLogNotFound) {
+				return false, nil
+			}
+			return false, err
+		}
+		if l.Type == raft.LogCommand {
+			return false, nil
+		}
+	}
+	return true, nil
+}
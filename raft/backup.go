@@ -0,0 +1,73 @@
+package raftnode
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	raft "github.com/hashicorp/raft"
+)
+
+// OpenSnapshot takes a snapshot now and opens it for reading, for backups.
+// When nothing has been applied since the last snapshot, that one is opened
+// instead. The caller must close the reader.
+func (n *Node) OpenSnapshot() (*raft.SnapshotMeta, io.ReadCloser, error) {
+	f := n.Raft.Snapshot()
+	err := f.Error()
+	if err == nil {
+		return f.Open()
+	}
+	if !errors.Is(err, raft.ErrNothingNewToSnapshot) {
+		return nil, nil, err
+	}
+	list, err := n.snapshots.List()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(list) == 0 {
+		return nil, nil, errors.New("no snapshot available")
+	}
+	return n.snapshots.Open(list[0].ID)
+}
+
+// Restore replaces the state of the whole cluster with a snapshot of size
+// bytes, such as a backup taken with OpenSnapshot, possibly on another
+// cluster. Only the leader can do this; followers pick the state up through
+// InstallSnapshot. index should be the last log index the snapshot covers (0
+// if unknown): the log jumps past it, so versions assigned to new writes stay
+// above the versions restored.
+//
+// The snapshot must already have been checked (store.InspectSnapshot): a
+// snapshot the FSM cannot load takes the node down. The current cluster's
+// membership records are written back afterwards, since the snapshot carries
+// those of the cluster it was taken on.
+func (n *Node) Restore(r io.Reader, size int64, index uint64, timeout time.Duration) error {
+	members, err := n.Members()
+	if err != nil {
+		return fmt.Errorf("read membership: %w", err)
+	}
+	meta := &raft.SnapshotMeta{Version: raft.SnapshotVersionMax, Index: index, Size: size}
+	if err := n.Raft.Restore(meta, r, timeout); err != nil {
+		return err
+	}
+
+	fut := n.Raft.GetConfiguration()
+	if err := fut.Error(); err != nil {
+		return err
+	}
+	inConfig := make(map[string]bool)
+	for _, srv := range fut.Configuration().Servers {
+		inConfig[string(srv.ID)] = true
+	}
+	for _, m := range members {
+		if !inConfig[m.ID] {
+			continue
+		}
+		if err := n.RegisterMember(m, timeout); err != nil {
+			log.Printf("re-register member %s after restore: %v", m.ID, err)
+		}
+	}
+	return nil
+}
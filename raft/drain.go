@@ -0,0 +1,79 @@
+package raftnode
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	raft "github.com/hashicorp/raft"
+)
+
+// ErrDraining is returned by Apply once Drain has been called: the node is on
+// its way down and takes no new writes.
+var ErrDraining = errors.New("node is draining")
+
+// TransferLeadership hands leadership to targetID, or to the most up to date
+// follower when targetID is empty, and returns once the transfer is done.
+// It fails with raft.ErrNotLeader on a follower.
+func (n *Node) TransferLeadership(targetID string) error {
+	if targetID == "" {
+		return n.Raft.LeadershipTransfer().Error()
+	}
+	fut := n.Raft.GetConfiguration()
+	if err := fut.Error(); err != nil {
+		return err
+	}
+	for _, srv := range fut.Configuration().Servers {
+		if string(srv.ID) != targetID {
+			continue
+		}
+		if srv.Suffrage != raft.Voter {
+			return fmt.Errorf("%s is not a voter", targetID)
+		}
+		return n.Raft.LeadershipTransferToServer(srv.ID, srv.Address).Error()
+	}
+	return fmt.Errorf("no such member: %s", targetID)
+}
+
+// Drain prepares the node to be stopped: it stops taking new writes, waits
+// up to timeout for the applies already in flight to finish, and hands
+// leadership to another voter if this node has it. Writes arriving afterwards
+// fail with ErrDraining. Raft keeps running, replicating and voting, until
+// Raft.Shutdown.
+func (n *Node) Drain(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		// Lock waits for every in-flight Apply (each holds a read lock)
+		// and holds off new ones until draining is set.
+		n.drainMu.Lock()
+		n.draining = true
+		n.drainMu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		return fmt.Errorf("in-flight writes still pending after %s", timeout)
+	}
+
+	if n.Raft.State() != raft.Leader || !n.hasOtherVoters() {
+		return nil
+	}
+	if err := n.TransferLeadership(""); err != nil {
+		return fmt.Errorf("leadership transfer: %w", err)
+	}
+	return nil
+}
+
+func (n *Node) hasOtherVoters() bool {
+	fut := n.Raft.GetConfiguration()
+	if fut.Error() != nil {
+		return false
+	}
+	for _, srv := range fut.Configuration().Servers {
+		if srv.Suffrage == raft.Voter && string(srv.ID) != n.ID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package raftnode
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sada-02/keyper/store"
+)
+
+func TestDrainWaitsForInFlightWrites(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dkvs_test_drain_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	defer os.RemoveAll(dir)
+	s, err := store.NewBadgerStore(dir)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer s.Close()
+
+	n, _ := testLeader(t, s, GroupCommit{MaxBatch: 64, Window: 200 * time.Millisecond})
+	if err := n.RegisterMember(Member{ID: "gone", RaftAddr: "127.0.0.1:1"}, time.Second); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	// parked in the group commit window while Drain starts
+	inFlight := make(chan error, 1)
+	go func() {
+		_, err := n.Apply(&Command{Op: "set", Key: "k", Value: []byte("v")}, 5*time.Second)
+		inFlight <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := n.Drain(5 * time.Second); err != nil {
+		t.Fatalf("drain: %v", err)
+	}
+	select {
+	case err := <-inFlight:
+		if err != nil {
+			t.Fatalf("in-flight write failed: %v", err)
+		}
+	default:
+		t.Fatal("drain returned before the in-flight write finished")
+	}
+	if _, err := s.Get([]byte("k")); err != nil {
+		t.Fatalf("in-flight write not applied: %v", err)
+	}
+	if _, err := n.Apply(&Command{Op: "set", Key: "late", Value: []byte("v")}, time.Second); !errors.Is(err, ErrDraining) {
+		t.Fatalf("expected ErrDraining after drain, got %v", err)
+	}
+
+	// leaving on the way down still drops the membership record
+	if err := n.RemoveServer("gone", time.Second); err != nil {
+		t.Fatalf("remove server: %v", err)
+	}
+	if _, err := s.GetMeta(memberPrefix + "gone"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("member record kept after drain: %v", err)
+	}
+}
@@ -2,132 +2,395 @@ package raftnode
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"os"
-	"time"
+	"log"
+	"sync"
+	"sync/atomic"
 
+	"github.com/dgraph-io/badger/v4"
 	raft "github.com/hashicorp/raft"
 	"github.com/sada-02/keyper/store"
+	"github.com/sada-02/keyper/watch"
 )
 
 // Command is the structure we store in the Raft log.
 type Command struct {
-	Op    string `json:"op"`              // "set" or "delete"
+	Op    string `json:"op"`              // "set", "delete", "txn", "batch", "group", "member", "member-remove", "shard-assign", "shard-leader", "shard-move", "shard-reshard" or "cut"
 	Key   string `json:"key"`             // key
 	Value []byte `json:"value,omitempty"` // value for set
+
+	// ExpiresAt is the absolute expiry deadline (unix seconds) for set.
+	// It is stamped once by the leader so every replica expires the key at
+	// the same moment; 0 means no expiry.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+
+	// Cond is an optional precondition (If-Match / If-None-Match) checked
+	// inside Apply, atomically with the write, on every replica.
+	Cond *store.Condition `json:"cond,omitempty"`
+
+	// Txn carries the guards and both branches of a "txn" command, which is
+	// applied in a single Badger transaction.
+	Txn *store.TxnRequest `json:"txn,omitempty"`
+
+	// Batch carries the ops of a "batch" command: independent sets and
+	// deletes written together, with a result per op.
+	Batch []store.TxnOp `json:"batch,omitempty"`
+
+	// Group carries the commands of a "group" entry: concurrent set, delete
+	// and txn commands coalesced by the leader into one log entry.
+	Group []Command `json:"group,omitempty"`
+
+	// Member carries the record of a "member" command, which registers or
+	// updates a node's advertised addresses in the membership table, and
+	// names the node dropped from it by "member-remove".
+	Member *Member `json:"member,omitempty"`
+
+	// Shard carries the entry of a "shard-assign" command, which sets the
+	// replicas of a shard in the placement table, the shard and node of a
+	// "shard-leader" report, the shard and move of a "shard-move", and the
+	// new shard and split or merge of a "shard-reshard".
+	Shard *ShardPlacement `json:"shard,omitempty"`
+
+	// Cut carries the keys a shard's "cut" hands on to another shard.
+	Cut *Cut `json:"cut,omitempty"`
 }
 
 // fsm implements raft.FSM using the Badger-backed store.
 type fsm struct {
 	store *store.BadgerStore
+	hub   *watch.Hub // receives an event per committed change; may be nil
+
+	compress bool // gzip snapshot bodies
+
+	// skipThrough is the applied index the store had when the FSM was
+	// built: entries up to it are already written and are not applied
+	// again when Raft replays its log on start.
+	skipThrough uint64
+
+	placement chan struct{}             // signalled when the placement table changes
+	table     atomic.Pointer[Placement] // the table as last read; see Node.Placement
+	owned     atomic.Pointer[ownership] // the key range the store owns
+	cutDir    string                    // where "cut" writes the keys handed on
+
+	// cuts applied but not finished are finished by runCuts; cutMu keeps
+	// Restore out while it works on one
+	cutMu   sync.Mutex
+	cutKick chan struct{}
+	cutQuit chan struct{}
+	cutStop sync.Once
+	cutDone chan struct{} // nil until startCuts
+
+	// failure is set, and failed closed, once an entry could not be applied
+	// without leaving the store out of step with the log; see fail
+	failure  atomic.Pointer[error]
+	failed   chan struct{}
+	failOnce sync.Once
 }
 
-func NewFSM(s *store.BadgerStore) raft.FSM {
-	return &fsm{store: s}
+// ErrFailed is returned for every entry, and snapshot, of an FSM that could
+// not apply an earlier entry and stopped applying; see Node.Failed.
+var ErrFailed = errors.New("replica stopped applying after a failed entry")
+
+// NewFSM builds the FSM over s. If hub is non-nil every committed change is
+// published to it after the write succeeds, on leader and followers alike.
+// compress selects gzip-compressed snapshots; restore accepts either kind.
+func NewFSM(s *store.BadgerStore, hub *watch.Hub, compress bool) raft.FSM {
+	return newFSM(s, hub, compress)
 }
 
-// Apply applies a Raft log entry to the underlying store.
+func newFSM(s *store.BadgerStore, hub *watch.Hub, compress bool) *fsm {
+	applied, err := AppliedIndex(s)
+	if err != nil {
+		// replaying everything is always safe
+		log.Printf("raft: read applied index: %v", err)
+	}
+	f := &fsm{
+		store: s, hub: hub, compress: compress, skipThrough: applied, placement: make(chan struct{}, 1),
+		cutKick: make(chan struct{}, 1), cutQuit: make(chan struct{}), failed: make(chan struct{}),
+	}
+	if err := f.reloadOwnership(); err != nil {
+		log.Printf("raft: read key range: %v", err)
+		f.owned.Store(&ownership{all: true})
+	}
+	return f
+}
+
+// Apply applies a Raft log entry to the underlying store. Every entry also
+// records its index as the store's applied index, in the same transaction as
+// its writes.
 func (f *fsm) Apply(logEntry *raft.Log) interface{} {
+	index := logEntry.Index
+	if index <= f.skipThrough {
+		return nil
+	}
+	if err := f.failedErr(); err != nil {
+		return err
+	}
 	var cmd Command
 	if err := json.Unmarshal(logEntry.Data, &cmd); err != nil {
+		_ = f.markApplied(index)
 		return fmt.Errorf("failed unmarshal command: %w", err)
 	}
 
+	switch cmd.Op {
+	case "group":
+		return f.applyGroup(cmd.Group, index)
+	case "member":
+		return f.applyMember(cmd.Member, index)
+	case "member-remove":
+		return f.removeMember(cmd.Member, index)
+	case "shard-assign":
+		return f.applyShardAssign(cmd.Shard, index)
+	case "shard-leader":
+		return f.applyShardLeader(cmd.Shard, index)
+	case "shard-move":
+		return f.applyShardMove(cmd.Shard, index)
+	case "shard-reshard":
+		return f.applyReshard(cmd.Shard, index)
+	case "cut":
+		return f.applyCut(cmd.Cut, index)
+	case "batch":
+		if err := f.checkOwned(&cmd); err != nil {
+			_ = f.markApplied(index)
+			return fmt.Errorf("batch failed: %w", err)
+		}
+		var results []store.BatchResult
+		err := f.update(index, func(tx *store.Tx) error {
+			var err error
+			results, err = tx.ApplyBatch(cmd.Batch, index)
+			return err
+		})
+		if errors.Is(err, badger.ErrTxnTooBig) {
+			// Too big for one transaction: write it in chunks, then the
+			// index. A batch is blind sets and deletes at a fixed version,
+			// so replaying it after a crash in between is harmless.
+			if results, err = f.store.ApplyBatch(cmd.Batch, index); err == nil {
+				err = f.markApplied(index)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("batch failed: %w", err)
+		}
+		applied := make([]store.TxnOp, 0, len(cmd.Batch))
+		for i, op := range cmd.Batch {
+			if results[i].Error == "" {
+				applied = append(applied, op)
+			}
+		}
+		f.publish(watch.TxnEvents(applied, index)...)
+		return results
+	default:
+		if err := f.checkOwned(&cmd); err != nil {
+			_ = f.markApplied(index)
+			return err
+		}
+		var res interface{}
+		var events []watch.Event
+		err := f.update(index, func(tx *store.Tx) error {
+			res, events = applyOne(tx, &cmd, index)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("%s failed: %w", cmd.Op, err)
+		}
+		f.publish(events...)
+		return res
+	}
+}
+
+// fail stops the FSM applying entries, because applying the entry at index
+// failed with err in a way the entries after it cannot be applied on top of.
+// The entry is not marked applied, so a restart applies it again.
+func (f *fsm) fail(index uint64, err error) {
+	f.failOnce.Do(func() {
+		err = fmt.Errorf("%w: entry %d: %v", ErrFailed, index, err)
+		f.failure.Store(&err)
+		close(f.failed)
+		log.Printf("raft: %v", err)
+	})
+}
+
+// failedErr returns the error fail recorded, or nil.
+func (f *fsm) failedErr() error {
+	if err := f.failure.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// update runs fn in one store transaction that also records index as the
+// applied index.
+func (f *fsm) update(index uint64, fn func(tx *store.Tx) error) error {
+	return f.store.Update(func(tx *store.Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return tx.SetMeta(appliedMeta, encodeIndex(index))
+	})
+}
+
+// writer is implemented by *store.BadgerStore and by *store.Tx, so a command
+// can be applied on its own or as part of a group.
+type writer interface {
+	CheckAndSet(kv *store.KVPair, cond *store.Condition) (uint64, error)
+	CheckAndDelete(key []byte, cond *store.Condition) error
+	ApplyTxn(req *store.TxnRequest, version uint64) (*store.TxnResult, error)
+}
+
+// applyOne applies a set, delete or txn command at the given log index and
+// returns the FSM response together with the events to publish once the
+// write is durable.
+func applyOne(w writer, cmd *Command, index uint64) (interface{}, []watch.Event) {
 	switch cmd.Op {
 	case "set":
-		if err := f.store.Set([]byte(cmd.Key), cmd.Value); err != nil {
-			return fmt.Errorf("set failed: %w", err)
+		// The log index doubles as the key's version: it is the same on
+		// every replica and increases with every write.
+		kv := &store.KVPair{
+			Key:       cmd.Key,
+			Value:     cmd.Value,
+			ExpiresAt: cmd.ExpiresAt,
+			Version:   index,
 		}
-		return nil
+		if _, err := w.CheckAndSet(kv, cmd.Cond); err != nil {
+			return fmt.Errorf("set failed: %w", err), nil
+		}
+		return nil, []watch.Event{{Type: "set", Key: cmd.Key, Value: cmd.Value, ExpiresAt: cmd.ExpiresAt, Revision: index}}
 	case "delete":
-		if err := f.store.Delete([]byte(cmd.Key)); err != nil {
-			return fmt.Errorf("delete failed: %w", err)
+		if err := w.CheckAndDelete([]byte(cmd.Key), cmd.Cond); err != nil {
+			return fmt.Errorf("delete failed: %w", err), nil
 		}
-		return nil
+		return nil, []watch.Event{{Type: "delete", Key: cmd.Key, Revision: index}}
+	case "txn":
+		if cmd.Txn == nil {
+			return fmt.Errorf("txn failed: missing body"), nil
+		}
+		res, err := w.ApplyTxn(cmd.Txn, index)
+		if err != nil {
+			return fmt.Errorf("txn failed: %w", err), nil
+		}
+		ops := cmd.Txn.Success
+		if !res.Succeeded {
+			ops = cmd.Txn.Failure
+		}
+		return res, watch.TxnEvents(ops, index)
 	default:
-		return fmt.Errorf("unknown op: %s", cmd.Op)
+		return fmt.Errorf("unknown op: %s", cmd.Op), nil
 	}
 }
 
-// Snapshot returns a snapshot of the current state.
-// We use store.Export to write newline JSON KV pairs into a temp file and return a fileSnapshot that streams it.
-func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
-	tmpFile, err := os.CreateTemp("", "fsm-snap-*.tmp")
+// applyGroup applies the commands of a group-commit entry in one Badger
+// transaction and returns one response per command. The coalescer never puts
+// two writes to the same key in a group, so sharing the log index as version
+// keeps versions unique per key. A failed condition only fails its own
+// command; any other error (typically the group outgrowing one transaction)
+// rolls the group back and the commands are applied one at a time instead.
+func (f *fsm) applyGroup(cmds []Command, index uint64) interface{} {
+	results := make([]interface{}, len(cmds))
+	var events []watch.Event
+	err := f.update(index, func(tx *store.Tx) error {
+		events = events[:0]
+		for i := range cmds {
+			if err := f.checkOwned(&cmds[i]); err != nil {
+				results[i] = err
+				continue
+			}
+			res, evs := applyOne(tx, &cmds[i], index)
+			if err, ok := res.(error); ok && !errors.Is(err, store.ErrConditionFailed) {
+				return err
+			}
+			results[i] = res
+			events = append(events, evs...)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		events = events[:0]
+		for i := range cmds {
+			if err := f.checkOwned(&cmds[i]); err != nil {
+				results[i] = err
+				continue
+			}
+			var evs []watch.Event
+			if err := f.update(index, func(tx *store.Tx) error {
+				results[i], evs = applyOne(tx, &cmds[i], index)
+				return nil
+			}); err != nil {
+				results[i] = err
+			}
+			events = append(events, evs...)
+		}
 	}
+	f.publish(events...)
+	return results
+}
 
-	// Use store.Export to write DB to tmpFile
-	if err := f.store.Export(tmpFile); err != nil {
-		_ = tmpFile.Close()
-		_ = os.Remove(tmpFile.Name())
-		return nil, err
+// publish forwards events to the watch hub, if one is attached.
+func (f *fsm) publish(events ...watch.Event) {
+	if f.hub != nil && len(events) > 0 {
+		f.hub.Publish(events...)
 	}
+}
 
-	// flush & rewind
-	if err := tmpFile.Sync(); err != nil {
-		_ = tmpFile.Close()
-		_ = os.Remove(tmpFile.Name())
-		return nil, err
-	}
-	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
-		_ = tmpFile.Close()
-		_ = os.Remove(tmpFile.Name())
+// Snapshot returns a snapshot of the current state.
+// Raft does not call Apply while Snapshot runs, so Snapshot only opens a
+// read view of the store, which pins the state as of the last applied entry,
+// and Persist dumps it while Apply carries on.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	// the store misses an entry the snapshot would claim
+	if err := f.failedErr(); err != nil {
 		return nil, err
 	}
-
-	return &fileSnapshot{file: tmpFile}, nil
+	return &storeSnapshot{view: f.store.OpenSnapshot(f.compress)}, nil
 }
 
-// Restore reads a snapshot (stream of KVPair JSON lines) and restores them into the store.
+// Restore replaces the store's contents with the snapshot, so keys deleted
+// since this replica's state was taken do not linger. Both the binary format
+// and the older JSON-lines snapshots are accepted.
+//
+// The applied index that came with the snapshot is left out: it belongs to
+// the log the snapshot was taken from, which for a restored backup is not
+// this one. The restore drops this store's own index with everything else,
+// so from the moment the old data goes until the next entry is applied the
+// store claims nothing, and a restart, even one after a crash part way
+// through, restores the snapshot again.
 func (f *fsm) Restore(rc io.ReadCloser) error {
 	defer rc.Close()
-	// Use store.Import to write key/value pairs into DB
-	if err := f.store.Import(rc); err != nil {
+	f.cutMu.Lock()
+	err := f.store.RestoreExcept(rc, appliedMeta)
+	f.cutMu.Unlock()
+	if err != nil {
 		return err
 	}
-	// small delay to ensure writes persisted
-	time.Sleep(10 * time.Millisecond)
+	f.skipThrough = 0
+	// the snapshot may hold cuts its replica had not finished
+	f.kickCuts()
+	if err := f.reloadOwnership(); err != nil {
+		return err
+	}
+	f.table.Store(nil)
+	// watchers cannot follow a wholesale state change event by event
+	if f.hub != nil {
+		f.hub.Reset()
+	}
+	f.placementChanged()
 	return nil
 }
 
-// fileSnapshot implements raft.FSMSnapshot by streaming a file.
-type fileSnapshot struct {
-	file *os.File
+// storeSnapshot implements raft.FSMSnapshot by dumping a store view.
+type storeSnapshot struct {
+	view *store.SnapshotView
 }
 
-func (s *fileSnapshot) Persist(sink raft.SnapshotSink) error {
-	defer func() {
-		_ = s.file.Close()
-	}()
-	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+func (s *storeSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := s.view.WriteTo(sink); err != nil {
 		_ = sink.Cancel()
 		return err
 	}
-
-	buf := make([]byte, 64*1024)
-	for {
-		n, rerr := s.file.Read(buf)
-		if n > 0 {
-			if _, werr := sink.Write(buf[:n]); werr != nil {
-				_ = sink.Cancel()
-				return werr
-			}
-		}
-		if rerr != nil {
-			if rerr == io.EOF {
-				break
-			}
-			_ = sink.Cancel()
-			return rerr
-		}
-	}
-	if err := sink.Close(); err != nil {
-		return err
-	}
-	_ = os.Remove(s.file.Name())
-	return nil
+	return sink.Close()
 }
 
-func (s *fileSnapshot) Release() {}
+func (s *storeSnapshot) Release() {
+	s.view.Close()
+}
@@ -0,0 +1,192 @@
+package raftnode
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	raft "github.com/hashicorp/raft"
+	"github.com/sada-02/keyper/store"
+)
+
+// testRaft starts a raft instance over an in-memory transport and log, with
+// the real FSM on a Badger store.
+func testRaft(t testing.TB, id string, s *store.BadgerStore) (*raft.Raft, *raft.InmemTransport) {
+	t.Helper()
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(id)
+	conf.HeartbeatTimeout = 100 * time.Millisecond
+	conf.ElectionTimeout = 100 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	// drop the whole log on snapshot so a new follower must be sent the snapshot
+	conf.TrailingLogs = 0
+	conf.LogOutput = io.Discard
+
+	_, trans := raft.NewInmemTransport(raft.ServerAddress(id))
+	logs := raft.NewInmemStore()
+	r, err := raft.NewRaft(conf, NewFSM(s, nil, false), logs, logs, raft.NewInmemSnapshotStore(), trans)
+	if err != nil {
+		t.Fatalf("new raft %s: %v", id, err)
+	}
+	t.Cleanup(func() { _ = r.Shutdown().Error() })
+	return r, trans
+}
+
+func apply(t testing.TB, r *raft.Raft, cmd Command) {
+	t.Helper()
+	b, _ := json.Marshal(cmd)
+	f := r.Apply(b, 5*time.Second)
+	if err := f.Error(); err != nil {
+		t.Fatalf("apply %s %s: %v", cmd.Op, cmd.Key, err)
+	}
+	if err, ok := f.Response().(error); ok {
+		t.Fatalf("apply %s %s: %v", cmd.Op, cmd.Key, err)
+	}
+}
+
+func TestFSMSkipsAppliedEntriesOnRestart(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dkvs_test_fsm_applied_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	defer os.RemoveAll(dir)
+	s, err := store.NewBadgerStore(dir)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer s.Close()
+
+	entry := func(index uint64, value string) *raft.Log {
+		b, _ := json.Marshal(Command{Op: "set", Key: "k", Value: []byte(value)})
+		return &raft.Log{Index: index, Type: raft.LogCommand, Data: b}
+	}
+	get := func() string {
+		t.Helper()
+		v, err := s.Get([]byte("k"))
+		if err != nil {
+			t.Fatalf("get k: %v", err)
+		}
+		return string(v)
+	}
+
+	f := NewFSM(s, nil, false)
+	f.Apply(entry(1, "one"))
+	f.Apply(entry(2, "two"))
+	if got, _ := AppliedIndex(s); got != 2 {
+		t.Fatalf("applied index %d, want 2", got)
+	}
+
+	// a restarted node replays its log from the start
+	f = NewFSM(s, nil, false)
+	f.Apply(entry(1, "one"))
+	if got := get(); got != "two" {
+		t.Fatalf("replayed entry was applied again: k = %q", got)
+	}
+	f.Apply(entry(2, "two"))
+	f.Apply(entry(3, "three"))
+	if got := get(); got != "three" {
+		t.Fatalf("new entry was not applied: k = %q", got)
+	}
+	if got, _ := AppliedIndex(s); got != 3 {
+		t.Fatalf("applied index %d, want 3", got)
+	}
+
+	// a restored snapshot comes with no index of its own, and holds the
+	// state from when it was taken, not from when it was persisted
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	f.Apply(entry(4, "four"))
+	snaps := raft.NewInmemSnapshotStore()
+	sink, err := snaps.Create(raft.SnapshotVersionMax, 3, 1, raft.Configuration{}, 1, nil)
+	if err != nil {
+		t.Fatalf("create snapshot: %v", err)
+	}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("persist: %v", err)
+	}
+	snap.Release()
+	_, rc, err := snaps.Open(sink.ID())
+	if err != nil {
+		t.Fatalf("open snapshot: %v", err)
+	}
+	if err := f.Restore(rc); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if got := get(); got != "three" {
+		t.Fatalf("restored k = %q, want the snapshot's three", got)
+	}
+	if got, _ := AppliedIndex(s); got != 0 {
+		t.Fatalf("applied index after restore %d, want 0", got)
+	}
+	f.Apply(entry(1, "one"))
+	if got := get(); got != "one" {
+		t.Fatalf("entry after restore was skipped: k = %q", got)
+	}
+}
+
+func TestFSMRestoreDropsStaleKeys(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "dkvs_test_fsm_restore_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	defer os.RemoveAll(base)
+
+	leaderStore, err := store.NewBadgerStore(filepath.Join(base, "a"))
+	if err != nil {
+		t.Fatalf("open store a: %v", err)
+	}
+	defer leaderStore.Close()
+	followerStore, err := store.NewBadgerStore(filepath.Join(base, "b"))
+	if err != nil {
+		t.Fatalf("open store b: %v", err)
+	}
+	defer followerStore.Close()
+
+	// the follower holds state the leader has since deleted
+	if err := followerStore.Set([]byte("gone"), []byte("old")); err != nil {
+		t.Fatalf("seed follower: %v", err)
+	}
+
+	a, transA := testRaft(t, "a", leaderStore)
+	b, transB := testRaft(t, "b", followerStore)
+	transA.Connect(transB.LocalAddr(), transB)
+	transB.Connect(transA.LocalAddr(), transA)
+
+	boot := raft.Configuration{Servers: []raft.Server{{ID: "a", Address: transA.LocalAddr()}}}
+	if err := a.BootstrapCluster(boot).Error(); err != nil {
+		t.Fatalf("bootstrap: %v", err)
+	}
+	select {
+	case <-a.LeaderCh():
+	case <-time.After(5 * time.Second):
+		t.Fatal("no leader")
+	}
+
+	apply(t, a, Command{Op: "set", Key: "gone", Value: []byte("v")})
+	apply(t, a, Command{Op: "delete", Key: "gone"})
+	apply(t, a, Command{Op: "set", Key: "keep", Value: []byte("v")})
+	if err := a.Snapshot().Error(); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+
+	if err := a.AddVoter("b", transB.LocalAddr(), 0, 5*time.Second).Error(); err != nil {
+		t.Fatalf("add voter: %v", err)
+	}
+
+	// catching up must go through InstallSnapshot: the leader has no log left
+	deadline := time.Now().Add(5 * time.Second)
+	for b.Stats()["last_snapshot_index"] == "0" || b.AppliedIndex() < a.AppliedIndex() {
+		if time.Now().After(deadline) {
+			t.Fatalf("follower did not install the snapshot: %v", b.Stats())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, err := followerStore.Get([]byte("keep")); err != nil {
+		t.Fatalf("follower never received keep: %v", err)
+	}
+	if _, err := followerStore.Get([]byte("gone")); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected stale key to be gone after InstallSnapshot, got %v", err)
+	}
+}
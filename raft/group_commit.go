@@ -0,0 +1,240 @@
+package raftnode
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	raft "github.com/hashicorp/raft"
+)
+
+// GroupCommit configures the coalescing of concurrent commands into a single
+// Raft log entry. While one group is being committed, commands that arrive
+// queue up and go out together in the next entry, so under load many writers
+// share one Apply, one log write and one Badger fsync. An idle node commits a
+// lone command straight away unless Window is set.
+type GroupCommit struct {
+	MaxBatch int           // most commands per entry; <= 1 disables grouping
+	Window   time.Duration // extra time to wait for more commands once one arrives
+}
+
+// groupable reports whether cmd may share a log entry with others. Batches
+// are already amortised and stay in their own entry.
+func groupable(cmd *Command) bool {
+	switch cmd.Op {
+	case "set", "delete", "txn":
+		return true
+	}
+	return false
+}
+
+// commandKeys lists every key cmd reads or writes.
+func commandKeys(cmd *Command) []string {
+	if cmd.Op != "txn" || cmd.Txn == nil {
+		return []string{cmd.Key}
+	}
+	keys := make([]string, 0, len(cmd.Txn.Guards)+len(cmd.Txn.Success)+len(cmd.Txn.Failure))
+	for _, g := range cmd.Txn.Guards {
+		keys = append(keys, g.Key)
+	}
+	for _, op := range cmd.Txn.Success {
+		keys = append(keys, op.Key)
+	}
+	for _, op := range cmd.Txn.Failure {
+		keys = append(keys, op.Key)
+	}
+	return keys
+}
+
+// pendingCommand is one caller waiting in the coalescer.
+type pendingCommand struct {
+	cmd     *Command
+	keys    []string
+	timeout time.Duration
+	done    chan applyOutcome // buffered; receives exactly one outcome
+}
+
+type applyOutcome struct {
+	res *ApplyResult
+	err error
+}
+
+// coalescer gathers commands submitted concurrently and commits them as one
+// "group" entry, then hands every caller its own response.
+type coalescer struct {
+	raft *raft.Raft
+	cfg  GroupCommit
+	reqs chan *pendingCommand
+
+	quit     chan struct{} // closed by stop
+	quitOnce sync.Once
+	stopped  chan struct{} // closed when run returns
+}
+
+func newCoalescer(r *raft.Raft, cfg GroupCommit) *coalescer {
+	c := &coalescer{
+		raft:    r,
+		cfg:     cfg,
+		reqs:    make(chan *pendingCommand, cfg.MaxBatch),
+		quit:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// stop ends the coalescer once the group being committed, if any, is done.
+// Commands submitted afterwards, or left queued, fail with ErrRaftShutdown.
+func (c *coalescer) stop() {
+	c.quitOnce.Do(func() { close(c.quit) })
+	<-c.stopped
+}
+
+// submit queues cmd and waits for its outcome. Like raft.Apply, timeout only
+// bounds how long the command may wait to be enqueued.
+func (c *coalescer) submit(cmd *Command, timeout time.Duration) (*ApplyResult, error) {
+	p := &pendingCommand{cmd: cmd, keys: commandKeys(cmd), timeout: timeout, done: make(chan applyOutcome, 1)}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case c.reqs <- p:
+	case <-expired:
+		return nil, raft.ErrEnqueueTimeout
+	case <-c.quit:
+		return nil, raft.ErrRaftShutdown
+	}
+	select {
+	case out := <-p.done:
+		return out.res, out.err
+	case <-c.stopped:
+		// run may have committed p on its way out
+		select {
+		case out := <-p.done:
+			return out.res, out.err
+		default:
+			return nil, raft.ErrRaftShutdown
+		}
+	}
+}
+
+func (c *coalescer) run() {
+	defer close(c.stopped)
+	var carry *pendingCommand
+	for {
+		first := carry
+		carry = nil
+		if first == nil {
+			select {
+			case first = <-c.reqs:
+			case <-c.quit:
+				return
+			}
+		}
+		group := []*pendingCommand{first}
+		keys := make(map[string]struct{})
+		for _, k := range first.keys {
+			keys[k] = struct{}{}
+		}
+
+		var window <-chan time.Time
+		var timer *time.Timer
+		if c.cfg.Window > 0 {
+			timer = time.NewTimer(c.cfg.Window)
+			window = timer.C
+		}
+	collect:
+		for len(group) < c.cfg.MaxBatch {
+			var p *pendingCommand
+			select {
+			case p = <-c.reqs:
+			default:
+				if window == nil {
+					break collect
+				}
+				select {
+				case p = <-c.reqs:
+				case <-window:
+					break collect
+				}
+			}
+			// Two writes to one key in one entry would share a version;
+			// start the next group with this command instead.
+			if overlaps(keys, p.keys) {
+				carry = p
+				break
+			}
+			for _, k := range p.keys {
+				keys[k] = struct{}{}
+			}
+			group = append(group, p)
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		// Committing synchronously is what makes this a group commit:
+		// everything that arrives meanwhile goes out in the next entry.
+		c.commit(group)
+	}
+}
+
+func overlaps(keys map[string]struct{}, more []string) bool {
+	for _, k := range more {
+		if _, ok := keys[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// commit applies the group as one entry (a lone command is sent as itself)
+// and delivers each caller's response.
+func (c *coalescer) commit(group []*pendingCommand) {
+	fail := func(err error) {
+		for _, p := range group {
+			p.done <- applyOutcome{err: err}
+		}
+	}
+
+	cmd := group[0].cmd
+	timeout := group[0].timeout
+	if len(group) > 1 {
+		cmd = &Command{Op: "group", Group: make([]Command, len(group))}
+		for i, p := range group {
+			cmd.Group[i] = *p.cmd
+			if p.timeout > timeout {
+				timeout = p.timeout
+			}
+		}
+	}
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		fail(err)
+		return
+	}
+	f := c.raft.Apply(b, timeout)
+	if err := f.Error(); err != nil {
+		fail(err)
+		return
+	}
+
+	if len(group) == 1 {
+		res, err := applyResult(f.Index(), f.Response())
+		group[0].done <- applyOutcome{res: res, err: err}
+		return
+	}
+	responses, ok := f.Response().([]interface{})
+	if !ok || len(responses) != len(group) {
+		fail(fmt.Errorf("unexpected group response %T", f.Response()))
+		return
+	}
+	for i, p := range group {
+		res, err := applyResult(f.Index(), responses[i])
+		p.done <- applyOutcome{res: res, err: err}
+	}
+}
@@ -0,0 +1,221 @@
+package raftnode
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+	raft "github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb"
+)
+
+// logStore is what a Node keeps its Raft log and stable state in.
+type logStore interface {
+	raft.LogStore
+	raft.StableStore
+	Close() error
+}
+
+// The keys raft keeps in its StableStore (unexported in hashicorp/raft).
+var (
+	stableUint64Keys = [][]byte{[]byte("CurrentTerm"), []byte("LastVoteTerm")}
+	stableBytesKeys  = [][]byte{[]byte("LastVoteCand")}
+)
+
+// logStorePath is where a log store of the given kind lives in raftDir.
+func logStorePath(raftDir, kind string) string {
+	if kind == LogStoreBadger {
+		return filepath.Join(raftDir, "log")
+	}
+	return filepath.Join(raftDir, "raft.db")
+}
+
+// otherLogStore is the kind of log store that is not kind.
+func otherLogStore(kind string) string {
+	if kind == LogStoreBadger {
+		return LogStoreBolt
+	}
+	return LogStoreBadger
+}
+
+// detectLogStore reports which kind of log store raftDir holds, or "".
+// Run finishMigration first, or a migration cut short at its last step
+// leaves nothing to find.
+func detectLogStore(raftDir string) string {
+	for _, kind := range []string{LogStoreBolt, LogStoreBadger} {
+		if _, err := os.Stat(logStorePath(raftDir, kind)); err == nil {
+			return kind
+		}
+	}
+	return ""
+}
+
+// openLogStore opens the log store of the given kind in raftDir. If the
+// directory only holds the other kind, its log and stable state are first
+// copied into a new store of this kind, and once the copy is complete the
+// old one is renamed with a .migrated suffix and the new one moved into
+// place.
+func openLogStore(raftDir, kind string) (logStore, error) {
+	switch kind {
+	case "":
+		kind = LogStoreBolt
+	case LogStoreBolt, LogStoreBadger:
+	default:
+		return nil, fmt.Errorf("unknown log store %q (want %s or %s)", kind, LogStoreBolt, LogStoreBadger)
+	}
+	if err := finishMigration(raftDir); err != nil {
+		return nil, err
+	}
+	path := logStorePath(raftDir, kind)
+	// a migration that did not finish copying is started over
+	_ = os.RemoveAll(path + ".migrating")
+
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		other := otherLogStore(kind)
+		if _, err := os.Stat(logStorePath(raftDir, other)); err == nil {
+			if err := migrateLogStore(raftDir, other, kind); err != nil {
+				return nil, fmt.Errorf("migrate raft log from %s to %s: %w", other, kind, err)
+			}
+		}
+	}
+	return openLogStoreAt(path, kind)
+}
+
+func openLogStoreAt(path, kind string) (logStore, error) {
+	if kind == LogStoreBadger {
+		s, err := NewBadgerLogStore(path)
+		if err != nil {
+			return nil, fmt.Errorf("badger log store: %w", err)
+		}
+		return s, nil
+	}
+	// bolt waits forever for its file lock unless told otherwise
+	s, err := raftboltdb.New(raftboltdb.Options{
+		Path:        path,
+		BoltOptions: &bolt.Options{Timeout: time.Second},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bolt store: %w", err)
+	}
+	return s, nil
+}
+
+func migrateLogStore(raftDir, from, to string) error {
+	start := time.Now()
+	src, err := openLogStoreAt(logStorePath(raftDir, from), from)
+	if err != nil {
+		return err
+	}
+	tmp := logStorePath(raftDir, to) + ".migrating"
+	dst, err := openLogStoreAt(tmp, to)
+	if err != nil {
+		_ = src.Close()
+		return err
+	}
+	n, err := copyLogStore(dst, src)
+	for _, s := range []logStore{dst, src} {
+		if cerr := s.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		_ = os.RemoveAll(tmp)
+		return err
+	}
+	// Setting the old store aside commits the migration: from then on the
+	// copy is the log, and finishMigration moves it into place should the
+	// last rename not happen.
+	old := logStorePath(raftDir, from)
+	_ = os.RemoveAll(old + ".migrated")
+	if err := os.Rename(old, old+".migrated"); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, logStorePath(raftDir, to)); err != nil {
+		return err
+	}
+	log.Printf("raft: migrated %d log entries from %s to %s in %s; the old store is kept as %s.migrated",
+		n, from, to, time.Since(start).Round(time.Millisecond), filepath.Base(old))
+	return nil
+}
+
+// finishMigration moves a complete migrated copy into place. A copy is
+// complete once the store it was made from has been set aside, so a
+// .migrating store is only moved when neither kind of log store remains.
+func finishMigration(raftDir string) error {
+	for _, kind := range []string{LogStoreBolt, LogStoreBadger} {
+		path := logStorePath(raftDir, kind)
+		if _, err := os.Stat(path + ".migrating"); err != nil {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if _, err := os.Stat(logStorePath(raftDir, otherLogStore(kind))); err == nil {
+			continue
+		}
+		if err := os.Rename(path+".migrating", path); err != nil {
+			return fmt.Errorf("finish migration to %s: %w", kind, err)
+		}
+		log.Printf("raft: finished a migration to the %s log store that was cut short", kind)
+	}
+	return nil
+}
+
+// copyLogStore copies every log entry and raft's stable keys from src to
+// dst and returns the number of entries copied.
+func copyLogStore(dst, src logStore) (int, error) {
+	first, err := src.FirstIndex()
+	if err != nil {
+		return 0, err
+	}
+	last, err := src.LastIndex()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	if last > 0 {
+		batch := make([]*raft.Log, 0, 256)
+		for i := first; i <= last; i++ {
+			l := new(raft.Log)
+			if err := src.GetLog(i, l); err != nil {
+				return n, fmt.Errorf("read log %d: %w", i, err)
+			}
+			batch = append(batch, l)
+			if len(batch) == cap(batch) || i == last {
+				if err := dst.StoreLogs(batch); err != nil {
+					return n, err
+				}
+				n += len(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+
+	for _, k := range stableUint64Keys {
+		v, err := src.GetUint64(k)
+		if err != nil && err.Error() != errKeyNotFound.Error() {
+			return n, err
+		}
+		if err == nil {
+			if err := dst.SetUint64(k, v); err != nil {
+				return n, err
+			}
+		}
+	}
+	for _, k := range stableBytesKeys {
+		v, err := src.Get(k)
+		if err != nil && err.Error() != errKeyNotFound.Error() {
+			return n, err
+		}
+		if err == nil {
+			if err := dst.Set(k, v); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
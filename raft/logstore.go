@@ -0,0 +1,376 @@
+package raftnode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	raft "github.com/hashicorp/raft"
+)
+
+// Log store backends, chosen by RaftConfig.LogStore.
+const (
+	LogStoreBolt   = "bolt"   // raft-boltdb in raft/raft.db (the default)
+	LogStoreBadger = "badger" // BadgerLogStore in raft/log/
+)
+
+// errKeyNotFound is what raft expects from a StableStore for a missing key;
+// it compares the message, not the value.
+var errKeyNotFound = errors.New("not found")
+
+var (
+	logPrefix    = []byte("l") // + 8-byte big-endian index
+	stablePrefix = []byte("s") // + key
+)
+
+const (
+	logEncodingV1 = 1
+
+	// logGCInterval is how often the value log is checked for space freed
+	// by DeleteRange.
+	logGCInterval = 5 * time.Minute
+)
+
+// logDeleteChunk is how many entries DeleteRange deletes per commit.
+var logDeleteChunk = 4096
+
+// BadgerLogStore is a raft.LogStore and raft.StableStore kept in a Badger
+// DB of its own. Unlike raft-boltdb, whose file never shrinks, the space of
+// compacted log entries is reclaimed by Badger's compactions and value log
+// GC. It must not share a DB with the FSM, whose Restore drops everything.
+type BadgerLogStore struct {
+	db   *badger.DB
+	stop chan struct{}
+	done chan struct{}
+
+	// first and last index, cached: finding them takes an iterator
+	mu          sync.Mutex
+	first, last uint64
+}
+
+// NewBadgerLogStore opens or creates a log store in dir.
+func NewBadgerLogStore(dir string) (*BadgerLogStore, error) {
+	opts := badger.DefaultOptions(dir)
+	opts.Logger = nil
+	opts.SyncWrites = true
+	// the log is small next to the data; keep its memory footprint small too
+	opts.MemTableSize = 16 << 20
+	opts.BlockCacheSize = 32 << 20
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	s := &BadgerLogStore{db: db, stop: make(chan struct{}), done: make(chan struct{})}
+	if err := s.loadBounds(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	go s.gcLoop()
+	return s, nil
+}
+
+// Close stops value log GC and closes the DB.
+func (s *BadgerLogStore) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.db.Close()
+}
+
+func (s *BadgerLogStore) gcLoop() {
+	defer close(s.done)
+	t := time.NewTicker(logGCInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			// each successful run rewrites one file; go until nothing is left
+			for s.db.RunValueLogGC(0.5) == nil {
+			}
+		}
+	}
+}
+
+func logKey(index uint64) []byte {
+	k := make([]byte, len(logPrefix)+8)
+	copy(k, logPrefix)
+	binary.BigEndian.PutUint64(k[len(logPrefix):], index)
+	return k
+}
+
+// FirstIndex returns the first index written, or 0 for an empty log.
+func (s *BadgerLogStore) FirstIndex() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.first, nil
+}
+
+// LastIndex returns the last index written, or 0 for an empty log.
+func (s *BadgerLogStore) LastIndex() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last, nil
+}
+
+// loadBounds reads the first and last index from the DB; callers other
+// than the constructor hold mu.
+func (s *BadgerLogStore) loadBounds() error {
+	first, err := s.edgeIndex(false)
+	if err != nil {
+		return err
+	}
+	last, err := s.edgeIndex(true)
+	if err != nil {
+		return err
+	}
+	s.first, s.last = first, last
+	return nil
+}
+
+func (s *BadgerLogStore) edgeIndex(last bool) (uint64, error) {
+	var idx uint64
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Reverse = last
+		opts.Prefix = logPrefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		if last {
+			it.Seek(logKey(^uint64(0)))
+		} else {
+			it.Rewind()
+		}
+		if it.Valid() {
+			idx = binary.BigEndian.Uint64(it.Item().Key()[len(logPrefix):])
+		}
+		return nil
+	})
+	return idx, err
+}
+
+// GetLog reads the entry at index into out.
+func (s *BadgerLogStore) GetLog(index uint64, out *raft.Log) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(logKey(index))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return raft.ErrLogNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			out.Index = index
+			return decodeLog(v, out)
+		})
+	})
+}
+
+// StoreLog stores one entry.
+func (s *BadgerLogStore) StoreLog(l *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{l})
+}
+
+// StoreLogs stores entries in one transaction, or in order across several
+// if they do not fit in one; a crash then leaves a prefix, which raft
+// handles like any shorter log.
+func (s *BadgerLogStore) StoreLogs(logs []*raft.Log) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.storeLogs(logs); err != nil {
+		// part of the batch may be on disk
+		_ = s.loadBounds()
+		return err
+	}
+	for _, l := range logs {
+		if s.first == 0 || l.Index < s.first {
+			s.first = l.Index
+		}
+		if l.Index > s.last {
+			s.last = l.Index
+		}
+	}
+	return nil
+}
+
+func (s *BadgerLogStore) storeLogs(logs []*raft.Log) error {
+	txn := s.db.NewTransaction(true)
+	defer func() { txn.Discard() }()
+	for _, l := range logs {
+		k, v := logKey(l.Index), encodeLog(l)
+		err := txn.Set(k, v)
+		if errors.Is(err, badger.ErrTxnTooBig) {
+			if err = txn.Commit(); err != nil {
+				return err
+			}
+			txn = s.db.NewTransaction(true)
+			err = txn.Set(k, v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+// DeleteRange deletes the entries from min to max, inclusive. Large ranges
+// span several commits, made one after the other in order: compaction, which
+// starts at the first index, deletes upwards and truncation of the tail
+// downwards, so whatever a crash leaves behind is still a contiguous log.
+func (s *BadgerLogStore) DeleteRange(min, max uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer func() { _ = s.loadBounds() }()
+	var keys [][]byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = logPrefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		end := logKey(max)
+		for it.Seek(logKey(min)); it.Valid(); it.Next() {
+			k := it.Item().KeyCopy(nil)
+			if bytes.Compare(k, end) > 0 {
+				break
+			}
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if min > s.first {
+		slices.Reverse(keys)
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > logDeleteChunk {
+			n = logDeleteChunk
+		}
+		err := s.db.Update(func(txn *badger.Txn) error {
+			for _, k := range keys[:n] {
+				if err := txn.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// Set stores a stable key.
+func (s *BadgerLogStore) Set(key, val []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(append(append([]byte{}, stablePrefix...), key...), val)
+	})
+}
+
+// Get reads a stable key; a missing key is an error, as raft expects.
+func (s *BadgerLogStore) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append(append([]byte{}, stablePrefix...), key...))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return errKeyNotFound
+		}
+		if err != nil {
+			return err
+		}
+		val, err = item.ValueCopy(nil)
+		return err
+	})
+	return val, err
+}
+
+// SetUint64 stores a stable key holding a number.
+func (s *BadgerLogStore) SetUint64(key []byte, val uint64) error {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], val)
+	return s.Set(key, b[:])
+}
+
+// GetUint64 reads a stable key holding a number.
+func (s *BadgerLogStore) GetUint64(key []byte) (uint64, error) {
+	b, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 8 {
+		return 0, fmt.Errorf("stable key %q: want 8 bytes, got %d", key, len(b))
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// encodeLog lays an entry out as: version, term, type, appended-at (unix
+// nanoseconds, 0 when unset), then data and extensions, each prefixed with
+// its length as a uvarint. The index is the key.
+func encodeLog(l *raft.Log) []byte {
+	b := make([]byte, 0, 1+8+1+8+2*binary.MaxVarintLen64+len(l.Data)+len(l.Extensions))
+	b = append(b, logEncodingV1)
+	b = binary.BigEndian.AppendUint64(b, l.Term)
+	b = append(b, byte(l.Type))
+	var at int64
+	if !l.AppendedAt.IsZero() {
+		at = l.AppendedAt.UnixNano()
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(at))
+	b = binary.AppendUvarint(b, uint64(len(l.Data)))
+	b = append(b, l.Data...)
+	b = binary.AppendUvarint(b, uint64(len(l.Extensions)))
+	b = append(b, l.Extensions...)
+	return b
+}
+
+func decodeLog(b []byte, l *raft.Log) error {
+	if len(b) < 18 || b[0] != logEncodingV1 {
+		return errors.New("corrupt log entry")
+	}
+	l.Term = binary.BigEndian.Uint64(b[1:9])
+	l.Type = raft.LogType(b[9])
+	l.AppendedAt = time.Time{}
+	if at := int64(binary.BigEndian.Uint64(b[10:18])); at != 0 {
+		l.AppendedAt = time.Unix(0, at)
+	}
+	b = b[18:]
+	var err error
+	if l.Data, b, err = readBytes(b); err != nil {
+		return err
+	}
+	if l.Extensions, _, err = readBytes(b); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readBytes reads a uvarint length and that many bytes, copied out of b
+// (Badger's value buffer is only valid inside the transaction).
+func readBytes(b []byte) ([]byte, []byte, error) {
+	n, w := binary.Uvarint(b)
+	if w <= 0 || uint64(len(b)-w) < n {
+		return nil, nil, errors.New("corrupt log entry")
+	}
+	b = b[w:]
+	if n == 0 {
+		return nil, b, nil
+	}
+	return append([]byte(nil), b[:n]...), b[n:], nil
+}
+
+// BadgerLogStore stands in for raft-boltdb's BoltStore
+var (
+	_ raft.LogStore    = (*BadgerLogStore)(nil)
+	_ raft.StableStore = (*BadgerLogStore)(nil)
+)
@@ -0,0 +1,78 @@
+package raftnode
+
+import (
+	"os"
+	"testing"
+
+	raft "github.com/hashicorp/raft"
+	raftbench "github.com/hashicorp/raft/bench"
+)
+
+// Compare the log stores with raft's own store benchmarks:
+//
+//	go test -run '^$' -bench LogStore ./raft/
+func benchLogStores(b *testing.B, run func(*testing.B, logStore)) {
+	for _, kind := range []string{LogStoreBolt, LogStoreBadger} {
+		b.Run(kind, func(b *testing.B) {
+			if raceEnabled && kind == LogStoreBolt {
+				b.Skip("boltdb/bolt fails checkptr under -race")
+			}
+			dir := testLogDir(b, "logbench")
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				b.Fatal(err)
+			}
+			s, err := openLogStore(dir, kind)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer s.Close()
+			run(b, s)
+		})
+	}
+}
+
+func BenchmarkLogStoreFirstIndex(b *testing.B) {
+	benchLogStores(b, func(b *testing.B, s logStore) { raftbench.FirstIndex(b, s) })
+}
+
+func BenchmarkLogStoreLastIndex(b *testing.B) {
+	benchLogStores(b, func(b *testing.B, s logStore) { raftbench.LastIndex(b, s) })
+}
+
+func BenchmarkLogStoreGetLog(b *testing.B) {
+	benchLogStores(b, func(b *testing.B, s logStore) { raftbench.GetLog(b, s) })
+}
+
+func BenchmarkLogStoreStoreLog(b *testing.B) {
+	benchLogStores(b, func(b *testing.B, s logStore) { raftbench.StoreLog(b, s) })
+}
+
+func BenchmarkLogStoreStoreLogs(b *testing.B) {
+	benchLogStores(b, func(b *testing.B, s logStore) { raftbench.StoreLogs(b, s) })
+}
+
+func BenchmarkLogStoreDeleteRange(b *testing.B) {
+	benchLogStores(b, func(b *testing.B, s logStore) { raftbench.DeleteRange(b, s) })
+}
+
+func BenchmarkLogStoreSetUint64(b *testing.B) {
+	benchLogStores(b, func(b *testing.B, s logStore) { raftbench.SetUint64(b, s) })
+}
+
+// a 64-entry batch of 1 KiB commands, the shape of a busy leader's append
+func BenchmarkLogStoreAppendBatch(b *testing.B) {
+	benchLogStores(b, func(b *testing.B, s logStore) {
+		data := make([]byte, 1024)
+		batch := make([]*raft.Log, 64)
+		b.SetBytes(int64(len(batch) * len(data)))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for j := range batch {
+				batch[j] = &raft.Log{Index: uint64(i*len(batch) + j + 1), Term: 1, Data: data}
+			}
+			if err := s.StoreLogs(batch); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
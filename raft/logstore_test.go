@@ -0,0 +1,210 @@
+package raftnode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/dgraph-io/badger/v4"
+	raft "github.com/hashicorp/raft"
+)
+
+func testLogDir(t testing.TB, name string) string {
+	dir := filepath.Join(os.TempDir(), "dkvs_test_"+name+"_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func testLogs(from, to uint64) []*raft.Log {
+	var logs []*raft.Log
+	for i := from; i <= to; i++ {
+		logs = append(logs, &raft.Log{Index: i, Term: 1 + i/10, Type: raft.LogCommand, Data: []byte("cmd-" + strconv.FormatUint(i, 10))})
+	}
+	return logs
+}
+
+func TestBadgerLogStore(t *testing.T) {
+	s, err := NewBadgerLogStore(testLogDir(t, "logstore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if first, _ := s.FirstIndex(); first != 0 {
+		t.Fatalf("empty store: first index %d", first)
+	}
+	if err := s.StoreLogs(testLogs(1, 30)); err != nil {
+		t.Fatal(err)
+	}
+	var l raft.Log
+	if err := s.GetLog(17, &l); err != nil {
+		t.Fatal(err)
+	}
+	if l.Index != 17 || l.Term != 2 || l.Type != raft.LogCommand || string(l.Data) != "cmd-17" {
+		t.Fatalf("got %+v", l)
+	}
+
+	// compaction from the front, truncation from the back
+	if err := s.DeleteRange(1, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteRange(26, 30); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := s.FirstIndex()
+	last, _ := s.LastIndex()
+	if first != 11 || last != 25 {
+		t.Fatalf("after delete: first %d last %d, want 11 and 25", first, last)
+	}
+	if err := s.GetLog(5, &l); err != raft.ErrLogNotFound {
+		t.Fatalf("deleted log: got %v", err)
+	}
+
+	// raft tells a missing stable key by the message
+	if _, err := s.GetUint64([]byte("CurrentTerm")); err == nil || err.Error() != "not found" {
+		t.Fatalf("missing key: got %v", err)
+	}
+	if err := s.SetUint64([]byte("CurrentTerm"), 7); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.GetUint64([]byte("CurrentTerm")); err != nil || v != 7 {
+		t.Fatalf("got %d, %v", v, err)
+	}
+}
+
+// TestBadgerLogStoreDeleteRangeContiguous watches the log on disk while
+// large ranges are deleted over many commits: at every point it must still
+// be one run of indexes, or a crash there would leave a hole in the log.
+func TestBadgerLogStoreDeleteRangeContiguous(t *testing.T) {
+	s, err := NewBadgerLogStore(testLogDir(t, "logstore_delete"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	defer func(n int) { logDeleteChunk = n }(logDeleteChunk)
+	logDeleteChunk = 10
+
+	if err := s.StoreLogs(testLogs(1, 3000)); err != nil {
+		t.Fatal(err)
+	}
+	contiguous := func() (first, last uint64, ok bool) {
+		ok = true
+		_ = s.db.View(func(txn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			opts.Prefix = logPrefix
+			it := txn.NewIterator(opts)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				i := binary.BigEndian.Uint64(it.Item().Key()[len(logPrefix):])
+				if first == 0 {
+					first = i
+				} else if i != last+1 {
+					ok = false
+				}
+				last = i
+			}
+			return nil
+		})
+		return first, last, ok
+	}
+
+	// compaction from the front, then truncation from the back
+	for _, r := range [][2]uint64{{1, 1500}, {2001, 3000}} {
+		done := make(chan error, 1)
+		go func() { done <- s.DeleteRange(r[0], r[1]) }()
+		for running := true; running; {
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+				running = false
+			default:
+			}
+			if first, last, ok := contiguous(); !ok {
+				t.Fatalf("deleting %d-%d left a hole between %d and %d", r[0], r[1], first, last)
+			}
+		}
+	}
+	if first, last, _ := contiguous(); first != 1501 || last != 2000 {
+		t.Fatalf("after deletes: first %d last %d, want 1501 and 2000", first, last)
+	}
+}
+
+func TestLogStoreMigration(t *testing.T) {
+	if raceEnabled {
+		t.Skip("boltdb/bolt fails checkptr under -race")
+	}
+	raftDir := testLogDir(t, "logmigrate")
+	if err := os.MkdirAll(raftDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	bolt, err := openLogStore(raftDir, LogStoreBolt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bolt.StoreLogs(testLogs(5, 600)); err != nil {
+		t.Fatal(err)
+	}
+	_ = bolt.SetUint64([]byte("CurrentTerm"), 9)
+	_ = bolt.Set([]byte("LastVoteCand"), []byte("n2"))
+	_ = bolt.Close()
+
+	check := func(s logStore) {
+		t.Helper()
+		first, _ := s.FirstIndex()
+		last, _ := s.LastIndex()
+		if first != 5 || last != 600 {
+			t.Fatalf("first %d last %d, want 5 and 600", first, last)
+		}
+		var l raft.Log
+		if err := s.GetLog(333, &l); err != nil || string(l.Data) != "cmd-333" {
+			t.Fatalf("log 333: %+v, %v", l, err)
+		}
+		if term, _ := s.GetUint64([]byte("CurrentTerm")); term != 9 {
+			t.Fatalf("current term %d", term)
+		}
+		if cand, _ := s.Get([]byte("LastVoteCand")); !bytes.Equal(cand, []byte("n2")) {
+			t.Fatalf("last vote candidate %q", cand)
+		}
+	}
+
+	// bolt to badger, and back again
+	for _, kind := range []string{LogStoreBadger, LogStoreBolt} {
+		s, err := openLogStore(raftDir, kind)
+		if err != nil {
+			t.Fatalf("open %s: %v", kind, err)
+		}
+		check(s)
+		_ = s.Close()
+		if got := detectLogStore(raftDir); got != kind {
+			t.Fatalf("after migrating to %s the dir holds %q", kind, got)
+		}
+	}
+
+	// a migration to badger that stopped after setting the bolt store aside
+	badgerPath, boltPath := logStorePath(raftDir, LogStoreBadger), logStorePath(raftDir, LogStoreBolt)
+	if err := os.Rename(badgerPath+".migrated", badgerPath+".migrating"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(boltPath, boltPath+".migrated"); err != nil {
+		t.Fatal(err)
+	}
+	if err := finishMigration(raftDir); err != nil {
+		t.Fatalf("finish migration: %v", err)
+	}
+	if got := detectLogStore(raftDir); got != LogStoreBadger {
+		t.Fatalf("after finishing the migration the dir holds %q", got)
+	}
+	s, err := openLogStore(raftDir, LogStoreBadger)
+	if err != nil {
+		t.Fatalf("open badger: %v", err)
+	}
+	check(s)
+	_ = s.Close()
+}
@@ -0,0 +1,200 @@
+package raftnode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	raft "github.com/hashicorp/raft"
+	"github.com/sada-02/keyper/store"
+)
+
+// memberPrefix names the metadata entries that make up the membership table.
+const memberPrefix = "members/"
+
+// Member is a node's entry in the replicated membership table. Raft itself
+// only knows each server's Raft address; the table adds the HTTP URL clients
+// and peers should use to reach it.
+type Member struct {
+	ID       string `json:"id"`
+	RaftAddr string `json:"raft_addr"`
+	HTTPAddr string `json:"http_addr"`
+}
+
+func (f *fsm) applyMember(m *Member, index uint64) interface{} {
+	if m == nil || m.ID == "" {
+		_ = f.markApplied(index)
+		return errors.New("member failed: missing id")
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("member failed: %w", err)
+	}
+	if err := f.update(index, func(tx *store.Tx) error {
+		return tx.SetMeta(memberPrefix+m.ID, b)
+	}); err != nil {
+		return fmt.Errorf("member failed: %w", err)
+	}
+	return nil
+}
+
+func (f *fsm) removeMember(m *Member, index uint64) interface{} {
+	if m == nil || m.ID == "" {
+		_ = f.markApplied(index)
+		return errors.New("member-remove failed: missing id")
+	}
+	if err := f.update(index, func(tx *store.Tx) error {
+		return tx.DeleteMeta(memberPrefix + m.ID)
+	}); err != nil {
+		return fmt.Errorf("member-remove failed: %w", err)
+	}
+	return nil
+}
+
+// Members returns the membership table as applied on this node, ordered by
+// ID. It may lag the leader's view like any other local read.
+func (n *Node) Members() ([]Member, error) {
+	entries, err := n.store.ListMeta(memberPrefix)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Member, 0, len(entries))
+	for name, b := range entries {
+		var m Member
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("decode member %s: %w", name, err)
+		}
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+// Member looks up one node in the membership table. Returns store.ErrNotFound
+// if the node never registered.
+func (n *Node) Member(id string) (*Member, error) {
+	b, err := n.store.GetMeta(memberPrefix + id)
+	if err != nil {
+		return nil, err
+	}
+	var m Member
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("decode member %s: %w", id, err)
+	}
+	return &m, nil
+}
+
+// RegisterMember records m in the membership table. Only the leader can
+// apply it.
+func (n *Node) RegisterMember(m Member, timeout time.Duration) error {
+	return n.ApplyCommand(&Command{Op: "member", Member: &m}, timeout)
+}
+
+// RemoveServer removes a node from the Raft configuration and then drops its
+// membership record. The record is only cosmetic once the node is out of the
+// configuration, so failing to drop it (say, because the leader removed
+// itself and shut down) is not an error. It works on a draining node, so a
+// node can leave the cluster on its way down.
+func (n *Node) RemoveServer(id string, timeout time.Duration) error {
+	if err := n.Raft.RemoveServer(raft.ServerID(id), 0, timeout).Error(); err != nil {
+		return err
+	}
+	_, err := n.apply(&Command{Op: "member-remove", Member: &Member{ID: id}}, timeout)
+	switch {
+	case err == nil, errors.Is(err, raft.ErrNotLeader), errors.Is(err, raft.ErrLeadershipLost),
+		errors.Is(err, raft.ErrRaftShutdown):
+	default:
+		log.Printf("drop member record %s: %v", id, err)
+	}
+	return nil
+}
+
+// ErrLearnerBehind is returned by Promote for a learner whose applied index
+// trails the leader's by more than allowed; it can be retried later.
+var ErrLearnerBehind = errors.New("learner has not caught up")
+
+// ErrNotMember is returned by Promote for a server not in the configuration.
+var ErrNotMember = errors.New("no such member")
+
+// Promote makes learner id a voter, provided applied, the learner's own
+// applied index, is within maxLag entries of this node's, so the new voter
+// takes part in commits straight away instead of stalling quorum while it
+// replays the log. A voter is left as it is. The configuration change is
+// conditional on the configuration the check was made against, so a
+// concurrent change fails it rather than being overwritten. Only the
+// leader can promote.
+func (n *Node) Promote(id string, applied, maxLag uint64, timeout time.Duration) error {
+	fut := n.Raft.GetConfiguration()
+	if err := fut.Error(); err != nil {
+		return err
+	}
+	for _, srv := range fut.Configuration().Servers {
+		if string(srv.ID) != id {
+			continue
+		}
+		if srv.Suffrage == raft.Voter {
+			return nil
+		}
+		if own := n.Raft.AppliedIndex(); applied+maxLag < own {
+			return fmt.Errorf("%w: %d entries behind the leader (max_lag %d)", ErrLearnerBehind, own-applied, maxLag)
+		}
+		return n.Raft.AddVoter(srv.ID, srv.Address, fut.Index(), timeout).Error()
+	}
+	return fmt.Errorf("%w: %s", ErrNotMember, id)
+}
+
+// LeaderHTTP returns the advertised HTTP URL of the current leader, or "" if
+// there is no leader or it has not registered one.
+func (n *Node) LeaderHTTP() string {
+	_, id := n.Raft.LeaderWithID()
+	if id == "" {
+		return ""
+	}
+	if string(id) == n.ID && n.HTTPAddr != "" {
+		return n.HTTPAddr
+	}
+	m, err := n.Member(string(id))
+	if err != nil {
+		return ""
+	}
+	return m.HTTPAddr
+}
+
+// watchLeadership keeps this node's own membership record current: whenever
+// it wins an election it registers its advertised addresses, which covers
+// the bootstrap node (it never joins anyone) and nodes restarted with new
+// addresses.
+func (n *Node) watchLeadership() {
+	ch := make(chan raft.Observation, 4)
+	n.Raft.RegisterObserver(raft.NewObserver(ch, false, func(o *raft.Observation) bool {
+		_, ok := o.Data.(raft.LeaderObservation)
+		return ok
+	}))
+	go func() {
+		for o := range ch {
+			lo := o.Data.(raft.LeaderObservation)
+			if string(lo.LeaderID) == n.ID {
+				go n.registerSelf()
+			}
+		}
+	}()
+}
+
+func (n *Node) registerSelf() {
+	self := Member{ID: n.ID, RaftAddr: n.Addr, HTTPAddr: n.HTTPAddr}
+	if cur, err := n.Member(n.ID); err == nil && *cur == self {
+		return
+	} else if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Printf("read own member record: %v", err)
+	}
+	// the new leader may still be catching up on the previous term
+	if err := n.Raft.Barrier(10 * time.Second).Error(); err != nil {
+		return
+	}
+	if err := n.RegisterMember(self, 10*time.Second); err != nil && !errors.Is(err, raft.ErrNotLeader) {
+		log.Printf("register member %s: %v", n.ID, err)
+	}
+}
@@ -0,0 +1,96 @@
+package raftnode
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	raft "github.com/hashicorp/raft"
+	"github.com/sada-02/keyper/store"
+)
+
+// suffrage returns id's suffrage in n's configuration, or -1 if it has none.
+func suffrage(t *testing.T, n *Node, id string) raft.ServerSuffrage {
+	t.Helper()
+	fut := n.Raft.GetConfiguration()
+	if err := fut.Error(); err != nil {
+		t.Fatalf("configuration: %v", err)
+	}
+	for _, srv := range fut.Configuration().Servers {
+		if string(srv.ID) == id {
+			return srv.Suffrage
+		}
+	}
+	return -1
+}
+
+// TestPromoteLearner adds a learner, cuts it off while the leader moves on
+// and checks that it is refused promotion until it has caught up again.
+func TestPromoteLearner(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "dkvs_test_promote_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	defer os.RemoveAll(base)
+	sa, err := store.NewBadgerStore(filepath.Join(base, "a"))
+	if err != nil {
+		t.Fatalf("open store a: %v", err)
+	}
+	defer sa.Close()
+	sb, err := store.NewBadgerStore(filepath.Join(base, "b"))
+	if err != nil {
+		t.Fatalf("open store b: %v", err)
+	}
+	defer sb.Close()
+
+	leader, transA := testLeader(t, sa, GroupCommit{})
+	rb, transB := testRaft(t, "b", sb)
+	transA.Connect(transB.LocalAddr(), transB)
+	transB.Connect(transA.LocalAddr(), transA)
+	if err := leader.AddNonvoter("b", string(transB.LocalAddr()), 5*time.Second); err != nil {
+		t.Fatalf("add nonvoter: %v", err)
+	}
+	if s := suffrage(t, leader, "b"); s != raft.Nonvoter {
+		t.Fatalf("b joined as %v, want a nonvoter", s)
+	}
+	caughtUp := func() {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for rb.AppliedIndex() < leader.Raft.AppliedIndex() {
+			if time.Now().After(deadline) {
+				t.Fatal("learner did not catch up")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	apply(t, leader.Raft, Command{Op: "set", Key: "k", Value: []byte("v")})
+	caughtUp()
+
+	// cut off, the learner falls behind while the leader goes on alone
+	transA.Disconnect(transB.LocalAddr())
+	for i := 0; i < 10; i++ {
+		apply(t, leader.Raft, Command{Op: "set", Key: "k" + strconv.Itoa(i), Value: []byte("v")})
+	}
+	if err := leader.Promote("b", rb.AppliedIndex(), 5, 5*time.Second); !errors.Is(err, ErrLearnerBehind) {
+		t.Fatalf("promote of a lagging learner: got %v, want ErrLearnerBehind", err)
+	}
+	if s := suffrage(t, leader, "b"); s != raft.Nonvoter {
+		t.Fatalf("refused learner is now a %v", s)
+	}
+
+	transA.Connect(transB.LocalAddr(), transB)
+	caughtUp()
+	if err := leader.Promote("b", rb.AppliedIndex(), 5, 5*time.Second); err != nil {
+		t.Fatalf("promote of a caught-up learner: %v", err)
+	}
+	if s := suffrage(t, leader, "b"); s != raft.Voter {
+		t.Fatalf("promoted learner is a %v, want a voter", s)
+	}
+	// promoting a voter again does nothing
+	if err := leader.Promote("b", 0, 0, 5*time.Second); err != nil {
+		t.Fatalf("promote of a voter: %v", err)
+	}
+	if err := leader.Promote("c", 0, 0, 5*time.Second); !errors.Is(err, ErrNotMember) {
+		t.Fatalf("promote of an unknown server: got %v, want ErrNotMember", err)
+	}
+}
@@ -5,30 +5,123 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	raft "github.com/hashicorp/raft"
-	"github.com/hashicorp/raft-boltdb"
 	"github.com/sada-02/keyper/store"
+	"github.com/sada-02/keyper/watch"
 )
 
 // Node wraps the raft instance and provides helpers.
 type Node struct {
 	Raft *raft.Raft
 	// ID and Addr are for info
-	ID   string
-	Addr string // raft bind address
+	ID       string
+	Addr     string // advertised raft address
+	HTTPAddr string // advertised HTTP URL, recorded in the membership table
+
+	store     *store.BadgerStore
+	snapshots raft.SnapshotStore
+	logs      logStore
+	placement <-chan struct{} // see PlacementChanged
+	fsm       *fsm
+
+	group *coalescer // nil when group commit is disabled
+
+	// drainMu is held shared by every Apply and exclusively by Drain, which
+	// uses it to wait out in-flight writes before setting draining.
+	drainMu  sync.RWMutex
+	draining bool
+
+	// lease state for LeaseRead
+	leaseMu      sync.Mutex
+	leaseTimeout time.Duration
+	leaseTerm    uint64
+	leaseUntil   time.Time
 }
 
 // RaftConfig contains parameters for starting a node.
 type RaftConfig struct {
 	NodeID   string
-	RaftAddr string // host:port for Raft transport
+	RaftAddr string // host:port the Raft transport binds to
+	// RaftAdvertise is the host:port other nodes dial to reach this one;
+	// defaults to RaftAddr. It must be routable when RaftAddr is 0.0.0.0.
+	RaftAdvertise string
+	// HTTPAddr is this node's advertised HTTP URL. The leader records it in
+	// the replicated membership table so redirects can name a real URL.
+	HTTPAddr string
 	DataDir  string // base data dir - we will create DataDir/raft
 	Store    *store.BadgerStore
-	JoinAddr string // if non-empty, perform join flow (call via HTTP to leader)
+	JoinAddr string     // if non-empty, perform join flow (call via HTTP to leader)
+	Watch    *watch.Hub // optional; receives committed changes for watchers
+
+	CompressSnapshots bool // gzip FSM snapshots (smaller, slower to take)
+
+	// CutDir is where the FSM writes the keys a "cut" hands on to another
+	// shard; shard groups set it, the main group has no use for it.
+	CutDir string
+
+	// LogStore picks where the Raft log lives: LogStoreBolt (the default)
+	// or LogStoreBadger. Switching migrates the existing log on start.
+	LogStore string
+
+	// GroupCommit coalesces concurrent commands into one log entry; the
+	// zero value disables it.
+	GroupCommit GroupCommit
+
+	// Tuning overrides Raft timing, snapshot and transport settings.
+	Tuning Tuning
+}
+
+// Tuning holds the Raft knobs operators may change. Zero fields keep the
+// defaults: hashicorp/raft's DefaultConfig, one retained snapshot, and a
+// pool of 3 connections per peer with a 10s I/O timeout.
+type Tuning struct {
+	HeartbeatTimeout   time.Duration
+	ElectionTimeout    time.Duration
+	LeaderLeaseTimeout time.Duration
+	CommitTimeout      time.Duration
+	SnapshotInterval   time.Duration // how often to check whether to snapshot
+	SnapshotThreshold  uint64        // log entries since the last snapshot before taking one
+	TrailingLogs       uint64        // log entries kept after a snapshot
+	MaxAppendEntries   int           // entries per AppendEntries RPC
+	SnapshotRetain     int           // snapshots kept on disk
+	MaxPool            int           // pooled connections per peer
+	TransportTimeout   time.Duration // I/O deadline for transport RPCs
+}
+
+// apply copies the non-zero fields of t into conf. A zero field cannot ask
+// for a zero setting; callers that take these from users must reject zero.
+func (t Tuning) apply(conf *raft.Config) {
+	if t.HeartbeatTimeout > 0 {
+		conf.HeartbeatTimeout = t.HeartbeatTimeout
+	}
+	if t.ElectionTimeout > 0 {
+		conf.ElectionTimeout = t.ElectionTimeout
+	}
+	if t.LeaderLeaseTimeout > 0 {
+		conf.LeaderLeaseTimeout = t.LeaderLeaseTimeout
+	}
+	if t.CommitTimeout > 0 {
+		conf.CommitTimeout = t.CommitTimeout
+	}
+	if t.SnapshotInterval > 0 {
+		conf.SnapshotInterval = t.SnapshotInterval
+	}
+	if t.SnapshotThreshold > 0 {
+		conf.SnapshotThreshold = t.SnapshotThreshold
+	}
+	if t.TrailingLogs > 0 {
+		conf.TrailingLogs = t.TrailingLogs
+	}
+	if t.MaxAppendEntries > 0 {
+		conf.MaxAppendEntries = t.MaxAppendEntries
+	}
 }
 
 // NewNode starts and returns a configured Raft node. If joinAddr is empty,
@@ -42,43 +135,95 @@ func NewNode(cfg *RaftConfig) (*Node, error) {
 	// Raft config
 	rconf := raft.DefaultConfig()
 	rconf.LocalID = raft.ServerID(cfg.NodeID)
+	cfg.Tuning.apply(rconf)
+	if err := raft.ValidateConfig(rconf); err != nil {
+		return nil, fmt.Errorf("raft config: %w", err)
+	}
 
 	// Create snapshot store (files)
-	snapshots, err := raft.NewFileSnapshotStore(raftDir, 1, os.Stderr)
+	retain := cfg.Tuning.SnapshotRetain
+	if retain <= 0 {
+		retain = 1
+	}
+	snapshots, err := raft.NewFileSnapshotStore(raftDir, retain, os.Stderr)
 	if err != nil {
 		return nil, fmt.Errorf("file snapshot store: %w", err)
 	}
 
-	// Create the BoltDB-backed stores for stable store and log store
-	boltDBPath := filepath.Join(raftDir, "raft.db")
-	boltStore, err := raftboltdb.NewBoltStore(boltDBPath)
+	// One store holds both the log and raft's stable state
+	logs, err := openLogStore(raftDir, cfg.LogStore)
 	if err != nil {
-		return nil, fmt.Errorf("bolt store: %w", err)
+		return nil, err
 	}
 
-	// Use boltStore for both stable and log store
-	logStore := boltStore
-	stableStore := boltStore
+	// The store records the last entry it applied, so when it already holds
+	// what the latest snapshot does, restoring that snapshot would only wind
+	// the store back for the log to replay; raft starts after the snapshot
+	// and the FSM skips entries the store already has.
+	applied, err := AppliedIndex(cfg.Store)
+	if err != nil {
+		log.Printf("raft: read applied index: %v", err)
+	}
+	if covered, err := storeCoversSnapshot(applied, snapshots, logs); err != nil {
+		log.Printf("raft: check snapshot against store: %v", err)
+	} else if covered {
+		rconf.NoSnapshotRestoreOnStart = true
+		log.Printf("raft: store is applied through index %d; not restoring the snapshot on start", applied)
+	}
 
 	// Transport
-	transport, err := raft.NewTCPTransport(cfg.RaftAddr, nil, 3, 10*time.Second, os.Stderr)
+	advertise := cfg.RaftAdvertise
+	if advertise == "" {
+		advertise = cfg.RaftAddr
+	}
+	advAddr, err := net.ResolveTCPAddr("tcp", advertise)
 	if err != nil {
+		_ = logs.Close()
+		return nil, fmt.Errorf("raft advertise address: %w", err)
+	}
+	maxPool, ioTimeout := cfg.Tuning.MaxPool, cfg.Tuning.TransportTimeout
+	if maxPool <= 0 {
+		maxPool = 3
+	}
+	if ioTimeout <= 0 {
+		ioTimeout = 10 * time.Second
+	}
+	transport, err := raft.NewTCPTransport(cfg.RaftAddr, advAddr, maxPool, ioTimeout, os.Stderr)
+	if err != nil {
+		_ = logs.Close()
 		return nil, fmt.Errorf("tcp transport: %w", err)
 	}
 
 	// FSM
-	f := NewFSM(cfg.Store)
+	f := newFSM(cfg.Store, cfg.Watch, cfg.CompressSnapshots)
+	f.cutDir = cfg.CutDir
 
 	// Instantiate Raft
-	r, err := raft.NewRaft(rconf, f, logStore, stableStore, snapshots, transport)
+	r, err := raft.NewRaft(rconf, f, logs, logs, snapshots, transport)
 	if err != nil {
+		_ = transport.Close()
+		_ = logs.Close()
 		return nil, fmt.Errorf("create raft: %w", err)
 	}
 
 	node := &Node{
-		Raft: r,
-		ID:   cfg.NodeID,
-		Addr: cfg.RaftAddr,
+		Raft:      r,
+		ID:        cfg.NodeID,
+		Addr:      advertise,
+		HTTPAddr:  cfg.HTTPAddr,
+		store:     cfg.Store,
+		snapshots: snapshots,
+		logs:      logs,
+		placement: f.placement,
+		fsm:       f,
+
+		leaseTimeout: rconf.LeaderLeaseTimeout,
+	}
+	if cfg.GroupCommit.MaxBatch > 1 {
+		node.group = newCoalescer(r, cfg.GroupCommit)
+	}
+	if node.HTTPAddr != "" {
+		node.watchLeadership()
 	}
 
 	// Bootstrap single-node if join address not provided and no existing state
@@ -109,7 +254,7 @@ func NewNode(cfg *RaftConfig) (*Node, error) {
 			Servers: []raft.Server{
 				{
 					ID:      raft.ServerID(cfg.NodeID),
-					Address: raft.ServerAddress(cfg.RaftAddr),
+					Address: raft.ServerAddress(advertise),
 				},
 			},
 		}
@@ -119,34 +264,90 @@ func NewNode(cfg *RaftConfig) (*Node, error) {
 		}
 	}
 
+	if f.cutDir != "" {
+		f.startCuts()
+	}
 	// If join address present, caller is expected to call join endpoint on existing cluster.
 	return node, nil
 }
 
+// Shutdown stops Raft and closes its log store, which releases the lock on
+// raft.db. The FSM's store is left to the caller.
+func (n *Node) Shutdown() error {
+	err := n.Raft.Shutdown().Error()
+	if n.group != nil {
+		n.group.stop()
+	}
+	if n.fsm != nil {
+		n.fsm.stopCuts()
+	}
+	if n.logs != nil {
+		if cerr := n.logs.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
 // Leader returns the current leader address (raft.ServerAddress -> string), or empty string.
 func (n *Node) Leader() string {
 	return string(n.Raft.Leader())
 }
 
+// ApplyResult is the outcome of a command committed through Raft.
+type ApplyResult struct {
+	Index    uint64      // log index the command was committed at
+	Response interface{} // non-error value returned by FSM.Apply, if any
+}
+
 // ApplyCommand marshals command and applies via Raft, returning error or nil.
 // It waits up to timeout for apply to complete.
 func (n *Node) ApplyCommand(cmd *Command, timeout time.Duration) error {
+	_, err := n.Apply(cmd, timeout)
+	return err
+}
+
+// Apply is ApplyCommand for callers that need the commit index (the version
+// of the keys written) or the FSM's response. With group commit enabled,
+// set, delete and txn commands may share their log entry with others that
+// were submitted concurrently; each caller still gets its own response.
+func (n *Node) Apply(cmd *Command, timeout time.Duration) (*ApplyResult, error) {
+	n.drainMu.RLock()
+	defer n.drainMu.RUnlock()
+	if n.draining {
+		return nil, ErrDraining
+	}
+	return n.apply(cmd, timeout)
+}
+
+// apply is Apply without the drain gate, for the node's own bookkeeping
+// while it drains.
+func (n *Node) apply(cmd *Command, timeout time.Duration) (*ApplyResult, error) {
+	if n.group != nil && groupable(cmd) {
+		return n.group.submit(cmd, timeout)
+	}
 	b, err := json.Marshal(cmd)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	f := n.Raft.Apply(b, timeout)
 	if err := f.Error(); err != nil {
-		return err
+		return nil, err
 	}
-	// result may be error returned by FSM.Apply
-	if res := f.Response(); res != nil {
-		// if FSM.Apply returned an error, it will be available here
-		if ferr, ok := res.(error); ok {
-			return ferr
+	return applyResult(f.Index(), f.Response())
+}
+
+// applyResult turns an FSM response into an ApplyResult, or into an error
+// if FSM.Apply returned one.
+func applyResult(index uint64, out interface{}) (*ApplyResult, error) {
+	res := &ApplyResult{Index: index}
+	if out != nil {
+		if ferr, ok := out.(error); ok {
+			return nil, ferr
 		}
+		res.Response = out
 	}
-	return nil
+	return res, nil
 }
 
 // Join logic (helper) — for simplicity, we perform an HTTP POST to /v1/join on the joinAddr
@@ -158,6 +359,14 @@ func (n *Node) AddVoter(nodeID, addr string, timeout time.Duration) error {
 	return f.Error()
 }
 
+// AddNonvoter adds a learner: it receives the log but does not vote or count
+// towards quorum, so it can catch up (or serve stale reads) without affecting
+// availability. AddVoter later promotes it.
+func (n *Node) AddNonvoter(nodeID, addr string, timeout time.Duration) error {
+	f := n.Raft.AddNonvoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, timeout)
+	return f.Error()
+}
+
 // Snapshot reader helper — not used externally
 func readAll(r io.Reader) ([]byte, error) {
 	buf := new(bytes.Buffer)
@@ -0,0 +1,344 @@
+package raftnode
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sada-02/keyper/shard"
+	"github.com/sada-02/keyper/store"
+)
+
+const (
+	// placementPrefix names the metadata entries of the shard placement
+	// table, one per shard.
+	placementPrefix = "shards/"
+	// placementVersionMeta holds the log index of the table's last change.
+	placementVersionMeta = "shards-version"
+)
+
+// ShardPlacement is a shard's entry in the replicated placement table.
+type ShardPlacement struct {
+	ID       string   `json:"id"`
+	Replicas []string `json:"replicas"`         // IDs of the nodes hosting a replica
+	Leader   string   `json:"leader,omitempty"` // node whose replica leads the shard, as last reported
+
+	// Bootstrap is the node that founded the shard's Raft group. Only it
+	// bootstraps the group; every other replica waits to be added.
+	Bootstrap string `json:"bootstrap,omitempty"`
+
+	// Move is the last replica move of the shard, in progress or not.
+	Move *ShardMove `json:"move,omitempty"`
+
+	// Range is the part of the key space the shard owns; nil means its
+	// initial range (see KeyRange). Reshard is the last split or merge that
+	// changed it, in progress or not.
+	Range   *shard.Range `json:"range,omitempty"`
+	Reshard *Reshard     `json:"reshard,omitempty"`
+}
+
+// KeyRange returns the range the shard owns: Range, or for a shard that
+// has never been split or merged its initial range out of count.
+func (s *ShardPlacement) KeyRange(count int) shard.Range {
+	if s.Range != nil {
+		return *s.Range
+	}
+	n, _ := strconv.Atoi(s.ID)
+	return shard.Initial(n, count)
+}
+
+// Phases of a shard move, in order; a move ends in MoveDone or MoveFailed.
+const (
+	MoveAddLearner   = "adding-learner"  // the target replica starts and joins as a learner
+	MoveCatchUp      = "catching-up"     // the learner catches up through snapshot and log
+	MovePromote      = "promoting"       // the learner becomes a voter
+	MoveRemoveSource = "removing-source" // the source replica leaves the group
+	MoveDone         = "done"            // the target replaces the source; the source tears down
+	MoveFailed       = "failed"
+)
+
+// ShardMove records the progress of moving a shard's replica off one node
+// and onto another.
+type ShardMove struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Phase string `json:"phase"`
+	Error string `json:"error,omitempty"` // why a failed move stopped
+}
+
+// Active reports whether the move is still in progress.
+func (m *ShardMove) Active() bool {
+	return m != nil && m.Phase != MoveDone && m.Phase != MoveFailed
+}
+
+// Hosts reports whether node should run a replica of the shard: it is one
+// of the replicas, or the target of a move in progress.
+func (s *ShardPlacement) Hosts(node string) bool {
+	return s.HasReplica(node) || (s.Move.Active() && s.Move.To == node)
+}
+
+// Placement is the whole placement table. Version is the log index of its
+// last change, so a client holding a copy can tell whether it is current.
+type Placement struct {
+	Version uint64           `json:"version"`
+	Shards  []ShardPlacement `json:"shards"`
+}
+
+// Locate returns the entry of the shard that owns key, or nil; count is the
+// number of shards the cluster started with.
+func (p *Placement) Locate(key string, count int) *ShardPlacement {
+	for i := range p.Shards {
+		if r := p.Shards[i].KeyRange(count); r.Contains(key) {
+			return &p.Shards[i]
+		}
+	}
+	return nil
+}
+
+// Shard returns the entry for shard id, or nil.
+func (p *Placement) Shard(id string) *ShardPlacement {
+	for i := range p.Shards {
+		if p.Shards[i].ID == id {
+			return &p.Shards[i]
+		}
+	}
+	return nil
+}
+
+// HasReplica reports whether node hosts a replica of the shard.
+func (s *ShardPlacement) HasReplica(node string) bool {
+	for _, r := range s.Replicas {
+		if r == node {
+			return true
+		}
+	}
+	return false
+}
+
+// applyShardAssign sets the replicas of a shard. The reported leader is kept
+// while it is still a replica; the founder is set once, when the shard is
+// first placed.
+func (f *fsm) applyShardAssign(p *ShardPlacement, index uint64) interface{} {
+	if p == nil || p.ID == "" || len(p.Replicas) == 0 {
+		_ = f.markApplied(index)
+		return errors.New("shard-assign failed: missing shard id or replicas")
+	}
+	err := f.update(index, func(tx *store.Tx) error {
+		next := ShardPlacement{ID: p.ID, Replicas: p.Replicas, Bootstrap: p.Bootstrap}
+		cur, err := shardEntry(tx, p.ID)
+		if err != nil {
+			return err
+		}
+		if cur != nil {
+			next.Bootstrap = cur.Bootstrap
+			next.Move, next.Range, next.Reshard = cur.Move, cur.Range, cur.Reshard
+			if next.HasReplica(cur.Leader) {
+				next.Leader = cur.Leader
+			}
+		}
+		return putShardEntry(tx, &next, index)
+	})
+	if err != nil {
+		return fmt.Errorf("shard-assign failed: %w", err)
+	}
+	f.placementChanged()
+	return nil
+}
+
+// applyShardLeader records which replica leads a shard. Reports for unknown
+// shards, or from nodes that no longer host one, are stale and ignored.
+func (f *fsm) applyShardLeader(p *ShardPlacement, index uint64) interface{} {
+	if p == nil || p.ID == "" || p.Leader == "" {
+		_ = f.markApplied(index)
+		return errors.New("shard-leader failed: missing shard id or leader")
+	}
+	changed := false
+	err := f.update(index, func(tx *store.Tx) error {
+		cur, err := shardEntry(tx, p.ID)
+		if err != nil || cur == nil || !cur.HasReplica(p.Leader) || cur.Leader == p.Leader {
+			return err
+		}
+		cur.Leader = p.Leader
+		changed = true
+		return putShardEntry(tx, cur, index)
+	})
+	if err != nil {
+		return fmt.Errorf("shard-leader failed: %w", err)
+	}
+	if changed {
+		f.placementChanged()
+	}
+	return nil
+}
+
+// applyShardMove starts a replica move, advances its phase or ends it. A move
+// starts only when none is in progress, from a replica to a node that is
+// not one; ending it in MoveDone swaps the target in for the source.
+func (f *fsm) applyShardMove(p *ShardPlacement, index uint64) interface{} {
+	if p == nil || p.ID == "" || p.Move == nil {
+		_ = f.markApplied(index)
+		return errors.New("shard-move failed: missing shard id or move")
+	}
+	err := f.update(index, func(tx *store.Tx) error {
+		cur, err := shardEntry(tx, p.ID)
+		if err != nil {
+			return err
+		}
+		if cur == nil {
+			return fmt.Errorf("no shard %s", p.ID)
+		}
+		m := *p.Move
+		switch {
+		case m.Phase == MoveAddLearner:
+			if cur.Move.Active() {
+				return fmt.Errorf("shard %s is already moving from %s to %s", p.ID, cur.Move.From, cur.Move.To)
+			}
+			if cur.Reshard.Active() {
+				return fmt.Errorf("shard %s is being split or merged", p.ID)
+			}
+			if !cur.HasReplica(m.From) || cur.HasReplica(m.To) || m.From == m.To {
+				return fmt.Errorf("shard %s cannot move from %s to %s", p.ID, m.From, m.To)
+			}
+		case !cur.Move.Active() || cur.Move.From != m.From || cur.Move.To != m.To:
+			return fmt.Errorf("shard %s has no move from %s to %s in progress", p.ID, m.From, m.To)
+		case m.Phase == MoveDone:
+			for i, r := range cur.Replicas {
+				if r == m.From {
+					cur.Replicas[i] = m.To
+				}
+			}
+			if cur.Leader == m.From {
+				cur.Leader = ""
+			}
+			// the group outlives its founder; nobody may found it again
+			if cur.Bootstrap == m.From {
+				cur.Bootstrap = ""
+			}
+		}
+		cur.Move = &m
+		return putShardEntry(tx, cur, index)
+	})
+	if err != nil {
+		return fmt.Errorf("shard-move failed: %w", err)
+	}
+	f.placementChanged()
+	return nil
+}
+
+// placementChanged wakes whoever waits on Node.PlacementChanged.
+func (f *fsm) placementChanged() {
+	select {
+	case f.placement <- struct{}{}:
+	default:
+	}
+}
+
+func shardEntry(tx *store.Tx, id string) (*ShardPlacement, error) {
+	b, err := tx.GetMeta(placementPrefix + id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p ShardPlacement
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("decode shard %s: %w", id, err)
+	}
+	return &p, nil
+}
+
+func putShardEntry(tx *store.Tx, p *ShardPlacement, index uint64) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if err := tx.SetMeta(placementPrefix+p.ID, b); err != nil {
+		return err
+	}
+	return tx.SetMeta(placementVersionMeta, encodeIndex(index))
+}
+
+// Placement returns the placement table as applied on this node, ordered by
+// shard ID. Like Members it may lag the leader's view; Version tells. The
+// table is shared with other callers until it changes; do not modify it.
+func (n *Node) Placement() (*Placement, error) {
+	version, err := n.placementVersion()
+	if err != nil {
+		return nil, err
+	}
+	if p := n.fsm.table.Load(); p != nil && p.Version == version {
+		return p, nil
+	}
+	// the version is read before the entries, so a change landing between
+	// the two leaves a table that looks stale and is read again next time
+	entries, err := n.store.ListMeta(placementPrefix)
+	if err != nil {
+		return nil, err
+	}
+	p := &Placement{Version: version, Shards: make([]ShardPlacement, 0, len(entries))}
+	for name, b := range entries {
+		var s ShardPlacement
+		if err := json.Unmarshal(b, &s); err != nil {
+			return nil, fmt.Errorf("decode shard %s: %w", name, err)
+		}
+		p.Shards = append(p.Shards, s)
+	}
+	sort.Slice(p.Shards, func(i, j int) bool { return shardLess(p.Shards[i].ID, p.Shards[j].ID) })
+	n.fsm.table.Store(p)
+	return p, nil
+}
+
+func (n *Node) placementVersion() (uint64, error) {
+	b, err := n.store.GetMeta(placementVersionMeta)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return 0, err
+	}
+	if len(b) != 8 {
+		return 0, nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// shardLess orders numeric shard IDs numerically and the rest after them.
+func shardLess(a, b string) bool {
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		return na < nb
+	case errA == nil || errB == nil:
+		return errA == nil
+	}
+	return a < b
+}
+
+// AssignShard places replicas of shard id on the given nodes. bootstrap
+// names the node that founds the shard's Raft group; it only takes effect
+// when the shard is placed for the first time. Only the leader can apply it.
+func (n *Node) AssignShard(id string, replicas []string, bootstrap string, timeout time.Duration) error {
+	return n.ApplyCommand(&Command{Op: "shard-assign", Shard: &ShardPlacement{ID: id, Replicas: replicas, Bootstrap: bootstrap}}, timeout)
+}
+
+// ReportShardLeader records that node's replica leads shard id. Only the
+// leader can apply it.
+func (n *Node) ReportShardLeader(id, node string, timeout time.Duration) error {
+	return n.ApplyCommand(&Command{Op: "shard-leader", Shard: &ShardPlacement{ID: id, Leader: node}}, timeout)
+}
+
+// MoveShard starts the move m of a replica of shard id, or records its
+// progress. Only the leader can apply it.
+func (n *Node) MoveShard(id string, m ShardMove, timeout time.Duration) error {
+	return n.ApplyCommand(&Command{Op: "shard-move", Shard: &ShardPlacement{ID: id, Move: &m}}, timeout)
+}
+
+// PlacementChanged receives a value after the placement table changes on
+// this node, including when a snapshot is restored. Changes that land while
+// nobody is receiving are coalesced into one.
+func (n *Node) PlacementChanged() <-chan struct{} {
+	return n.placement
+}
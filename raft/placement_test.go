@@ -0,0 +1,93 @@
+package raftnode
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	raft "github.com/hashicorp/raft"
+	"github.com/sada-02/keyper/shard"
+	"github.com/sada-02/keyper/store"
+)
+
+func TestPlacementTable(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dkvs_test_placement_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	defer os.RemoveAll(dir)
+	s, err := store.NewBadgerStore(dir)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer s.Close()
+
+	f := newFSM(s, nil, false)
+	n := &Node{store: s, placement: f.placement, fsm: f}
+	index := uint64(0)
+	apply := func(cmd Command) interface{} {
+		index++
+		b, _ := json.Marshal(cmd)
+		return f.Apply(&raft.Log{Index: index, Type: raft.LogCommand, Data: b})
+	}
+	placement := func() *Placement {
+		t.Helper()
+		p, err := n.Placement()
+		if err != nil {
+			t.Fatalf("placement: %v", err)
+		}
+		return p
+	}
+
+	if p := placement(); p.Version != 0 || len(p.Shards) != 0 {
+		t.Fatalf("empty table: %+v", p)
+	}
+	apply(Command{Op: "shard-assign", Shard: &ShardPlacement{ID: "1", Replicas: []string{"a"}, Bootstrap: "a"}})
+	apply(Command{Op: "shard-assign", Shard: &ShardPlacement{ID: "0", Replicas: []string{"a"}, Bootstrap: "a"}})
+	select {
+	case <-n.PlacementChanged():
+	default:
+		t.Fatal("no change signalled")
+	}
+	apply(Command{Op: "shard-leader", Shard: &ShardPlacement{ID: "1", Leader: "a"}})
+	// the founder stays, and so does the leader while it is a replica
+	apply(Command{Op: "shard-assign", Shard: &ShardPlacement{ID: "1", Replicas: []string{"b", "a"}, Bootstrap: "b"}})
+
+	p := placement()
+	if p.Version != 4 || len(p.Shards) != 2 || p.Shards[0].ID != "0" {
+		t.Fatalf("got %+v", p)
+	}
+	if s := p.Shard("1"); s.Leader != "a" || s.Bootstrap != "a" || len(s.Replicas) != 2 {
+		t.Fatalf("shard 1: %+v", s)
+	}
+
+	// stale reports change nothing, not even the version
+	apply(Command{Op: "shard-leader", Shard: &ShardPlacement{ID: "1", Leader: "c"}})
+	apply(Command{Op: "shard-leader", Shard: &ShardPlacement{ID: "7", Leader: "a"}})
+	if p := placement(); p.Version != 4 || p.Shard("1").Leader != "a" {
+		t.Fatalf("after stale reports: %+v", p)
+	}
+
+	apply(Command{Op: "shard-assign", Shard: &ShardPlacement{ID: "1", Replicas: []string{"b"}}})
+	if p := placement(); p.Version != 7 || p.Shard("1").Leader != "" {
+		t.Fatalf("leader kept after losing its replica: %+v", p.Shard("1"))
+	}
+	if err, ok := apply(Command{Op: "shard-assign", Shard: &ShardPlacement{ID: "1"}}).(error); !ok {
+		t.Fatalf("assign without replicas: got %v", err)
+	}
+
+	// two splits started at once cannot both make the same shard
+	split := func(from, to string) interface{} {
+		r := &Reshard{Kind: ReshardSplit, From: []string{from}, To: to, Keep: &shard.Range{}, Phase: ReshardCutting}
+		return apply(Command{Op: "shard-reshard", Shard: &ShardPlacement{ID: to, Reshard: r}})
+	}
+	if res := split("0", "2"); res != nil {
+		t.Fatalf("split 0 into 2: %v", res)
+	}
+	if err, _ := split("1", "2").(error); !errors.Is(err, ErrShardTaken) {
+		t.Fatalf("second split into 2: got %v, want ErrShardTaken", err)
+	}
+	if res := split("1", "3"); res != nil {
+		t.Fatalf("split 1 into 3: %v", res)
+	}
+}
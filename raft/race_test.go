@@ -0,0 +1,7 @@
+//go:build race
+
+package raftnode
+
+// raceEnabled reports a -race build, which turns on checkptr; the
+// boltdb/bolt log store trips it, so tests that open raft.db skip.
+const raceEnabled = true
@@ -0,0 +1,73 @@
+package raftnode
+
+import (
+	"time"
+
+	raft "github.com/hashicorp/raft"
+)
+
+// LinearizableRead waits until every entry committed before the call has been
+// applied locally. Only the leader can do this; followers get raft.ErrNotLeader.
+func (n *Node) LinearizableRead(timeout time.Duration) error {
+	if n.Raft.State() != raft.Leader {
+		return raft.ErrNotLeader
+	}
+	// Barrier resolves once every preceding log entry has been applied to the FSM.
+	return n.Raft.Barrier(timeout).Error()
+}
+
+// LeaseRead is LinearizableRead without the per-read round trip: a Barrier
+// confirms leadership and catches the FSM up, and for the next lease period
+// (Raft's LeaderLeaseTimeout, which is never longer than the heartbeat
+// timeout followers wait before starting an election) reads are served
+// without one. The lease is dropped when the term changes. It relies on
+// clocks not drifting by more than the lease within one period.
+func (n *Node) LeaseRead(timeout time.Duration) error {
+	if n.Raft.State() != raft.Leader {
+		return raft.ErrNotLeader
+	}
+	term := n.Raft.CurrentTerm()
+	n.leaseMu.Lock()
+	valid := n.leaseTerm == term && time.Now().Before(n.leaseUntil)
+	n.leaseMu.Unlock()
+	if valid {
+		return nil
+	}
+
+	start := time.Now()
+	if err := n.Raft.Barrier(timeout).Error(); err != nil {
+		return err
+	}
+	// A quorum acknowledged this node as leader after start, so no one else
+	// can be elected before start plus the lease.
+	n.leaseMu.Lock()
+	if until := start.Add(n.leaseTimeout); term == n.Raft.CurrentTerm() && until.After(n.leaseUntil) {
+		n.leaseTerm = term
+		n.leaseUntil = until
+	}
+	n.leaseMu.Unlock()
+	return nil
+}
+
+// ReadLag reports how far local state may be behind the cluster: the number
+// of entries known to be committed but not yet applied here, and (on a
+// follower) the time since the leader was last heard from. The commit index
+// is the one last heard from the leader, so a follower that is far behind on
+// log replication underestimates its lag in entries; the staleness bound
+// covers that case.
+func (n *Node) ReadLag() (entries uint64, staleness time.Duration) {
+	commit, applied := n.Raft.CommitIndex(), n.Raft.AppliedIndex()
+	if commit > applied {
+		entries = commit - applied
+	}
+	switch n.Raft.State() {
+	case raft.Leader:
+		return entries, 0
+	case raft.Follower:
+		if last := n.Raft.LastContact(); !last.IsZero() {
+			return entries, time.Since(last)
+		}
+	}
+	// never heard from a leader (or mid-election): unbounded
+	return entries, time.Duration(1<<63 - 1)
+}
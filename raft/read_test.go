@@ -0,0 +1,67 @@
+package raftnode
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	raft "github.com/hashicorp/raft"
+	"github.com/sada-02/keyper/store"
+)
+
+func TestLeaseReadAndLag(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "dkvs_test_lease_read_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	defer os.RemoveAll(base)
+	sa, err := store.NewBadgerStore(filepath.Join(base, "a"))
+	if err != nil {
+		t.Fatalf("open store a: %v", err)
+	}
+	defer sa.Close()
+	sb, err := store.NewBadgerStore(filepath.Join(base, "b"))
+	if err != nil {
+		t.Fatalf("open store b: %v", err)
+	}
+	defer sb.Close()
+
+	leader, transA := testLeader(t, sa, GroupCommit{})
+	leader.leaseTimeout = time.Minute
+	rb, transB := testRaft(t, "b", sb)
+	transA.Connect(transB.LocalAddr(), transB)
+	transB.Connect(transA.LocalAddr(), transA)
+	follower := &Node{Raft: rb, ID: "b", leaseTimeout: time.Minute}
+	if err := leader.Raft.AddVoter("b", transB.LocalAddr(), 0, 5*time.Second).Error(); err != nil {
+		t.Fatalf("add voter: %v", err)
+	}
+	apply(t, leader.Raft, Command{Op: "set", Key: "k", Value: []byte("v")})
+
+	// the first lease read pays for a Barrier, the next ones do not
+	if err := leader.LeaseRead(5 * time.Second); err != nil {
+		t.Fatalf("lease read: %v", err)
+	}
+	last := leader.Raft.LastIndex()
+	if err := leader.LeaseRead(5 * time.Second); err != nil {
+		t.Fatalf("lease read: %v", err)
+	}
+	if leader.Raft.LastIndex() != last {
+		t.Fatalf("lease read within the lease appended to the log")
+	}
+
+	if err := follower.LeaseRead(time.Second); !errors.Is(err, raft.ErrNotLeader) {
+		t.Fatalf("expected ErrNotLeader on follower, got %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for rb.AppliedIndex() < leader.Raft.AppliedIndex() {
+		if time.Now().After(deadline) {
+			t.Fatal("follower did not catch up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	entries, staleness := follower.ReadLag()
+	if entries != 0 || staleness > time.Second {
+		t.Fatalf("caught-up follower reports lag of %d entries / %v", entries, staleness)
+	}
+}
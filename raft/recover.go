@@ -0,0 +1,167 @@
+package raftnode
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	raft "github.com/hashicorp/raft"
+	"github.com/sada-02/keyper/store"
+)
+
+// ErrNothingToRecover is returned by RecoverCluster when the data dir's
+// configuration already holds exactly the voters in the peers file, as it
+// does after an earlier recovery with the same file.
+var ErrNothingToRecover = errors.New("the peers file matches the current configuration; nothing to recover")
+
+// RecoverOptions controls RecoverCluster.
+type RecoverOptions struct {
+	NodeID    string // this node's ID; must be one of the peers
+	DataDir   string // the node's data dir, as passed to the server
+	PeersFile string // JSON list of surviving members: [{"id","address","non_voter"}]
+
+	// Force skips the check that a quorum of the old configuration is
+	// unreachable. Only for when the check itself is wrong (say, the old
+	// addresses were reused by unrelated services).
+	Force bool
+
+	// ProbeTimeout bounds each dial to an old voter; zero means one second.
+	ProbeTimeout time.Duration
+}
+
+// RecoverCluster rewrites the Raft configuration stored in a stopped node's
+// data dir so the node can start again after the cluster lost quorum. The
+// latest snapshot and the log are replayed into the FSM, snapshotted, and the
+// log is replaced by the configuration from the peers file; starting the node
+// normally afterwards resumes Raft with only those members.
+//
+// It refuses to run when it would do harm: while the server still holds the
+// data dir, when there is no Raft state, when this node is not a voter in the
+// peers file, when the peers file leaves the configuration unchanged, and
+// when a quorum of the current voters still answers on its Raft address (the
+// cluster is healthy and recovering would split it).
+func RecoverCluster(opts RecoverOptions) (*raft.Configuration, error) {
+	peers, err := raft.ReadConfigJSON(opts.PeersFile)
+	if err != nil {
+		return nil, fmt.Errorf("read peers file: %w", err)
+	}
+	isVoter := false
+	for _, srv := range peers.Servers {
+		if string(srv.ID) == opts.NodeID && srv.Suffrage == raft.Voter {
+			isVoter = true
+		}
+	}
+	if !isVoter {
+		return nil, fmt.Errorf("node %s is not a voter in the peers file", opts.NodeID)
+	}
+
+	raftDir := filepath.Join(opts.DataDir, "raft")
+	if err := finishMigration(raftDir); err != nil {
+		return nil, err
+	}
+	kind := detectLogStore(raftDir)
+	if kind == "" {
+		return nil, fmt.Errorf("no raft state in %s", opts.DataDir)
+	}
+
+	// Badger locks its directory, so this fails if the server is running.
+	st, err := store.NewBadgerStore(opts.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("open store (is the server still running?): %w", err)
+	}
+	defer st.Close()
+	logs, err := openLogStoreAt(logStorePath(raftDir, kind), kind)
+	if err != nil {
+		return nil, err
+	}
+	defer logs.Close()
+	snapshots, err := raft.NewFileSnapshotStore(raftDir, 1, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("file snapshot store: %w", err)
+	}
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(opts.NodeID)
+	conf.LogOutput = io.Discard
+	_, trans := raft.NewInmemTransport("")
+	fsm := NewFSM(st, nil, false)
+
+	current, err := raft.GetConfiguration(conf, fsm, logs, logs, snapshots, trans)
+	if err != nil {
+		return nil, fmt.Errorf("read current configuration: %w", err)
+	}
+	if sameVoters(current, peers) {
+		return nil, ErrNothingToRecover
+	}
+	if !opts.Force {
+		if reachable, quorum := probeVoters(current, opts.NodeID, opts.ProbeTimeout); reachable >= quorum {
+			return nil, fmt.Errorf("%d of %d voters in the current configuration are reachable (quorum is %d); the cluster looks healthy, refusing to recover (use force to override)",
+				reachable, countVoters(current), quorum)
+		}
+	}
+
+	if err := raft.RecoverCluster(conf, fsm, logs, logs, snapshots, trans, peers); err != nil {
+		return nil, fmt.Errorf("recover cluster: %w", err)
+	}
+	return &peers, nil
+}
+
+func countVoters(c raft.Configuration) int {
+	n := 0
+	for _, srv := range c.Servers {
+		if srv.Suffrage == raft.Voter {
+			n++
+		}
+	}
+	return n
+}
+
+func sameVoters(a, b raft.Configuration) bool {
+	voters := make(map[raft.ServerID]raft.ServerAddress)
+	for _, srv := range a.Servers {
+		if srv.Suffrage == raft.Voter {
+			voters[srv.ID] = srv.Address
+		}
+	}
+	if countVoters(b) != len(voters) {
+		return false
+	}
+	for _, srv := range b.Servers {
+		if srv.Suffrage != raft.Voter {
+			continue
+		}
+		if addr, ok := voters[srv.ID]; !ok || addr != srv.Address {
+			return false
+		}
+	}
+	return true
+}
+
+// probeVoters dials the Raft address of every voter in c other than self
+// and reports how many voters (self included) are up, and the quorum size.
+func probeVoters(c raft.Configuration, self string, timeout time.Duration) (reachable, quorum int) {
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	quorum = countVoters(c)/2 + 1
+	for _, srv := range c.Servers {
+		if srv.Suffrage != raft.Voter {
+			continue
+		}
+		if string(srv.ID) == self {
+			reachable++
+			continue
+		}
+		conn, err := net.DialTimeout("tcp", string(srv.Address), timeout)
+		if err != nil {
+			continue
+		}
+		_ = conn.Close()
+		reachable++
+	}
+	return reachable, quorum
+}
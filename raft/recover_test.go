@@ -0,0 +1,145 @@
+package raftnode
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	raft "github.com/hashicorp/raft"
+	"github.com/sada-02/keyper/store"
+)
+
+type testMember struct {
+	node  *Node
+	store *store.BadgerStore
+}
+
+func startMember(t *testing.T, id, addr, dir, join string) *testMember {
+	t.Helper()
+	st, err := store.NewBadgerStore(dir)
+	if err != nil {
+		t.Fatalf("open store %s: %v", id, err)
+	}
+	n, err := NewNode(&RaftConfig{NodeID: id, RaftAddr: addr, DataDir: dir, Store: st, JoinAddr: join})
+	if err != nil {
+		_ = st.Close()
+		t.Fatalf("start %s: %v", id, err)
+	}
+	return &testMember{node: n, store: st}
+}
+
+func (m *testMember) stop() {
+	_ = m.node.Shutdown()
+	_ = m.store.Close()
+}
+
+func waitLeader(t *testing.T, n *Node) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for n.Raft.State() != raft.Leader {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never became leader", n.ID)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// TestRecoverAfterLosingQuorum runs a three-node cluster over TCP, loses two
+// nodes for good and brings the survivor back as a single-node cluster.
+func TestRecoverAfterLosingQuorum(t *testing.T) {
+	if raceEnabled {
+		t.Skip("boltdb/bolt fails checkptr under -race")
+	}
+	base := filepath.Join(os.TempDir(), "dkvs_test_recover_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	defer os.RemoveAll(base)
+
+	ids := []string{"n1", "n2", "n3"}
+	addrs := make([]string, 3)
+	dirs := make([]string, 3)
+	for i := range ids {
+		addrs[i] = freeAddr(t)
+		dirs[i] = filepath.Join(base, ids[i])
+	}
+
+	n1 := startMember(t, "n1", addrs[0], dirs[0], "")
+	waitLeader(t, n1.node)
+	n2 := startMember(t, "n2", addrs[1], dirs[1], "join")
+	n3 := startMember(t, "n3", addrs[2], dirs[2], "join")
+	for i := 1; i < 3; i++ {
+		if err := n1.node.AddVoter(ids[i], addrs[i], 5*time.Second); err != nil {
+			t.Fatalf("add %s: %v", ids[i], err)
+		}
+	}
+
+	write := func(m *testMember, key string) {
+		t.Helper()
+		if _, err := m.node.Apply(&Command{Op: "set", Key: key, Value: []byte("v")}, 5*time.Second); err != nil {
+			t.Fatalf("write %s: %v", key, err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		write(n1, "before-"+strconv.Itoa(i))
+	}
+	// recovery must replay both a snapshot and the log after it
+	if err := n1.node.Raft.Snapshot().Error(); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		write(n1, "after-"+strconv.Itoa(i))
+	}
+
+	peers := filepath.Join(base, "peers.json")
+	if err := os.WriteFile(peers, []byte(`[{"id":"n1","address":"`+addrs[0]+`"}]`), 0o644); err != nil {
+		t.Fatalf("write peers file: %v", err)
+	}
+	opts := RecoverOptions{NodeID: "n1", DataDir: dirs[0], PeersFile: peers, ProbeTimeout: 200 * time.Millisecond}
+
+	if _, err := RecoverCluster(opts); err == nil || !strings.Contains(err.Error(), "still running") {
+		t.Fatalf("expected recover to refuse a running node, got %v", err)
+	}
+	n1.stop()
+	// n2 and n3 still form a quorum of the old configuration
+	if _, err := RecoverCluster(opts); err == nil || !strings.Contains(err.Error(), "healthy") {
+		t.Fatalf("expected recover to refuse a healthy cluster, got %v", err)
+	}
+
+	n2.stop()
+	n3.stop()
+	if _, err := RecoverCluster(opts); err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+	if _, err := RecoverCluster(opts); err == nil || !strings.Contains(err.Error(), "nothing to recover") {
+		t.Fatalf("expected a second recover to be refused, got %v", err)
+	}
+
+	n1 = startMember(t, "n1", addrs[0], dirs[0], "")
+	defer n1.stop()
+	waitLeader(t, n1.node)
+	for _, key := range []string{"before-0", "before-19", "after-4"} {
+		if _, err := n1.store.Get([]byte(key)); err != nil {
+			t.Fatalf("%s lost in recovery: %v", key, err)
+		}
+	}
+	write(n1, "recovered")
+	fut := n1.node.Raft.GetConfiguration()
+	if err := fut.Error(); err != nil {
+		t.Fatalf("configuration: %v", err)
+	}
+	if servers := fut.Configuration().Servers; len(servers) != 1 || servers[0].ID != "n1" {
+		t.Fatalf("expected n1 alone in the configuration, got %+v", servers)
+	}
+}
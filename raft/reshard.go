@@ -0,0 +1,452 @@
+package raftnode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sada-02/keyper/shard"
+	"github.com/sada-02/keyper/store"
+)
+
+// rangeMeta names the metadata entry holding the key range the store owns,
+// as JSON: a shard.Range, or null once the store has handed all its keys on.
+// A store without the entry owns every key.
+const rangeMeta = "key-range"
+
+// ErrNotOwned is returned for writes to keys the store has handed on to
+// another shard, or not received yet. The client should retry once routing
+// has caught up.
+var ErrNotOwned = errors.New("key is not owned by this shard")
+
+// ErrShardTaken is returned for a split or merge into a shard that exists,
+// or that another split or merge in progress makes. The caller can pick the
+// next free shard and try again.
+var ErrShardTaken = errors.New("shard is taken")
+
+// ownership is the key range the FSM's store owns, as read from rangeMeta.
+type ownership struct {
+	all bool         // no range recorded: every key
+	r   *shard.Range // nil, unless all, when the store owns no key
+}
+
+func (o *ownership) contains(key string) bool {
+	return o.all || (o.r != nil && o.r.Contains(key))
+}
+
+func loadOwnership(s *store.BadgerStore) (*ownership, error) {
+	b, err := s.GetMeta(rangeMeta)
+	if errors.Is(err, store.ErrNotFound) {
+		return &ownership{all: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	o := &ownership{}
+	if err := json.Unmarshal(b, &o.r); err != nil {
+		return nil, fmt.Errorf("decode key range: %w", err)
+	}
+	return o, nil
+}
+
+// reloadOwnership rereads the store's range after it changed wholesale.
+func (f *fsm) reloadOwnership() error {
+	o, err := loadOwnership(f.store)
+	if err != nil {
+		return err
+	}
+	f.owned.Store(o)
+	return nil
+}
+
+// checkOwned returns ErrNotOwned if cmd writes a key the store does not own.
+func (f *fsm) checkOwned(cmd *Command) error {
+	o := f.owned.Load()
+	if o.all {
+		return nil
+	}
+	keys := []string{cmd.Key}
+	switch {
+	case cmd.Op == "batch":
+		keys = keys[:0]
+		for _, op := range cmd.Batch {
+			// ops without a key fail on their own, in the batch's results
+			if op.Key != "" {
+				keys = append(keys, op.Key)
+			}
+		}
+	case cmd.Op == "txn" && cmd.Txn != nil:
+		keys = keys[:0]
+		for _, op := range append(append([]store.TxnOp(nil), cmd.Txn.Success...), cmd.Txn.Failure...) {
+			keys = append(keys, op.Key)
+		}
+		for _, g := range cmd.Txn.Guards {
+			keys = append(keys, g.Key)
+		}
+	}
+	for _, k := range keys {
+		if !o.contains(k) {
+			return fmt.Errorf("%s %q: %w", cmd.Op, k, ErrNotOwned)
+		}
+	}
+	return nil
+}
+
+// Cut is the body of a "cut" command, which hands keys of shard From on to
+// shard To. Every replica writes the keys outside Keep, together with Range
+// as their new owner's range, to CutFile(From, To); it then deletes them and
+// from that entry on owns only Keep. A nil Keep hands every key on.
+type Cut struct {
+	From  string       `json:"from"`
+	To    string       `json:"to"`
+	Keep  *shard.Range `json:"keep"`
+	Range shard.Range  `json:"range"`
+}
+
+// CutFile is where a replica keeping its cuts in dir writes the keys shard
+// from hands on to shard to.
+func CutFile(dir, from, to string) string {
+	return filepath.Join(dir, from+"-"+to+".cut")
+}
+
+// cutPrefix names the metadata entries of cuts applied but not finished,
+// one per cut, by the index of its entry: the keys such a cut hands on are
+// still in the store, and maybe not in its file yet.
+const cutPrefix = "cuts/"
+
+func cutMeta(index uint64) string {
+	return fmt.Sprintf("%s%020d", cutPrefix, index)
+}
+
+// pendingCut is a cut as recorded under cutPrefix, with the range the store
+// owned before it.
+type pendingCut struct {
+	Cut
+	All  bool         `json:"all"`
+	Prev *shard.Range `json:"prev"`
+}
+
+// handsOn reports whether the cut hands key on.
+func (c *pendingCut) handsOn(key []byte) bool {
+	k := string(key)
+	return (c.All || (c.Prev != nil && c.Prev.Contains(k))) && (c.Keep == nil || !c.Keep.Contains(k))
+}
+
+// applyCut narrows the store's range to Keep and records the cut as pending,
+// with the applied index, in one transaction; runCuts writes the cut file and
+// deletes the keys afterwards, off the apply path. From this entry on the
+// keys handed on cannot be written, so reading them later reads them as
+// they were at the cut, on every replica alike. A cut that hands on nothing
+// the store still owns, such as one sent again, only records its index.
+//
+// Should the transaction fail, this replica would go on owning keys every
+// other one handed on. It keeps its old range and stops applying instead,
+// leaving the node's other rafts running; see Node.Failed.
+func (f *fsm) applyCut(c *Cut, index uint64) interface{} {
+	if c == nil || c.From == "" || c.To == "" || f.cutDir == "" {
+		_ = f.markApplied(index)
+		return errors.New("cut failed: missing shards, or no cut directory configured")
+	}
+	o := f.owned.Load()
+	if !o.all && (o.r == nil || (c.Keep != nil && *o.r == *c.Keep)) {
+		_ = f.markApplied(index)
+		return nil
+	}
+	pending, _ := json.Marshal(&pendingCut{Cut: *c, All: o.all, Prev: o.r})
+	keep, _ := json.Marshal(c.Keep)
+	err := f.update(index, func(tx *store.Tx) error {
+		if err := tx.SetMeta(rangeMeta, keep); err != nil {
+			return err
+		}
+		return tx.SetMeta(cutMeta(index), pending)
+	})
+	if err != nil {
+		f.fail(index, fmt.Errorf("cut of shard %s into %s: %w", c.From, c.To, err))
+		return f.failedErr()
+	}
+	f.owned.Store(&ownership{r: c.Keep})
+	f.kickCuts()
+	return nil
+}
+
+// startCuts starts runCuts, which first finishes the cuts a crash or
+// shutdown left pending.
+func (f *fsm) startCuts() {
+	f.cutDone = make(chan struct{})
+	go f.runCuts()
+	f.kickCuts()
+}
+
+// stopCuts stops runCuts, if it was started, and waits for it to return.
+func (f *fsm) stopCuts() {
+	f.cutStop.Do(func() { close(f.cutQuit) })
+	if f.cutDone != nil {
+		<-f.cutDone
+	}
+}
+
+// kickCuts has runCuts look for pending cuts.
+func (f *fsm) kickCuts() {
+	select {
+	case f.cutKick <- struct{}{}:
+	default:
+	}
+}
+
+// runCuts finishes pending cuts whenever kicked, retrying until they are all
+// done or stopCuts is called.
+func (f *fsm) runCuts() {
+	defer close(f.cutDone)
+	for {
+		select {
+		case <-f.cutQuit:
+			return
+		case <-f.cutKick:
+		}
+		waiting := ""
+		for {
+			err := f.finishCuts()
+			if err == nil {
+				break
+			}
+			if err.Error() != waiting {
+				waiting = err.Error()
+				log.Printf("raft: finish cut: %v", err)
+			}
+			select {
+			case <-f.cutQuit:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// finishCuts finishes every pending cut, oldest first, so each one finds
+// the keys it hands on where the cut left them: it writes the cut file
+// unless a run before a crash did, deletes the keys and then the entry.
+// Restore waits for the cut in hand, and the next one is read from the
+// store as Restore left it.
+func (f *fsm) finishCuts() error {
+	for {
+		done, err := f.finishCut()
+		if done || err != nil {
+			return err
+		}
+	}
+}
+
+// finishCut finishes the oldest pending cut; done is true if there is none.
+func (f *fsm) finishCut() (done bool, err error) {
+	f.cutMu.Lock()
+	defer f.cutMu.Unlock()
+	entries, err := f.store.ListMeta(cutPrefix)
+	if err != nil || len(entries) == 0 {
+		return true, err
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var c pendingCut
+	if err := json.Unmarshal(entries[names[0]], &c); err != nil {
+		return false, fmt.Errorf("decode %s: %w", names[0], err)
+	}
+	path := CutFile(f.cutDir, c.From, c.To)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		meta, _ := json.Marshal(c.Range)
+		if err := os.MkdirAll(f.cutDir, 0o755); err != nil {
+			return false, err
+		}
+		if err := f.store.Cut(path, c.handsOn, map[string][]byte{rangeMeta: meta}); err != nil {
+			return false, fmt.Errorf("write cut of shard %s into %s: %w", c.From, c.To, err)
+		}
+	}
+	if err := f.store.DeleteKeys(c.handsOn); err != nil {
+		return false, fmt.Errorf("delete keys cut from shard %s: %w", c.From, err)
+	}
+	return false, f.store.DeleteMeta(names[0])
+}
+
+// Failed is closed once the node's FSM has stopped applying entries after
+// one it could not apply; Failure then says which and why. The node's
+// state no longer follows its log, and it should be shut down.
+func (n *Node) Failed() <-chan struct{} {
+	return n.fsm.failed
+}
+
+// Failure returns the error that stopped the node's FSM, or nil.
+func (n *Node) Failure() error {
+	return n.fsm.failedErr()
+}
+
+// Owns reports whether the node's store owns key, so writes to it apply.
+func (n *Node) Owns(key string) bool {
+	return n.fsm.owned.Load().contains(key)
+}
+
+// KeyRange returns the key range the store owns: all is true when it has
+// none recorded and owns every key; otherwise r is nil if it owns none.
+func (n *Node) KeyRange() (r *shard.Range, all bool) {
+	o := n.fsm.owned.Load()
+	return o.r, o.all
+}
+
+// Cut applies c, handing keys of this node's shard on to another, and
+// returns the index of its entry. Only the leader can apply it.
+func (n *Node) Cut(c Cut, timeout time.Duration) (uint64, error) {
+	res, err := n.Apply(&Command{Op: "cut", Cut: &c}, timeout)
+	if err != nil {
+		return 0, err
+	}
+	return res.Index, nil
+}
+
+// Kinds of Reshard.
+const (
+	ReshardSplit = "split"
+	ReshardMerge = "merge"
+)
+
+// Phases of a split or merge, in order.
+const (
+	ReshardCutting = "cutting" // the shards split or merged hand their keys on, each in its own log
+	ReshardSeeding = "seeding" // the table routes to the new shard, whose founder loads the cut keys
+	ReshardDone    = "done"
+)
+
+// Reshard records a split of a shard in two, or a merge of two into one.
+// A split leaves the parent with Keep and makes To with Range; a merge
+// replaces both shards with To.
+type Reshard struct {
+	Kind  string       `json:"kind"` // ReshardSplit or ReshardMerge
+	From  []string     `json:"from"`
+	To    string       `json:"to"`
+	Keep  *shard.Range `json:"keep,omitempty"`
+	Range shard.Range  `json:"range"`
+	Phase string       `json:"phase"`
+}
+
+// Active reports whether the split or merge is still in progress.
+func (r *Reshard) Active() bool {
+	return r != nil && r.Phase != ReshardDone
+}
+
+// applyReshard starts a split or merge, switches the table over to the new
+// shard or marks it done. It starts on shards with no move or split in
+// progress, into a To no other split or merge in progress makes; the switch shrinks the parent of a split and drops the shards
+// merged, and adds To on replicas and bootstrap node p names, in one entry,
+// so routing changes at once.
+func (f *fsm) applyReshard(p *ShardPlacement, index uint64) interface{} {
+	if p == nil || p.ID == "" || p.Reshard == nil || p.Reshard.To != p.ID || len(p.Reshard.From) == 0 {
+		_ = f.markApplied(index)
+		return errors.New("shard-reshard failed: missing shards")
+	}
+	r := *p.Reshard
+	err := f.update(index, func(tx *store.Tx) error {
+		from := make([]*ShardPlacement, len(r.From))
+		for i, id := range r.From {
+			s, err := shardEntry(tx, id)
+			if err != nil {
+				return err
+			}
+			from[i] = s
+		}
+		to, err := shardEntry(tx, r.To)
+		if err != nil {
+			return err
+		}
+
+		switch r.Phase {
+		case ReshardCutting:
+			if to != nil {
+				return fmt.Errorf("shard %s exists: %w", r.To, ErrShardTaken)
+			}
+			entries, err := tx.ListMeta(placementPrefix)
+			if err != nil {
+				return err
+			}
+			for name, b := range entries {
+				var s ShardPlacement
+				if err := json.Unmarshal(b, &s); err != nil {
+					return fmt.Errorf("decode shard %s: %w", name, err)
+				}
+				if s.Reshard.Active() && s.Reshard.To == r.To {
+					return fmt.Errorf("shard %s is being made by a %s of %v: %w", r.To, s.Reshard.Kind, s.Reshard.From, ErrShardTaken)
+				}
+			}
+			if !(r.Kind == ReshardSplit && len(from) == 1 && r.Keep != nil) && !(r.Kind == ReshardMerge && len(from) == 2 && r.From[0] != r.From[1]) {
+				return fmt.Errorf("malformed %s of %v", r.Kind, r.From)
+			}
+			for i, s := range from {
+				switch {
+				case s == nil:
+					return fmt.Errorf("no shard %s", r.From[i])
+				case s.Move.Active(), s.Reshard.Active():
+					return fmt.Errorf("shard %s is busy with a move, split or merge", s.ID)
+				}
+				s.Reshard = &r
+				if err := putShardEntry(tx, s, index); err != nil {
+					return err
+				}
+			}
+			return nil
+		case ReshardSeeding:
+			if to != nil {
+				return nil // switched already
+			}
+			for i, s := range from {
+				if s == nil || !s.Reshard.Active() || s.Reshard.To != r.To {
+					return fmt.Errorf("shard %s is not being resharded into %s", r.From[i], r.To)
+				}
+			}
+			if r.Kind == ReshardSplit {
+				parent := from[0]
+				parent.Range, parent.Reshard = r.Keep, &r
+				if err := putShardEntry(tx, parent, index); err != nil {
+					return err
+				}
+			} else {
+				for _, s := range from {
+					if err := tx.DeleteMeta(placementPrefix + s.ID); err != nil {
+						return err
+					}
+				}
+			}
+			rng := r.Range
+			return putShardEntry(tx, &ShardPlacement{ID: r.To, Replicas: p.Replicas, Bootstrap: p.Bootstrap, Range: &rng, Reshard: &r}, index)
+		case ReshardDone:
+			if to == nil {
+				return fmt.Errorf("no shard %s", r.To)
+			}
+			for _, s := range append(from, to) {
+				if s != nil && s.Reshard != nil && s.Reshard.To == r.To {
+					s.Reshard = &r
+					if err := putShardEntry(tx, s, index); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+		return fmt.Errorf("unknown phase %q", r.Phase)
+	})
+	if err != nil {
+		return fmt.Errorf("shard-reshard failed: %w", err)
+	}
+	f.placementChanged()
+	return nil
+}
+
+// Reshard starts the split or merge r, or records its progress. replicas
+// and bootstrap place the new shard when r switches the table over. Only
+// the leader can apply it.
+func (n *Node) Reshard(r Reshard, replicas []string, bootstrap string, timeout time.Duration) error {
+	return n.ApplyCommand(&Command{Op: "shard-reshard", Shard: &ShardPlacement{ID: r.To, Replicas: replicas, Bootstrap: bootstrap, Reshard: &r}}, timeout)
+}
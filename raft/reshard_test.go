@@ -0,0 +1,172 @@
+package raftnode
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	raft "github.com/hashicorp/raft"
+	"github.com/sada-02/keyper/shard"
+	"github.com/sada-02/keyper/store"
+)
+
+// TestFSMCut cuts the keys from "m" on out of a store and checks that writes
+// to them, alone or in a batch, are refused from then on, and that once the
+// cut is finished, as it is after a restart, they are in the cut file and
+// gone from the store.
+func TestFSMCut(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dkvs_test_fsm_cut_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	s, err := store.NewBadgerStore(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer s.Close()
+
+	f := newFSM(s, nil, false)
+	f.cutDir = filepath.Join(dir, "cuts")
+	index := uint64(0)
+	apply := func(cmd Command) interface{} {
+		index++
+		b, _ := json.Marshal(cmd)
+		return f.Apply(&raft.Log{Index: index, Type: raft.LogCommand, Data: b})
+	}
+	for _, k := range []string{"a", "m", "z"} {
+		if err, ok := apply(Command{Op: "set", Key: k, Value: []byte(k)}).(error); ok {
+			t.Fatalf("set %s: %v", k, err)
+		}
+	}
+
+	keep, rest, err := shard.Range{}.SplitKey("m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := apply(Command{Op: "cut", Cut: &Cut{From: "0", To: "1", Keep: &keep, Range: rest}}).(error); ok {
+		t.Fatalf("cut: %v", err)
+	}
+	if got, err := AppliedIndex(s); err != nil || got != index {
+		t.Fatalf("applied index %d, %v; want %d", got, err, index)
+	}
+	// applying the cut only records it; the keys go later
+	if _, err := os.Stat(CutFile(f.cutDir, "0", "1")); !os.IsNotExist(err) {
+		t.Fatalf("cut file written while applying: %v", err)
+	}
+	if err, _ := apply(Command{Op: "set", Key: "z", Value: []byte("new")}).(error); !errors.Is(err, ErrNotOwned) {
+		t.Fatalf("set of a key cut away: got %v, want ErrNotOwned", err)
+	}
+
+	// as after a restart, a new FSM finishes what the old one left pending
+	f = newFSM(s, nil, false)
+	f.cutDir = filepath.Join(dir, "cuts")
+	if err := f.finishCuts(); err != nil {
+		t.Fatalf("finish cuts: %v", err)
+	}
+	if left, _ := s.ListMeta(cutPrefix); len(left) != 0 {
+		t.Fatalf("cuts still pending: %v", left)
+	}
+	cut, err := os.Open(CutFile(f.cutDir, "0", "1"))
+	if err != nil {
+		t.Fatalf("open cut: %v", err)
+	}
+	defer cut.Close()
+	// m and z, and the range they go to
+	if info, err := store.InspectSnapshot(cut); err != nil || info.Records != 3 {
+		t.Fatalf("cut holds %+v, %v; want 3 records", info, err)
+	}
+	if _, err := s.Get([]byte("z")); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("z still in the store after the cut: %v", err)
+	}
+	if v, err := s.Get([]byte("a")); err != nil || string(v) != "a" {
+		t.Fatalf("a = %q, %v after the cut", v, err)
+	}
+
+	if err, _ := apply(Command{Op: "set", Key: "x", Value: []byte("x")}).(error); !errors.Is(err, ErrNotOwned) {
+		t.Fatalf("set of a key cut away: got %v, want ErrNotOwned", err)
+	}
+	batch := []store.TxnOp{{Op: "set", Key: "b", Value: []byte("b")}, {Op: "set", Key: "x", Value: []byte("x")}}
+	if err, _ := apply(Command{Op: "batch", Batch: batch}).(error); !errors.Is(err, ErrNotOwned) {
+		t.Fatalf("batch with a key cut away: got %v, want ErrNotOwned", err)
+	}
+	if _, err := s.Get([]byte("b")); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("refused batch wrote b: %v", err)
+	}
+	if res := apply(Command{Op: "batch", Batch: batch[:1]}); res == nil {
+		t.Fatal("batch of owned keys: no results")
+	} else if err, ok := res.(error); ok {
+		t.Fatalf("batch of owned keys: %v", err)
+	}
+}
+
+// TestFSMCutFailure fails the transaction recording a cut, by closing the
+// store under the FSM, and checks that the FSM keeps its range and stops
+// applying entries rather than bringing the process down, and that after a
+// restart the cut applies again.
+func TestFSMCutFailure(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dkvs_test_fsm_cut_failure_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	s, err := store.NewBadgerStore(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+
+	f := newFSM(s, nil, false)
+	f.cutDir = filepath.Join(dir, "cuts")
+	index := uint64(0)
+	apply := func(f *fsm, cmd Command) interface{} {
+		index++
+		b, _ := json.Marshal(cmd)
+		return f.Apply(&raft.Log{Index: index, Type: raft.LogCommand, Data: b})
+	}
+	for _, k := range []string{"a", "z"} {
+		if err, ok := apply(f, Command{Op: "set", Key: k, Value: []byte(k)}).(error); ok {
+			t.Fatalf("set %s: %v", k, err)
+		}
+	}
+	keep, rest, err := shard.Range{}.SplitKey("m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cut := Command{Op: "cut", Cut: &Cut{From: "0", To: "1", Keep: &keep, Range: rest}}
+
+	s.Close()
+	if err, _ := apply(f, cut).(error); !errors.Is(err, ErrFailed) {
+		t.Fatalf("cut on a closed store: got %v, want ErrFailed", err)
+	}
+	select {
+	case <-f.failed:
+	default:
+		t.Fatal("failed not closed after the cut failed")
+	}
+	if !f.owned.Load().contains("z") {
+		t.Fatal("failed cut narrowed the range")
+	}
+	if err, _ := apply(f, Command{Op: "set", Key: "b", Value: []byte("b")}).(error); !errors.Is(err, ErrFailed) {
+		t.Fatalf("set after the failure: got %v, want ErrFailed", err)
+	}
+	if _, err := f.Snapshot(); !errors.Is(err, ErrFailed) {
+		t.Fatalf("snapshot after the failure: got %v, want ErrFailed", err)
+	}
+
+	// the store stopped before the cut, which a restart applies again
+	if s, err = store.NewBadgerStore(filepath.Join(dir, "data")); err != nil {
+		t.Fatalf("reopen store: %v", err)
+	}
+	defer s.Close()
+	if got, err := AppliedIndex(s); err != nil || got != 2 {
+		t.Fatalf("applied index %d, %v after the failure; want 2", got, err)
+	}
+	f = newFSM(s, nil, false)
+	f.cutDir = filepath.Join(dir, "cuts")
+	index = 2
+	if err, ok := apply(f, cut).(error); ok {
+		t.Fatalf("cut after restart: %v", err)
+	}
+	if f.owned.Load().contains("z") || f.failedErr() != nil {
+		t.Fatalf("cut after restart: owns z %v, failure %v", f.owned.Load().contains("z"), f.failedErr())
+	}
+}
@@ -0,0 +1,12 @@
+package shard
+
+import "strconv"
+
+// ForKey returns the ID of the shard, out of count, that owns key. Shard IDs
+// are "0" to count-1, the IDs the server starts its shard rafts with.
+func ForKey(key string, count int) string {
+	if count <= 1 {
+		return "0"
+	}
+	return strconv.FormatUint(uint64(hashKey(key))%uint64(count), 10)
+}
@@ -0,0 +1,24 @@
+package shard
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestForKey(t *testing.T) {
+	seen := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := "key-" + strconv.Itoa(i)
+		id := ForKey(key, 4)
+		if ForKey(key, 4) != id {
+			t.Fatalf("key %s moved between calls", key)
+		}
+		seen[id]++
+	}
+	if len(seen) != 4 {
+		t.Fatalf("1000 keys hit shards %v, want all of 0-3", seen)
+	}
+	if id := ForKey("anything", 1); id != "0" {
+		t.Fatalf("single shard: got %s", id)
+	}
+}
@@ -0,0 +1,107 @@
+package shard
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Range is the part of the key space a shard owns: the keys whose hash is
+// Rem modulo Mod and which sort from Start up to, but not including, End.
+// Mod 0 or 1 takes every hash; an empty Start or End leaves that side open.
+//
+// The shards a cluster starts with own Initial ranges, which route keys
+// exactly as ForKey does. A hash split doubles Mod, so a shard's keys go to
+// two halves that merge back into it; a key split cuts Start..End at a key.
+type Range struct {
+	Mod   uint32 `json:"mod"`
+	Rem   uint32 `json:"rem"`
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+// Initial is the range of shard i out of the count a cluster starts with.
+func Initial(i, count int) Range {
+	if count <= 1 {
+		return Range{}
+	}
+	return Range{Mod: uint32(count), Rem: uint32(i)}
+}
+
+// Contains reports whether key falls in r.
+func (r Range) Contains(key string) bool {
+	if r.Mod > 1 && hashKey(key)%r.Mod != r.Rem {
+		return false
+	}
+	return key >= r.Start && (r.End == "" || key < r.End)
+}
+
+// Overlaps reports whether some key could fall in both r and o.
+func (r Range) Overlaps(o Range) bool {
+	if r.End != "" && o.Start >= r.End || o.End != "" && r.Start >= o.End {
+		return false
+	}
+	m := gcd(max(r.Mod, 1), max(o.Mod, 1))
+	return r.Rem%m == o.Rem%m
+}
+
+func (r Range) String() string {
+	s := "all hashes"
+	if r.Mod > 1 {
+		s = fmt.Sprintf("hash %% %d = %d", r.Mod, r.Rem)
+	}
+	if r.Start != "" || r.End != "" {
+		s += fmt.Sprintf(", keys [%q, %q)", r.Start, r.End)
+	}
+	return s
+}
+
+// SplitHash splits r into the two halves of its hash class.
+func (r Range) SplitHash() (Range, Range, error) {
+	mod := max(r.Mod, 1)
+	if mod > 1<<31 {
+		return Range{}, Range{}, errors.New("hash range too small to split")
+	}
+	lo, hi := r, r
+	lo.Mod, hi.Mod = 2*mod, 2*mod
+	hi.Rem = r.Rem + mod
+	return lo, hi, nil
+}
+
+// SplitKey splits r at key into the keys before it and the rest.
+func (r Range) SplitKey(key string) (Range, Range, error) {
+	if key <= r.Start || (r.End != "" && key >= r.End) {
+		return Range{}, Range{}, fmt.Errorf("key %q is not inside %s", key, r)
+	}
+	lo, hi := r, r
+	lo.End, hi.Start = key, key
+	return lo, hi, nil
+}
+
+// Merge returns the range made of a and b, which must be the two halves of
+// a hash split or adjacent key ranges of the same hash class.
+func Merge(a, b Range) (Range, error) {
+	if a.Start == b.Start && a.End == b.End && a.Mod == b.Mod && a.Mod > 1 && a.Mod%2 == 0 {
+		half := a.Mod / 2
+		if a.Rem%half == b.Rem%half && a.Rem != b.Rem {
+			return Range{Mod: half, Rem: a.Rem % half, Start: a.Start, End: a.End}, nil
+		}
+	}
+	if max(a.Mod, 1) == max(b.Mod, 1) && a.Rem == b.Rem {
+		switch {
+		case a.End != "" && a.End == b.Start:
+			a.End = b.End
+			return a, nil
+		case b.End != "" && b.End == a.Start:
+			b.End = a.End
+			return b, nil
+		}
+	}
+	return Range{}, fmt.Errorf("%s and %s are not adjacent", a, b)
+}
+
+func gcd(a, b uint32) uint32 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
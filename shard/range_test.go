@@ -0,0 +1,47 @@
+package shard
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRangeSplitMerge(t *testing.T) {
+	for i := 0; i < 4; i++ {
+		r := Initial(i, 4)
+		lo, hi, err := r.SplitHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, b, err := hi.SplitKey("key-5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k := 0; k < 1000; k++ {
+			key := "key-" + strconv.Itoa(k)
+			if r.Contains(key) != (ForKey(key, 4) == strconv.Itoa(i)) {
+				t.Fatalf("%s: initial range %d disagrees with ForKey", key, i)
+			}
+			n := 0
+			for _, part := range []Range{lo, a, b} {
+				if part.Contains(key) {
+					n++
+				}
+			}
+			if r.Contains(key) != (n == 1) || n > 1 {
+				t.Fatalf("%s: in %d parts of a split of shard %d", key, n, i)
+			}
+		}
+		if back, err := Merge(b, a); err != nil || back != hi {
+			t.Fatalf("merge key halves: %v, %v", back, err)
+		}
+		if back, err := Merge(hi, lo); err != nil || back != r {
+			t.Fatalf("merge hash halves: %v, %v", back, err)
+		}
+		if !lo.Overlaps(r) || lo.Overlaps(hi) || a.Overlaps(b) {
+			t.Fatalf("overlaps wrong for shard %d", i)
+		}
+	}
+	if _, err := Merge(Initial(0, 4), Initial(1, 4)); err == nil {
+		t.Fatal("merged shards 0 and 1 of 4, which are not halves of one range")
+	}
+}
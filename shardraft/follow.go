@@ -0,0 +1,167 @@
+package shardraft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	raft "github.com/hashicorp/raft"
+	"github.com/sada-02/keyper/raft"
+	"github.com/sada-02/keyper/shard"
+)
+
+// placementInterval is how often Follow rechecks the placement table even
+// when it has not changed, to retry failed starts and leader reports.
+const placementInterval = 2 * time.Second
+
+// Follow keeps this node's shard rafts in line with the placement table of
+// the main raft rn until stop is closed. Whenever the table changes, and
+// every placementInterval, it starts and stops shard rafts and reports the
+// shards led from here. On the main leader it also maintains the table:
+// shards missing from it are placed on the leader, which founds them, and
+// shards with fewer than Replicas replicas get more, on the voters hosting
+// the fewest shards; and replica moves, splits and merges in progress are
+// driven to their end. A shard is reported as led from here only once its
+// replica is Ready.
+func (h *Host) Follow(rn *raftnode.Node, stop <-chan struct{}) {
+	tick := time.NewTicker(placementInterval)
+	defer tick.Stop()
+	nodeURL := func(node string) string {
+		if m, err := rn.Member(node); err == nil {
+			return m.HTTPAddr
+		}
+		return ""
+	}
+	for {
+		p, err := rn.Placement()
+		if err != nil {
+			log.Printf("read shard placement: %v", err)
+		} else {
+			if rn.Raft.State() == raft.Leader {
+				h.place(rn, p)
+				h.driveMoves(rn, p, nodeURL, stop)
+				h.driveReshards(rn, p, nodeURL, stop)
+			}
+			h.Reconcile(p, nodeURL)
+			for _, sr := range h.List() {
+				s := p.Shard(sr.ShardID)
+				if s == nil || s.Leader == h.cfg.NodeID || sr.Node.Raft.State() != raft.Leader || !sr.Ready() {
+					continue
+				}
+				if err := reportLeader(rn, sr.ShardID, h.cfg.NodeID); err != nil {
+					log.Printf("report leader of shard %s: %v", sr.ShardID, err)
+				}
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-rn.PlacementChanged():
+		case <-tick.C:
+		}
+	}
+}
+
+// place brings the table up to ShardCount shards of Replicas replicas each,
+// as far as the main raft's voters allow. A shard the cluster started with
+// is not placed again once splits or merges have handed its keys to others.
+// Each change is applied on its own; the next pass sees its result.
+func (h *Host) place(rn *raftnode.Node, p *raftnode.Placement) {
+	for i := 0; i < h.cfg.ShardCount; i++ {
+		id := strconv.Itoa(i)
+		if p.Shard(id) != nil || overlapsAny(p, shard.Initial(i, h.cfg.ShardCount), h.cfg.ShardCount) {
+			continue
+		}
+		if err := rn.AssignShard(id, []string{h.cfg.NodeID}, h.cfg.NodeID, 5*time.Second); err != nil {
+			log.Printf("place shard %s: %v", id, err)
+		}
+		return
+	}
+
+	fut := rn.Raft.GetConfiguration()
+	if err := fut.Error(); err != nil {
+		return
+	}
+	var voters []string
+	for _, srv := range fut.Configuration().Servers {
+		if srv.Suffrage == raft.Voter {
+			voters = append(voters, string(srv.ID))
+		}
+	}
+	load := make(map[string]int)
+	for _, s := range p.Shards {
+		for _, r := range s.Replicas {
+			load[r]++
+		}
+	}
+	sort.Slice(voters, func(i, j int) bool {
+		if load[voters[i]] != load[voters[j]] {
+			return load[voters[i]] < load[voters[j]]
+		}
+		return voters[i] < voters[j]
+	})
+
+	for _, s := range p.Shards {
+		if len(s.Replicas) >= h.cfg.Replicas || s.Move.Active() || s.Reshard.Active() {
+			continue
+		}
+		replicas := append([]string(nil), s.Replicas...)
+		for _, v := range voters {
+			if len(replicas) == h.cfg.Replicas {
+				break
+			}
+			if !s.HasReplica(v) {
+				replicas = append(replicas, v)
+			}
+		}
+		if len(replicas) == len(s.Replicas) {
+			continue
+		}
+		if err := rn.AssignShard(s.ID, replicas, "", 5*time.Second); err != nil {
+			log.Printf("place shard %s: %v", s.ID, err)
+		}
+		return
+	}
+}
+
+// overlapsAny reports whether r shares keys with a shard in p.
+func overlapsAny(p *raftnode.Placement, r shard.Range, count int) bool {
+	for i := range p.Shards {
+		if p.Shards[i].KeyRange(count).Overlaps(r) {
+			return true
+		}
+	}
+	return false
+}
+
+var reportClient = &http.Client{Timeout: 5 * time.Second}
+
+// reportLeader records in the placement table that node leads shardID,
+// directly on the main leader and through its /v1/shards/{id}/leader
+// endpoint from anywhere else.
+func reportLeader(rn *raftnode.Node, shardID, node string) error {
+	if rn.Raft.State() == raft.Leader {
+		return rn.ReportShardLeader(shardID, node, 5*time.Second)
+	}
+	leader := rn.LeaderHTTP()
+	if leader == "" {
+		return errors.New("no leader")
+	}
+	body, _ := json.Marshal(map[string]string{"node_id": node})
+	resp, err := reportClient.Post(leader+"/v1/shards/"+shardID+"/leader", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("%s answered %s", leader, resp.Status)
+	}
+	return nil
+}
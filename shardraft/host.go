@@ -0,0 +1,260 @@
+package shardraft
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/sada-02/keyper/raft"
+)
+
+// HostConfig says how a Host starts shard rafts on this node.
+type HostConfig struct {
+	NodeID     string // this node's ID in the main raft and the placement table
+	RaftHost   string // host the shard rafts listen on
+	RaftAdHost string // host other nodes dial them on
+	BasePort   int    // shard i listens on BasePort + i
+	HTTPAddr   string // this node's advertised HTTP URL
+	DataDir    string
+	Options    Options
+
+	// ShardCount and Replicas are how many shards the cluster has and how
+	// many replicas of each the main leader places (see Follow).
+	ShardCount int
+	Replicas   int
+}
+
+// Host runs the shard rafts that the placement table puts on this node.
+type Host struct {
+	cfg HostConfig
+
+	mu     sync.RWMutex
+	shards map[string]*ShardRaft
+	moving map[string]bool   // shards whose move this node drives, see Follow
+	splits map[string]bool   // new shards whose split or merge this node drives
+	failed map[string]string // shards stopped after their replica failed, and why; see watch
+	closed bool
+}
+
+// NewHost returns a Host running no shards.
+func NewHost(cfg HostConfig) *Host {
+	return &Host{cfg: cfg, shards: make(map[string]*ShardRaft), moving: make(map[string]bool), splits: make(map[string]bool), failed: make(map[string]string)}
+}
+
+// Get returns the running shard raft for id, or nil.
+func (h *Host) Get(id string) *ShardRaft {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.shards[id]
+}
+
+// List returns the running shard rafts ordered by shard ID.
+func (h *Host) List() []*ShardRaft {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	out := make([]*ShardRaft, 0, len(h.shards))
+	for _, sr := range h.shards {
+		out = append(out, sr)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, _ := strconv.Atoi(out[i].ShardID)
+		b, _ := strconv.Atoi(out[j].ShardID)
+		return a < b
+	})
+	return out
+}
+
+// Failed returns the shards whose replica on this node failed and was
+// stopped, with the error that stopped it. Such a replica is not started
+// again until the process restarts.
+func (h *Host) Failed() map[string]string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	out := make(map[string]string, len(h.failed))
+	for id, why := range h.failed {
+		out[id] = why
+	}
+	return out
+}
+
+// Reconcile starts a shard raft for every shard p places on this node and
+// stops those it no longer does. A stopped shard keeps its data on disk,
+// unless its replica was moved off this node, was the target of a move
+// that failed, or its shard was merged into another: then the data is
+// deleted too, as are cuts the shard they were made for has loaded.
+// A replica that does not found the shard's group joins it through the
+// shard's leader, or its founder if no leader is recorded; nodeURL maps
+// their node IDs to HTTP URLs, and a replica with neither URL known is left
+// for a later call. The target of a move joins as a learner. The founder of
+// a shard made by a split or merge loads its keys from the cut of its
+// parents before the other replicas start. It must not be called
+// concurrently with itself.
+func (h *Host) Reconcile(p *raftnode.Placement, nodeURL func(node string) string) {
+	want := make(map[string]*raftnode.ShardPlacement)
+	for i := range p.Shards {
+		if s := &p.Shards[i]; s.Hosts(h.cfg.NodeID) {
+			want[s.ID] = s
+		}
+	}
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return
+	}
+	var stop []*ShardRaft
+	for id, sr := range h.shards {
+		if want[id] == nil {
+			stop = append(stop, sr)
+			delete(h.shards, id)
+		}
+	}
+	for id := range h.failed {
+		if want[id] == nil {
+			delete(h.failed, id)
+		}
+	}
+	var start []*raftnode.ShardPlacement
+	for id, s := range want {
+		if h.shards[id] == nil && h.failed[id] == "" {
+			start = append(start, s)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, sr := range stop {
+		sr.Shutdown()
+		log.Printf("stopped shard %s: no longer placed on this node", sr.ShardID)
+	}
+	for i := range p.Shards {
+		s := &p.Shards[i]
+		if want[s.ID] == nil && h.movedAway(s) {
+			h.teardown(s.ID, "left over from a move")
+		}
+		if r := s.Reshard; r != nil && r.Kind == raftnode.ReshardMerge && r.To == s.ID {
+			for _, id := range r.From {
+				if p.Shard(id) == nil {
+					h.teardown(id, "merged into shard "+s.ID)
+				}
+			}
+		}
+	}
+	h.dropCuts(p)
+	for _, s := range start {
+		seeding := s.Reshard.Active() && s.Reshard.To == s.ID
+		if seeding && s.Bootstrap != h.cfg.NodeID {
+			continue // joins once the founder holds the shard's keys
+		}
+		join := ""
+		if s.Bootstrap != h.cfg.NodeID {
+			for _, node := range []string{s.Leader, s.Bootstrap} {
+				if node != "" && node != h.cfg.NodeID && nodeURL != nil && join == "" {
+					join = nodeURL(node)
+				}
+			}
+			if join == "" {
+				continue
+			}
+		}
+		sr, err := h.start(s.ID, join)
+		if err != nil {
+			log.Printf("warning: unable to start shard raft %s: %v", s.ID, err)
+			continue
+		}
+		h.mu.Lock()
+		if h.closed {
+			h.mu.Unlock()
+			sr.Shutdown()
+			return
+		}
+		sr.awaitSeed = s.Range != nil
+		h.shards[s.ID] = sr
+		h.mu.Unlock()
+		go h.watch(sr)
+		log.Printf("started shard %s raft at %s (node id %s)", s.ID, sr.Node.Addr, sr.Node.ID)
+		if seeding {
+			go h.seed(sr, *s.Reshard)
+		}
+		if join != "" {
+			voter := !s.Move.Active() || s.Move.To != h.cfg.NodeID
+			go func() {
+				if err := sr.Join(join, h.cfg.HTTPAddr, voter); err != nil {
+					log.Printf("shard %s: %v", sr.ShardID, err)
+				}
+			}()
+		}
+	}
+}
+
+// watch shuts sr down if its FSM fails, leaving the main raft and the
+// node's other shards running; requests for the shard then go to its other
+// replicas.
+func (h *Host) watch(sr *ShardRaft) {
+	select {
+	case <-sr.quit:
+		return
+	case <-sr.Node.Failed():
+	}
+	h.mu.Lock()
+	if h.shards[sr.ShardID] == sr {
+		delete(h.shards, sr.ShardID)
+	}
+	h.failed[sr.ShardID] = sr.Node.Failure().Error()
+	h.mu.Unlock()
+	sr.Shutdown()
+	log.Printf("stopped shard %s: %v", sr.ShardID, sr.Node.Failure())
+}
+
+// movedAway reports whether this node's replica of s, if it has one on disk,
+// is left over from a move: the source of one that completed or the target
+// of one that failed.
+func (h *Host) movedAway(s *raftnode.ShardPlacement) bool {
+	m := s.Move
+	if m == nil {
+		return false
+	}
+	return (m.Phase == raftnode.MoveDone && m.From == h.cfg.NodeID) ||
+		(m.Phase == raftnode.MoveFailed && m.To == h.cfg.NodeID)
+}
+
+// teardown deletes the data of a stopped replica of shard id, saying why.
+func (h *Host) teardown(id, why string) {
+	dir := shardDir(h.cfg.DataDir, id)
+	if _, err := os.Stat(dir); err != nil {
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("warning: unable to delete data of shard %s: %v", id, err)
+		return
+	}
+	log.Printf("deleted data of shard %s %s", id, why)
+}
+
+func (h *Host) start(id, join string) (*ShardRaft, error) {
+	n, err := strconv.Atoi(id)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("shard id %q is not a shard number", id)
+	}
+	port := strconv.Itoa(h.cfg.BasePort + n)
+	raftAddr := net.JoinHostPort(h.cfg.RaftHost, port)
+	raftAdvertise := net.JoinHostPort(h.cfg.RaftAdHost, port)
+	return StartShardRaft(h.cfg.NodeID, id, raftAddr, raftAdvertise, h.cfg.HTTPAddr, h.cfg.DataDir, join, h.cfg.Options)
+}
+
+// Shutdown stops every shard raft; later Reconcile calls do nothing.
+func (h *Host) Shutdown() {
+	h.mu.Lock()
+	h.closed = true
+	shards := h.shards
+	h.shards = make(map[string]*ShardRaft)
+	h.mu.Unlock()
+
+	for id, sr := range shards {
+		sr.Shutdown()
+		log.Printf("shard %s shut down", id)
+	}
+}
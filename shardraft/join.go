@@ -0,0 +1,65 @@
+package shardraft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// joinClient hands leader redirects back to Join instead of following them.
+var joinClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Join has this replica added to its shard's Raft group, as a voter or, when
+// voter is false, a learner. It posts to target's /v1/shards/{id}/join,
+// follows redirects to the shard's leader and retries until the leader
+// accepts or the replica is shut down. Joining a group the replica is
+// already a voter of succeeds at once, even as a learner.
+func (sr *ShardRaft) Join(target, httpAddr string, voter bool) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"node_id":   sr.Node.ID,
+		"raft_addr": sr.Node.Addr,
+		"http_addr": httpAddr,
+		"voter":     voter,
+	})
+	at := target
+	for attempt := 1; ; attempt++ {
+		resp, err := joinClient.Post(at+"/v1/shards/"+sr.ShardID+"/join", "application/json", bytes.NewReader(body))
+		wait := time.Second
+		switch {
+		case err != nil:
+			at = target
+		case resp.StatusCode == http.StatusNoContent:
+			_ = resp.Body.Close()
+			return nil
+		case resp.StatusCode == http.StatusTemporaryRedirect:
+			// a bare Raft address means the leader has no URL recorded
+			// yet; ask again where we are
+			if l := resp.Header.Get("X-Raft-Leader"); strings.HasPrefix(l, "http://") || strings.HasPrefix(l, "https://") {
+				at = l
+			}
+			wait = 200 * time.Millisecond
+		default:
+			err = errors.New(resp.Status)
+		}
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		if err != nil && attempt%10 == 1 {
+			log.Printf("join shard %s via %s: %v", sr.ShardID, at, err)
+		}
+		select {
+		case <-sr.quit:
+			return errors.New("shard stopped before joining")
+		case <-time.After(wait):
+		}
+	}
+}
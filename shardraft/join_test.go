@@ -0,0 +1,205 @@
+package shardraft_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	raft "github.com/hashicorp/raft"
+	"github.com/sada-02/keyper/httpapi"
+	"github.com/sada-02/keyper/raft"
+	"github.com/sada-02/keyper/shardraft"
+	"github.com/sada-02/keyper/store"
+)
+
+var fastRaft = raftnode.Tuning{
+	HeartbeatTimeout:   200 * time.Millisecond,
+	ElectionTimeout:    200 * time.Millisecond,
+	LeaderLeaseTimeout: 100 * time.Millisecond,
+	CommitTimeout:      10 * time.Millisecond,
+}
+
+type testNode struct {
+	id    string
+	url   string
+	node  *raftnode.Node
+	host  *shardraft.Host
+	store *store.BadgerStore
+	srv   *http.Server
+	stop  chan struct{}
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startNode runs a node the way the server does: main raft, HTTP API and
+// shard host following the placement table.
+func startNode(t *testing.T, id, dir string, shards, replicas int, join string) *testNode {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	n := &testNode{id: id, url: "http://" + l.Addr().String(), stop: make(chan struct{})}
+
+	if n.store, err = store.NewBadgerStore(dir); err != nil {
+		t.Fatalf("open store %s: %v", id, err)
+	}
+	n.node, err = raftnode.NewNode(&raftnode.RaftConfig{
+		NodeID:   id,
+		RaftAddr: "127.0.0.1:" + strconv.Itoa(freePort(t)),
+		HTTPAddr: n.url,
+		DataDir:  dir,
+		Store:    n.store,
+		JoinAddr: join,
+		LogStore: raftnode.LogStoreBadger,
+		Tuning:   fastRaft,
+	})
+	if err != nil {
+		t.Fatalf("start %s: %v", id, err)
+	}
+	n.host = shardraft.NewHost(shardraft.HostConfig{
+		NodeID:     id,
+		RaftHost:   "127.0.0.1",
+		RaftAdHost: "127.0.0.1",
+		BasePort:   freePort(t),
+		HTTPAddr:   n.url,
+		DataDir:    dir,
+		Options:    shardraft.Options{Raft: fastRaft, LogStore: raftnode.LogStoreBadger},
+		ShardCount: shards,
+		Replicas:   replicas,
+	})
+
+	h := httpapi.NewHandler(n.store, id)
+	h.RaftNode = n.node
+	h.ShardCount = shards
+	h.Shards = n.host
+	mux := http.NewServeMux()
+	h.Register(mux)
+	h.RegisterShardRoutes(mux)
+	n.srv = &http.Server{Handler: mux}
+	go func() { _ = n.srv.Serve(l) }()
+
+	if join != "" {
+		body, _ := json.Marshal(map[string]string{"node_id": id, "raft_addr": n.node.Addr, "http_addr": n.url})
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			resp, err := http.Post(join+"/v1/join", "application/json", bytes.NewReader(body))
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusNoContent {
+					break
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s could not join: %v", id, err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	go n.host.Follow(n.node, n.stop)
+	return n
+}
+
+func (n *testNode) close() {
+	close(n.stop)
+	n.host.Shutdown()
+	_ = n.srv.Close()
+	_ = n.node.Shutdown()
+	_ = n.store.Close()
+}
+
+// TestShardsJoinEveryNode starts a three-node cluster with two shards and
+// waits for every shard's Raft group to have a voter on each node.
+func TestShardsJoinEveryNode(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "dkvs_test_shardjoin_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(base)
+	defer os.RemoveAll(base)
+
+	const shards = 2
+	var nodes []*testNode
+	for i := 1; i <= 3; i++ {
+		join := ""
+		if i > 1 {
+			join = nodes[0].url
+		}
+		id := "n" + strconv.Itoa(i)
+		n := startNode(t, id, filepath.Join(base, id), shards, 3, join)
+		defer n.close()
+		nodes = append(nodes, n)
+	}
+
+	for s := 0; s < shards; s++ {
+		id := strconv.Itoa(s)
+		want := map[string]bool{"n1-shard-" + id: true, "n2-shard-" + id: true, "n3-shard-" + id: true}
+		deadline := time.Now().Add(30 * time.Second)
+		for !hasVoters(nodes, id, want) {
+			if time.Now().After(deadline) {
+				for _, n := range nodes {
+					if sr := n.host.Get(id); sr != nil {
+						t.Logf("%s: %v", sr.Node.ID, sr.Node.Raft.GetConfiguration().Configuration().Servers)
+					}
+				}
+				t.Fatalf("shard %s never got a voter on every node", id)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	// the placement table agrees, and names each shard's leader
+	p, err := nodes[0].node.Placement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range p.Shards {
+		if len(s.Replicas) != 3 {
+			t.Fatalf("shard %s placed on %v", s.ID, s.Replicas)
+		}
+	}
+}
+
+// hasVoters reports whether the leader of shard id has exactly the want
+// servers in its configuration, all of them voters, and every node runs the
+// shard.
+func hasVoters(nodes []*testNode, id string, want map[string]bool) bool {
+	var leader *shardraft.ShardRaft
+	for _, n := range nodes {
+		sr := n.host.Get(id)
+		if sr == nil {
+			return false
+		}
+		if sr.Node.Raft.State() == raft.Leader {
+			leader = sr
+		}
+	}
+	if leader == nil {
+		return false
+	}
+	fut := leader.Node.Raft.GetConfiguration()
+	if fut.Error() != nil {
+		return false
+	}
+	servers := fut.Configuration().Servers
+	if len(servers) != len(want) {
+		return false
+	}
+	for _, srv := range servers {
+		if !want[string(srv.ID)] || srv.Suffrage != raft.Voter {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,249 @@
+package shardraft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	raft "github.com/hashicorp/raft"
+	"github.com/sada-02/keyper/raft"
+)
+
+// moveInterval is how often a move in progress retries its current step.
+const moveInterval = 500 * time.Millisecond
+
+// moveTimeout bounds how long a move may take to get its target promoted; a
+// move that has not got that far by then fails. Once the target votes, the
+// move is finished however long that takes.
+const moveTimeout = 10 * time.Minute
+
+// moveMaxLag is how many entries the target's applied index may trail the
+// shard leader's when it is promoted.
+const moveMaxLag = 10
+
+// driveMoves starts driving every move in progress in p that this node is
+// not driving yet. Only the main leader drives moves; a new leader picks up
+// those the old one left unfinished.
+func (h *Host) driveMoves(rn *raftnode.Node, p *raftnode.Placement, nodeURL func(string) string, stop <-chan struct{}) {
+	for _, s := range p.Shards {
+		if !s.Move.Active() {
+			continue
+		}
+		h.mu.Lock()
+		busy := h.moving[s.ID]
+		h.moving[s.ID] = true
+		h.mu.Unlock()
+		if !busy {
+			go h.drive(rn, s.ID, nodeURL, stop)
+		}
+	}
+}
+
+// drive takes the move of shard id through its phases, recording each one
+// in the placement table, until the move ends, this node stops leading the
+// main raft or stop is closed.
+func (h *Host) drive(rn *raftnode.Node, id string, nodeURL func(string) string, stop <-chan struct{}) {
+	defer func() {
+		h.mu.Lock()
+		delete(h.moving, id)
+		h.mu.Unlock()
+	}()
+	started := time.Now()
+	waiting := ""
+	for rn.Raft.State() == raft.Leader {
+		p, err := rn.Placement()
+		if err != nil {
+			log.Printf("move shard %s: read placement: %v", id, err)
+			return
+		}
+		s := p.Shard(id)
+		if s == nil || !s.Move.Active() {
+			return
+		}
+		m := *s.Move
+		next, err := step(s, nodeURL)
+		switch {
+		case err == nil:
+			m.Phase = next
+		case m.Phase != raftnode.MoveRemoveSource && m.Phase != raftnode.MovePromote && time.Since(started) > moveTimeout:
+			abandon(s, nodeURL)
+			m.Phase, m.Error = raftnode.MoveFailed, err.Error()
+		case err.Error() != waiting:
+			waiting = err.Error()
+			log.Printf("move shard %s from %s to %s: %s: %v", id, m.From, m.To, m.Phase, err)
+		}
+		if m.Phase != s.Move.Phase {
+			if err := rn.MoveShard(id, m, 5*time.Second); err != nil {
+				log.Printf("move shard %s: record %s: %v", id, m.Phase, err)
+			} else {
+				log.Printf("move shard %s from %s to %s: %s", id, m.From, m.To, m.Phase)
+				waiting = ""
+				continue
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(moveInterval):
+		}
+	}
+}
+
+// step tries to finish the current phase of the move of shard s. It returns
+// the phase that follows, or why the current one is not finished yet.
+func step(s *raftnode.ShardPlacement, nodeURL func(string) string) (string, error) {
+	m := s.Move
+	from, to := ServerID(m.From, s.ID), ServerID(m.To, s.ID)
+	switch m.Phase {
+	case raftnode.MoveAddLearner, raftnode.MoveCatchUp:
+		members, err := shardMembers(s, nodeURL)
+		if err != nil {
+			return "", err
+		}
+		target, leader := members.find(to), members.find(members.Leader)
+		switch {
+		case target == nil:
+			return "", fmt.Errorf("%s has not joined the group", to)
+		case m.Phase == raftnode.MoveAddLearner:
+			return raftnode.MoveCatchUp, nil
+		case leader == nil:
+			return "", errors.New("the group has no leader")
+		case target.Error != "":
+			return "", fmt.Errorf("%s: %s", to, target.Error)
+		case target.AppliedIndex == 0 || target.AppliedIndex+moveMaxLag < leader.AppliedIndex:
+			return "", fmt.Errorf("%s has applied %d of %d entries", to, target.AppliedIndex, leader.AppliedIndex)
+		}
+		return raftnode.MovePromote, nil
+	case raftnode.MovePromote:
+		if err := shardCall(s, nodeURL, http.MethodPost, "/members/"+to+"/promote?max_lag="+strconv.Itoa(moveMaxLag)); err != nil {
+			return "", err
+		}
+		return raftnode.MoveRemoveSource, nil
+	case raftnode.MoveRemoveSource:
+		if err := shardCall(s, nodeURL, http.MethodDelete, "/members/"+from, http.StatusNotFound); err != nil {
+			return "", err
+		}
+		return raftnode.MoveDone, nil
+	}
+	return "", fmt.Errorf("unknown phase %q", m.Phase)
+}
+
+// abandon takes the target of a failed move back out of the shard's group,
+// if it got in. Its data goes once it sees the move failed.
+func abandon(s *raftnode.ShardPlacement, nodeURL func(string) string) {
+	if err := shardCall(s, nodeURL, http.MethodDelete, "/members/"+ServerID(s.Move.To, s.ID), http.StatusNotFound); err != nil {
+		log.Printf("move shard %s: remove %s: %v", s.ID, s.Move.To, err)
+	}
+}
+
+type shardMember struct {
+	ID           string `json:"id"`
+	AppliedIndex uint64 `json:"applied_index"`
+	Error        string `json:"error"`
+}
+
+type shardMemberList struct {
+	Leader  string        `json:"leader"`
+	Members []shardMember `json:"members"`
+}
+
+func (l *shardMemberList) find(id string) *shardMember {
+	for i := range l.Members {
+		if id != "" && l.Members[i].ID == id {
+			return &l.Members[i]
+		}
+	}
+	return nil
+}
+
+// shardNodes returns the HTTP URLs of the nodes hosting s, its leader first.
+func shardNodes(s *raftnode.ShardPlacement, nodeURL func(string) string) []string {
+	var out []string
+	for _, node := range append([]string{s.Leader}, s.Replicas...) {
+		if node == "" {
+			continue
+		}
+		if u := nodeURL(node); u != "" {
+			out = append(out, strings.TrimRight(u, "/"))
+		}
+	}
+	return out
+}
+
+// shardMembers reads the shard's Raft configuration, with each server's
+// progress, from the first node hosting s that answers.
+func shardMembers(s *raftnode.ShardPlacement, nodeURL func(string) string) (*shardMemberList, error) {
+	err := errors.New("no replica has a known address")
+	for _, base := range shardNodes(s, nodeURL) {
+		var resp *http.Response
+		resp, err = joinClient.Get(base + "/v1/shards/" + s.ID + "/members")
+		if err != nil {
+			continue
+		}
+		var out shardMemberList
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("%s answered %s", base, resp.Status)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&out)
+		}
+		_ = resp.Body.Close()
+		if err == nil {
+			return &out, nil
+		}
+	}
+	return nil, err
+}
+
+// shardCall sends a bodiless request for path under /v1/shards/{id} to the
+// shard's leader, following its redirects. It succeeds on 204 and on any of
+// the statuses in ok.
+func shardCall(s *raftnode.ShardPlacement, nodeURL func(string) string, method, path string, ok ...int) error {
+	_, err := shardDo(s, nodeURL, method, path, nil, ok...)
+	return err
+}
+
+// shardDo is shardCall with a JSON request body, if body is non-nil, that
+// returns the response body.
+func shardDo(s *raftnode.ShardPlacement, nodeURL func(string) string, method, path string, body []byte, ok ...int) ([]byte, error) {
+	nodes := shardNodes(s, nodeURL)
+	if len(nodes) == 0 {
+		return nil, errors.New("no replica has a known address")
+	}
+	at := nodes[0]
+	for hops := 0; hops < 3; hops++ {
+		req, err := http.NewRequest(method, at+"/v1/shards/"+s.ID+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := joinClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusNoContent {
+			return msg, nil
+		}
+		for _, code := range ok {
+			if resp.StatusCode == code {
+				return msg, nil
+			}
+		}
+		l := resp.Header.Get("X-Raft-Leader")
+		if resp.StatusCode != http.StatusTemporaryRedirect || !(strings.HasPrefix(l, "http://") || strings.HasPrefix(l, "https://")) {
+			return nil, fmt.Errorf("%s answered %s: %s", at, resp.Status, strings.TrimSpace(string(msg)))
+		}
+		at = strings.TrimRight(l, "/")
+	}
+	return nil, errors.New("too many redirects")
+}
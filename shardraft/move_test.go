@@ -0,0 +1,140 @@
+package shardraft_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sada-02/keyper/raft"
+)
+
+// TestShardMove places one shard on two of three nodes, moves the replica
+// off the shard's founder onto the third node and checks that the data
+// followed, the founder left the group and deleted its replica.
+func TestShardMove(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "dkvs_test_shardmove_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(base)
+	defer os.RemoveAll(base)
+
+	var nodes []*testNode
+	for i := 1; i <= 3; i++ {
+		join := ""
+		if i > 1 {
+			join = nodes[0].url
+		}
+		id := "n" + strconv.Itoa(i)
+		n := startNode(t, id, filepath.Join(base, id), 1, 2, join)
+		defer n.close()
+		nodes = append(nodes, n)
+	}
+
+	// wait for the shard to be on n1 and one other node, and write to it
+	var from, to *testNode
+	deadline := time.Now().Add(30 * time.Second)
+	for to == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("shard 0 never got two replicas")
+		}
+		time.Sleep(100 * time.Millisecond)
+		p, err := nodes[0].node.Placement()
+		if err != nil || len(p.Shards) != 1 || len(p.Shards[0].Replicas) != 2 || p.Shards[0].Leader == "" {
+			continue
+		}
+		for _, n := range nodes {
+			if !p.Shards[0].HasReplica(n.id) {
+				to = n
+			}
+		}
+		from = nodes[0]
+	}
+	for i := 0; i < 20; i++ {
+		req, _ := http.NewRequest(http.MethodPut, from.url+"/v1/keys/k"+strconv.Itoa(i), bytes.NewReader([]byte("v")))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("put: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("put: %s", resp.Status)
+		}
+	}
+
+	// assign cannot take a replica away; that is what moves are for
+	p, _ := nodes[0].node.Placement()
+	var swapped []string
+	for _, r := range p.Shards[0].Replicas {
+		if r != from.id {
+			swapped = append(swapped, r)
+		}
+	}
+	body, _ := json.Marshal(map[string]interface{}{"shard_id": "0", "nodes": append(swapped, to.id)})
+	resp, err := http.Post(nodes[0].url+"/v1/shards/assign", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("assign: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("assign dropping %s: %s, want 409", from.id, resp.Status)
+	}
+
+	body, _ = json.Marshal(map[string]string{"from": from.id, "to": to.id})
+	resp, err = http.Post(nodes[0].url+"/v1/shards/0/move", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	msg, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("move: %s: %s", resp.Status, msg)
+	}
+
+	deadline = time.Now().Add(30 * time.Second)
+	for {
+		p, err := nodes[0].node.Placement()
+		if err == nil && p.Shards[0].Move != nil && p.Shards[0].Move.Phase == raftnode.MoveDone {
+			if !p.Shards[0].HasReplica(to.id) || p.Shards[0].HasReplica(from.id) {
+				t.Fatalf("shard 0 placed on %v after the move", p.Shards[0].Replicas)
+			}
+			break
+		}
+		if err == nil && p.Shards[0].Move != nil && p.Shards[0].Move.Phase == raftnode.MoveFailed {
+			t.Fatalf("move failed: %s", p.Shards[0].Move.Error)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("move never finished: %+v", p.Shards[0].Move)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	want := map[string]bool{}
+	for _, n := range nodes {
+		if n != from {
+			want[n.id+"-shard-0"] = true
+		}
+	}
+	dir := filepath.Join(base, from.id, "shards", "0")
+	deadline = time.Now().Add(10 * time.Second)
+	for {
+		_, statErr := os.Stat(dir)
+		if from.host.Get("0") == nil && os.IsNotExist(statErr) && hasVoters([]*testNode{nodes[1], nodes[2]}, "0", want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("source replica not torn down (running %v, data %v)", from.host.Get("0") != nil, statErr)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for i := 0; i < 20; i++ {
+		v, err := to.host.Get("0").Store.Get([]byte("k" + strconv.Itoa(i)))
+		if err != nil || string(v) != "v" {
+			t.Fatalf("k%d on the new replica: %q, %v", i, v, err)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package shardraft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	raft "github.com/hashicorp/raft"
+	"github.com/sada-02/keyper/raft"
+	"github.com/sada-02/keyper/store"
+)
+
+// Founder returns the node that founds the shard a split or merge of from
+// makes: one hosting a replica of every shard in from, the first one's
+// leader if it can. It returns "" if no node hosts them all.
+func Founder(from ...*raftnode.ShardPlacement) string {
+	if len(from) == 0 {
+		return ""
+	}
+next:
+	for _, node := range append([]string{from[0].Leader}, from[0].Replicas...) {
+		if node == "" {
+			continue
+		}
+		for _, s := range from {
+			if !s.HasReplica(node) {
+				continue next
+			}
+		}
+		return node
+	}
+	return ""
+}
+
+// driveReshards starts driving every split and merge in progress in p that
+// this node is not driving yet. Like moves, only the main leader drives
+// them, and a new leader picks up those the old one left unfinished.
+func (h *Host) driveReshards(rn *raftnode.Node, p *raftnode.Placement, nodeURL func(string) string, stop <-chan struct{}) {
+	for _, s := range p.Shards {
+		if !s.Reshard.Active() {
+			continue
+		}
+		to := s.Reshard.To
+		h.mu.Lock()
+		busy := h.splits[to]
+		h.splits[to] = true
+		h.mu.Unlock()
+		if !busy {
+			go h.driveReshard(rn, to, nodeURL, stop)
+		}
+	}
+}
+
+// driveReshard takes the split or merge into shard to through its phases,
+// recording each one in the placement table, until it is done, this node
+// stops leading the main raft or stop is closed.
+func (h *Host) driveReshard(rn *raftnode.Node, to string, nodeURL func(string) string, stop <-chan struct{}) {
+	defer func() {
+		h.mu.Lock()
+		delete(h.splits, to)
+		h.mu.Unlock()
+	}()
+	waiting := ""
+	cuts := make(map[string]uint64)
+	for rn.Raft.State() == raft.Leader {
+		p, err := rn.Placement()
+		if err != nil {
+			log.Printf("reshard into shard %s: read placement: %v", to, err)
+			return
+		}
+		cur := reshardOf(p, to)
+		if cur == nil {
+			return
+		}
+		r := *cur
+		next, founder, err := reshardStep(p, &r, cuts, nodeURL)
+		if err == nil {
+			r.Phase = next
+			var replicas []string
+			if s := p.Shard(r.From[0]); s != nil && next == raftnode.ReshardSeeding {
+				replicas = s.Replicas
+			}
+			if err := rn.Reshard(r, replicas, founder, 5*time.Second); err != nil {
+				log.Printf("%s %v into shard %s: record %s: %v", r.Kind, r.From, to, next, err)
+			} else {
+				log.Printf("%s %v into shard %s: %s", r.Kind, r.From, to, next)
+				waiting = ""
+				continue
+			}
+		} else if err.Error() != waiting {
+			waiting = err.Error()
+			log.Printf("%s %v into shard %s: %s: %v", r.Kind, r.From, to, r.Phase, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(moveInterval):
+		}
+	}
+}
+
+// reshardOf returns the split or merge into shard to in progress in p, or nil.
+func reshardOf(p *raftnode.Placement, to string) *raftnode.Reshard {
+	for i := range p.Shards {
+		if r := p.Shards[i].Reshard; r.Active() && r.To == to {
+			return r
+		}
+	}
+	return nil
+}
+
+// reshardStep tries to finish the current phase of r. While cutting, it has
+// each shard in r.From cut off the keys it hands on, once, keeping the index
+// of the cut in cuts by shard, and waits for the founder's replica of it to
+// apply the cut, so the founder has them all when the table switches over;
+// it returns the founder with the next phase. While seeding, it waits for
+// the new shard to report a leader, which it only does once it holds its
+// keys.
+func reshardStep(p *raftnode.Placement, r *raftnode.Reshard, cuts map[string]uint64, nodeURL func(string) string) (next, founder string, err error) {
+	switch r.Phase {
+	case raftnode.ReshardCutting:
+		from := make([]*raftnode.ShardPlacement, len(r.From))
+		for i, id := range r.From {
+			if from[i] = p.Shard(id); from[i] == nil {
+				return "", "", fmt.Errorf("no shard %s", id)
+			}
+		}
+		founder = Founder(from...)
+		if founder == "" {
+			return "", "", fmt.Errorf("no node hosts a replica of every shard of %v", r.From)
+		}
+		for _, s := range from {
+			index, ok := cuts[s.ID]
+			if !ok {
+				c := raftnode.Cut{From: s.ID, To: r.To, Range: r.Range}
+				if r.Kind == raftnode.ReshardSplit {
+					c.Keep = r.Keep
+				}
+				body, _ := json.Marshal(c)
+				out, err := shardDo(s, nodeURL, http.MethodPost, "/cut", body, http.StatusOK)
+				if err != nil {
+					return "", "", err
+				}
+				var res struct {
+					Index uint64 `json:"index"`
+				}
+				if err := json.Unmarshal(out, &res); err != nil {
+					return "", "", fmt.Errorf("cut shard %s: %w", s.ID, err)
+				}
+				index = res.Index
+				cuts[s.ID] = index
+			}
+			members, err := shardMembers(s, nodeURL)
+			if err != nil {
+				return "", "", err
+			}
+			if m := members.find(ServerID(founder, s.ID)); m == nil || m.AppliedIndex < index {
+				return "", "", fmt.Errorf("%s has not applied the cut of shard %s yet", founder, s.ID)
+			}
+		}
+		return raftnode.ReshardSeeding, founder, nil
+	case raftnode.ReshardSeeding:
+		if s := p.Shard(r.To); s == nil || s.Leader == "" {
+			return "", "", fmt.Errorf("shard %s has not loaded its keys yet", r.To)
+		}
+		return raftnode.ReshardDone, "", nil
+	}
+	return "", "", fmt.Errorf("unknown phase %q", r.Phase)
+}
+
+// seed loads the keys of the shard sr founds, which a split or merge r
+// makes, from the cuts this node's replicas of r.From wrote. It retries
+// until the keys are in or sr shuts down; a replica that has them already,
+// from before a restart, is left alone.
+func (h *Host) seed(sr *ShardRaft, r raftnode.Reshard) {
+	waiting := ""
+	for {
+		if _, all := sr.Node.KeyRange(); !all {
+			return
+		}
+		err := h.loadCuts(sr, r)
+		if err == nil {
+			log.Printf("shard %s loaded its keys from the cut of %v", sr.ShardID, r.From)
+			return
+		}
+		if err.Error() != waiting {
+			waiting = err.Error()
+			log.Printf("shard %s: load keys: %v", sr.ShardID, err)
+		}
+		select {
+		case <-sr.quit:
+			return
+		case <-time.After(moveInterval):
+		}
+	}
+}
+
+// loadCuts joins the cuts for r into one snapshot and restores it as the
+// state of sr's group, which sr must lead. The restore jumps the log past
+// the highest version in the cuts, so new writes version above them.
+func (h *Host) loadCuts(sr *ShardRaft, r raftnode.Reshard) error {
+	if sr.Node.Raft.State() != raft.Leader {
+		return errors.New("not leading the new group yet")
+	}
+	dir := filepath.Join(h.cfg.DataDir, "shards")
+	var cuts []string
+	for _, from := range r.From {
+		path := raftnode.CutFile(dir, from, r.To)
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("no cut from shard %s yet", from)
+		}
+		cuts = append(cuts, path)
+	}
+	seed := filepath.Join(dir, r.To+".seed")
+	defer os.Remove(seed)
+	if err := store.JoinSnapshots(seed, cuts...); err != nil {
+		return err
+	}
+	f, err := os.Open(seed)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := store.InspectSnapshot(f)
+	if err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return sr.Node.Restore(f, size, info.MaxVersion, time.Minute)
+}
+
+// dropCuts deletes the cuts on this node that the shard they were made for
+// has loaded: its split or merge is done, or it has since been merged away.
+func (h *Host) dropCuts(p *raftnode.Placement) {
+	paths, _ := filepath.Glob(filepath.Join(h.cfg.DataDir, "shards", "*.cut"))
+	for _, path := range paths {
+		_, to, ok := strings.Cut(strings.TrimSuffix(filepath.Base(path), ".cut"), "-")
+		if !ok {
+			continue
+		}
+		loaded := false
+		if s := p.Shard(to); s != nil {
+			loaded = !s.Reshard.Active()
+		} else {
+			for _, s := range p.Shards {
+				if r := s.Reshard; r != nil && r.Kind == raftnode.ReshardMerge && r.To == s.ID && (r.From[0] == to || r.From[1] == to) {
+					loaded = true
+				}
+			}
+		}
+		if !loaded {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("warning: unable to delete cut %s: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package shardraft_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sada-02/keyper/httpapi"
+	"github.com/sada-02/keyper/raft"
+	"github.com/sada-02/keyper/shard"
+)
+
+// TestShardSplitMerge splits a shard by hash, splits the new half by key,
+// merges the two key halves back and checks after each step that every key
+// routes to the shard owning it and keeps its value.
+func TestShardSplitMerge(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "dkvs_test_shardsplit_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(base)
+	defer os.RemoveAll(base)
+
+	var nodes []*testNode
+	for i := 1; i <= 3; i++ {
+		join := ""
+		if i > 1 {
+			join = nodes[0].url
+		}
+		id := "n" + strconv.Itoa(i)
+		n := startNode(t, id, filepath.Join(base, id), 1, 3, join)
+		defer n.close()
+		nodes = append(nodes, n)
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		p, err := nodes[0].node.Placement()
+		if err == nil && len(p.Shards) == 1 && len(p.Shards[0].Replicas) == 3 && p.Shards[0].Leader != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("shard 0 never got three replicas")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	keys := make(map[string]string)
+	for i := 0; i < 40; i++ {
+		k := "k" + strconv.Itoa(i)
+		keys[k] = "v" + strconv.Itoa(i)
+		keyRequest(t, nodes[0], http.MethodPut, k, keys[k])
+	}
+
+	for _, step := range []struct {
+		path, body, to string
+		shards         []string
+	}{
+		{"/v1/shards/0/split", "", "1", []string{"0", "1"}},
+		{"/v1/shards/1/split", `{"key":"k3"}`, "2", []string{"0", "1", "2"}},
+		{"/v1/shards/1/merge", `{"with":"2"}`, "3", []string{"0", "3"}},
+	} {
+		resp, err := http.Post(nodes[0].url+step.path, "application/json", bytes.NewReader([]byte(step.body)))
+		if err != nil {
+			t.Fatalf("%s: %v", step.path, err)
+		}
+		msg, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("%s: %s: %s", step.path, resp.Status, msg)
+		}
+
+		deadline := time.Now().Add(30 * time.Second)
+		var p *raftnode.Placement
+		for {
+			p, err = nodes[0].node.Placement()
+			if err == nil {
+				if s := p.Shard(step.to); s != nil && s.Reshard != nil && s.Reshard.Phase == raftnode.ReshardDone {
+					break
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s never finished: %+v", step.path, p)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		var ids []string
+		for _, s := range p.Shards {
+			ids = append(ids, s.ID)
+		}
+		if len(ids) != len(step.shards) {
+			t.Fatalf("after %s the table has shards %v, want %v", step.path, ids, step.shards)
+		}
+
+		for k, v := range keys {
+			shard, got := keyRequest(t, nodes[1], http.MethodGet, k, "")
+			if got != v {
+				t.Fatalf("after %s: %s = %q, want %q", step.path, k, got, v)
+			}
+			if want := p.Locate(k, 1).ID; shard != want {
+				t.Fatalf("after %s: %s served by shard %s, want %s", step.path, k, shard, want)
+			}
+		}
+		// writes go on at the new shard's versions
+		keys["k0"] = "w" + step.to
+		keyRequest(t, nodes[0], http.MethodPut, "k0", keys["k0"])
+	}
+
+	// the shards merged away, and the cuts, are gone from every node
+	for _, n := range nodes {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			cuts, _ := filepath.Glob(filepath.Join(base, n.id, "shards", "*.cut"))
+			if len(cuts) == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("cuts left on %s: %v", n.id, cuts)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		for _, id := range []string{"1", "2"} {
+			dir := filepath.Join(base, n.id, "shards", id)
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				if _, err := os.Stat(dir); os.IsNotExist(err) && n.host.Get(id) == nil {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("shard %s still on %s after the merge", id, n.id)
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+	}
+}
+
+// TestShardConcurrentSplits splits two shards at once: each split must make
+// a shard of its own, and both must finish with every key in place.
+func TestShardConcurrentSplits(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "dkvs_test_shardsplits_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(base)
+	defer os.RemoveAll(base)
+
+	n := startNode(t, "n1", filepath.Join(base, "n1"), 2, 1, "")
+	defer n.close()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		p, err := n.node.Placement()
+		if err == nil && len(p.Shards) == 2 && p.Shards[0].Leader != "" && p.Shards[1].Leader != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("shards 0 and 1 never got leaders")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	keys := make(map[string]string)
+	for i := 0; i < 40; i++ {
+		k := "k" + strconv.Itoa(i)
+		keys[k] = "v" + strconv.Itoa(i)
+		keyRequest(t, n, http.MethodPut, k, keys[k])
+	}
+
+	type result struct {
+		status int
+		res    raftnode.Reshard
+		msg    string
+	}
+	results := make(chan result, 2)
+	for _, id := range []string{"0", "1"} {
+		go func(id string) {
+			resp, err := http.Post(n.url+"/v1/shards/"+id+"/split", "application/json", nil)
+			if err != nil {
+				results <- result{msg: err.Error()}
+				return
+			}
+			defer resp.Body.Close()
+			msg, _ := io.ReadAll(resp.Body)
+			r := result{status: resp.StatusCode, msg: string(msg)}
+			_ = json.Unmarshal(msg, &r.res)
+			results <- r
+		}(id)
+	}
+	var to []string
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.status != http.StatusAccepted {
+			t.Fatalf("split: %d: %s", r.status, r.msg)
+		}
+		to = append(to, r.res.To)
+	}
+	if to[0] == to[1] {
+		t.Fatalf("both splits make shard %s", to[0])
+	}
+
+	deadline = time.Now().Add(30 * time.Second)
+	var p *raftnode.Placement
+	for {
+		var err error
+		p, err = n.node.Placement()
+		if err == nil {
+			a, b := p.Shard(to[0]), p.Shard(to[1])
+			if a != nil && b != nil && !a.Reshard.Active() && !b.Reshard.Active() {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("splits into %v never finished: %+v", to, p)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(p.Shards) != 4 {
+		t.Fatalf("after both splits the table has %d shards, want 4", len(p.Shards))
+	}
+	for k, v := range keys {
+		shard, got := keyRequest(t, n, http.MethodGet, k, "")
+		if got != v {
+			t.Fatalf("%s = %q, want %q", k, got, v)
+		}
+		if want := p.Locate(k, 2).ID; shard != want {
+			t.Fatalf("%s served by shard %s, want %s", k, shard, want)
+		}
+	}
+}
+
+// TestShardTxnBatch sends a batch and a txn whose keys are all on one shard
+// and checks that the shard applies them, and that one spanning both shards
+// is refused.
+func TestShardTxnBatch(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "dkvs_test_shardtxn_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(base)
+	defer os.RemoveAll(base)
+
+	n := startNode(t, "n1", filepath.Join(base, "n1"), 2, 1, "")
+	defer n.close()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		p, err := n.node.Placement()
+		if err == nil && len(p.Shards) == 2 && p.Shards[0].Leader != "" && p.Shards[1].Leader != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("shards 0 and 1 never got leaders")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	var on [2][]string // keys of shard 0 and shard 1
+	for i := 0; len(on[0]) < 3 || len(on[1]) < 3; i++ {
+		k := "k" + strconv.Itoa(i)
+		s, _ := strconv.Atoi(shard.ForKey(k, 2))
+		on[s] = append(on[s], k)
+	}
+
+	post := func(path, body string) (int, string, string) {
+		deadline := time.Now().Add(30 * time.Second)
+		for {
+			resp, err := http.Post(n.url+path, "application/json", strings.NewReader(body))
+			if err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+			msg, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusServiceUnavailable || time.Now().After(deadline) {
+				return resp.StatusCode, resp.Header.Get(httpapi.ShardHeader), string(msg)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	code, sid, msg := post("/v1/batch", `{"ops":[{"op":"set","key":"`+on[1][0]+`","value":"YQ=="},{"op":"set","key":"`+on[1][1]+`","value":"Yg=="}]}`)
+	if code != http.StatusOK || sid != "1" {
+		t.Fatalf("batch on shard 1: %d from shard %q: %s", code, sid, msg)
+	}
+	code, sid, msg = post("/v1/txn", `{"guards":[{"key":"`+on[1][0]+`","exists":true}],"success":[{"op":"set","key":"`+on[1][2]+`","value":"Yw=="}]}`)
+	if code != http.StatusOK || sid != "1" || !strings.Contains(msg, `"succeeded":true`) {
+		t.Fatalf("txn on shard 1: %d from shard %q: %s", code, sid, msg)
+	}
+	for k, v := range map[string]string{on[1][0]: "a", on[1][1]: "b", on[1][2]: "c"} {
+		if _, got := keyRequest(t, n, http.MethodGet, k, ""); got != v {
+			t.Fatalf("%s = %q, want %q", k, got, v)
+		}
+	}
+	if code, _, msg = post("/v1/batch", `{"ops":[{"op":"set","key":"`+on[0][0]+`","value":"YQ=="},{"op":"set","key":"`+on[1][0]+`","value":"YQ=="}]}`); code != http.StatusBadRequest {
+		t.Fatalf("batch over both shards: %d: %s", code, msg)
+	}
+}
+
+// TestShardCutFailure fails a cut on one shard, by closing its store under
+// it, and checks that only that shard's replica stops: the node's other
+// shard and its main raft keep serving, and /v1/shards/status reports it.
+func TestShardCutFailure(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "dkvs_test_shardfail_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	_ = os.RemoveAll(base)
+	defer os.RemoveAll(base)
+
+	n := startNode(t, "n1", filepath.Join(base, "n1"), 2, 1, "")
+	defer n.close()
+	deadline := time.Now().Add(30 * time.Second)
+	var p *raftnode.Placement
+	for {
+		var err error
+		p, err = n.node.Placement()
+		if err == nil && len(p.Shards) == 2 && p.Shards[0].Leader != "" && p.Shards[1].Leader != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("shards 0 and 1 never got leaders")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	var other string // a key of shard 1
+	for i := 0; other == ""; i++ {
+		if k := "k" + strconv.Itoa(i); shard.ForKey(k, 2) == "1" {
+			other = k
+		}
+	}
+	keyRequest(t, n, http.MethodPut, other, "v")
+
+	keep, rest, err := p.Shard("0").KeyRange(2).SplitHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(raftnode.Cut{From: "0", To: "9", Keep: &keep, Range: rest})
+	_ = n.host.Get("0").Store.Close()
+	resp, err := http.Post(n.url+"/v1/shards/0/cut", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("cut: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("cut on a closed store succeeded")
+	}
+
+	deadline = time.Now().Add(10 * time.Second)
+	for n.host.Get("0") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("shard 0 still running after its cut failed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	resp, err = http.Get(n.url + "/v1/shards/status")
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	var status []struct {
+		ShardID string `json:"shard_id"`
+		Failed  string `json:"failed"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if err != nil || len(status) != 2 || status[0].ShardID != "1" || status[0].Failed != "" || status[1].ShardID != "0" || !strings.Contains(status[1].Failed, "cut of shard 0") {
+		t.Fatalf("status %+v, %v; want shard 1 running and shard 0 failed", status, err)
+	}
+	if _, got := keyRequest(t, n, http.MethodGet, other, ""); got != "v" {
+		t.Fatalf("%s = %q on the shard left running", other, got)
+	}
+	if err := n.node.RegisterMember(raftnode.Member{ID: "n1", HTTPAddr: n.url}, 5*time.Second); err != nil {
+		t.Fatalf("main raft after the failure: %v", err)
+	}
+}
+
+// keyRequest sends a request for key to n, following redirects to the
+// key's shard leader and retrying while the key is in transit between
+// shards, and returns the shard that served it and the body. Writes must
+// succeed; reads must find the key.
+func keyRequest(t *testing.T, n *testNode, method, key, value string) (string, string) {
+	t.Helper()
+	at := n.url
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		req, _ := http.NewRequest(method, at+"/v1/keys/"+key, bytes.NewReader([]byte(value)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, key, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusNoContent:
+			return resp.Header.Get(httpapi.ShardHeader), string(body)
+		case http.StatusServiceUnavailable:
+		case http.StatusTemporaryRedirect:
+			if l := resp.Header.Get("X-Raft-Leader"); strings.HasPrefix(l, "http://") {
+				at = l
+			}
+		default:
+			t.Fatalf("%s %s: %s: %s", method, key, resp.Status, body)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s %s: still unavailable", method, key)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
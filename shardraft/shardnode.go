@@ -3,6 +3,7 @@ package shardraft
 import (
 	"fmt"
 	"path/filepath"
+	"sync"
 
 	"github.com/sada-02/keyper/raft"
 	"github.com/sada-02/keyper/store"
@@ -13,31 +14,72 @@ type ShardRaft struct {
 	ShardID string
 	Node    *raftnode.Node
 	Store   *store.BadgerStore
+
+	quit     chan struct{} // closed by Shutdown
+	quitOnce sync.Once
+
+	// awaitSeed is set on replicas of shards made by a split or merge,
+	// whose keys arrive with the cut of their parents; see Ready.
+	awaitSeed bool
+}
+
+// Ready reports whether the replica has the keys of its shard. A shard made
+// by a split or merge is not ready until its store holds the parents' cut.
+func (sr *ShardRaft) Ready() bool {
+	if !sr.awaitSeed {
+		return true
+	}
+	_, all := sr.Node.KeyRange()
+	return !all
+}
+
+// Options tunes the Raft instance and Badger store of every shard.
+type Options struct {
+	Raft     raftnode.Tuning
+	Badger   store.Options
+	LogStore string // raftnode.LogStoreBolt or raftnode.LogStoreBadger
+}
+
+// ServerID is the ID of node's replica of shardID in the shard's Raft group.
+func ServerID(node, shardID string) string {
+	return node + "-shard-" + shardID
+}
+
+// shardDir is where the replica of shardID keeps its store and Raft state.
+func shardDir(dataDir, shardID string) string {
+	return filepath.Join(dataDir, "shards", shardID)
 }
 
 // StartShardRaft starts a raft instance for shardID on this node.
 // - nodeBaseID: the node's base ID (e.g. "node1").
 // - raftAddr: the raft listen address for the shard (host:port).
+// - raftAdvertise: the address other nodes dial for this shard; empty means raftAddr.
+// - httpAddr: this node's advertised HTTP URL, recorded in the shard's membership table.
 // - dataDir: base data dir; shard data will live in dataDir/shards/<shardID>
-// - joinAddr: optional join HTTP address to add this raft server (leader); can be empty to bootstrap single-node.
-func StartShardRaft(nodeBaseID, shardID, raftAddr, dataDir, joinAddr string) (*ShardRaft, error) {
-	shardDataDir := filepath.Join(dataDir, "shards", shardID)
+// - joinAddr: empty bootstraps a single-node group; otherwise the replica waits to be added, see Join.
+// - opts: Raft and Badger tuning, shared with the node's main raft.
+func StartShardRaft(nodeBaseID, shardID, raftAddr, raftAdvertise, httpAddr, dataDir, joinAddr string, opts Options) (*ShardRaft, error) {
+	shardDataDir := shardDir(dataDir, shardID)
 
 	// open per-shard Badger store
-	st, err := store.NewBadgerStore(shardDataDir)
+	st, err := store.NewBadgerStoreWithOptions(shardDataDir, opts.Badger)
 	if err != nil {
 		return nil, fmt.Errorf("open shard store %s: %w", shardID, err)
 	}
 
-	// Build a unique node id per shard: "<nodeBaseID>-shard-<shardID>"
-	nodeID := fmt.Sprintf("%s-shard-%s", nodeBaseID, shardID)
+	nodeID := ServerID(nodeBaseID, shardID)
 
 	raftCfg := &raftnode.RaftConfig{
-		NodeID:   nodeID,
-		RaftAddr: raftAddr,
-		DataDir:  shardDataDir,
-		Store:    st,
-		JoinAddr: joinAddr,
+		NodeID:        nodeID,
+		RaftAddr:      raftAddr,
+		RaftAdvertise: raftAdvertise,
+		HTTPAddr:      httpAddr,
+		DataDir:       shardDataDir,
+		Store:         st,
+		JoinAddr:      joinAddr,
+		Tuning:        opts.Raft,
+		LogStore:      opts.LogStore,
+		CutDir:        filepath.Join(dataDir, "shards"),
 	}
 
 	node, err := raftnode.NewNode(raftCfg)
@@ -50,15 +92,21 @@ func StartShardRaft(nodeBaseID, shardID, raftAddr, dataDir, joinAddr string) (*S
 		ShardID: shardID,
 		Node:    node,
 		Store:   st,
+		quit:    make(chan struct{}),
 	}, nil
 }
 
-// Shutdown shuts down the underlying raft node and closes store.
+// Shutdown shuts down the underlying raft node and closes store. Raft is
+// fully stopped before the store is closed, so no apply races the close.
+// Calls after the first wait for it to finish and do nothing.
 func (sr *ShardRaft) Shutdown() {
-	if sr.Node != nil && sr.Node.Raft != nil {
-		_ = sr.Node.Raft.Shutdown()
-	}
-	if sr.Store != nil {
-		_ = sr.Store.Close()
-	}
+	sr.quitOnce.Do(func() {
+		close(sr.quit)
+		if sr.Node != nil && sr.Node.Raft != nil {
+			_ = sr.Node.Shutdown()
+		}
+		if sr.Store != nil {
+			_ = sr.Store.Close()
+		}
+	})
 }
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxKeySize is Badger's limit on key length.
+const maxKeySize = 65000
+
+// BatchResult is the outcome of one op of a batch. Error is set, and nothing
+// was written for the op, when the op was rejected.
+type BatchResult struct {
+	Op      string `json:"op"`
+	Key     string `json:"key"`
+	Version uint64 `json:"version,omitempty"` // version written by a set
+	Error   string `json:"error,omitempty"`
+}
+
+// validateOp reports why op cannot be applied, or nil.
+func validateOp(op TxnOp) error {
+	if op.Key == "" {
+		return errors.New("op key required")
+	}
+	if len(op.Key) > maxKeySize {
+		return fmt.Errorf("key too large: %d bytes", len(op.Key))
+	}
+	if IsMetaKey([]byte(op.Key)) {
+		return errors.New("key reserved")
+	}
+	if op.Op != "set" && op.Op != "delete" {
+		return fmt.Errorf("unknown op: %s", op.Op)
+	}
+	return nil
+}
+
+// ApplyBatch applies independent set/delete ops with a Badger WriteBatch,
+// which amortises the synchronous commit over the whole batch. Unlike
+// ApplyTxn there are no guards and the batch is not atomic: malformed ops are
+// skipped and reported in their result while the rest are written. Keys set
+// get the given version (the Raft log index); with a zero version the ops are
+// written one at a time so each key can get its current version plus one.
+func (s *BadgerStore) ApplyBatch(ops []TxnOp, version uint64) ([]BatchResult, error) {
+	results := batchResults(ops)
+
+	if version == 0 {
+		for i, op := range ops {
+			if results[i].Error != "" {
+				continue
+			}
+			switch op.Op {
+			case "set":
+				v, err := s.CheckAndSet(&KVPair{Key: op.Key, Value: op.Value, ExpiresAt: op.ExpiresAt}, nil)
+				if err != nil {
+					return nil, err
+				}
+				results[i].Version = v
+			case "delete":
+				if err := s.CheckAndDelete([]byte(op.Key), nil); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return results, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for i, op := range ops {
+		if results[i].Error != "" {
+			continue
+		}
+		switch op.Op {
+		case "set":
+			kv := &KVPair{Key: op.Key, Value: op.Value, ExpiresAt: op.ExpiresAt, Version: version}
+			if err := wb.SetEntry(encodeEntry(kv)); err != nil {
+				return nil, err
+			}
+			results[i].Version = version
+		case "delete":
+			if err := wb.Delete([]byte(op.Key)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ApplyBatch is BadgerStore.ApplyBatch inside the transaction, which makes
+// the batch atomic. A batch too big for one transaction fails with an error
+// matching badger.ErrTxnTooBig.
+func (tx *Tx) ApplyBatch(ops []TxnOp, version uint64) ([]BatchResult, error) {
+	results := batchResults(ops)
+	for i, op := range ops {
+		if results[i].Error != "" {
+			continue
+		}
+		switch op.Op {
+		case "set":
+			v, err := checkAndSet(tx.txn, &KVPair{Key: op.Key, Value: op.Value, ExpiresAt: op.ExpiresAt, Version: version}, nil)
+			if err != nil {
+				return nil, err
+			}
+			results[i].Version = v
+		case "delete":
+			if err := checkAndDelete(tx.txn, []byte(op.Key), nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return results, nil
+}
+
+// batchResults returns a result per op, with malformed ops already failed.
+func batchResults(ops []TxnOp) []BatchResult {
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		results[i] = BatchResult{Op: op.Op, Key: op.Key}
+		if err := validateOp(op); err != nil {
+			results[i].Error = err.Error()
+		}
+	}
+	return results
+}
@@ -0,0 +1,161 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Cut writes the keys picked by match, and the metadata entries in meta, to
+// a snapshot at path that Restore loads, for splitting a store in two. It
+// reads one consistent view of the store; the file appears complete or not
+// at all. Metadata already in the store is never picked.
+func (s *BadgerStore) Cut(path string, match func(key []byte) bool, meta map[string][]byte) error {
+	return writeSnapshotFile(path, func(emit func(e *badger.Entry) error) error {
+		err := s.view(func(txn *badger.Txn) error {
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				item := it.Item()
+				if IsMetaKey(item.Key()) || !match(item.Key()) {
+					continue
+				}
+				v, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				e := badger.NewEntry(item.KeyCopy(nil), v).WithMeta(item.UserMeta())
+				e.ExpiresAt = item.ExpiresAt()
+				if err := emit(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for name, v := range meta {
+			if err := emit(badger.NewEntry(metaKey(name), v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteKeys deletes every key picked by match, in as many transactions as
+// it takes. Metadata is never picked.
+func (s *BadgerStore) DeleteKeys(match func(key []byte) bool) error {
+	var keys [][]byte
+	err := s.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if k := it.Item().Key(); !IsMetaKey(k) && match(k) {
+				keys = append(keys, it.Item().KeyCopy(nil))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, k := range keys {
+		if err := wb.Delete(k); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// JoinSnapshots writes the entries of every snapshot in srcs, in order, to
+// one snapshot at dst; a key in several keeps its last value.
+func JoinSnapshots(dst string, srcs ...string) error {
+	return writeSnapshotFile(dst, func(emit func(e *badger.Entry) error) error {
+		for _, src := range srcs {
+			f, err := os.Open(src)
+			if err != nil {
+				return err
+			}
+			err = decodeSnapshot(f, emit)
+			_ = f.Close()
+			if err != nil {
+				return fmt.Errorf("read %s: %w", src, err)
+			}
+		}
+		return nil
+	})
+}
+
+// writeSnapshotFile writes the entries fill emits to an uncompressed
+// snapshot at path, through a temporary file renamed into place at the end.
+func writeSnapshotFile(path string, fill func(emit func(e *badger.Entry) error) error) error {
+	body, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".body-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(body.Name())
+	defer body.Close()
+
+	crc := crc32.New(castagnoli)
+	counted := &countingWriter{w: io.MultiWriter(body, crc)}
+	bw := bufio.NewWriterSize(counted, 256*1024)
+	var records uint64
+	err = fill(func(e *badger.Entry) error {
+		records++
+		return writeRecord(bw, e.Key, e.UserMeta, e.ExpiresAt, e.Value)
+	})
+	if err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	var hdr snapshotHeader
+	copy(hdr.Magic[:], snapshotMagic)
+	hdr.Version = snapshotVersion
+	hdr.Records = records
+	hdr.BodyLen = uint64(counted.n)
+	hdr.Checksum = crc.Sum32()
+
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		_ = out.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := binary.Write(out, binary.BigEndian, &hdr); err != nil {
+		return fail(err)
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	if _, err := io.Copy(out, body); err != nil {
+		return fail(err)
+	}
+	if err := out.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := out.Close(); err != nil {
+		return fail(err)
+	}
+	return os.Rename(tmp, path)
+}
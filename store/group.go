@@ -0,0 +1,42 @@
+package store
+
+import (
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Tx runs several conditional writes in one Badger transaction, so a group
+// of Raft commands costs one commit (and one fsync) instead of one each.
+// Writes made earlier in the Tx are visible to the conditions of later ones.
+// A failed condition writes nothing for that call and leaves the Tx usable.
+type Tx struct {
+	txn *badger.Txn
+}
+
+// Update runs fn in a single read-write transaction and commits it if fn
+// returns nil. fn may be run again if the commit conflicts with a concurrent
+// writer, so it must not keep state from an earlier attempt. If the
+// transaction grows past Badger's limits the error matches
+// badger.ErrTxnTooBig and nothing is written.
+func (s *BadgerStore) Update(fn func(tx *Tx) error) error {
+	return s.update(func(txn *badger.Txn) error {
+		return fn(&Tx{txn: txn})
+	})
+}
+
+// CheckAndSet is BadgerStore.CheckAndSet inside the transaction.
+func (tx *Tx) CheckAndSet(kv *KVPair, cond *Condition) (uint64, error) {
+	return checkAndSet(tx.txn, kv, cond)
+}
+
+// CheckAndDelete is BadgerStore.CheckAndDelete inside the transaction.
+func (tx *Tx) CheckAndDelete(key []byte, cond *Condition) error {
+	return checkAndDelete(tx.txn, key, cond)
+}
+
+// ApplyTxn is BadgerStore.ApplyTxn inside the transaction.
+func (tx *Tx) ApplyTxn(req *TxnRequest, version uint64) (*TxnResult, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	return applyTxn(tx.txn, req, version)
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// metaPrefix reserves a corner of the keyspace for cluster metadata that is
+// replicated through the FSM (membership and the like). Living in the same
+// Badger DB means it is covered by snapshots and restores for free; Scan
+// skips it and the HTTP API refuses user keys that start with it.
+var metaPrefix = []byte("\x00keyper/")
+
+// IsMetaKey reports whether key falls in the reserved metadata keyspace.
+func IsMetaKey(key []byte) bool {
+	return bytes.HasPrefix(key, metaPrefix)
+}
+
+func metaKey(name string) []byte {
+	return append(append([]byte(nil), metaPrefix...), name...)
+}
+
+// SetMeta stores a metadata value under name.
+func (s *BadgerStore) SetMeta(name string, value []byte) error {
+	return s.update(func(txn *badger.Txn) error {
+		return txn.Set(metaKey(name), value)
+	})
+}
+
+// GetMeta reads the metadata value stored under name. Returns ErrNotFound if
+// missing.
+func (s *BadgerStore) GetMeta(name string) ([]byte, error) {
+	var out []byte
+	err := s.view(func(txn *badger.Txn) error {
+		item, err := txn.Get(metaKey(name))
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		out, err = item.ValueCopy(nil)
+		return err
+	})
+	return out, err
+}
+
+// DeleteMeta removes the metadata value stored under name.
+func (s *BadgerStore) DeleteMeta(name string) error {
+	return s.update(func(txn *badger.Txn) error {
+		return txn.Delete(metaKey(name))
+	})
+}
+
+// GetMeta is BadgerStore.GetMeta inside the transaction.
+func (tx *Tx) GetMeta(name string) ([]byte, error) {
+	item, err := tx.txn.Get(metaKey(name))
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+// SetMeta is BadgerStore.SetMeta inside the transaction.
+func (tx *Tx) SetMeta(name string, value []byte) error {
+	return tx.txn.Set(metaKey(name), value)
+}
+
+// DeleteMeta is BadgerStore.DeleteMeta inside the transaction.
+func (tx *Tx) DeleteMeta(name string) error {
+	return tx.txn.Delete(metaKey(name))
+}
+
+// ListMeta returns every metadata value whose name starts with prefix, keyed
+// by the full name.
+func (s *BadgerStore) ListMeta(prefix string) (map[string][]byte, error) {
+	var out map[string][]byte
+	err := s.view(func(txn *badger.Txn) error {
+		var err error
+		out, err = listMeta(txn, prefix)
+		return err
+	})
+	return out, err
+}
+
+// ListMeta is BadgerStore.ListMeta inside the transaction.
+func (tx *Tx) ListMeta(prefix string) (map[string][]byte, error) {
+	return listMeta(tx.txn, prefix)
+}
+
+func listMeta(txn *badger.Txn, prefix string) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = metaKey(prefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		out[string(item.Key()[len(metaPrefix):])] = val
+	}
+	return out, nil
+}
@@ -0,0 +1,461 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/ristretto/z"
+)
+
+// Snapshot format (version 1):
+//
+//	header   32 bytes, big endian:
+//	         magic "KEYPRSNP" | version u16 | flags u16 | records u64 | body length u64 | CRC-32C of body u32
+//	body     records, gzip-compressed as a whole when flagGzip is set
+//	record   uvarint record length | uvarint key length | key | user meta byte | uvarint expires_at | value
+//
+// Values are stored exactly as Badger holds them (version header included),
+// so a restore reproduces keys byte for byte without re-encoding.
+const (
+	snapshotMagic   = "KEYPRSNP"
+	snapshotVersion = 1
+	headerLen       = 32
+
+	flagGzip uint16 = 1 << 0
+
+	// spoolDir holds in-progress snapshot dumps inside the store directory.
+	spoolDir = "snapshot-tmp"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type snapshotHeader struct {
+	Magic    [8]byte
+	Version  uint16
+	Flags    uint16
+	Records  uint64
+	BodyLen  uint64
+	Checksum uint32
+}
+
+// SnapshotFile is a point-in-time dump of the store spooled to local disk,
+// ready to be streamed into a Raft snapshot sink.
+type SnapshotFile struct {
+	path   string
+	header snapshotHeader
+}
+
+// Snapshot dumps the current contents of the store into a spool file next to
+// the data, using Badger's parallel Stream so large stores dump quickly. The
+// dump reflects every write that completed before Snapshot was called, but
+// may or may not hold writes made while it runs, so it only serves the
+// non-raft admin snapshot. Raft snapshots need an exact cut and use
+// OpenSnapshot instead: Badger pins a Stream to a read timestamp only in
+// managed mode, which this store does not use.
+func (s *BadgerStore) Snapshot(compress bool) (*SnapshotFile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.spool(compress, func(emit recordFunc) error {
+		stream := s.db.NewStream()
+		stream.LogPrefix = "keyper.snapshot"
+		stream.Send = func(buf *z.Buffer) error {
+			list, err := badger.BufferToKVList(buf)
+			if err != nil {
+				return err
+			}
+			for _, kv := range list.Kv {
+				var meta byte
+				if len(kv.UserMeta) > 0 {
+					meta = kv.UserMeta[0]
+				}
+				if err := emit(kv.Key, meta, kv.ExpiresAt, kv.Value); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err := stream.Orchestrate(context.Background()); err != nil {
+			return fmt.Errorf("stream store: %w", err)
+		}
+		return nil
+	})
+}
+
+// SnapshotView is the store as it stood when OpenSnapshot returned, kept
+// readable while writes go on so it can be dumped later. Restore waits until
+// every open view is closed.
+type SnapshotView struct {
+	s        *BadgerStore
+	txn      *badger.Txn
+	compress bool
+	once     sync.Once
+}
+
+// OpenSnapshot opens a view of the store's current contents. It is cheap:
+// it only starts a read transaction, and the dump happens in WriteTo. The
+// view must be closed.
+func (s *BadgerStore) OpenSnapshot(compress bool) *SnapshotView {
+	s.mu.RLock()
+	return &SnapshotView{s: s, txn: s.db.NewTransaction(false), compress: compress}
+}
+
+// WriteTo writes the view to w in the format Snapshot uses. The body is
+// spooled next to the data first, since the header that leads it carries
+// its length and checksum. It reads the view with a single iterator, which
+// is slower than Snapshot's parallel Stream on large stores; that is the
+// price of a consistent cut.
+func (v *SnapshotView) WriteTo(w io.Writer) (int64, error) {
+	snap, err := v.s.spool(v.compress, func(emit recordFunc) error {
+		it := v.txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := emit(item.Key(), item.UserMeta(), item.ExpiresAt(), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer snap.Remove()
+	return snap.WriteTo(w)
+}
+
+// Close ends the view. It is safe to call more than once.
+func (v *SnapshotView) Close() {
+	v.once.Do(func() {
+		v.txn.Discard()
+		v.s.mu.RUnlock()
+	})
+}
+
+// recordFunc takes one record of a snapshot body.
+type recordFunc func(key []byte, meta byte, expiresAt uint64, value []byte) error
+
+// spool writes the records fill emits as a snapshot body into a spool file
+// next to the data, and returns it with its header.
+func (s *BadgerStore) spool(compress bool, fill func(emit recordFunc) error) (*SnapshotFile, error) {
+	dir := filepath.Join(s.dir, spoolDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, "snap-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	snap := &SnapshotFile{path: f.Name()}
+	fail := func(err error) (*SnapshotFile, error) {
+		_ = f.Close()
+		_ = os.Remove(snap.path)
+		return nil, err
+	}
+
+	crc := crc32.New(castagnoli)
+	counted := &countingWriter{w: io.MultiWriter(f, crc)}
+	bw := bufio.NewWriterSize(counted, 256*1024)
+	var body io.Writer = bw
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(bw)
+		body = gz
+		snap.header.Flags |= flagGzip
+	}
+
+	var records uint64
+	err = fill(func(key []byte, meta byte, expiresAt uint64, value []byte) error {
+		records++
+		return writeRecord(body, key, meta, expiresAt, value)
+	})
+	if err != nil {
+		return fail(err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return fail(err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := f.Close(); err != nil {
+		return fail(err)
+	}
+
+	copy(snap.header.Magic[:], snapshotMagic)
+	snap.header.Version = snapshotVersion
+	snap.header.Records = records
+	snap.header.BodyLen = uint64(counted.n)
+	snap.header.Checksum = crc.Sum32()
+	return snap, nil
+}
+
+// WriteTo writes the header followed by the spooled body to w.
+func (f *SnapshotFile) WriteTo(w io.Writer) (int64, error) {
+	if err := binary.Write(w, binary.BigEndian, &f.header); err != nil {
+		return 0, err
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return headerLen, err
+	}
+	defer file.Close()
+	n, err := io.Copy(w, file)
+	return headerLen + n, err
+}
+
+// Remove deletes the spool file.
+func (f *SnapshotFile) Remove() error {
+	return os.Remove(f.path)
+}
+
+// Restore replaces the entire contents of the store with a snapshot produced
+// by Snapshot. Snapshots in the original newline-delimited JSON format (see
+// Export) are accepted too, so stores can be upgraded across the format change.
+//
+// The snapshot is first spooled to disk and fully decoded (and, for the binary
+// format, checksummed), so a truncated or corrupt snapshot is rejected while
+// the current data is still intact. Only then is everything dropped and the
+// snapshot loaded, with reads and writes blocked until it is done.
+func (s *BadgerStore) Restore(r io.Reader) error {
+	return s.RestoreExcept(r)
+}
+
+// RestoreExcept is Restore, leaving out the named metadata entries of the
+// snapshot. The store holds none of them afterwards, and since they are
+// never written, not even after a crash part way through the load.
+func (s *BadgerStore) RestoreExcept(r io.Reader, meta ...string) error {
+	dir := filepath.Join(s.dir, spoolDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "restore-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("spool snapshot: %w", err)
+	}
+
+	// verification pass: decode everything, keep nothing
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := decodeSnapshot(f, func(*badger.Entry) error { return nil }); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.db.DropAll(); err != nil {
+		return fmt.Errorf("drop existing data: %w", err)
+	}
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	err = decodeSnapshot(f, func(e *badger.Entry) error {
+		for _, name := range meta {
+			if bytes.Equal(e.Key, metaKey(name)) {
+				return nil
+			}
+		}
+		return wb.SetEntry(e)
+	})
+	if err != nil {
+		return err
+	}
+	return wb.Flush()
+}
+
+// SnapshotInfo summarises a snapshot checked by InspectSnapshot.
+type SnapshotInfo struct {
+	Records    uint64 // entries in the snapshot
+	MaxVersion uint64 // highest key version, i.e. the last Raft index that wrote a key
+}
+
+// InspectSnapshot decodes a whole snapshot without loading it, verifying the
+// record count and checksum of the binary format. Backups use it to check a
+// file before trusting it, and restores to learn how far versions have gone.
+func InspectSnapshot(r io.Reader) (*SnapshotInfo, error) {
+	info := &SnapshotInfo{}
+	err := decodeSnapshot(r, func(e *badger.Entry) error {
+		info.Records++
+		if e.UserMeta&metaVersioned != 0 && len(e.Value) >= versionLen {
+			if v := binary.BigEndian.Uint64(e.Value); v > info.MaxVersion {
+				info.MaxVersion = v
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// decodeSnapshot reads a binary or legacy JSON-lines snapshot from r and hands
+// every entry to fn. For the binary format the record count and checksum are
+// checked after the last record.
+func decodeSnapshot(r io.Reader, fn func(e *badger.Entry) error) error {
+	br := bufio.NewReaderSize(r, 256*1024)
+	magic, err := br.Peek(len(snapshotMagic))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if !bytes.Equal(magic, []byte(snapshotMagic)) {
+		dec := json.NewDecoder(br)
+		for {
+			var kv KVPair
+			if err := dec.Decode(&kv); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return fmt.Errorf("decode legacy snapshot: %w", err)
+			}
+			if err := fn(importEntry(&kv)); err != nil {
+				return err
+			}
+		}
+	}
+
+	var hdr snapshotHeader
+	if err := binary.Read(br, binary.BigEndian, &hdr); err != nil {
+		return fmt.Errorf("read snapshot header: %w", err)
+	}
+	if hdr.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot format version %d", hdr.Version)
+	}
+
+	crc := crc32.New(castagnoli)
+	raw := io.TeeReader(io.LimitReader(br, int64(hdr.BodyLen)), crc)
+	var body io.Reader = raw
+	if hdr.Flags&flagGzip != 0 {
+		gz, err := gzip.NewReader(raw)
+		if err != nil {
+			return fmt.Errorf("open compressed snapshot: %w", err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	records, err := readRecords(bufio.NewReaderSize(body, 256*1024), fn)
+	if err != nil {
+		return err
+	}
+	// consume anything the decompressor left unread so the checksum covers the whole body
+	if _, err := io.Copy(io.Discard, raw); err != nil {
+		return err
+	}
+	if records != hdr.Records {
+		return fmt.Errorf("snapshot truncated: got %d records, header says %d", records, hdr.Records)
+	}
+	if sum := crc.Sum32(); sum != hdr.Checksum {
+		return fmt.Errorf("snapshot checksum mismatch: got %08x want %08x", sum, hdr.Checksum)
+	}
+	return nil
+}
+
+func writeRecord(w io.Writer, key []byte, meta byte, expiresAt uint64, value []byte) error {
+	var scratch [3 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], uint64(len(key)))
+	keyLenLen := n
+	n += binary.PutUvarint(scratch[n:], expiresAt)
+	recLen := keyLenLen + len(key) + 1 + (n - keyLenLen) + len(value)
+
+	var prefix [binary.MaxVarintLen64]byte
+	pn := binary.PutUvarint(prefix[:], uint64(recLen))
+	if _, err := w.Write(prefix[:pn]); err != nil {
+		return err
+	}
+	if _, err := w.Write(scratch[:keyLenLen]); err != nil {
+		return err
+	}
+	if _, err := w.Write(key); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{meta}); err != nil {
+		return err
+	}
+	if _, err := w.Write(scratch[keyLenLen:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(value)
+	return err
+}
+
+// readRecords decodes records until EOF, handing each one to fn as a Badger
+// entry, and returns how many were read.
+func readRecords(r *bufio.Reader, fn func(e *badger.Entry) error) (uint64, error) {
+	var count uint64
+	var buf []byte
+	for {
+		recLen, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, fmt.Errorf("read record length: %w", err)
+		}
+		if cap(buf) < int(recLen) {
+			buf = make([]byte, recLen)
+		}
+		buf = buf[:recLen]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return count, fmt.Errorf("read record: %w", err)
+		}
+
+		keyLen, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < keyLen+1 {
+			return count, errors.New("corrupt snapshot record")
+		}
+		rest := buf[n:]
+		key := append([]byte(nil), rest[:keyLen]...)
+		meta := rest[keyLen]
+		rest = rest[keyLen+1:]
+		expiresAt, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return count, errors.New("corrupt snapshot record")
+		}
+		value := append([]byte(nil), rest[n:]...)
+
+		e := badger.NewEntry(key, value).WithMeta(meta)
+		e.ExpiresAt = expiresAt
+		if err := fn(e); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -1,9 +1,13 @@
 package store
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"io"
+	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/dgraph-io/badger/v4"
 )
@@ -15,22 +19,68 @@ var (
 
 // BadgerStore wraps a Badger DB instance with a minimal API.
 type BadgerStore struct {
-	db *badger.DB
+	db  *badger.DB
+	dir string
+
+	// mu is held shared by every read and write and exclusively by Restore,
+	// so nobody observes the store half-way through being replaced.
+	mu sync.RWMutex
+}
+
+// Options tunes the Badger DB behind a BadgerStore. Zero sizes and counts
+// keep Badger's defaults.
+type Options struct {
+	SyncWrites       bool  // fsync every write (durable; the default)
+	MemTableSize     int64 // bytes per memtable
+	ValueLogFileSize int64 // bytes per value log file
+	ValueThreshold   int64 // values at least this big go to the value log
+	BlockCacheSize   int64 // bytes of block cache
+	IndexCacheSize   int64 // bytes of index cache (0 keeps indices in memory)
+	NumCompactors    int   // concurrent compactions (must not be 1)
+}
+
+// DefaultOptions returns the options NewBadgerStore uses.
+func DefaultOptions() Options {
+	return Options{SyncWrites: true}
 }
 
 // NewBadgerStore opens/creates a Badger DB at the given dir.
 func NewBadgerStore(dir string) (*BadgerStore, error) {
+	return NewBadgerStoreWithOptions(dir, DefaultOptions())
+}
+
+// NewBadgerStoreWithOptions opens/creates a Badger DB at dir, tuned by o.
+func NewBadgerStoreWithOptions(dir string, o Options) (*BadgerStore, error) {
 	opts := badger.DefaultOptions(dir)
 	// Disable verbose logging (applications may set a logger here).
 	opts.Logger = nil
-	// Ensure writes are synced to disk (durable).
-	opts.SyncWrites = true
+	opts.SyncWrites = o.SyncWrites
+	if o.MemTableSize > 0 {
+		opts.MemTableSize = o.MemTableSize
+	}
+	if o.ValueLogFileSize > 0 {
+		opts.ValueLogFileSize = o.ValueLogFileSize
+	}
+	if o.ValueThreshold > 0 {
+		opts.ValueThreshold = o.ValueThreshold
+	}
+	if o.BlockCacheSize > 0 {
+		opts.BlockCacheSize = o.BlockCacheSize
+	}
+	if o.IndexCacheSize > 0 {
+		opts.IndexCacheSize = o.IndexCacheSize
+	}
+	if o.NumCompactors > 0 {
+		opts.NumCompactors = o.NumCompactors
+	}
 
 	db, err := badger.Open(opts)
 	if err != nil {
 		return nil, err
 	}
-	return &BadgerStore{db: db}, nil
+	// snapshot dumps left behind by a crash are never resumed
+	_ = os.RemoveAll(filepath.Join(dir, spoolDir))
+	return &BadgerStore{db: db, dir: dir}, nil
 }
 
 // Close closes the underlying DB.
@@ -43,74 +93,140 @@ func (s *BadgerStore) Close() error {
 
 // Get reads a value for a key. Returns ErrNotFound if missing.
 func (s *BadgerStore) Get(key []byte) ([]byte, error) {
-	var valCopy []byte
-	err := s.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(key)
-		if err != nil {
-			if err == badger.ErrKeyNotFound {
-				return ErrNotFound
-			}
-			return err
-		}
-		v, err := item.ValueCopy(nil)
-		if err != nil {
-			return err
-		}
-		valCopy = v
-		return nil
-	})
-	return valCopy, err
+	kv, err := s.GetEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	return kv.Value, nil
 }
 
 // Set writes key -> value (overwrite if exists).
 func (s *BadgerStore) Set(key, value []byte) error {
-	return s.db.Update(func(txn *badger.Txn) error {
-		return txn.SetEntry(&badger.Entry{
-			Key:   key,
-			Value: value,
-		})
-	})
+	return s.SetWithExpiry(key, value, 0)
+}
+
+// SetWithExpiry writes key -> value with an absolute expiry deadline given in
+// unix seconds. A zero expiresAt means the key never expires. Once the deadline
+// has passed, Badger hides the key and Get returns ErrNotFound.
+func (s *BadgerStore) SetWithExpiry(key, value []byte, expiresAt int64) error {
+	_, err := s.CheckAndSet(&KVPair{
+		Key:       string(key),
+		Value:     value,
+		ExpiresAt: expiresAt,
+	}, nil)
+	return err
 }
 
-// Delete removes a key. If key not present, returns ErrNotFound.
+// Delete removes a key. Deleting a missing key is not an error.
 func (s *BadgerStore) Delete(key []byte) error {
-	err := s.db.Update(func(txn *badger.Txn) error {
-		if err := txn.Delete(key); err != nil {
-			if err == badger.ErrKeyNotFound {
-				return ErrNotFound
+	return s.CheckAndDelete(key, nil)
+}
+
+// Scan returns up to limit live keys in the half-open range [start, end), in
+// ascending key order, or descending when reverse is set. An empty start or end
+// leaves that side of the range unbounded. The returned bool reports whether
+// more keys remain in the range after the last one returned.
+func (s *BadgerStore) Scan(start, end []byte, limit int, reverse bool) ([]KVPair, bool, error) {
+	if limit <= 0 {
+		return nil, false, errors.New("scan limit must be positive")
+	}
+	out := make([]KVPair, 0)
+	more := false
+	err := s.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = reverse
+		// small pages do not benefit from prefetching a large value window
+		if limit < opts.PrefetchSize {
+			opts.PrefetchSize = limit
+		}
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		if reverse {
+			// In reverse mode Seek lands on the largest key <= target; end is
+			// exclusive so an exact hit is skipped below.
+			if len(end) > 0 {
+				it.Seek(end)
+			} else {
+				it.Rewind()
+			}
+		} else {
+			if len(start) > 0 {
+				it.Seek(start)
+			} else {
+				it.Rewind()
 			}
-			return err
+		}
+
+		for ; it.Valid(); it.Next() {
+			item := it.Item()
+			k := item.Key()
+			if reverse {
+				if len(end) > 0 && bytes.Compare(k, end) >= 0 {
+					continue
+				}
+				if len(start) > 0 && bytes.Compare(k, start) < 0 {
+					break
+				}
+			} else if len(end) > 0 && bytes.Compare(k, end) >= 0 {
+				break
+			}
+			if IsMetaKey(k) {
+				continue
+			}
+			if len(out) == limit {
+				more = true
+				break
+			}
+			kv, err := decodeItem(item)
+			if err != nil {
+				return err
+			}
+			out = append(out, kv)
 		}
 		return nil
 	})
-	return err
+	if err != nil {
+		return nil, false, err
+	}
+	return out, more, nil
+}
+
+// PrefixEnd returns the smallest key that is greater than every key starting
+// with prefix, for use as the exclusive end of a prefix scan. It returns nil
+// when no such key exists (empty prefix or a prefix of only 0xff bytes).
+func PrefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
 }
 
 // KVPair is the on-disk/export JSON format for snapshots.
 type KVPair struct {
-	Key   string `json:"key"`
-	Value []byte `json:"value"`
+	Key       string `json:"key"`
+	Value     []byte `json:"value"`
+	ExpiresAt int64  `json:"expires_at,omitempty"` // unix seconds, 0 = no expiry
+	Version   uint64 `json:"version,omitempty"`    // Raft index of the last write
 }
 
 // Export writes the entire DB as newline-separated JSON KVPair objects to w.
 // Caller is responsible for choosing how to persist/stream w (file, socket, etc).
 func (s *BadgerStore) Export(w io.Writer) error {
 	enc := json.NewEncoder(w)
-	return s.db.View(func(txn *badger.Txn) error {
+	return s.view(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		it := txn.NewIterator(opts)
 		defer it.Close()
 		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			k := item.KeyCopy(nil)
-			v, err := item.ValueCopy(nil)
+			kv, err := decodeItem(it.Item())
 			if err != nil {
 				return err
 			}
-			kv := KVPair{
-				Key:   string(k),
-				Value: v,
-			}
 			if err := enc.Encode(&kv); err != nil {
 				return err
 			}
@@ -120,7 +236,8 @@ func (s *BadgerStore) Export(w io.Writer) error {
 }
 
 // Import reads newline-separated JSON KVPair objects from r and writes them into the DB.
-// It will overwrite existing keys with the values read.
+// It will overwrite existing keys with the values read. Versions and expiry
+// deadlines are preserved, so keys that expired while in transit stay invisible.
 func (s *BadgerStore) Import(r io.Reader) error {
 	dec := json.NewDecoder(r)
 	for {
@@ -131,8 +248,24 @@ func (s *BadgerStore) Import(r io.Reader) error {
 			}
 			return err
 		}
-		if err := s.Set([]byte(kv.Key), kv.Value); err != nil {
+		if err := s.update(func(txn *badger.Txn) error {
+			return txn.SetEntry(importEntry(&kv))
+		}); err != nil {
 			return err
 		}
 	}
 }
+
+// importEntry builds the Badger entry for an exported pair.
+func importEntry(kv *KVPair) *badger.Entry {
+	if kv.Version != 0 {
+		return encodeEntry(kv)
+	}
+	// pre-versioning export: keep the value unversioned rather than
+	// inventing a version the other replicas do not share
+	e := badger.NewEntry([]byte(kv.Key), kv.Value)
+	if kv.ExpiresAt > 0 {
+		e.ExpiresAt = uint64(kv.ExpiresAt)
+	}
+	return e
+}
@@ -1,11 +1,15 @@
 package store_test
 
 import (
+	"bytes"
+	"errors"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/sada-02/keyper/store"
 )
@@ -83,3 +87,432 @@ func TestBadgerStoreConcurrency(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestBadgerStoreExpiry(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dkvs_test_expiry_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	defer os.RemoveAll(dir)
+
+	s, err := store.NewBadgerStore(dir)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer s.Close()
+
+	now := time.Now().Unix()
+
+	if err := s.SetWithExpiry([]byte("live"), []byte("v"), now+60); err != nil {
+		t.Fatalf("set live: %v", err)
+	}
+	if _, err := s.Get([]byte("live")); err != nil {
+		t.Fatalf("expected live key before deadline: %v", err)
+	}
+
+	// a deadline in the past must be invisible immediately
+	if err := s.SetWithExpiry([]byte("dead"), []byte("v"), now-1); err != nil {
+		t.Fatalf("set dead: %v", err)
+	}
+	if _, err := s.Get([]byte("dead")); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for expired key, got %v", err)
+	}
+
+	// expiry must survive an export/import round trip
+	var buf bytes.Buffer
+	if err := s.Export(&buf); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if !strings.Contains(buf.String(), `"expires_at":`+strconv.FormatInt(now+60, 10)) {
+		t.Fatalf("expected expires_at in export, got %s", buf.String())
+	}
+}
+
+func TestBadgerStoreScan(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dkvs_test_scan_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	defer os.RemoveAll(dir)
+
+	s, err := store.NewBadgerStore(dir)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer s.Close()
+
+	for _, k := range []string{"a", "b/1", "b/2", "b/3", "c"} {
+		if err := s.Set([]byte(k), []byte("v-"+k)); err != nil {
+			t.Fatalf("set %s: %v", k, err)
+		}
+	}
+
+	keys := func(kvs []store.KVPair) string {
+		out := []string{}
+		for _, kv := range kvs {
+			out = append(out, kv.Key)
+		}
+		return strings.Join(out, ",")
+	}
+
+	// full forward scan
+	got, more, err := s.Scan(nil, nil, 10, false)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if keys(got) != "a,b/1,b/2,b/3,c" || more {
+		t.Fatalf("unexpected full scan: %s more=%v", keys(got), more)
+	}
+
+	// prefix range with a page limit
+	got, more, err = s.Scan([]byte("b/"), store.PrefixEnd([]byte("b/")), 2, false)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if keys(got) != "b/1,b/2" || !more {
+		t.Fatalf("unexpected prefix page: %s more=%v", keys(got), more)
+	}
+
+	// reverse with exclusive end
+	got, more, err = s.Scan([]byte("b/"), []byte("b/3"), 10, true)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if keys(got) != "b/2,b/1" || more {
+		t.Fatalf("unexpected reverse scan: %s more=%v", keys(got), more)
+	}
+
+	if pe := store.PrefixEnd([]byte{'a', 0xff}); string(pe) != "b" {
+		t.Fatalf("unexpected prefix end: %q", pe)
+	}
+}
+
+func TestBadgerStoreConditionalWrites(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dkvs_test_cas_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	defer os.RemoveAll(dir)
+
+	s, err := store.NewBadgerStore(dir)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer s.Close()
+
+	key := []byte("cfg")
+	absent := &store.Condition{MustNotExist: true}
+
+	// create-only write succeeds once, at the explicit version
+	if v, err := s.CheckAndSet(&store.KVPair{Key: "cfg", Value: []byte("v1"), Version: 7}, absent); err != nil || v != 7 {
+		t.Fatalf("create: v=%d err=%v", v, err)
+	}
+	_, err = s.CheckAndSet(&store.KVPair{Key: "cfg", Value: []byte("v2")}, absent)
+	var cerr *store.ConditionError
+	if !errors.As(err, &cerr) || !cerr.Exists || cerr.Version != 7 {
+		t.Fatalf("expected condition error at version 7, got %v", err)
+	}
+
+	// stale version is rejected, current version wins
+	stale, current := uint64(6), uint64(7)
+	if _, err := s.CheckAndSet(&store.KVPair{Key: "cfg", Value: []byte("v2")}, &store.Condition{Version: &stale}); !errors.Is(err, store.ErrConditionFailed) {
+		t.Fatalf("expected stale CAS to fail, got %v", err)
+	}
+	if v, err := s.CheckAndSet(&store.KVPair{Key: "cfg", Value: []byte("v2")}, &store.Condition{Version: &current}); err != nil || v != 8 {
+		t.Fatalf("cas: v=%d err=%v", v, err)
+	}
+
+	kv, err := s.GetEntry(key)
+	if err != nil || string(kv.Value) != "v2" || kv.Version != 8 {
+		t.Fatalf("unexpected entry: %+v err=%v", kv, err)
+	}
+
+	// conditional delete
+	if err := s.CheckAndDelete(key, &store.Condition{Version: &current}); !errors.Is(err, store.ErrConditionFailed) {
+		t.Fatalf("expected stale delete to fail, got %v", err)
+	}
+	if err := s.CheckAndDelete(key, &store.Condition{MustExist: true}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := s.Get(key); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected not found after delete, got %v", err)
+	}
+}
+
+func TestBadgerStoreApplyTxn(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dkvs_test_txn_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	defer os.RemoveAll(dir)
+
+	s, err := store.NewBadgerStore(dir)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Set([]byte("from"), []byte("payload")); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	// move "from" -> "to" only if "to" does not exist yet
+	move := &store.TxnRequest{
+		Guards: []store.Guard{
+			{Key: "from", Condition: store.Condition{Value: []byte("payload")}},
+			{Key: "to", Condition: store.Condition{MustNotExist: true}},
+		},
+		Success: []store.TxnOp{
+			{Op: "set", Key: "to", Value: []byte("payload")},
+			{Op: "delete", Key: "from"},
+		},
+		Failure: []store.TxnOp{
+			{Op: "set", Key: "conflict", Value: []byte("1")},
+		},
+	}
+	res, err := s.ApplyTxn(move, 10)
+	if err != nil {
+		t.Fatalf("txn: %v", err)
+	}
+	if !res.Succeeded || len(res.Results) != 2 || res.Results[0].Version != 10 {
+		t.Fatalf("unexpected txn result: %+v", res)
+	}
+	if _, err := s.Get([]byte("from")); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected from to be gone, got %v", err)
+	}
+
+	// second run: guards fail, only the failure branch is applied
+	res, err = s.ApplyTxn(move, 11)
+	if err != nil {
+		t.Fatalf("txn: %v", err)
+	}
+	if res.Succeeded || len(res.Results) != 1 || res.Results[0].Key != "conflict" {
+		t.Fatalf("unexpected txn result: %+v", res)
+	}
+	if v, err := s.Get([]byte("to")); err != nil || string(v) != "payload" {
+		t.Fatalf("unexpected to: %s err=%v", v, err)
+	}
+
+	bad := &store.TxnRequest{Success: []store.TxnOp{{Op: "incr", Key: "x"}}}
+	if _, err := s.ApplyTxn(bad, 12); err == nil {
+		t.Fatalf("expected validation error for unknown op")
+	}
+}
+
+func TestBadgerStoreSnapshotRoundTrip(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "dkvs_test_snapshot_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	defer os.RemoveAll(base)
+
+	src, err := store.NewBadgerStore(filepath.Join(base, "src"))
+	if err != nil {
+		t.Fatalf("open src: %v", err)
+	}
+	defer src.Close()
+
+	// binary values, including newlines and NULs that broke line-based formats
+	binVal := []byte{0x00, '\n', 0xff, '{', '"', '\r', 0x00}
+	deadline := time.Now().Unix() + 3600
+	if err := src.Set([]byte("bin"), binVal); err != nil {
+		t.Fatalf("set bin: %v", err)
+	}
+	if err := src.SetWithExpiry([]byte("ttl"), []byte("v"), deadline); err != nil {
+		t.Fatalf("set ttl: %v", err)
+	}
+	if _, err := src.CheckAndSet(&store.KVPair{Key: "versioned", Value: []byte("x"), Version: 42}, nil); err != nil {
+		t.Fatalf("set versioned: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := src.Set([]byte("k"+strconv.Itoa(i)), []byte(strings.Repeat("v", i))); err != nil {
+			t.Fatalf("set k%d: %v", i, err)
+		}
+	}
+
+	for _, compress := range []bool{false, true} {
+		snap, err := src.Snapshot(compress)
+		if err != nil {
+			t.Fatalf("snapshot (compress=%v): %v", compress, err)
+		}
+		var buf bytes.Buffer
+		if _, err := snap.WriteTo(&buf); err != nil {
+			t.Fatalf("write snapshot: %v", err)
+		}
+		_ = snap.Remove()
+
+		dst, err := store.NewBadgerStore(filepath.Join(base, "dst"+strconv.FormatBool(compress)))
+		if err != nil {
+			t.Fatalf("open dst: %v", err)
+		}
+		// restore replaces the contents: keys missing from the snapshot go away
+		if err := dst.Set([]byte("stale"), []byte("old")); err != nil {
+			t.Fatalf("set stale: %v", err)
+		}
+		if err := dst.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatalf("restore (compress=%v): %v", compress, err)
+		}
+
+		got, err := dst.Get([]byte("bin"))
+		if err != nil || !bytes.Equal(got, binVal) {
+			t.Fatalf("bin: got %q, %v", got, err)
+		}
+		if _, err := dst.Get([]byte("stale")); !errors.Is(err, store.ErrNotFound) {
+			t.Fatalf("expected stale key to be dropped by restore, got %v", err)
+		}
+		kv, err := dst.GetEntry([]byte("ttl"))
+		if err != nil || kv.ExpiresAt != deadline {
+			t.Fatalf("ttl: got %+v, %v", kv, err)
+		}
+		kv, err = dst.GetEntry([]byte("versioned"))
+		if err != nil || kv.Version != 42 {
+			t.Fatalf("versioned: got %+v, %v", kv, err)
+		}
+		items, _, err := dst.Scan(nil, nil, 1000, false)
+		if err != nil || len(items) != 503 {
+			t.Fatalf("scan: got %d items, %v", len(items), err)
+		}
+
+		// a flipped byte in the body must be caught by the checksum
+		corrupt := append([]byte(nil), buf.Bytes()...)
+		corrupt[len(corrupt)-1] ^= 0xff
+		if err := dst.Restore(bytes.NewReader(corrupt)); err == nil {
+			t.Fatalf("expected restore of corrupted snapshot to fail (compress=%v)", compress)
+		}
+		if got, err := dst.Get([]byte("bin")); err != nil || !bytes.Equal(got, binVal) {
+			t.Fatalf("rejected snapshot must leave data intact: got %q, %v", got, err)
+		}
+		dst.Close()
+	}
+
+	// snapshots written in the old JSON-lines format still restore
+	var legacy bytes.Buffer
+	if err := src.Export(&legacy); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	old, err := store.NewBadgerStore(filepath.Join(base, "legacy"))
+	if err != nil {
+		t.Fatalf("open legacy: %v", err)
+	}
+	defer old.Close()
+	if err := old.Restore(&legacy); err != nil {
+		t.Fatalf("restore legacy: %v", err)
+	}
+	if got, err := old.Get([]byte("bin")); err != nil || !bytes.Equal(got, binVal) {
+		t.Fatalf("legacy bin: got %q, %v", got, err)
+	}
+
+	// RestoreExcept leaves out the named metadata, and drops the store's own
+	if err := src.SetMeta("skip", []byte("src")); err != nil {
+		t.Fatalf("set meta: %v", err)
+	}
+	if err := src.SetMeta("keep", []byte("src")); err != nil {
+		t.Fatalf("set meta: %v", err)
+	}
+	snap, err := src.Snapshot(false)
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	defer snap.Remove()
+	var withMeta bytes.Buffer
+	if _, err := snap.WriteTo(&withMeta); err != nil {
+		t.Fatalf("write snapshot: %v", err)
+	}
+	if err := old.SetMeta("skip", []byte("old")); err != nil {
+		t.Fatalf("set meta: %v", err)
+	}
+	if err := old.RestoreExcept(&withMeta, "skip"); err != nil {
+		t.Fatalf("restore except: %v", err)
+	}
+	if _, err := old.GetMeta("skip"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("skipped meta: got %v, want not found", err)
+	}
+	if got, err := old.GetMeta("keep"); err != nil || string(got) != "src" {
+		t.Fatalf("kept meta: got %q, %v", got, err)
+	}
+}
+
+func TestBadgerStoreApplyBatch(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dkvs_test_batch_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	defer os.RemoveAll(dir)
+
+	s, err := store.NewBadgerStore(dir)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Set([]byte("old"), []byte("v")); err != nil {
+		t.Fatalf("set old: %v", err)
+	}
+
+	ops := []store.TxnOp{
+		{Op: "set", Key: "a", Value: []byte("1")},
+		{Op: "set", Key: "", Value: []byte("no key")},
+		{Op: "delete", Key: "old"},
+		{Op: "rename", Key: "b"},
+		{Op: "set", Key: "c", Value: []byte("3")},
+	}
+	results, err := s.ApplyBatch(ops, 77)
+	if err != nil {
+		t.Fatalf("apply batch: %v", err)
+	}
+	if len(results) != len(ops) {
+		t.Fatalf("expected %d results, got %d", len(ops), len(results))
+	}
+	for i, wantErr := range []bool{false, true, false, true, false} {
+		if (results[i].Error != "") != wantErr {
+			t.Fatalf("result %d: unexpected error state %+v", i, results[i])
+		}
+	}
+	if results[0].Version != 77 || results[4].Version != 77 {
+		t.Fatalf("expected sets at version 77, got %+v", results)
+	}
+	if kv, err := s.GetEntry([]byte("c")); err != nil || string(kv.Value) != "3" || kv.Version != 77 {
+		t.Fatalf("c: got %+v, %v", kv, err)
+	}
+	if _, err := s.Get([]byte("old")); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected old deleted, got %v", err)
+	}
+
+	// without a log index every key gets its own next version
+	results, err = s.ApplyBatch([]store.TxnOp{{Op: "set", Key: "a", Value: []byte("2")}}, 0)
+	if err != nil || results[0].Version != 78 {
+		t.Fatalf("expected version 78, got %+v, %v", results, err)
+	}
+}
+
+func TestBadgerStoreMetaHiddenFromScan(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dkvs_test_meta_"+strconv.FormatInt(int64(os.Getpid()), 10))
+	defer os.RemoveAll(dir)
+
+	s, err := store.NewBadgerStore(dir)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.SetMeta("members/n1", []byte(`{"id":"n1"}`)); err != nil {
+		t.Fatalf("set meta: %v", err)
+	}
+	if err := s.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("set a: %v", err)
+	}
+
+	kvs, _, err := s.Scan(nil, nil, 10, false)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if len(kvs) != 1 || kvs[0].Key != "a" {
+		t.Fatalf("expected only user key a, got %+v", kvs)
+	}
+	metas, err := s.ListMeta("members/")
+	if err != nil || string(metas["members/n1"]) != `{"id":"n1"}` {
+		t.Fatalf("list meta: %v %v", metas, err)
+	}
+
+	// metadata travels with snapshots
+	snap, err := s.Snapshot(false)
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	defer snap.Remove()
+	var buf bytes.Buffer
+	if _, err := snap.WriteTo(&buf); err != nil {
+		t.Fatalf("write snapshot: %v", err)
+	}
+	if err := s.DeleteMeta("members/n1"); err != nil {
+		t.Fatalf("delete meta: %v", err)
+	}
+	if err := s.Restore(&buf); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if _, err := s.GetMeta("members/n1"); err != nil {
+		t.Fatalf("meta lost across snapshot: %v", err)
+	}
+}
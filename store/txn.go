@@ -0,0 +1,124 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Guard is a Condition on one key, evaluated at the start of a transaction.
+type Guard struct {
+	Key string `json:"key"`
+	Condition
+}
+
+// TxnOp is a single mutation inside a transaction.
+type TxnOp struct {
+	Op        string `json:"op"` // "set" or "delete"
+	Key       string `json:"key"`
+	Value     []byte `json:"value,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"` // unix seconds, 0 = no expiry
+}
+
+// TxnRequest is an all-or-nothing multi-key update in the style of etcd's
+// Txn: if every guard holds the Success ops run, otherwise the Failure ops do.
+type TxnRequest struct {
+	Guards  []Guard `json:"guards,omitempty"`
+	Success []TxnOp `json:"success,omitempty"`
+	Failure []TxnOp `json:"failure,omitempty"`
+}
+
+// TxnOpResult is the outcome of one op of the branch that ran.
+type TxnOpResult struct {
+	Op      string `json:"op"`
+	Key     string `json:"key"`
+	Version uint64 `json:"version,omitempty"` // version written by a set
+}
+
+// TxnResult reports which branch ran and the per-op results of that branch.
+type TxnResult struct {
+	Succeeded bool          `json:"succeeded"`
+	Results   []TxnOpResult `json:"results"`
+}
+
+// Validate checks that every op is well formed, so a malformed request can be
+// rejected before it is proposed to Raft.
+func (r *TxnRequest) Validate() error {
+	for _, g := range r.Guards {
+		if g.Key == "" {
+			return errors.New("guard key required")
+		}
+	}
+	for _, branch := range [][]TxnOp{r.Success, r.Failure} {
+		for _, op := range branch {
+			if err := validateOp(op); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyTxn evaluates the guards and applies one branch of req in a single
+// Badger transaction, so either every op of the branch is visible or none is.
+// Keys set by the transaction get the given version (the Raft log index); a
+// zero version falls back to each key's current version plus one.
+func (s *BadgerStore) ApplyTxn(req *TxnRequest, version uint64) (*TxnResult, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	var res *TxnResult
+	err := s.update(func(txn *badger.Txn) error {
+		var err error
+		res, err = applyTxn(txn, req, version)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func applyTxn(txn *badger.Txn, req *TxnRequest, version uint64) (*TxnResult, error) {
+	res := &TxnResult{Succeeded: true}
+	for _, g := range req.Guards {
+		cur, err := getKV(txn, []byte(g.Key))
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		if g.check([]byte(g.Key), cur) != nil {
+			res.Succeeded = false
+			break
+		}
+	}
+
+	ops := req.Success
+	if !res.Succeeded {
+		ops = req.Failure
+	}
+	res.Results = make([]TxnOpResult, 0, len(ops))
+	for _, op := range ops {
+		out := TxnOpResult{Op: op.Op, Key: op.Key}
+		switch op.Op {
+		case "set":
+			kv := &KVPair{Key: op.Key, Value: op.Value, ExpiresAt: op.ExpiresAt, Version: version}
+			if kv.Version == 0 {
+				cur, err := getKV(txn, []byte(op.Key))
+				if err != nil && !errors.Is(err, ErrNotFound) {
+					return nil, err
+				}
+				kv.Version = nextVersion(cur, 0)
+			}
+			if err := txn.SetEntry(encodeEntry(kv)); err != nil {
+				return nil, err
+			}
+			out.Version = kv.Version
+		case "delete":
+			if err := txn.Delete([]byte(op.Key)); err != nil {
+				return nil, err
+			}
+		}
+		res.Results = append(res.Results, out)
+	}
+	return res, nil
+}
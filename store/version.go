@@ -0,0 +1,232 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Values written by this package carry the key's version in front of the
+// payload. The versioned UserMeta flag marks such entries, so values written
+// before versioning existed still read back unchanged (as version 0).
+const (
+	metaVersioned byte = 1 << 0
+	versionLen         = 8
+)
+
+// ErrConditionFailed is matched (via errors.Is) by every *ConditionError.
+var ErrConditionFailed = errors.New("precondition failed")
+
+// Condition is a precondition on the current state of a key. It is checked
+// in the same Badger transaction as the write it guards, so check and write
+// are atomic. All fields that are set must hold. A nil *Condition always holds.
+type Condition struct {
+	MustExist    bool    `json:"must_exist,omitempty"`     // If-Match: *
+	MustNotExist bool    `json:"must_not_exist,omitempty"` // If-None-Match: *
+	Version      *uint64 `json:"version,omitempty"`        // If-Match: "<version>"
+	Value        []byte  `json:"value,omitempty"`          // current value equals
+}
+
+// ConditionError reports a failed Condition together with the key's current
+// state, so callers can tell the client which version is actually stored.
+type ConditionError struct {
+	Key     string
+	Exists  bool
+	Version uint64 // current version; only meaningful when Exists
+}
+
+func (e *ConditionError) Error() string {
+	if !e.Exists {
+		return fmt.Sprintf("precondition failed for %q: key does not exist", e.Key)
+	}
+	return fmt.Sprintf("precondition failed for %q: current version %d", e.Key, e.Version)
+}
+
+// Is makes errors.Is(err, ErrConditionFailed) true for condition errors.
+func (e *ConditionError) Is(target error) bool {
+	return target == ErrConditionFailed
+}
+
+// check evaluates c against cur (nil when the key does not exist).
+func (c *Condition) check(key []byte, cur *KVPair) error {
+	if c == nil {
+		return nil
+	}
+	ok := true
+	if c.MustNotExist && cur != nil {
+		ok = false
+	}
+	if c.MustExist && cur == nil {
+		ok = false
+	}
+	if c.Version != nil && (cur == nil || cur.Version != *c.Version) {
+		ok = false
+	}
+	if c.Value != nil && (cur == nil || !bytes.Equal(cur.Value, c.Value)) {
+		ok = false
+	}
+	if ok {
+		return nil
+	}
+	cerr := &ConditionError{Key: string(key)}
+	if cur != nil {
+		cerr.Exists = true
+		cerr.Version = cur.Version
+	}
+	return cerr
+}
+
+// GetEntry reads a key together with its version and expiry.
+// Returns ErrNotFound if missing.
+func (s *BadgerStore) GetEntry(key []byte) (*KVPair, error) {
+	var kv *KVPair
+	err := s.view(func(txn *badger.Txn) error {
+		var err error
+		kv, err = getKV(txn, key)
+		return err
+	})
+	return kv, err
+}
+
+// CheckAndSet atomically checks cond against the current state of kv.Key and,
+// if it holds, writes kv. A zero kv.Version is replaced by the current version
+// plus one; Raft callers pass the log index instead so every replica agrees.
+// It returns the version that was written.
+func (s *BadgerStore) CheckAndSet(kv *KVPair, cond *Condition) (uint64, error) {
+	var written uint64
+	err := s.update(func(txn *badger.Txn) error {
+		var err error
+		written, err = checkAndSet(txn, kv, cond)
+		return err
+	})
+	return written, err
+}
+
+// CheckAndDelete atomically checks cond against the current state of key and,
+// if it holds, deletes it. Without a condition the delete is blind.
+func (s *BadgerStore) CheckAndDelete(key []byte, cond *Condition) error {
+	return s.update(func(txn *badger.Txn) error {
+		return checkAndDelete(txn, key, cond)
+	})
+}
+
+func checkAndSet(txn *badger.Txn, kv *KVPair, cond *Condition) (uint64, error) {
+	cur, err := getKV(txn, []byte(kv.Key))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return 0, err
+	}
+	if err := cond.check([]byte(kv.Key), cur); err != nil {
+		return 0, err
+	}
+	out := *kv
+	out.Version = nextVersion(cur, kv.Version)
+	if err := txn.SetEntry(encodeEntry(&out)); err != nil {
+		return 0, err
+	}
+	return out.Version, nil
+}
+
+func checkAndDelete(txn *badger.Txn, key []byte, cond *Condition) error {
+	if cond != nil {
+		cur, err := getKV(txn, key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err := cond.check(key, cur); err != nil {
+			return err
+		}
+	}
+	return txn.Delete(key)
+}
+
+// nextVersion returns the version a write should carry: the explicit version
+// (the Raft log index) when given, otherwise the current version plus one.
+func nextVersion(cur *KVPair, version uint64) uint64 {
+	if version != 0 {
+		return version
+	}
+	if cur == nil {
+		return 1
+	}
+	return cur.Version + 1
+}
+
+// update runs fn in a read-write transaction, retrying a few times when a
+// concurrent writer conflicts with the keys fn read. The FSM applies entries
+// one at a time and never conflicts; direct (non-Raft) writes may.
+func (s *BadgerStore) update(fn func(txn *badger.Txn) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		err = s.db.Update(fn)
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+// view runs fn in a read-only transaction.
+func (s *BadgerStore) view(fn func(txn *badger.Txn) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.View(fn)
+}
+
+// getKV reads and decodes key inside txn. Returns ErrNotFound if missing.
+func getKV(txn *badger.Txn, key []byte) (*KVPair, error) {
+	item, err := txn.Get(key)
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	kv, err := decodeItem(item)
+	if err != nil {
+		return nil, err
+	}
+	return &kv, nil
+}
+
+// encodeEntry builds the Badger entry for kv, prefixing the value with its
+// version and carrying the expiry deadline.
+func encodeEntry(kv *KVPair) *badger.Entry {
+	val := make([]byte, versionLen+len(kv.Value))
+	binary.BigEndian.PutUint64(val, kv.Version)
+	copy(val[versionLen:], kv.Value)
+	e := &badger.Entry{
+		Key:      []byte(kv.Key),
+		Value:    val,
+		UserMeta: metaVersioned,
+	}
+	if kv.ExpiresAt > 0 {
+		e.ExpiresAt = uint64(kv.ExpiresAt)
+	}
+	return e
+}
+
+// decodeItem copies an item out of Badger, splitting off the version header.
+func decodeItem(item *badger.Item) (KVPair, error) {
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		return KVPair{}, err
+	}
+	kv := KVPair{
+		Key:       string(item.KeyCopy(nil)),
+		Value:     v,
+		ExpiresAt: int64(item.ExpiresAt()),
+	}
+	if item.UserMeta()&metaVersioned != 0 {
+		if len(v) < versionLen {
+			return KVPair{}, fmt.Errorf("corrupt value for key %q: short version header", kv.Key)
+		}
+		kv.Version = binary.BigEndian.Uint64(v[:versionLen])
+		kv.Value = v[versionLen:]
+	}
+	return kv, nil
+}
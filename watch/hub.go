@@ -0,0 +1,210 @@
+package watch
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/sada-02/keyper/store"
+)
+
+// DefaultHistory is the number of recent events a Hub keeps for resuming.
+const DefaultHistory = 4096
+
+// subscriberBuffer is how many events a subscriber may fall behind before it
+// is cut off; a cut-off watcher resumes from the last revision it saw.
+const subscriberBuffer = 256
+
+var (
+	// ErrCompacted is returned by Subscribe when the requested revision is
+	// older than the retained history, so some events can no longer be replayed.
+	ErrCompacted = errors.New("requested revision has been compacted")
+)
+
+// Event describes one committed change to a key. Revision is the Raft log
+// index of the entry that made the change; several events (from a txn or a
+// batch) may share one revision.
+type Event struct {
+	Type      string `json:"type"` // "set" or "delete"
+	Key       string `json:"key"`
+	Value     []byte `json:"value,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Revision  uint64 `json:"revision"`
+}
+
+// TxnEvents converts the ops of the txn branch that ran into events.
+func TxnEvents(ops []store.TxnOp, revision uint64) []Event {
+	events := make([]Event, 0, len(ops))
+	for _, op := range ops {
+		ev := Event{Type: op.Op, Key: op.Key, Revision: revision}
+		if op.Op == "set" {
+			ev.Value = op.Value
+			ev.ExpiresAt = op.ExpiresAt
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+// Hub fans committed events out to watchers and keeps a bounded history so a
+// watcher that disconnected can resume from a given revision.
+type Hub struct {
+	mu      sync.Mutex
+	subs    map[*Subscription]struct{}
+	history []Event // ring buffer, oldest at head
+	head    int
+	size    int
+	last    uint64 // revision of the newest event published
+	floor   uint64 // every event with Revision > floor is still in history
+	started bool   // floor is only known once the first event is seen
+}
+
+// NewHub creates a hub retaining up to historySize events (DefaultHistory if <= 0).
+func NewHub(historySize int) *Hub {
+	if historySize <= 0 {
+		historySize = DefaultHistory
+	}
+	return &Hub{
+		subs:    make(map[*Subscription]struct{}),
+		history: make([]Event, historySize),
+	}
+}
+
+// Subscription receives the events matching its key or prefix on C. C is
+// closed when the subscription ends; Err then tells why.
+type Subscription struct {
+	C <-chan Event
+
+	c      chan Event
+	hub    *Hub
+	key    string
+	prefix bool
+	err    error
+	done   bool
+}
+
+// Err returns why the subscription was closed by the hub (nil if closed by the caller).
+func (s *Subscription) Err() error {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.err
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.drop(s, nil)
+}
+
+func (s *Subscription) matches(key string) bool {
+	if s.prefix {
+		return strings.HasPrefix(key, s.key)
+	}
+	return key == s.key
+}
+
+// Subscribe starts watching a single key, or every key under a prefix when
+// prefix is set (an empty prefix watches everything). If since is non-nil,
+// retained events with Revision > *since are replayed first; ErrCompacted is
+// returned if some of them are no longer available.
+func (h *Hub) Subscribe(key string, prefix bool, since *uint64) (*Subscription, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := make(chan Event, subscriberBuffer)
+	s := &Subscription{C: c, c: c, hub: h, key: key, prefix: prefix}
+
+	if since != nil && *since < h.last {
+		if !h.started || *since < h.floor {
+			return nil, ErrCompacted
+		}
+		for i := 0; i < h.size; i++ {
+			ev := h.history[(h.head+i)%len(h.history)]
+			if ev.Revision <= *since || !s.matches(ev.Key) {
+				continue
+			}
+			select {
+			case c <- ev:
+			default:
+				// more backlog than a subscriber can buffer: treat as compacted
+				return nil, ErrCompacted
+			}
+		}
+	}
+	h.subs[s] = struct{}{}
+	return s, nil
+}
+
+// Publish records events and delivers them to matching subscribers. It never
+// blocks: a subscriber whose buffer is full is closed with an error so it can
+// resume from its last revision. Events without a revision (non-Raft mode) get
+// the next local sequence number.
+func (h *Hub) Publish(events ...Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ev := range events {
+		if ev.Revision == 0 {
+			ev.Revision = h.last + 1
+		}
+		if !h.started {
+			h.floor = ev.Revision - 1
+			h.started = true
+		}
+		if ev.Revision > h.last {
+			h.last = ev.Revision
+		}
+
+		// append to the ring, evicting the oldest event when full
+		if h.size == len(h.history) {
+			h.floor = h.history[h.head].Revision
+			h.history[h.head] = ev
+			h.head = (h.head + 1) % len(h.history)
+		} else {
+			h.history[(h.head+h.size)%len(h.history)] = ev
+			h.size++
+		}
+
+		for s := range h.subs {
+			if !s.matches(ev.Key) {
+				continue
+			}
+			select {
+			case s.c <- ev:
+			default:
+				h.drop(s, errors.New("watcher fell behind"))
+			}
+		}
+	}
+}
+
+// Reset forgets the history and closes every subscription. The FSM calls it
+// when state is replaced wholesale by a snapshot, since watchers can no longer
+// be told what changed one key at a time.
+func (h *Hub) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		h.drop(s, errors.New("state restored from snapshot"))
+	}
+	h.head, h.size = 0, 0
+	h.started = false
+}
+
+// LastRevision returns the revision of the newest published event.
+func (h *Hub) LastRevision() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.last
+}
+
+// drop removes s and closes its channel. Caller holds h.mu.
+func (h *Hub) drop(s *Subscription, err error) {
+	if s.done {
+		return
+	}
+	s.done = true
+	s.err = err
+	delete(h.subs, s)
+	close(s.c)
+}
@@ -0,0 +1,82 @@
+package watch
+
+import (
+	"errors"
+	"testing"
+)
+
+func recv(t *testing.T, s *Subscription) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-s.C:
+		if !ok {
+			t.Fatalf("subscription closed: %v", s.Err())
+		}
+		return ev
+	default:
+		t.Fatalf("expected an event")
+	}
+	return Event{}
+}
+
+func TestHubFiltersByKeyAndPrefix(t *testing.T) {
+	h := NewHub(16)
+	one, err := h.Subscribe("a/1", false, nil)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	all, err := h.Subscribe("a/", true, nil)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	h.Publish(Event{Type: "set", Key: "a/1", Revision: 5}, Event{Type: "set", Key: "b", Revision: 6}, Event{Type: "delete", Key: "a/2", Revision: 7})
+
+	if ev := recv(t, one); ev.Key != "a/1" || ev.Revision != 5 {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	if len(one.C) != 0 {
+		t.Fatalf("key watcher got events for other keys")
+	}
+	if ev := recv(t, all); ev.Key != "a/1" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	if ev := recv(t, all); ev.Key != "a/2" || ev.Type != "delete" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	one.Close()
+	if _, ok := <-one.C; ok {
+		t.Fatalf("expected closed channel")
+	}
+}
+
+func TestHubResumeAndCompaction(t *testing.T) {
+	h := NewHub(4)
+	for rev := uint64(10); rev < 16; rev++ {
+		h.Publish(Event{Type: "set", Key: "k", Revision: rev})
+	}
+	// history holds 12..15, so resuming after 11 is still complete
+	since := uint64(11)
+	s, err := h.Subscribe("k", false, &since)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	for want := uint64(12); want < 16; want++ {
+		if ev := recv(t, s); ev.Revision != want {
+			t.Fatalf("got revision %d want %d", ev.Revision, want)
+		}
+	}
+
+	since = 10
+	if _, err := h.Subscribe("k", false, &since); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("expected ErrCompacted, got %v", err)
+	}
+
+	h.Reset()
+	if _, ok := <-s.C; ok || s.Err() == nil {
+		t.Fatalf("expected subscription closed with error after reset")
+	}
+	if _, err := h.Subscribe("k", false, &since); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("expected ErrCompacted after reset, got %v", err)
+	}
+}